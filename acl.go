@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+// ACL actions
+const (
+	aclAllow = "allow"
+	aclDeny  = "deny"
+)
+
+// ACLRule allows or denies requests matching all of its conditions. Empty
+// conditions match every request.
+type ACLRule struct {
+	Name       string
+	Action     string
+	Networks   []*net.IPNet
+	Methods    []string
+	PathPrefix string
+}
+
+// ACLConfig is a domain's ordered list of access rules; the first matching
+// rule decides, and DefaultAction applies when none matches
+type ACLConfig struct {
+	Rules         []ACLRule
+	DefaultAction string
+}
+
+func validACLAction(action string) error {
+	switch action {
+	case aclAllow, aclDeny:
+		return nil
+	}
+	return fmt.Errorf("unknown action %q", action)
+}
+
+// Read the [acl] default_action and one [acl.<name>] section per rule, in file order
+func loadACL(cfg *ini.File) (ACLConfig, error) {
+	acl := ACLConfig{DefaultAction: cfg.Section("acl").Key("default_action").MustString(aclAllow)}
+	if err := validACLAction(acl.DefaultAction); err != nil {
+		return acl, fmt.Errorf("acl: %w", err)
+	}
+
+	for _, section := range cfg.Sections() {
+		if !strings.HasPrefix(section.Name(), "acl.") {
+			continue
+		}
+
+		rule := ACLRule{
+			Name:       section.Name(),
+			Action:     section.Key("action").String(),
+			Methods:    section.Key("methods").Strings(","),
+			PathPrefix: section.Key("path_prefix").String(),
+		}
+		if err := validACLAction(rule.Action); err != nil {
+			return acl, fmt.Errorf("%s: %w", rule.Name, err)
+		}
+		for i, method := range rule.Methods {
+			rule.Methods[i] = strings.ToUpper(method)
+		}
+		networks, err := parseIPList(section.Key("cidr").Strings(","))
+		if err != nil {
+			return acl, fmt.Errorf("%s: %w", rule.Name, err)
+		}
+		rule.Networks = networks
+		acl.Rules = append(acl.Rules, rule)
+	}
+	return acl, nil
+}
+
+func (rule *ACLRule) matches(r *http.Request, ip net.IP) bool {
+	if len(rule.Networks) > 0 && (ip == nil || !ipInList(ip, rule.Networks)) {
+		return false
+	}
+	if len(rule.Methods) > 0 {
+		found := false
+		for _, method := range rule.Methods {
+			if method == r.Method {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return strings.HasPrefix(r.URL.Path, rule.PathPrefix)
+}
+
+// Evaluate the rules top-down and report whether the request is allowed
+func (acl *ACLConfig) allows(r *http.Request) bool {
+	ip := clientIP(r)
+	for i := range acl.Rules {
+		if acl.Rules[i].matches(r, ip) {
+			return acl.Rules[i].Action == aclAllow
+		}
+	}
+	return acl.DefaultAction != aclDeny
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gopkg.in/ini.v1"
+)
+
+func loadTestACL(t *testing.T, contents string) ACLConfig {
+	t.Helper()
+	cfg, err := ini.Load([]byte(contents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl, err := loadACL(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return acl
+}
+
+// The README example: only 10.0.0.0/8 may POST to /admin
+func TestACLRuleOrder(t *testing.T) {
+	acl := loadTestACL(t, `
+[acl.admin-internal]
+action = allow
+cidr = 10.0.0.0/8
+methods = post
+path_prefix = /admin
+
+[acl.admin-others]
+action = deny
+methods = POST
+path_prefix = /admin
+`)
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		remote string
+		want   bool
+	}{
+		{"internal post", http.MethodPost, "/admin/users", "10.1.2.3:1000", true},
+		{"external post", http.MethodPost, "/admin/users", "198.51.100.1:1000", false},
+		{"external get", http.MethodGet, "/admin/users", "198.51.100.1:1000", true},
+		{"external post elsewhere", http.MethodPost, "/orders", "198.51.100.1:1000", true},
+		{"ipv6 post", http.MethodPost, "/admin", "[2001:db8::1]:1000", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "http://example.com"+tt.path, nil)
+			r.RemoteAddr = tt.remote
+			if got := acl.allows(r); got != tt.want {
+				t.Errorf("allows = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestACLDefaultAction(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		path   string
+		want   bool
+	}{
+		{"no rules", "", "/", true},
+		{"default deny", "[acl]\ndefault_action = deny\n", "/", false},
+		{"default deny with an allow rule", "[acl]\ndefault_action = deny\n[acl.public]\naction = allow\npath_prefix = /public\n", "/public/logo.png", true},
+		{"default deny outside the rule", "[acl]\ndefault_action = deny\n[acl.public]\naction = allow\npath_prefix = /public\n", "/private", false},
+		{"first match wins", "[acl.first]\naction = deny\n[acl.second]\naction = allow\n", "/", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acl := loadTestACL(t, tt.config)
+			if got := acl.allows(httptest.NewRequest(http.MethodGet, "http://example.com"+tt.path, nil)); got != tt.want {
+				t.Errorf("allows = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadACLInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+	}{
+		{"default action", "[acl]\ndefault_action = reject\n"},
+		{"missing action", "[acl.rule]\npath_prefix = /\n"},
+		{"cidr", "[acl.rule]\naction = deny\ncidr = 10.0.0.0/33\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := ini.Load([]byte(tt.config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := loadACL(cfg); err == nil {
+				t.Error("loadACL succeeded")
+			}
+		})
+	}
+}
+
+// Denied requests get 403 from the domain without reaching the backend
+func TestACLDenied(t *testing.T) {
+	backend := newNamedBackend(t, "backend")
+	loadTestConfig(t, "")
+	loadTestDomains(t, map[string]string{
+		"example.com": "[proxy]\nbackend_url = " + backend.URL + "\n[acl.admin]\naction = deny\npath_prefix = /admin\n",
+	})
+	if got := serveTest(httptest.NewRequest(http.MethodGet, "http://example.com/admin", nil)); got.Code != http.StatusForbidden {
+		t.Errorf("status %d, want 403", got.Code)
+	}
+	if got := serveTest(httptest.NewRequest(http.MethodGet, "http://example.com/", nil)); got.Code != http.StatusOK {
+		t.Errorf("status %d, want 200", got.Code)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"strings"
+)
+
+// adminMux serves operational endpoints. It is only exposed on the admin
+// listener, never on the public port.
+var adminMux = http.NewServeMux()
+
+func init() {
+	adminMux.HandleFunc("/metrics", metricsHandler)
+	adminMux.HandleFunc("/status", statusHandler)
+	adminMux.HandleFunc("/admin/cache/purge", cachePurgeHandler)
+	adminMux.HandleFunc("/readyz", readyHandler)
+	adminMux.HandleFunc("/admin/dashboard", dashboardHandler)
+	adminMux.HandleFunc("/admin/resolve", resolveHandler)
+}
+
+// Require the configured admin token as a bearer token, if one is set
+func adminAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Probes cannot always send a token, and readiness reveals nothing
+		if currentConfig().Admin.Token != "" && r.URL.Path != "/readyz" {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			// Browsers can only send the token as a basic auth password
+			if _, password, ok := r.BasicAuth(); ok {
+				token = password
+			}
+			if subtle.ConstantTimeCompare([]byte(token), []byte(currentConfig().Admin.Token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="coffee_proxy_reverse admin"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func startAdminServer() {
+	if startupConfig.Admin.Listen == "" && startupConfig.Admin.SocketPath == "" {
+		return
+	}
+
+	// Profiling endpoints are only ever registered on the admin listener
+	if startupConfig.Debug.Pprof {
+		adminMux.HandleFunc("/debug/pprof/", pprof.Index)
+		adminMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		adminMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		adminMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		adminMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	handler := adminAuthMiddleware(adminMux)
+	if startupConfig.Admin.Listen != "" {
+		listeners, err := getListeners("admin", "tcp", startupConfig.Admin.Listen)
+		if err != nil {
+			fatal("Failed to start admin server", "error", err)
+		}
+		logger.Info("Starting admin server", "addr", startupConfig.Admin.Listen)
+		go func() {
+			fatal("Admin server failed", "error", http.Serve(listeners[0], handler))
+		}()
+	}
+
+	// Only local processes allowed by the socket file's permissions can
+	// connect to the Unix socket
+	if startupConfig.Admin.SocketPath != "" {
+		listeners, err := getListeners("admin_socket", "unix", startupConfig.Admin.SocketPath)
+		if err != nil {
+			fatal("Failed to start admin server", "socket", startupConfig.Admin.SocketPath, "error", err)
+		}
+		if err := os.Chmod(startupConfig.Admin.SocketPath, startupConfig.Admin.SocketMode); err != nil {
+			fatal("Failed to set admin socket permissions", "socket", startupConfig.Admin.SocketPath, "error", err)
+		}
+		logger.Info("Starting admin server", "socket", startupConfig.Admin.SocketPath)
+		go func() {
+			fatal("Admin server failed", "error", http.Serve(listeners[0], handler))
+		}()
+	}
+}
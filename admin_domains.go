@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/ini.v1"
+)
+
+// Hostnames, optionally with a port, that can be added through the admin
+// API. Persisted domains become file names, so nothing else is allowed.
+var domainNamePattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9.-]*[A-Za-z0-9])?(:[0-9]+)?$`)
+
+// Domains added through POST /admin/domains without persist, as .conf
+// contents. They live in memory until removed or the proxy restarts, and
+// are merged into every load of the domains. Each load parses them afresh,
+// since loading a config adds the keys it looks up to it.
+var (
+	apiDomains     = make(map[string][]byte)
+	apiDomainsLock sync.Mutex
+)
+
+func init() {
+	adminMux.HandleFunc("POST /admin/domains", addDomainHandler)
+	adminMux.HandleFunc("DELETE /admin/domains/{host}", removeDomainHandler)
+}
+
+// Return the domains added through the admin API, sorted by name
+func addedDomains() ([]string, map[string]*ini.File) {
+	apiDomainsLock.Lock()
+	defer apiDomainsLock.Unlock()
+	domains := make(map[string]*ini.File, len(apiDomains))
+	names := make([]string, 0, len(apiDomains))
+	for name, contents := range apiDomains {
+		cfg, err := ini.Load(contents)
+		if err != nil {
+			logger.Error("Error parsing domain added through the admin API", "domain", name, "error", err)
+			continue
+		}
+		domains[name] = cfg
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, domains
+}
+
+// Body of POST /admin/domains. Config holds the sections and keys of a
+// domain .conf file, as in the registry; backend_url and backend_urls
+// override its [proxy] backend_url.
+type domainRequest struct {
+	Domain      string                 `json:"domain"`
+	BackendURL  string                 `json:"backend_url"`
+	BackendURLs []string               `json:"backend_urls"`
+	Config      map[string]interface{} `json:"config"`
+	Persist     bool                   `json:"persist"`
+}
+
+func domainFile(domain string) string {
+	return filepath.Join(domainsDirectory, domain+".conf")
+}
+
+// Why a domain can't be changed through the admin API, if it can't: it is
+// defined by a .conf file or by the registry
+func domainDefinedElsewhere(domain string) error {
+	if _, err := os.Stat(domainFile(domain)); err == nil {
+		return fmt.Errorf("%s is defined by %s", domain, domainFile(domain))
+	}
+	domainsLoadLock.Lock()
+	defer domainsLoadLock.Unlock()
+	if _, exists := lastRegistry[domain]; exists && currentConfig().Domains.Registry != "" {
+		return fmt.Errorf("%s is defined by the registry %s", domain, currentConfig().Domains.Registry)
+	}
+	return nil
+}
+
+// Add a domain, or replace one added earlier through the API. It is
+// validated before anything changes and takes effect at once. With persist
+// it is written to the domain directory, where it survives restarts.
+func addDomainHandler(w http.ResponseWriter, r *http.Request) {
+	var req domainRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !domainNamePattern.MatchString(req.Domain) || strings.Contains(req.Domain, "..") {
+		http.Error(w, "domain must be a hostname, optionally with a port", http.StatusBadRequest)
+		return
+	}
+
+	cfg := ini.Empty()
+	if req.Config != nil {
+		var err error
+		if cfg, err = registryEntryConfig(req.Config); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	backendURLs := req.BackendURLs
+	if req.BackendURL != "" {
+		backendURLs = append([]string{req.BackendURL}, backendURLs...)
+	}
+	if len(backendURLs) > 0 {
+		cfg.Section("proxy").Key("backend_url").SetValue(strings.Join(backendURLs, ","))
+	}
+	var contents bytes.Buffer
+	if _, err := cfg.WriteTo(&contents); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	domainConfig, err := loadDomainConfig(cfg)
+	if err == nil {
+		_, _, err = newReverseProxy(domainConfig)
+	}
+	if err != nil {
+		http.Error(w, "invalid domain config: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := domainDefinedElsewhere(req.Domain); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	apiDomainsLock.Lock()
+	_, replaced := apiDomains[req.Domain]
+	if req.Persist {
+		err = saveDomainFile(req.Domain, contents.Bytes())
+		if err == nil {
+			delete(apiDomains, req.Domain)
+		}
+	} else {
+		apiDomains[req.Domain] = contents.Bytes()
+	}
+	apiDomainsLock.Unlock()
+	if err != nil {
+		logger.Error("Failed to save domain", "domain", req.Domain, "error", err)
+		http.Error(w, "saving domain: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := loadDomains(domainsDirectory); err != nil {
+		http.Error(w, "loading domains: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logger.Info("Domain added through the admin API", "domain", req.Domain, "persisted", req.Persist, "replaced", replaced)
+
+	status := http.StatusCreated
+	if replaced {
+		status = http.StatusOK
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"domain": req.Domain, "persisted": req.Persist})
+}
+
+// Write a domain's .conf file, renaming it into place so the directory
+// watcher never loads it half written
+func saveDomainFile(domain string, contents []byte) error {
+	if err := os.MkdirAll(domainsDirectory, 0755); err != nil {
+		return err
+	}
+	tmp := domainFile(domain) + ".tmp"
+	if err := os.WriteFile(tmp, contents, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, domainFile(domain)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// Remove a domain added through the API, or one persisted to the domain
+// directory. Registry domains can only be removed from the registry.
+func removeDomainHandler(w http.ResponseWriter, r *http.Request) {
+	domain := r.PathValue("host")
+	if !domainNamePattern.MatchString(domain) || strings.Contains(domain, "..") {
+		http.Error(w, "invalid domain", http.StatusBadRequest)
+		return
+	}
+
+	apiDomainsLock.Lock()
+	_, added := apiDomains[domain]
+	delete(apiDomains, domain)
+	apiDomainsLock.Unlock()
+
+	if !added {
+		err := os.Remove(domainFile(domain))
+		if errors.Is(err, os.ErrNotExist) {
+			if err := domainDefinedElsewhere(domain); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+			} else {
+				http.Error(w, "domain not found", http.StatusNotFound)
+			}
+			return
+		}
+		if err != nil {
+			http.Error(w, "removing domain: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := loadDomains(domainsDirectory); err != nil {
+		http.Error(w, "loading domains: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logger.Info("Domain removed through the admin API", "domain", domain)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Domains added through the admin API take effect at once, replace earlier
+// ones, persist to the domain directory on request, and can be removed;
+// domains defined by files are left alone
+func TestAdminDomains(t *testing.T) {
+	first := newNamedBackend(t, "first")
+	second := newNamedBackend(t, "second")
+	loadTestConfig(t, "[admin]\ntoken = secret\n")
+	// Domains are loaded from and persisted to domainsDirectory, relative
+	// to the working directory
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	if err := os.Mkdir(domainsDirectory, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(domainFile("file.example.com"), []byte("[proxy]\nbackend_url = "+first.URL+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadDomains(domainsDirectory); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		apiDomainsLock.Lock()
+		apiDomains = make(map[string][]byte)
+		apiDomainsLock.Unlock()
+		loadDomains(domainsDirectory + "/none")
+	})
+
+	steps := []struct {
+		name       string
+		method     string
+		path       string
+		token      string
+		body       string
+		wantStatus int
+		// Host to request afterwards, and the backend it should reach, or
+		// "" for none
+		host    string
+		reached string
+	}{
+		{"no token", http.MethodPost, "/admin/domains", "", `{"domain": "api.example.com", "backend_url": "` + first.URL + `"}`, http.StatusUnauthorized, "api.example.com", ""},
+		{"invalid json", http.MethodPost, "/admin/domains", "secret", `{"domain":`, http.StatusBadRequest, "", ""},
+		{"invalid domain", http.MethodPost, "/admin/domains", "secret", `{"domain": "../etc/passwd", "backend_url": "` + first.URL + `"}`, http.StatusBadRequest, "", ""},
+		{"invalid config", http.MethodPost, "/admin/domains", "secret", `{"domain": "api.example.com", "config": {"proxy": {"balance": "fastest"}}, "backend_url": "` + first.URL + `"}`, http.StatusBadRequest, "api.example.com", ""},
+		{"add", http.MethodPost, "/admin/domains", "secret", `{"domain": "api.example.com", "backend_url": "` + first.URL + `"}`, http.StatusCreated, "api.example.com", "first"},
+		{"replace", http.MethodPost, "/admin/domains", "secret", `{"domain": "api.example.com", "backend_urls": ["` + second.URL + `"]}`, http.StatusOK, "api.example.com", "second"},
+		{"defined by a file", http.MethodPost, "/admin/domains", "secret", `{"domain": "file.example.com", "backend_url": "` + second.URL + `"}`, http.StatusConflict, "file.example.com", "first"},
+		{"persist", http.MethodPost, "/admin/domains", "secret", `{"domain": "saved.example.com", "backend_url": "` + second.URL + `", "persist": true}`, http.StatusCreated, "saved.example.com", "second"},
+		{"remove without token", http.MethodDelete, "/admin/domains/api.example.com", "", "", http.StatusUnauthorized, "api.example.com", "second"},
+		{"remove", http.MethodDelete, "/admin/domains/api.example.com", "secret", "", http.StatusNoContent, "api.example.com", ""},
+		{"remove persisted", http.MethodDelete, "/admin/domains/saved.example.com", "secret", "", http.StatusNoContent, "saved.example.com", ""},
+		{"remove missing", http.MethodDelete, "/admin/domains/api.example.com", "secret", "", http.StatusNotFound, "", ""},
+	}
+	handler := adminAuthMiddleware(adminMux)
+	for _, step := range steps {
+		r := httptest.NewRequest(step.method, "http://admin"+step.path, strings.NewReader(step.body))
+		if step.token != "" {
+			r.Header.Set("Authorization", "Bearer "+step.token)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, r)
+		if recorder.Code != step.wantStatus {
+			t.Fatalf("%s: status %d (%s), want %d", step.name, recorder.Code, strings.TrimSpace(recorder.Body.String()), step.wantStatus)
+		}
+		if step.host == "" {
+			continue
+		}
+		got := serveTest(httptest.NewRequest(http.MethodGet, "http://"+step.host+"/", nil))
+		if step.reached == "" && got.Code != http.StatusNotFound {
+			t.Errorf("%s: %s got status %d, want 404", step.name, step.host, got.Code)
+		} else if step.reached != "" && got.Body.String() != step.reached {
+			t.Errorf("%s: %s reached %q (status %d), want %s", step.name, step.host, got.Body, got.Code, step.reached)
+		}
+	}
+
+	if _, err := os.Stat(domainFile("saved.example.com")); !os.IsNotExist(err) {
+		t.Errorf("removed domain's file still there: %v", err)
+	}
+	if _, err := os.Stat(domainFile("file.example.com")); err != nil {
+		t.Errorf("file-defined domain's file: %v", err)
+	}
+}
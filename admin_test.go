@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The admin API answers over socket_path, with the configured permissions
+// on the socket file and the token still required
+func TestAdminSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "admin.sock")
+	loadTestConfig(t, "[admin]\nsocket_path = "+socket+"\nsocket_mode = 0660\ntoken = secret\n")
+	startAdminServer()
+
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0660 {
+		t.Errorf("socket mode %s, want a socket with 0660", info.Mode())
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}}
+	tests := []struct {
+		path       string
+		token      string
+		wantStatus int
+	}{
+		{"/status", "secret", http.StatusOK},
+		{"/status", "", http.StatusUnauthorized},
+		{"/metrics", "secret", http.StatusOK},
+		{"/missing", "secret", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path+" "+tt.token, func(t *testing.T) {
+			r, err := http.NewRequest(http.MethodGet, "http://admin"+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			resp, err := client.Do(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	directory := t.TempDir()
+	stale := filepath.Join(directory, "stale.sock")
+	listeners, err := listenUnixSocket(stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listeners[0].Close()
+	regular := filepath.Join(directory, "regular")
+	if err := os.WriteFile(regular, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		wantErr bool
+	}{
+		{"new", filepath.Join(directory, "new.sock"), false},
+		{"socket left behind", stale, false},
+		{"not a socket", regular, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listeners, err := listenUnixSocket(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("listenUnixSocket error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil {
+				listeners[0].Close()
+			}
+		})
+	}
+}
+
+func TestAdminSocketModeInvalid(t *testing.T) {
+	for _, mode := range []string{"rw-rw----", "0999", "01777"} {
+		path := filepath.Join(t.TempDir(), "system.conf")
+		if err := os.WriteFile(path, []byte(testConfigBase+"[admin]\nsocket_mode = "+mode+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := loadConfig(path); err == nil {
+			t.Errorf("loadConfig accepted socket_mode = %s", mode)
+		}
+	}
+}
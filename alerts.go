@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimitAlert is the JSON body posted to the alert webhook
+type rateLimitAlert struct {
+	Event  string    `json:"event"`
+	IP     string    `json:"ip"`
+	Domain string    `json:"domain"`
+	Count  int       `json:"count"`
+	Window float64   `json:"window_seconds"`
+	Time   time.Time `json:"time"`
+}
+
+// rejectionState counts consecutive rate-limit rejections for one IP
+type rejectionState struct {
+	count     int
+	first     time.Time
+	lastAlert time.Time
+}
+
+var (
+	rejections     = make(map[string]*rejectionState)
+	rejectionsLock sync.Mutex
+
+	alertQueue   = make(chan rateLimitAlert, 100)
+	alertLimiter *rate.Limiter
+	alertOnce    sync.Once
+)
+
+// Record a rate-limit rejection for ip. When an IP is rejected threshold
+// times in a row within the window, a warning is logged and an alert is
+// queued for the webhook, at most once per cooldown per IP.
+func recordRejection(ip, domain string) {
+	alerts := currentConfig().Alerts
+	if alerts.Threshold <= 0 {
+		return
+	}
+
+	now := time.Now()
+	window := time.Duration(alerts.Window) * time.Second
+
+	rejectionsLock.Lock()
+	state, exists := rejections[ip]
+	if !exists || now.Sub(state.first) > window {
+		if !exists {
+			state = &rejectionState{}
+			rejections[ip] = state
+		}
+		state.count = 0
+		state.first = now
+	}
+	state.count++
+
+	var alert *rateLimitAlert
+	cooldown := time.Duration(alerts.Cooldown) * time.Second
+	if state.count >= alerts.Threshold && now.Sub(state.lastAlert) >= cooldown {
+		state.lastAlert = now
+		alert = &rateLimitAlert{Event: "rate_limit_burst", IP: ip, Domain: domain, Count: state.count, Window: window.Seconds(), Time: now}
+	}
+
+	// Keep the map bounded by dropping IPs that have gone quiet
+	if len(rejections) > 10000 {
+		for key, s := range rejections {
+			if now.Sub(s.first) > window && now.Sub(s.lastAlert) > cooldown {
+				delete(rejections, key)
+			}
+		}
+	}
+	rejectionsLock.Unlock()
+
+	if alert == nil {
+		return
+	}
+	logger.Warn("Client repeatedly rate limited", "ip", ip, "domain", domain, "count", alert.Count, "window", window)
+
+	if alerts.WebhookURL == "" {
+		return
+	}
+	alertOnce.Do(func() {
+		alertLimiter = rate.NewLimiter(rate.Limit(1), 10)
+		go sendAlerts(alerts.WebhookURL)
+	})
+	select {
+	case alertQueue <- *alert:
+	default:
+		logger.Warn("Alert queue full, dropping alert", "ip", ip)
+	}
+}
+
+// Clear the rejection streak once an IP gets through again
+func resetRejections(ip string) {
+	if currentConfig().Alerts.Threshold <= 0 {
+		return
+	}
+	rejectionsLock.Lock()
+	if state, exists := rejections[ip]; exists {
+		state.count = 0
+	}
+	rejectionsLock.Unlock()
+}
+
+// Post queued alerts to the webhook, limited so an attack from many IPs
+// cannot flood the receiver
+func sendAlerts(webhookURL string) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	for alert := range alertQueue {
+		if !alertLimiter.Allow() {
+			logger.Warn("Alert webhook rate limited, dropping alert", "ip", alert.IP)
+			continue
+		}
+
+		body, _ := json.Marshal(alert)
+		resp, err := client.Post(webhookURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			logger.Error("Error sending alert", "webhook", webhookURL, "error", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			logger.Error("Alert webhook rejected alert", "webhook", webhookURL, "status", resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// BackendConfig describes one backend server of a domain
+type BackendConfig struct {
+	Name       string
+	URL        string
+	Weight     int
+	HealthPath string
+	Timeout    time.Duration
+
+	// What a health check of HealthPath must get back: this status rather
+	// than any below 500, and a body containing this text
+	ExpectedStatus       int
+	ExpectedBodyContains string
+}
+
+// Parse a comma-separated list of backend URLs into backends with default settings
+func parseBackendList(list string) []BackendConfig {
+	var backends []BackendConfig
+	for _, backendURL := range strings.Split(list, ",") {
+		backendURL = strings.TrimSpace(backendURL)
+		if backendURL == "" {
+			continue
+		}
+		backends = append(backends, BackendConfig{Name: backendURL, URL: backendURL, Weight: 1})
+	}
+	return backends
+}
+
+// Read a domain's backends: the backend_url shorthand in [proxy] plus one
+// [backend.<name>] section per backend carrying its own metadata.
+func loadBackends(cfg *ini.File) ([]BackendConfig, error) {
+	backends := parseBackendList(cfg.Section("proxy").Key("backend_url").String())
+
+	for _, section := range cfg.Sections() {
+		if !strings.HasPrefix(section.Name(), "backend.") {
+			continue
+		}
+
+		backend := BackendConfig{
+			Name:       strings.TrimPrefix(section.Name(), "backend."),
+			URL:        section.Key("url").String(),
+			Weight:     section.Key("weight").MustInt(1),
+			HealthPath: section.Key("health_path").String(),
+			Timeout:    time.Duration(section.Key("timeout").MustFloat64(0) * float64(time.Second)),
+
+			ExpectedStatus:       section.Key("expected_status").MustInt(0),
+			ExpectedBodyContains: section.Key("expected_body_contains").String(),
+		}
+		if backend.URL == "" {
+			return nil, fmt.Errorf("%s: url is required", section.Name())
+		}
+		if backend.Weight < 1 {
+			return nil, fmt.Errorf("%s: weight must be at least 1", section.Name())
+		}
+		if (backend.ExpectedStatus != 0 || backend.ExpectedBodyContains != "") && backend.HealthPath == "" {
+			return nil, fmt.Errorf("%s: expected_status and expected_body_contains require health_path", section.Name())
+		}
+		if backend.ExpectedStatus != 0 && (backend.ExpectedStatus < 100 || backend.ExpectedStatus > 599) {
+			return nil, fmt.Errorf("%s: expected_status %d is not an HTTP status", section.Name(), backend.ExpectedStatus)
+		}
+		backends = append(backends, backend)
+	}
+	return backends, nil
+}
+
+// Return the transport settings for one of the domain's backends
+func (domainConfig DomainConfig) transportKey(backendConfig BackendConfig) transportKey {
+	return transportKey{
+		maxIdleConnsPerHost:   currentConfig().Backend.MaxIdleConnsPerHost,
+		maxConnsPerHost:       currentConfig().Backend.MaxConnsPerHost,
+		disableKeepAlives:     currentConfig().Backend.DisableKeepAlives,
+		clientCertFile:        domainConfig.BackendCertFile,
+		clientKeyFile:         domainConfig.BackendKeyFile,
+		responseHeaderTimeout: backendConfig.Timeout,
+		upstreamProxy:         domainConfig.UpstreamProxy,
+		dnsCacheTTL:           time.Duration(currentConfig().Backend.DNSCacheTTL) * time.Second,
+		serverName:            domainConfig.BackendSNI,
+		disableHTTP2:          domainConfig.DisableBackendHTTP2,
+		sessionCacheSize:      currentConfig().Backend.TLSSessionCacheSize,
+	}
+}
+
+// backend is a BackendConfig ready to serve requests
+type backend struct {
+	BackendConfig
+	target    *url.URL
+	transport http.RoundTripper
+
+	// currentWeight is the smooth weighted round-robin state, guarded by the group's mutex
+	currentWeight int
+	health        backendHealth
+
+	// Semaphore for max_conns_per_backend; nil means unlimited
+	conns chan struct{}
+}
+
+// backendGroup balances requests across the backends of a domain or route
+type backendGroup struct {
+	mu       sync.Mutex
+	backends []*backend
+	balance  string
+	ring     []ringPoint
+}
+
+func newBackendGroup(configs []BackendConfig, domainConfig DomainConfig) (*backendGroup, error) {
+	group := &backendGroup{balance: domainConfig.Balance}
+	for _, backendConfig := range configs {
+		target, err := url.Parse(backendConfig.URL)
+		if err != nil {
+			return nil, fmt.Errorf("backend %s: invalid url: %w", backendConfig.Name, err)
+		}
+
+		transport, err := getTransport(domainConfig.transportKey(backendConfig))
+		if err != nil {
+			return nil, err
+		}
+
+		b := &backend{
+			BackendConfig: backendConfig,
+			target:        target,
+			transport:     transport,
+		}
+		b.health.weight.Store(int64(backendConfig.Weight * weightScale))
+		if domainConfig.MaxConnsPerBackend > 0 {
+			b.conns = make(chan struct{}, domainConfig.MaxConnsPerBackend)
+		}
+		group.backends = append(group.backends, b)
+	}
+	if group.balance == balanceIPHash {
+		group.ring = buildHashRing(group.backends)
+	}
+	return group, nil
+}
+
+// Pick the next backend using smooth weighted round-robin, which spreads
+// heavier backends' turns evenly instead of sending them in bursts.
+// Unhealthy backends are skipped; nil means none is available.
+func (g *backendGroup) next() *backend {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var best *backend
+	total := 0
+	for _, b := range g.backends {
+		if b.health.unhealthy.Load() {
+			continue
+		}
+		weight := b.weight()
+		b.currentWeight += weight
+		total += weight
+		if best == nil || b.currentWeight > best.currentWeight {
+			best = b
+		}
+	}
+	if best != nil {
+		best.currentWeight -= total
+	}
+	return best
+}
+
+type backendKey struct{}
+
+// backendTransport sends each request through the transport of the backend
+// chosen for it by the Director, retrying failures as the domain allows
+type backendTransport struct {
+	retries      int
+	retryBackoff time.Duration
+	retryJitter  time.Duration
+}
+
+func (t backendTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	b, ok := req.Context().Value(backendKey{}).(*backend)
+	if !ok {
+		return nil, errNoBackend
+	}
+	return t.roundTripWithRetries(req, b)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// errBackendBusy is returned when a backend already has max_conns_per_backend
+// requests in flight
+var errBackendBusy = errors.New("backend connection limit reached")
+
+// Take one of the backend's connection slots, if it has a limit and a slot is free
+func (b *backend) acquireConn() bool {
+	if b.conns == nil {
+		return true
+	}
+	select {
+	case b.conns <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (b *backend) releaseConn() {
+	if b.conns != nil {
+		<-b.conns
+	}
+}
+
+// Send a request to a backend within its connection limit. The slot is
+// held until the response body is closed, since the backend connection is
+// busy until then.
+func roundTripLimited(req *http.Request, b *backend) (*http.Response, error) {
+	if !b.acquireConn() {
+		return nil, errBackendBusy
+	}
+	resp, err := roundTripBackend(req, b)
+	if err != nil {
+		b.releaseConn()
+		return nil, err
+	}
+	resp.Body = &releasingBody{body: resp.Body, release: sync.OnceFunc(b.releaseConn)}
+	return resp, nil
+}
+
+// releasingBody gives back a backend connection slot when closed. Write is
+// only used for upgraded connections.
+type releasingBody struct {
+	body    io.ReadCloser
+	release func()
+}
+
+func (rb *releasingBody) Read(b []byte) (int, error) {
+	return rb.body.Read(b)
+}
+
+func (rb *releasingBody) Write(b []byte) (int, error) {
+	w, ok := rb.body.(io.Writer)
+	if !ok {
+		return 0, errors.New("response body is not writable")
+	}
+	return w.Write(b)
+}
+
+func (rb *releasingBody) Close() error {
+	defer rb.release()
+	return rb.body.Close()
+}
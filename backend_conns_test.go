@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A backend at max_conns_per_backend turns further requests away with 503
+// at once, and takes them again as its requests finish
+func TestMaxConnsPerBackend(t *testing.T) {
+	arrived := make(chan struct{})
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			arrived <- struct{}{}
+			<-release
+		}
+	}))
+	defer slow.Close()
+	loadTestConfig(t, "")
+	loadTestDomains(t, map[string]string{"example.com": "[proxy]\nbackend_url = " + slow.URL + "\nmax_conns_per_backend = 2\n"})
+	backendHost := slow.Listener.Addr().String()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serveTest(httptest.NewRequest(http.MethodGet, "http://example.com/slow", nil))
+		}()
+		<-arrived
+	}
+
+	before := counterValue(backendErrors, "example.com", backendHost, "backend_busy")
+	start := time.Now()
+	if got := serveTest(httptest.NewRequest(http.MethodGet, "http://example.com/", nil)); got.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d with the backend saturated, want 503", got.Code)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("turned away after %s, want at once", elapsed)
+	}
+	if counterValue(backendErrors, "example.com", backendHost, "backend_busy") != before+1 {
+		t.Error("busy backend not counted as backend_busy")
+	}
+
+	close(release)
+	wg.Wait()
+	for i := 0; i < 3; i++ {
+		if got := serveTest(httptest.NewRequest(http.MethodGet, "http://example.com/", nil)); got.Code != http.StatusOK {
+			t.Errorf("status %d after the backend's requests finished, want 200", got.Code)
+		}
+	}
+}
+
+func TestAcquireConn(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int
+		want  []bool
+	}{
+		{"unlimited", 0, []bool{true, true, true}},
+		{"limit 2", 2, []bool{true, true, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &backend{}
+			if tt.limit > 0 {
+				b.conns = make(chan struct{}, tt.limit)
+			}
+			for i, want := range tt.want {
+				if got := b.acquireConn(); got != want {
+					t.Errorf("acquire %d = %v, want %v", i+1, got, want)
+				}
+			}
+			b.releaseConn()
+			if !b.acquireConn() {
+				t.Error("no slot after a release")
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// clientCert holds a backend mTLS certificate that is reloaded whenever its
+// files change on disk, so rotated certificates apply without a restart.
+type clientCert struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+var (
+	clientCerts     = make(map[string]*clientCert)
+	clientCertsLock sync.Mutex
+	certWatcher     *fsnotify.Watcher
+)
+
+// Load a client certificate pair, sharing one instance per file pair
+func loadClientCert(certFile, keyFile string) (*clientCert, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("both backend_cert_file and backend_key_file must be set")
+	}
+
+	clientCertsLock.Lock()
+	defer clientCertsLock.Unlock()
+
+	key := certFile + "|" + keyFile
+	if cc, exists := clientCerts[key]; exists {
+		return cc, nil
+	}
+
+	cc := &clientCert{certFile: certFile, keyFile: keyFile}
+	if err := cc.reload(); err != nil {
+		return nil, err
+	}
+	if err := watchCertFiles(certFile, keyFile); err != nil {
+		logger.Error("Error watching backend certificate", "cert_file", certFile, "error", err)
+	}
+
+	clientCerts[key] = cc
+	return cc, nil
+}
+
+func (cc *clientCert) reload() error {
+	cert, err := tls.LoadX509KeyPair(cc.certFile, cc.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading backend certificate %s: %w", cc.certFile, err)
+	}
+
+	cc.mu.Lock()
+	cc.cert = &cert
+	cc.mu.Unlock()
+	return nil
+}
+
+// get is used as tls.Config.GetClientCertificate
+func (cc *clientCert) get(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+	return cc.cert, nil
+}
+
+// Watch the directories holding the given files; watching the directory
+// rather than the file also catches certificates replaced via rename.
+// Must be called with clientCertsLock held.
+func watchCertFiles(files ...string) error {
+	if certWatcher == nil {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			return err
+		}
+		certWatcher = watcher
+		go handleCertEvents(watcher)
+	}
+
+	for _, file := range files {
+		if err := certWatcher.Add(filepath.Dir(file)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func handleCertEvents(watcher *fsnotify.Watcher) {
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+
+			clientCertsLock.Lock()
+			for _, cc := range clientCerts {
+				if filepath.Clean(event.Name) != filepath.Clean(cc.certFile) && filepath.Clean(event.Name) != filepath.Clean(cc.keyFile) {
+					continue
+				}
+				if err := cc.reload(); err != nil {
+					logger.Error("Error reloading backend certificate", "cert_file", cc.certFile, "error", err)
+					continue
+				}
+				logger.Info("Reloaded backend certificate", "cert_file", cc.certFile)
+			}
+			clientCertsLock.Unlock()
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logger.Error("Error watching backend certificates", "error", err)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t testing.TB) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// Issue a certificate for name and 127.0.0.1, valid until notAfter, as a
+// key pair
+func (ca *testCA) issue(t testing.TB, name string, notAfter time.Time) tls.Certificate {
+	t.Helper()
+	return ca.issueFor(t, name, []net.IP{net.ParseIP("127.0.0.1")}, notAfter)
+}
+
+// Issue a certificate for name and ips only
+func (ca *testCA) issueFor(t testing.TB, name string, ips []net.IP, notAfter time.Time) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  ips,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// Write a key pair to PEM files in dir, returning their paths
+func writeKeyPair(t testing.TB, dir string, cert tls.Certificate) (certFile, keyFile string) {
+	t.Helper()
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// Trust ca for the backends of the domain serving host
+func trustBackendCA(t testing.TB, host string, ca *testCA) {
+	t.Helper()
+	dp := lookupDomain(httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+	for _, g := range dp.groups {
+		for _, b := range g.backends {
+			transport := b.transport.(*http.Transport)
+			if transport.TLSClientConfig == nil {
+				transport.TLSClientConfig = &tls.Config{}
+			}
+			transport.TLSClientConfig.RootCAs = ca.pool
+		}
+	}
+}
+
+func TestBackendMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	otherCA := newTestCA(t)
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	backend.TLS = &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "backend", time.Now().Add(time.Hour))},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+	}
+	backend.StartTLS()
+	defer backend.Close()
+
+	tests := []struct {
+		name       string
+		clientCert *tls.Certificate
+		wantStatus int
+		wantBody   string
+	}{
+		{"no client certificate", nil, http.StatusBadGateway, ""},
+		{"trusted client certificate", ptr(ca.issue(t, "proxy", time.Now().Add(time.Hour))), http.StatusOK, "hello proxy"},
+		{"untrusted client certificate", ptr(otherCA.issue(t, "stranger", time.Now().Add(time.Hour))), http.StatusBadGateway, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, "")
+			domain := "[proxy]\nbackend_url = " + backend.URL + "\n"
+			if tt.clientCert != nil {
+				certFile, keyFile := writeKeyPair(t, t.TempDir(), *tt.clientCert)
+				domain += "backend_cert_file = " + certFile + "\nbackend_key_file = " + keyFile + "\n"
+			} else {
+				// Its own transport, so trusting the CA below doesn't
+				// touch other tests'
+				domain += "backend_sni = 127.0.0.1\n"
+			}
+			loadTestDomains(t, map[string]string{"example.com": domain})
+			trustBackendCA(t, "example.com", ca)
+
+			got := serveTest(httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+			if got.Code != tt.wantStatus || (tt.wantBody != "" && got.Body.String() != tt.wantBody) {
+				t.Errorf("got %d %q, want %d %q", got.Code, got.Body.String(), tt.wantStatus, tt.wantBody)
+			}
+		})
+	}
+}
+
+// A rotated certificate is used once it is reloaded
+func TestClientCertReload(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certFile, keyFile := writeKeyPair(t, dir, ca.issue(t, "first", time.Now().Add(time.Hour)))
+	cc, err := loadClientCert(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeKeyPair(t, dir, ca.issue(t, "second", time.Now().Add(time.Hour)))
+	if err := cc.reload(); err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := cc.get(nil)
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	if leaf.Subject.CommonName != "second" {
+		t.Errorf("certificate after reload is %q, want second", leaf.Subject.CommonName)
+	}
+
+	if _, err := loadClientCert(certFile, ""); err == nil {
+		t.Error("loadClientCert without a key file succeeded")
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// A backend addressed by IP whose certificate only names its host is
+// reachable with backend_sni
+func TestBackendSNI(t *testing.T) {
+	ca := newTestCA(t)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("sni " + r.TLS.ServerName))
+	}))
+	backend.TLS = &tls.Config{Certificates: []tls.Certificate{ca.issueFor(t, "backend.internal", nil, time.Now().Add(time.Hour))}}
+	backend.StartTLS()
+	defer backend.Close()
+
+	tests := []struct {
+		name       string
+		options    string
+		wantStatus int
+		wantBody   string
+	}{
+		// Its own transport, so trusting the CA below doesn't touch other
+		// tests'
+		{"no override", "backend_http2 = false\n", http.StatusBadGateway, ""},
+		{"override", "backend_sni = backend.internal\n", http.StatusOK, "sni backend.internal"},
+		{"wrong override", "backend_sni = other.internal\n", http.StatusBadGateway, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, "")
+			loadTestDomains(t, map[string]string{"example.com": "[proxy]\nbackend_url = " + backend.URL + "\n" + tt.options})
+			trustBackendCA(t, "example.com", ca)
+
+			got := serveTest(httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+			if got.Code != tt.wantStatus || (tt.wantBody != "" && got.Body.String() != tt.wantBody) {
+				t.Errorf("got %d %q, want %d %q", got.Code, got.Body.String(), tt.wantStatus, tt.wantBody)
+			}
+		})
+	}
+}
+
+// backend_http2 = false keeps the backend on HTTP/1.1 even though it
+// offers HTTP/2 and the client came in over HTTP/2
+func TestBackendHTTP2(t *testing.T) {
+	ca := newTestCA(t)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	backend.EnableHTTP2 = true
+	backend.TLS = &tls.Config{Certificates: []tls.Certificate{ca.issue(t, "backend", time.Now().Add(time.Hour))}}
+	backend.StartTLS()
+	defer backend.Close()
+
+	tests := []struct {
+		http2     string
+		wantProto string
+	}{
+		{"true", "HTTP/2.0"},
+		{"false", "HTTP/1.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.http2, func(t *testing.T) {
+			loadTestConfig(t, "")
+			loadTestDomains(t, map[string]string{"example.com": "[proxy]\nbackend_url = " + backend.URL + "\nbackend_http2 = " + tt.http2 + "\n"})
+			trustBackendCA(t, "example.com", ca)
+
+			r := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+			r.Proto, r.ProtoMajor, r.ProtoMinor = "HTTP/2.0", 2, 0
+			got := serveTest(r)
+			if got.Code != http.StatusOK || got.Body.String() != tt.wantProto {
+				t.Errorf("backend got %q (status %d), want %s", got.Body, got.Code, tt.wantProto)
+			}
+		})
+	}
+}
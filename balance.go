@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// Load balancing strategies for balance
+const (
+	balanceRoundRobin = "round_robin"
+	balanceIPHash     = "ip_hash"
+	balanceRandom     = "random"
+)
+
+func validBalance(balance string) error {
+	switch balance {
+	case balanceRoundRobin, balanceIPHash, balanceRandom:
+		return nil
+	}
+	return fmt.Errorf("unknown balance strategy %q", balance)
+}
+
+// Points each backend gets on the hash ring per unit of weight. More points
+// spread clients more evenly.
+const ringPointsPerWeight = 100
+
+type ringPoint struct {
+	hash    uint32
+	backend *backend
+}
+
+// Build the consistent hash ring for ip_hash. The ring always holds every
+// backend; unhealthy ones are skipped at lookup, so when a backend goes
+// down only its own clients move, each to the next backend on the ring.
+func buildHashRing(backends []*backend) []ringPoint {
+	var ring []ringPoint
+	for _, b := range backends {
+		for i := 0; i < b.Weight*ringPointsPerWeight; i++ {
+			hash := crc32.ChecksumIEEE([]byte(b.Name + "#" + strconv.Itoa(i)))
+			ring = append(ring, ringPoint{hash: hash, backend: b})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	return ring
+}
+
+// Pick the backend for a request using the group's balance strategy
+func (g *backendGroup) pick(r *http.Request) *backend {
+	switch g.balance {
+	case balanceIPHash:
+		if ip := clientIP(r); ip != nil {
+			return g.hashed(ip.String())
+		}
+	case balanceRandom:
+		return g.random()
+	}
+	return g.next()
+}
+
+// Pick a healthy backend at random in proportion to its weight. Unlike
+// round-robin this keeps no shared state, so it takes no lock and
+// concurrent requests don't contend on the group.
+func (g *backendGroup) random() *backend {
+	total := 0
+	for _, b := range g.backends {
+		if !b.health.unhealthy.Load() {
+			total += b.weight()
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+
+	n := rand.IntN(total)
+	var last *backend
+	for _, b := range g.backends {
+		if b.health.unhealthy.Load() {
+			continue
+		}
+		// A backend marked unhealthy or reweighted since the first pass
+		// shifts the range, in which case the last healthy one seen is used
+		last = b
+		weight := b.weight()
+		if n < weight {
+			return b
+		}
+		n -= weight
+	}
+	return last
+}
+
+// Pick the first healthy backend at or after the key's position on the ring
+func (g *backendGroup) hashed(key string) *backend {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if len(g.ring) == 0 {
+		return nil
+	}
+	hash := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(g.ring), func(i int) bool { return g.ring[i].hash >= hash })
+	for i := 0; i < len(g.ring); i++ {
+		point := g.ring[(start+i)%len(g.ring)]
+		if !point.backend.health.unhealthy.Load() {
+			return point.backend
+		}
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newHashGroup(names ...string) *backendGroup {
+	group := &backendGroup{balance: balanceIPHash}
+	for _, name := range names {
+		group.backends = append(group.backends, &backend{BackendConfig: BackendConfig{Name: name, Weight: 1}})
+	}
+	group.ring = buildHashRing(group.backends)
+	return group
+}
+
+// Requests from one client IP always reach the same backend
+func TestIPHashStable(t *testing.T) {
+	group := newHashGroup("a", "b", "c")
+	used := map[string]int{}
+	for i := 0; i < 300; i++ {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		r.RemoteAddr = fmt.Sprintf("198.51.100.%d:%d", i%250, 1000+i)
+		first := group.pick(r)
+		for j := 0; j < 5; j++ {
+			if got := group.pick(r); got != first {
+				t.Fatalf("client %s moved from %s to %s", r.RemoteAddr, first.Name, got.Name)
+			}
+		}
+		used[first.Name]++
+	}
+	if len(used) != 3 {
+		t.Errorf("clients spread over %v, want all three backends", used)
+	}
+}
+
+// When a backend goes down only its own clients move, and they come back
+// once it recovers
+func TestIPHashFailover(t *testing.T) {
+	group := newHashGroup("a", "b", "c")
+	down := group.backends[1]
+
+	before := map[string]*backend{}
+	for i := 0; i < 250; i++ {
+		ip := fmt.Sprintf("203.0.113.%d", i)
+		before[ip] = group.hashed(ip)
+	}
+
+	down.health.unhealthy.Store(true)
+	moved := 0
+	for ip, b := range before {
+		got := group.hashed(ip)
+		if got == down {
+			t.Fatalf("%s still sent to the unhealthy backend", ip)
+		}
+		if b != down && got != b {
+			t.Errorf("%s moved from healthy %s to %s", ip, b.Name, got.Name)
+		}
+		if b == down {
+			moved++
+			// Spill-over is deterministic too
+			if again := group.hashed(ip); again != got {
+				t.Errorf("%s spilled to %s then %s", ip, got.Name, again.Name)
+			}
+		}
+	}
+	if moved == 0 {
+		t.Fatal("no clients were on the backend taken down")
+	}
+
+	down.health.unhealthy.Store(false)
+	for ip, b := range before {
+		if got := group.hashed(ip); got != b {
+			t.Errorf("%s on %s after recovery, want %s", ip, got.Name, b.Name)
+		}
+	}
+
+	for _, b := range group.backends {
+		b.health.unhealthy.Store(true)
+	}
+	if got := group.hashed("203.0.113.1"); got != nil {
+		t.Errorf("picked %s with every backend down", got.Name)
+	}
+}
+
+func TestValidBalance(t *testing.T) {
+	tests := []struct {
+		balance string
+		wantErr bool
+	}{
+		{balanceRoundRobin, false},
+		{balanceIPHash, false},
+		{balanceRandom, false},
+		{"least_conn", true},
+	}
+	for _, tt := range tests {
+		if err := validBalance(tt.balance); (err != nil) != tt.wantErr {
+			t.Errorf("validBalance(%q) = %v, want error %v", tt.balance, err, tt.wantErr)
+		}
+	}
+}
+
+func newWeightedGroup(balance string, weights ...int) *backendGroup {
+	group := &backendGroup{balance: balance}
+	for i, weight := range weights {
+		b := &backend{BackendConfig: BackendConfig{Name: string(rune('a' + i)), Weight: weight}}
+		b.health.weight.Store(int64(weight * weightScale))
+		group.backends = append(group.backends, b)
+	}
+	group.ring = buildHashRing(group.backends)
+	return group
+}
+
+// Random picks follow the weights and never land on a backend that is down
+func TestRandomBalance(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights []int
+		down    []int
+		want    []float64
+	}{
+		{"equal", []int{1, 1}, nil, []float64{0.5, 0.5}},
+		{"weighted", []int{3, 1}, nil, []float64{0.75, 0.25}},
+		{"one down", []int{1, 1, 1}, []int{1}, []float64{0.5, 0, 0.5}},
+		{"heaviest down", []int{1, 5, 2}, []int{1}, []float64{1.0 / 3, 0, 2.0 / 3}},
+	}
+	const picks = 20000
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			group := newWeightedGroup(balanceRandom, tt.weights...)
+			for _, i := range tt.down {
+				group.backends[i].health.unhealthy.Store(true)
+			}
+			counts := map[*backend]int{}
+			for i := 0; i < picks; i++ {
+				b := group.random()
+				if b == nil || b.health.unhealthy.Load() {
+					t.Fatalf("picked %v", b)
+				}
+				counts[b]++
+			}
+			for i, b := range group.backends {
+				got := float64(counts[b]) / picks
+				if got < tt.want[i]-0.03 || got > tt.want[i]+0.03 {
+					t.Errorf("backend %s got %.3f of picks, want %.3f", b.Name, got, tt.want[i])
+				}
+			}
+		})
+	}
+
+	group := newWeightedGroup(balanceRandom, 1, 1)
+	for _, b := range group.backends {
+		b.health.unhealthy.Store(true)
+	}
+	if got := group.random(); got != nil {
+		t.Errorf("picked %s with every backend down", got.Name)
+	}
+}
+
+func BenchmarkBalance(b *testing.B) {
+	for _, balance := range []string{balanceRoundRobin, balanceIPHash, balanceRandom} {
+		b.Run(balance, func(b *testing.B) {
+			group := newWeightedGroup(balance, 3, 1, 2, 1)
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if group.pick(r) == nil {
+						b.Fatal("no backend picked")
+					}
+				}
+			})
+		})
+	}
+}
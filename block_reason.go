@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Machine-readable reasons a request was refused, sent to clients with
+// [security] expose_block_reason and always logged
+const (
+	blockBlacklist       = "blacklist"
+	blockNotWhitelisted  = "not-whitelisted"
+	blockACL             = "acl"
+	blockOriginSecret    = "origin-secret"
+	blockWebSocketOrigin = "websocket-origin"
+)
+
+// Refuse a request with status, logging why. Clients only learn the reason,
+// in the X-Block-Reason header and a JSON body, when expose_block_reason is
+// on, since it tells them which policy they ran into.
+func writeBlocked(w http.ResponseWriter, r *http.Request, status int, reason string) {
+	logger.Debug("Request blocked", "reason", reason, "remote_addr", r.RemoteAddr, "host", r.Host, "method", r.Method, "path", r.URL.Path)
+	if !currentConfig().Security.ExposeBlockReason {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	w.Header().Set("X-Block-Reason", reason)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": http.StatusText(status), "reason": reason})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Every block is logged with its reason; clients only get it, in a header
+// and JSON body, with expose_block_reason
+func TestBlockReasons(t *testing.T) {
+	backend := newNamedBackend(t, "backend")
+	t.Setenv("TEST_ORIGIN_SECRET", "s3cret")
+	domains := map[string]string{
+		"example.com":        "[proxy]\nbackend_url = " + backend.URL + "\n",
+		"acl.example.com":    "[proxy]\nbackend_url = " + backend.URL + "\n[acl]\ndefault_action = deny\n",
+		"origin.example.com": "[proxy]\nbackend_url = " + backend.URL + "\n[origin_protection]\nheader_name = X-Origin-Secret\nsecret_env = TEST_ORIGIN_SECRET\n",
+		"ws.example.com":     "[proxy]\nbackend_url = " + backend.URL + "\n[websocket]\nallowed_origins = https://app.example.com\n",
+	}
+
+	tests := []struct {
+		name       string
+		host       string
+		remote     string
+		websocket  bool
+		wantStatus int
+		wantReason string
+	}{
+		{"blacklist", "example.com", "192.0.2.66:1234", false, http.StatusForbidden, blockBlacklist},
+		{"not whitelisted", "example.com", "198.51.100.99:1234", false, http.StatusUnauthorized, blockNotWhitelisted},
+		{"acl", "acl.example.com", "192.0.2.1:1234", false, http.StatusForbidden, blockACL},
+		{"origin secret", "origin.example.com", "192.0.2.1:1234", false, http.StatusForbidden, blockOriginSecret},
+		{"websocket origin", "ws.example.com", "192.0.2.1:1234", true, http.StatusForbidden, blockWebSocketOrigin},
+	}
+	for _, expose := range []bool{false, true} {
+		for _, tt := range tests {
+			name := tt.name
+			if expose {
+				name += " exposed"
+			}
+			t.Run(name, func(t *testing.T) {
+				config := "[blacklist]\nips = 192.0.2.66\n"
+				if expose {
+					config += "[security]\nexpose_block_reason = true\n"
+				}
+				loadTestConfig(t, config)
+				loadTestDomains(t, domains)
+				logs := captureLogs(t)
+
+				r := httptest.NewRequest(http.MethodGet, "http://"+tt.host+"/", nil)
+				r.RemoteAddr = tt.remote
+				if tt.websocket {
+					r.Header.Set("Connection", "Upgrade")
+					r.Header.Set("Upgrade", "websocket")
+					r.Header.Set("Origin", "https://evil.example")
+				}
+				got := serveTest(r)
+				if got.Code != tt.wantStatus {
+					t.Fatalf("status %d, want %d", got.Code, tt.wantStatus)
+				}
+				if !strings.Contains(logs.String(), "reason="+tt.wantReason) {
+					t.Errorf("block not logged with reason %s: %s", tt.wantReason, logs)
+				}
+
+				if !expose {
+					if reason := got.Header().Get("X-Block-Reason"); reason != "" || strings.Contains(got.Body.String(), tt.wantReason) {
+						t.Errorf("reason exposed without expose_block_reason: header %q, body %q", reason, got.Body)
+					}
+					return
+				}
+				if reason := got.Header().Get("X-Block-Reason"); reason != tt.wantReason {
+					t.Errorf("X-Block-Reason %q, want %q", reason, tt.wantReason)
+				}
+				var body struct {
+					Error  string `json:"error"`
+					Reason string `json:"reason"`
+				}
+				if err := json.NewDecoder(got.Body).Decode(&body); err != nil {
+					t.Fatal(err)
+				}
+				if body.Reason != tt.wantReason || body.Error != http.StatusText(tt.wantStatus) {
+					t.Errorf("body %+v, want reason %s and error %q", body, tt.wantReason, http.StatusText(tt.wantStatus))
+				}
+			})
+		}
+	}
+}
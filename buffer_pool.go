@@ -0,0 +1,34 @@
+package main
+
+import "sync"
+
+// Size of the buffers response bodies are copied through unless
+// [backend] copy_buffer_size is set; the same as net/http/httputil's own
+const defaultCopyBufferSize = 32 * 1024
+
+// copyBufferPool lends fixed-size buffers for copying response bodies to
+// clients. Concurrent downloads each hold one buffer while copying and hand
+// it back afterwards, so memory stays bounded however large the bodies are
+// and the buffers are reused rather than left to the garbage collector.
+type copyBufferPool struct {
+	pool sync.Pool
+}
+
+var copyBuffers = &copyBufferPool{}
+
+// Get returns a buffer of copy_buffer_size bytes. Buffers of an earlier
+// size, from before a reload changed it, are dropped.
+func (p *copyBufferPool) Get() []byte {
+	size := currentConfig().Backend.CopyBufferSize
+	if buf, ok := p.pool.Get().(*[]byte); ok && len(*buf) == size {
+		return *buf
+	}
+	return make([]byte, size)
+}
+
+func (p *copyBufferPool) Put(buf []byte) {
+	if len(buf) != currentConfig().Backend.CopyBufferSize {
+		return
+	}
+	p.pool.Put(&buf)
+}
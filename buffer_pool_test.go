@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyBufferPool(t *testing.T) {
+	loadTestConfig(t, "[backend]\ncopy_buffer_size = 4096\n")
+	buf := copyBuffers.Get()
+	if len(buf) != 4096 {
+		t.Fatalf("buffer of %d bytes, want copy_buffer_size", len(buf))
+	}
+
+	// Buffers from before a reload changed the size are not lent out again
+	copyBuffers.Put(buf)
+	loadTestConfig(t, "[backend]\ncopy_buffer_size = 8192\n")
+	if got := copyBuffers.Get(); len(got) != 8192 {
+		t.Errorf("buffer of %d bytes after the size changed, want 8192", len(got))
+	}
+	copyBuffers.Put(make([]byte, 4096))
+	if got := copyBuffers.Get(); len(got) != 8192 {
+		t.Errorf("buffer of %d bytes after putting back an old one, want 8192", len(got))
+	}
+}
+
+func TestCopyBufferSizeInvalid(t *testing.T) {
+	for _, size := range []string{"0", "1023", "-1"} {
+		path := filepath.Join(t.TempDir(), "system.conf")
+		if err := os.WriteFile(path, []byte(testConfigBase+"[backend]\ncopy_buffer_size = "+size+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := loadConfig(path); err == nil {
+			t.Errorf("loadConfig accepted copy_buffer_size = %s", size)
+		}
+	}
+}
+
+// A proxied download copied to the client through a copy buffer
+func TestLargeDownloadThroughPool(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789abcdef"), 256*1024)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer backend.Close()
+	loadTestConfig(t, "[backend]\ncopy_buffer_size = 1024\n")
+	loadTestDomains(t, map[string]string{"example.com": "[proxy]\nbackend_url = " + backend.URL + "\n"})
+	if got := serveTest(httptest.NewRequest(http.MethodGet, "http://example.com/", nil)); !bytes.Equal(got.Body.Bytes(), body) {
+		t.Errorf("downloaded %d bytes differing from the %d the backend sent", got.Body.Len(), len(body))
+	}
+}
+
+// discardResponse is a ResponseWriter that throws the body away, so the
+// benchmark measures the proxy's copying rather than the recorder's
+type discardResponse struct {
+	header http.Header
+}
+
+func (d *discardResponse) Header() http.Header         { return d.header }
+func (d *discardResponse) Write(p []byte) (int, error) { return len(p), nil }
+func (d *discardResponse) WriteHeader(int)             {}
+
+// Concurrent 4MB downloads with and without the buffer pool; compare the
+// allocations per download
+func BenchmarkLargeDownload(b *testing.B) {
+	body := bytes.Repeat([]byte("0123456789abcdef"), 256*1024)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer backend.Close()
+	loadTestConfig(b, "")
+	target, err := url.Parse(backend.URL)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, bench := range []struct {
+		name string
+		pool httputil.BufferPool
+	}{
+		{"pooled", copyBuffers},
+		{"unpooled", nil},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			proxy := httputil.NewSingleHostReverseProxy(target)
+			proxy.BufferPool = bench.pool
+			b.ReportAllocs()
+			b.SetBytes(int64(len(body)))
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					proxy.ServeHTTP(&discardResponse{header: http.Header{}}, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+				}
+			})
+		})
+	}
+}
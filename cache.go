@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// CacheConfig controls caching of a domain's responses
+type CacheConfig struct {
+	Enabled      bool
+	TTL          time.Duration
+	MaxEntrySize int64
+
+	// Serve expired entries up to StaleMaxAge past expiry when the backend fails
+	ServeStaleOnError bool
+	StaleMaxAge       time.Duration
+}
+
+var (
+	cacheHits      = newCounterVec("cache_hits_total", "Requests answered from the response cache.", "domain")
+	cacheMisses    = newCounterVec("cache_misses_total", "Cacheable requests not found in the response cache.", "domain")
+	cacheCoalesced = newCounterVec("cache_coalesced_total", "Cache misses answered with the response fetched by a concurrent request for the same URL.", "domain")
+
+	// Coalesces concurrent cache misses for the same key
+	cacheFlight singleflight.Group
+)
+
+// A cached backend response
+type cacheEntry struct {
+	key      string
+	status   int
+	header   http.Header
+	body     []byte
+	storedAt time.Time
+	expires  time.Time
+
+	// Expired entries are kept until staleUntil to be served on backend errors
+	staleUntil time.Time
+
+	// Request header values the response varies on
+	vary map[string]string
+}
+
+// responseCache is an in-memory LRU cache of responses shared by all
+// domains. Keys include the host, so domains never see each other's entries.
+type responseCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    map[string]*list.Element
+	lru        *list.List
+}
+
+var cache = newResponseCache(10000)
+
+func newResponseCache(maxEntries int) *responseCache {
+	return &responseCache{maxEntries: maxEntries, entries: make(map[string]*list.Element), lru: list.New()}
+}
+
+// The cache key of a request: host, path and query
+func cacheKey(r *http.Request) string {
+	return r.Host + r.URL.RequestURI()
+}
+
+// Return the fresh entry for a request, or nil
+func (c *responseCache) get(key string, r *http.Request) *cacheEntry {
+	return c.lookup(key, r, false)
+}
+
+// Return the entry for a request even if it has expired, as long as it is
+// still within its stale window
+func (c *responseCache) getStale(key string, r *http.Request) *cacheEntry {
+	return c.lookup(key, r, true)
+}
+
+func (c *responseCache) lookup(key string, r *http.Request, allowStale bool) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*cacheEntry)
+	now := time.Now()
+	if now.After(entry.staleUntil) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		return nil
+	}
+	if !allowStale && now.After(entry.expires) {
+		return nil
+	}
+	for name, value := range entry.vary {
+		if r.Header.Get(name) != value {
+			return nil
+		}
+	}
+	c.lru.MoveToFront(elem)
+	return entry
+}
+
+func (c *responseCache) set(entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[entry.key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// Change the cache's capacity, evicting the least recently used entries
+// that no longer fit
+func (c *responseCache) setMaxEntries(maxEntries int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.maxEntries = maxEntries
+	for c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// Drop every entry, returning how many there were. The maps are swapped
+// rather than cleared so the lock is only held briefly.
+func (c *responseCache) purgeAll() int {
+	c.mu.Lock()
+	n := c.lru.Len()
+	c.entries = make(map[string]*list.Element)
+	c.lru = list.New()
+	c.mu.Unlock()
+	return n
+}
+
+// Drop the entry for one key, returning 1 if it existed
+func (c *responseCache) purge(key string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return 0
+	}
+	c.lru.Remove(elem)
+	delete(c.entries, key)
+	return 1
+}
+
+// Report whether a request may be answered from or stored in the cache
+func cacheableRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	return r.Header.Get("Authorization") == "" && r.Header.Get("Upgrade") == ""
+}
+
+// Report whether the client asked to bypass cached copies
+func requestNoCache(r *http.Request) bool {
+	cc := strings.ToLower(r.Header.Get("Cache-Control"))
+	return strings.Contains(cc, "no-cache") || strings.Contains(cc, "no-store") || r.Header.Get("Pragma") == "no-cache"
+}
+
+// Work out how long a response may be cached, honouring its Cache-Control
+// header and falling back to the domain's ttl. Zero means don't store it.
+func responseTTL(header http.Header, defaultTTL time.Duration) time.Duration {
+	if header.Get("Set-Cookie") != "" {
+		return 0
+	}
+
+	ttl := defaultTTL
+	maxAgeSet := false
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.ToLower(strings.TrimSpace(directive)), "=")
+		switch name {
+		case "no-store", "no-cache", "private":
+			return 0
+		case "s-maxage", "max-age":
+			// s-maxage is meant for shared caches like this one and wins over max-age
+			if name == "max-age" && maxAgeSet {
+				continue
+			}
+			seconds, err := strconv.Atoi(strings.Trim(value, `"`))
+			if err != nil {
+				return 0
+			}
+			ttl = time.Duration(seconds) * time.Second
+			maxAgeSet = name == "s-maxage"
+		}
+	}
+	if ttl < 0 {
+		return 0
+	}
+	return ttl
+}
+
+// Write a cached response to the client. Stale responses are marked with
+// a Warning header.
+func (entry *cacheEntry) serve(w http.ResponseWriter, r *http.Request, stale bool) {
+	header := w.Header()
+	for name, values := range entry.header {
+		header[name] = values
+	}
+	header.Set("Age", strconv.Itoa(int(time.Since(entry.storedAt).Seconds())))
+	if stale {
+		header.Set("Warning", `110 - "Response is Stale"`)
+		header.Set("X-Cache", "STALE")
+	} else {
+		header.Set("X-Cache", "HIT")
+	}
+	if notModified(r, entry.header) {
+		header.Del("Content-Type")
+		header.Del("Content-Length")
+		header.Del("Content-Encoding")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(entry.status)
+	if r.Method != http.MethodHead {
+		w.Write(entry.body)
+	}
+}
+
+// Report whether the client's copy of a cached response is still current,
+// by If-None-Match against the ETag or, when the client sent no
+// If-None-Match, by If-Modified-Since against Last-Modified
+func notModified(r *http.Request, header http.Header) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := header.Get("ETag")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || weakETagMatch(candidate, etag) {
+				return true
+			}
+		}
+		return false
+	}
+
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return !lastModified.Truncate(time.Second).After(ims)
+}
+
+// Compare two entity tags ignoring the weak indicator, as If-None-Match does
+func weakETagMatch(a, b string) bool {
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// cacheRecorder passes a response through to the client while keeping a
+// copy of it for the cache, up to the domain's max_entry_size
+type cacheRecorder struct {
+	http.ResponseWriter
+	key      string
+	status   int
+	body     bytes.Buffer
+	maxSize  int64
+	tooLarge bool
+
+	// Set when a stale entry was served instead of a backend response
+	servedStale bool
+}
+
+type cacheRecorderKey struct{}
+
+// Report whether a response declared or sent trailers
+func hasTrailers(header http.Header) bool {
+	if len(header.Values("Trailer")) > 0 {
+		return true
+	}
+	for name := range header {
+		if strings.HasPrefix(name, http.TrailerPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (cr *cacheRecorder) WriteHeader(status int) {
+	if cr.status == 0 {
+		cr.status = status
+		if cr.Header().Get("X-Cache") == "" {
+			cr.Header().Set("X-Cache", "MISS")
+		}
+	}
+	cr.ResponseWriter.WriteHeader(status)
+}
+
+func (cr *cacheRecorder) Write(b []byte) (int, error) {
+	if cr.status == 0 {
+		cr.WriteHeader(http.StatusOK)
+	}
+	if !cr.tooLarge {
+		if int64(cr.body.Len()+len(b)) > cr.maxSize {
+			cr.tooLarge = true
+			cr.body = bytes.Buffer{}
+		} else {
+			cr.body.Write(b)
+		}
+	}
+	return cr.ResponseWriter.Write(b)
+}
+
+func (cr *cacheRecorder) Flush() {
+	if flusher, ok := cr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (cr *cacheRecorder) Unwrap() http.ResponseWriter {
+	return cr.ResponseWriter
+}
+
+// Store the recorded response if it is a complete, cacheable 200 to a GET
+func (cr *cacheRecorder) store(r *http.Request, cacheConfig CacheConfig) {
+	if r.Method != http.MethodGet || cr.status != http.StatusOK || cr.tooLarge || cr.servedStale {
+		return
+	}
+
+	// Trailers end up in the header map once the body is written, and a
+	// cached copy could not send them as trailers again
+	if hasTrailers(cr.Header()) {
+		return
+	}
+
+	header := cr.Header().Clone()
+	ttl := responseTTL(header, cacheConfig.TTL)
+	if ttl <= 0 {
+		return
+	}
+
+	vary := make(map[string]string)
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return
+			}
+			if name != "" {
+				vary[name] = r.Header.Get(name)
+			}
+		}
+	}
+
+	header.Del("X-Cache")
+	now := time.Now()
+	cache.set(&cacheEntry{
+		key:      cr.key,
+		status:   cr.status,
+		header:   header,
+		body:     cr.body.Bytes(),
+		storedAt: now,
+		expires:  now.Add(ttl),
+		vary:     vary,
+
+		staleUntil: now.Add(ttl + staleMaxAge(cacheConfig)),
+	})
+}
+
+// Answer a cacheable request from the cache, or from the backend on a miss.
+// Concurrent misses for the same key are coalesced: one request goes to the
+// backend while the rest wait and then use the response it stored.
+func (dp *domainProxy) serveCached(w http.ResponseWriter, r *http.Request) {
+	key := cacheKey(r)
+	if !requestNoCache(r) {
+		if entry := cache.get(key, r); entry != nil {
+			cacheHits.inc(dp.name)
+			entry.serve(w, r, false)
+			return
+		}
+	}
+	cacheMisses.inc(dp.name)
+
+	if r.Method != http.MethodGet {
+		dp.forward(w, r)
+		return
+	}
+
+	// singleflight re-panics in a new goroutine when there are waiters, which
+	// would crash the process, so recover here and re-panic on this goroutine
+	leader := false
+	var panicked interface{}
+	cacheFlight.Do(key, func() (interface{}, error) {
+		leader = true
+		defer func() {
+			panicked = recover()
+		}()
+		dp.forwardAndStore(w, r, key)
+		return nil, nil
+	})
+	if leader {
+		if panicked != nil {
+			panic(panicked)
+		}
+		return
+	}
+
+	if entry := cache.get(key, r); entry != nil {
+		cacheCoalesced.inc(dp.name)
+		entry.serve(w, r, false)
+		return
+	}
+	// The shared response could not be cached, so fetch our own
+	dp.forwardAndStore(w, r, key)
+}
+
+// Forward a request to the backend, storing the response if it is cacheable
+func (dp *domainProxy) forwardAndStore(w http.ResponseWriter, r *http.Request, key string) {
+	recorder := &cacheRecorder{ResponseWriter: w, key: key, maxSize: dp.config.Cache.MaxEntrySize}
+	r = r.WithContext(context.WithValue(r.Context(), cacheRecorderKey{}, recorder))
+	dp.forward(recorder, r)
+	recorder.store(r, dp.config.Cache)
+}
+
+// Purge the whole cache, or only the entry for the url query parameter,
+// reporting how many entries were removed
+func cachePurgeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var purged int
+	if rawURL := r.URL.Query().Get("url"); rawURL != "" {
+		u, err := url.Parse(rawURL)
+		if err != nil || u.Host == "" {
+			http.Error(w, "url must be an absolute URL", http.StatusBadRequest)
+			return
+		}
+		purged = cache.purge(u.Host + u.RequestURI())
+	} else {
+		purged = cache.purgeAll()
+	}
+	logger.Info("Purged response cache", "url", r.URL.Query().Get("url"), "entries", purged)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"purged": purged})
+}
+
+func staleMaxAge(cacheConfig CacheConfig) time.Duration {
+	if !cacheConfig.ServeStaleOnError {
+		return 0
+	}
+	return cacheConfig.StaleMaxAge
+}
+
+// Answer a request whose backend failed with the stale cached copy, if
+// there is one. Returns true if the request was answered.
+func serveStaleOnError(w http.ResponseWriter, r *http.Request) bool {
+	recorder, ok := r.Context().Value(cacheRecorderKey{}).(*cacheRecorder)
+	if !ok {
+		return false
+	}
+	entry := cache.getStale(recorder.key, r)
+	if entry == nil {
+		return false
+	}
+	recorder.servedStale = true
+	entry.serve(w, r, true)
+	return true
+}
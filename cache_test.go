@@ -0,0 +1,208 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Empty the shared response cache when the test ends
+func resetCache(t testing.TB) {
+	t.Cleanup(func() { cache.purgeAll() })
+}
+
+// Age a cached entry as if it had expired ago, keeping it stale until
+// staleUntil from now
+func expireCacheEntry(t testing.TB, key string, ago, staleUntil time.Duration) {
+	t.Helper()
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	elem, ok := cache.entries[key]
+	if !ok {
+		t.Fatalf("%s is not cached", key)
+	}
+	entry := elem.Value.(*cacheEntry)
+	entry.expires = time.Now().Add(-ago)
+	entry.staleUntil = time.Now().Add(staleUntil)
+}
+
+// A failed backend is covered by the expired cached copy while it is
+// within stale_max_age
+func TestServeStaleOnError(t *testing.T) {
+	tests := []struct {
+		name        string
+		options     string
+		staleUntil  time.Duration
+		wantStatus  int
+		wantWarning string
+	}{
+		{"stale copy served", "serve_stale_on_error = true\n", time.Hour, http.StatusOK, `110 - "Response is Stale"`},
+		{"past stale_max_age", "serve_stale_on_error = true\n", -time.Second, http.StatusBadGateway, ""},
+		{"disabled", "", time.Hour, http.StatusBadGateway, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetCache(t)
+			backend := newNamedBackend(t, "fresh")
+			loadTestConfig(t, "")
+			loadTestDomains(t, map[string]string{"example.com": "[proxy]\nbackend_url = " + backend.URL + "\n[cache]\nenabled = true\n" + tt.options})
+
+			if got := serveTest(httptest.NewRequest(http.MethodGet, "http://example.com/page", nil)); got.Header().Get("X-Cache") != "MISS" {
+				t.Fatalf("first request X-Cache %q, want MISS", got.Header().Get("X-Cache"))
+			}
+			if got := serveTest(httptest.NewRequest(http.MethodGet, "http://example.com/page", nil)); got.Header().Get("X-Cache") != "HIT" {
+				t.Fatalf("second request X-Cache %q, want HIT", got.Header().Get("X-Cache"))
+			}
+			expireCacheEntry(t, "example.com/page", time.Minute, tt.staleUntil)
+			backend.Close()
+
+			got := serveTest(httptest.NewRequest(http.MethodGet, "http://example.com/page", nil))
+			if got.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d", got.Code, tt.wantStatus)
+			}
+			if warning := got.Header().Get("Warning"); warning != tt.wantWarning {
+				t.Errorf("Warning %q, want %q", warning, tt.wantWarning)
+			}
+			if tt.wantStatus == http.StatusOK && (got.Body.String() != "fresh" || got.Header().Get("X-Cache") != "STALE") {
+				t.Errorf("got %q with X-Cache %q, want the stale copy", got.Body.String(), got.Header().Get("X-Cache"))
+			}
+		})
+	}
+}
+
+// Concurrent misses for one URL make a single backend request, unless its
+// response can't be cached, when the waiters fetch their own
+func TestCacheMissCoalescing(t *testing.T) {
+	const clients = 50
+	tests := []struct {
+		name         string
+		cacheControl string
+		wantCalls    int64
+	}{
+		{"cacheable", "max-age=60", 1},
+		{"uncacheable", "no-store", clients},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetCache(t)
+			release := make(chan struct{})
+			var calls atomic.Int64
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				<-release
+				w.Header().Set("Cache-Control", tt.cacheControl)
+				w.Write([]byte("shared"))
+			}))
+			defer backend.Close()
+			loadTestConfig(t, "")
+			loadTestDomains(t, map[string]string{"herd.example.com": "[proxy]\nbackend_url = " + backend.URL + "\n[cache]\nenabled = true\n"})
+
+			missesBefore := counterValue(cacheMisses, "herd.example.com")
+			coalescedBefore := counterValue(cacheCoalesced, "herd.example.com")
+			var wg sync.WaitGroup
+			bodies := make(chan string, clients)
+			for i := 0; i < clients; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					bodies <- serveTest(httptest.NewRequest(http.MethodGet, "http://herd.example.com/popular", nil)).Body.String()
+				}()
+			}
+			// Let every client miss and join the flight before the backend answers
+			for counterValue(cacheMisses, "herd.example.com")-missesBefore < clients {
+				time.Sleep(time.Millisecond)
+			}
+			time.Sleep(20 * time.Millisecond)
+			close(release)
+			wg.Wait()
+			close(bodies)
+
+			for body := range bodies {
+				if body != "shared" {
+					t.Fatalf("client got %q, want shared", body)
+				}
+			}
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("%d backend calls, want %d", got, tt.wantCalls)
+			}
+			wantCoalesced := uint64(clients - tt.wantCalls)
+			if got := counterValue(cacheCoalesced, "herd.example.com") - coalescedBefore; got != wantCoalesced {
+				t.Errorf("%d requests coalesced, want %d", got, wantCoalesced)
+			}
+		})
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	lastModified := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	header := http.Header{"Etag": {`"v2"`}, "Last-Modified": {lastModified.Format(http.TimeFormat)}}
+	tests := []struct {
+		name   string
+		method string
+		header map[string]string
+		want   bool
+	}{
+		{"matching etag", http.MethodGet, map[string]string{"If-None-Match": `"v2"`}, true},
+		{"weak etag", http.MethodGet, map[string]string{"If-None-Match": `W/"v2"`}, true},
+		{"one of several", http.MethodGet, map[string]string{"If-None-Match": `"v1", "v2"`}, true},
+		{"wildcard", http.MethodGet, map[string]string{"If-None-Match": "*"}, true},
+		{"other etag", http.MethodGet, map[string]string{"If-None-Match": `"v1"`}, false},
+		{"etag wins over date", http.MethodGet, map[string]string{"If-None-Match": `"v1"`, "If-Modified-Since": lastModified.Format(http.TimeFormat)}, false},
+		{"not modified since", http.MethodGet, map[string]string{"If-Modified-Since": lastModified.Format(http.TimeFormat)}, true},
+		{"modified since", http.MethodGet, map[string]string{"If-Modified-Since": lastModified.Add(-time.Second).Format(http.TimeFormat)}, false},
+		{"invalid date", http.MethodGet, map[string]string{"If-Modified-Since": "yesterday"}, false},
+		{"unconditional", http.MethodGet, nil, false},
+		{"post", http.MethodPost, map[string]string{"If-None-Match": `"v2"`}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "http://example.com/", nil)
+			for name, value := range tt.header {
+				r.Header.Set(name, value)
+			}
+			if got := notModified(r, header); got != tt.want {
+				t.Errorf("notModified = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Cached responses answer matching conditional requests with 304 and no body
+func TestCacheConditionalRequest(t *testing.T) {
+	resetCache(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v2"`)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("content"))
+	}))
+	defer backend.Close()
+	loadTestConfig(t, "")
+	loadTestDomains(t, map[string]string{"example.com": "[proxy]\nbackend_url = " + backend.URL + "\n[cache]\nenabled = true\n"})
+	serveTest(httptest.NewRequest(http.MethodGet, "http://example.com/etag", nil))
+
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		wantStatus  int
+		wantBody    string
+	}{
+		{"matching etag", `"v2"`, http.StatusNotModified, ""},
+		{"other etag", `"v1"`, http.StatusOK, "content"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/etag", nil)
+			r.Header.Set("If-None-Match", tt.ifNoneMatch)
+			got := serveTest(r)
+			if got.Code != tt.wantStatus || got.Body.String() != tt.wantBody {
+				t.Errorf("got %d %q, want %d %q", got.Code, got.Body.String(), tt.wantStatus, tt.wantBody)
+			}
+			if got.Header().Get("X-Cache") != "HIT" || got.Header().Get("ETag") != `"v2"` {
+				t.Errorf("X-Cache %q, ETag %q, want a cache hit with the ETag", got.Header().Get("X-Cache"), got.Header().Get("ETag"))
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+func validCanonicalHost(host string) error {
+	if host == "" || strings.ContainsAny(host, "/:?#@ ") {
+		return fmt.Errorf("canonical_host must be a bare hostname, got %q", host)
+	}
+	return nil
+}
+
+// Permanently redirect a request for any other hostname of the domain, such
+// as an alias, to the canonical one, keeping the scheme, port, path and
+// query. Methods other than GET and HEAD get 308 so clients resend the body.
+// Returns true if a redirect was sent.
+func redirectToCanonicalHost(w http.ResponseWriter, r *http.Request, canonical string) bool {
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host, port = r.Host, ""
+	}
+	if strings.EqualFold(host, canonical) {
+		return false
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	target := canonical
+	if port != "" {
+		target = net.JoinHostPort(canonical, port)
+	}
+
+	status := http.StatusMovedPermanently
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		status = http.StatusPermanentRedirect
+	}
+	http.Redirect(w, r, scheme+"://"+target+r.URL.RequestURI(), status)
+	return true
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCanonicalHostRedirect(t *testing.T) {
+	backend := newNamedBackend(t, "site")
+	tests := []struct {
+		name         string
+		domain       string
+		aliases      string
+		canonical    string
+		method       string
+		url          string
+		tls          bool
+		wantStatus   int
+		wantLocation string
+	}{
+		{"www to bare", "example.com", "www.example.com", "example.com", http.MethodGet, "http://www.example.com/shop?page=2", false, http.StatusMovedPermanently, "http://example.com/shop?page=2"},
+		{"bare to www", "www.example.com", "example.com", "www.example.com", http.MethodGet, "http://example.com/shop", false, http.StatusMovedPermanently, "http://www.example.com/shop"},
+		{"canonical served", "example.com", "www.example.com", "example.com", http.MethodGet, "http://example.com/shop", false, http.StatusOK, ""},
+		{"https kept", "example.com", "www.example.com", "example.com", http.MethodGet, "https://www.example.com/", true, http.StatusMovedPermanently, "https://example.com/"},
+		{"body resent", "example.com", "www.example.com", "example.com", http.MethodPost, "http://www.example.com/orders", false, http.StatusPermanentRedirect, "http://example.com/orders"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, "")
+			loadTestDomains(t, map[string]string{
+				tt.domain: "[proxy]\nbackend_url = " + backend.URL + "\naliases = " + tt.aliases + "\ncanonical_host = " + tt.canonical + "\n",
+			})
+			r := httptest.NewRequest(tt.method, tt.url, nil)
+			if tt.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			got := serveTest(r)
+			if got.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d", got.Code, tt.wantStatus)
+			}
+			if location := got.Header().Get("Location"); location != tt.wantLocation {
+				t.Errorf("Location %q, want %q", location, tt.wantLocation)
+			}
+		})
+	}
+}
+
+// Hosts as they reach redirectToCanonicalHost, including ones with a port
+// from a domain named after it
+func TestRedirectToCanonicalHost(t *testing.T) {
+	tests := []struct {
+		host         string
+		wantLocation string
+	}{
+		{"example.com", ""},
+		{"EXAMPLE.com", ""},
+		{"example.com:8080", ""},
+		{"www.example.com:8080", "http://example.com:8080/a?b=c"},
+		{"[::1]:8080", "http://example.com:8080/a?b=c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/a?b=c", nil)
+			r.Host = tt.host
+			recorder := httptest.NewRecorder()
+			redirected := redirectToCanonicalHost(recorder, r, "example.com")
+			if redirected != (tt.wantLocation != "") || recorder.Header().Get("Location") != tt.wantLocation {
+				t.Errorf("redirected %v to %q, want %q", redirected, recorder.Header().Get("Location"), tt.wantLocation)
+			}
+		})
+	}
+}
+
+func TestValidCanonicalHost(t *testing.T) {
+	tests := []struct {
+		host    string
+		wantErr bool
+	}{
+		{"example.com", false},
+		{"", true},
+		{"example.com:443", true},
+		{"https://example.com", true},
+		{"example.com/path", true},
+	}
+	for _, tt := range tests {
+		if err := validCanonicalHost(tt.host); (err != nil) != tt.wantErr {
+			t.Errorf("validCanonicalHost(%q) = %v, want error %v", tt.host, err, tt.wantErr)
+		}
+	}
+}
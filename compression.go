@@ -0,0 +1,179 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Encodings the proxy can compress responses with
+const (
+	encodingBrotli = "br"
+	encodingGzip   = "gzip"
+)
+
+// Brotli quality used for responses; higher levels compress little better
+// for far more CPU, which doesn't pay off when compressing every response
+const brotliLevel = 4
+
+// Content types compressed unless [compression] content_types is set
+var defaultCompressibleTypes = []string{
+	"text/html", "text/css", "text/plain", "text/xml", "text/javascript",
+	"application/javascript", "application/json", "application/xml", "image/svg+xml",
+}
+
+var compressedResponses = newCounterVec("compressed_responses_total", "Backend responses compressed by the proxy, by encoding.", "encoding")
+
+type compressionKey struct{}
+
+func validCompressionAlgorithms(algorithms []string) error {
+	for _, algorithm := range algorithms {
+		if algorithm != encodingBrotli && algorithm != encodingGzip {
+			return fmt.Errorf("compression: unknown algorithm %q, expected br or gzip", algorithm)
+		}
+	}
+	return nil
+}
+
+// Parse Accept-Encoding values into each coding's q-value. Codings are
+// lowercased, a missing or malformed q-value counts as 1, and "*" stands
+// for every coding not listed.
+func parseAcceptEncoding(values []string) map[string]float64 {
+	accepted := make(map[string]float64)
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			coding, params, _ := strings.Cut(part, ";")
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding == "" {
+				continue
+			}
+			q := 1.0
+			for _, param := range strings.Split(params, ";") {
+				name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if strings.EqualFold(name, "q") {
+					if parsed, err := strconv.ParseFloat(value, 64); err == nil && parsed >= 0 && parsed <= 1 {
+						q = parsed
+					}
+				}
+			}
+			accepted[coding] = q
+		}
+	}
+	return accepted
+}
+
+// Choose the encoding for a response: the configured algorithm the client
+// prefers most, with ties going to the one listed first in algorithms.
+// Returns "" to send the response as is, including when the client sent
+// no Accept-Encoding or accepts none of the algorithms.
+func selectEncoding(values []string, algorithms []string) string {
+	accepted := parseAcceptEncoding(values)
+	best, bestQ := "", 0.0
+	for _, algorithm := range algorithms {
+		q, listed := accepted[algorithm]
+		if !listed {
+			q = accepted["*"]
+		}
+		if q > bestQ {
+			best, bestQ = algorithm, q
+		}
+	}
+	return best
+}
+
+// Whether a response's Content-Type is one of types, which may name a
+// whole family as "text/*"
+func compressibleType(contentType string, types []string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range types {
+		if t == mediaType || strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(t, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Compress a backend response with the encoding negotiated for its request,
+// if it is worth it: an uncompressed body of a listed type and at least
+// min_size bytes. Event streams, partial content and responses marked
+// no-transform are left alone. Responses that could have been compressed
+// vary on Accept-Encoding even when sent as is, so caches keep both forms.
+func compressResponse(resp *http.Response) {
+	encoding, negotiated := resp.Request.Context().Value(compressionKey{}).(string)
+	if !negotiated {
+		return
+	}
+	header := resp.Header
+	switch {
+	case resp.Request.Method == http.MethodHead,
+		resp.StatusCode < http.StatusOK,
+		resp.StatusCode == http.StatusNoContent,
+		resp.StatusCode == http.StatusPartialContent,
+		resp.StatusCode == http.StatusNotModified,
+		header.Get("Content-Encoding") != "",
+		header.Get("Content-Range") != "",
+		strings.Contains(strings.ToLower(header.Get("Cache-Control")), "no-transform"),
+		resp.ContentLength >= 0 && resp.ContentLength < currentConfig().Compression.MinSize,
+		strings.HasPrefix(header.Get("Content-Type"), "text/event-stream"),
+		!compressibleType(header.Get("Content-Type"), currentConfig().Compression.ContentTypes):
+		return
+	}
+
+	header.Add("Vary", "Accept-Encoding")
+	if encoding == "" {
+		return
+	}
+	header.Set("Content-Encoding", encoding)
+	header.Del("Content-Length")
+	resp.ContentLength = -1
+	// The compressed body is no longer byte-for-byte what a strong
+	// validator promised
+	if etag := header.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("Etag", "W/"+etag)
+	}
+	resp.Body = newCompressedBody(resp.Body, encoding)
+	compressedResponses.inc(encoding)
+}
+
+// compressedBody reads a backend body through an encoder running on its own
+// goroutine
+type compressedBody struct {
+	*io.PipeReader
+	body io.ReadCloser
+}
+
+func newCompressedBody(body io.ReadCloser, encoding string) *compressedBody {
+	pr, pw := io.Pipe()
+	go func() {
+		var encoder io.WriteCloser
+		if encoding == encodingBrotli {
+			encoder = brotli.NewWriterLevel(pw, brotliLevel)
+		} else {
+			encoder = gzip.NewWriter(pw)
+		}
+		buf := copyBuffers.Get()
+		_, err := io.CopyBuffer(encoder, body, buf)
+		copyBuffers.Put(buf)
+		if closeErr := encoder.Close(); err == nil {
+			err = closeErr
+		}
+		pw.CloseWithError(err)
+	}()
+	return &compressedBody{PipeReader: pr, body: body}
+}
+
+// Close stops the encoder and closes the backend body, which also ends a
+// read the encoder is blocked in
+func (cb *compressedBody) Close() error {
+	cb.PipeReader.Close()
+	return cb.body.Close()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestParseAcceptEncoding(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   map[string]float64
+	}{
+		{nil, map[string]float64{}},
+		{[]string{"gzip, br"}, map[string]float64{"gzip": 1, "br": 1}},
+		{[]string{"br;q=0.8, GZIP;q=0.9"}, map[string]float64{"br": 0.8, "gzip": 0.9}},
+		{[]string{"gzip;q=0", "*;q=0.1"}, map[string]float64{"gzip": 0, "*": 0.1}},
+		{[]string{"br; Q=0.5 , identity"}, map[string]float64{"br": 0.5, "identity": 1}},
+		{[]string{"gzip;q=high, br;q=2, deflate;q=-1"}, map[string]float64{"gzip": 1, "br": 1, "deflate": 1}},
+		{[]string{" , ;q=0.5"}, map[string]float64{}},
+	}
+	for _, tt := range tests {
+		if got := parseAcceptEncoding(tt.values); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseAcceptEncoding(%q) = %v, want %v", tt.values, got, tt.want)
+		}
+	}
+}
+
+func TestSelectEncoding(t *testing.T) {
+	brFirst := []string{encodingBrotli, encodingGzip}
+	tests := []struct {
+		accept     string
+		algorithms []string
+		want       string
+	}{
+		{"gzip, br", brFirst, "br"},
+		{"gzip, br", []string{encodingGzip, encodingBrotli}, "gzip"},
+		{"br;q=0.5, gzip", brFirst, "gzip"},
+		{"gzip", brFirst, "gzip"},
+		{"gzip, br", []string{encodingGzip}, "gzip"},
+		{"br", []string{encodingGzip}, ""},
+		{"br;q=0, gzip;q=0", brFirst, ""},
+		{"*", brFirst, "br"},
+		{"*;q=0.5, gzip", brFirst, "gzip"},
+		{"br;q=0, *", brFirst, "gzip"},
+		{"identity", brFirst, ""},
+		{"", brFirst, ""},
+	}
+	for _, tt := range tests {
+		var values []string
+		if tt.accept != "" {
+			values = []string{tt.accept}
+		}
+		if got := selectEncoding(values, tt.algorithms); got != tt.want {
+			t.Errorf("selectEncoding(%q, %v) = %q, want %q", tt.accept, tt.algorithms, got, tt.want)
+		}
+	}
+}
+
+// Responses come back in the negotiated encoding and decode to what the
+// backend sent; ones not worth compressing are passed through
+func TestCompressResponse(t *testing.T) {
+	page := strings.Repeat("<p>coffee</p>\n", 200)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<p>hi</p>"))
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte(page))
+		case "/no-transform":
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("Cache-Control", "no-transform")
+			w.Write([]byte(page))
+		default:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("Etag", `"v1"`)
+			w.Write([]byte(page))
+		}
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name         string
+		algorithms   string
+		path         string
+		accept       string
+		wantEncoding string
+		wantVary     bool
+	}{
+		{"brotli", "", "/", "gzip, br", "br", true},
+		{"gzip", "", "/", "gzip", "gzip", true},
+		{"configured order", "algorithms = gzip, br\n", "/", "gzip, br", "gzip", true},
+		{"client accepts none", "", "/", "identity", "", true},
+		{"no accept-encoding", "", "/", "", "", true},
+		{"below min_size", "", "/small", "br", "", false},
+		{"type not listed", "", "/image", "br", "", false},
+		{"no-transform", "", "/no-transform", "br", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, "[compression]\nenabled = true\n"+tt.algorithms)
+			loadTestDomains(t, map[string]string{"example.com": "[proxy]\nbackend_url = " + backend.URL + "\n"})
+			r := httptest.NewRequest(http.MethodGet, "http://example.com"+tt.path, nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept-Encoding", tt.accept)
+			}
+			got := serveTest(r)
+			if encoding := got.Header().Get("Content-Encoding"); encoding != tt.wantEncoding {
+				t.Fatalf("Content-Encoding %q, want %q", encoding, tt.wantEncoding)
+			}
+			if vary := got.Header().Get("Vary") == "Accept-Encoding"; vary != tt.wantVary {
+				t.Errorf("Vary %q, want Accept-Encoding %v", got.Header().Get("Vary"), tt.wantVary)
+			}
+
+			var body io.Reader = got.Body
+			switch tt.wantEncoding {
+			case encodingBrotli:
+				body = brotli.NewReader(got.Body)
+			case encodingGzip:
+				zr, err := gzip.NewReader(got.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = zr
+			}
+			decoded, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.path == "/" && !bytes.Equal(decoded, []byte(page)) {
+				t.Errorf("decoded %d bytes differing from the %d the backend sent", len(decoded), len(page))
+			}
+			if tt.wantEncoding != "" && got.Header().Get("Etag") != `W/"v1"` {
+				t.Errorf("Etag %q, want it weakened", got.Header().Get("Etag"))
+			}
+		})
+	}
+}
+
+func TestValidCompressionAlgorithms(t *testing.T) {
+	tests := []struct {
+		algorithms []string
+		wantErr    bool
+	}{
+		{[]string{"br", "gzip"}, false},
+		{[]string{"gzip"}, false},
+		{[]string{"deflate"}, true},
+		{[]string{"gzip", "zstd"}, true},
+	}
+	for _, tt := range tests {
+		if err := validCompressionAlgorithms(tt.algorithms); (err != nil) != tt.wantErr {
+			t.Errorf("validCompressionAlgorithms(%v) = %v, want error %v", tt.algorithms, err, tt.wantErr)
+		}
+	}
+}
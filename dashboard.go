@@ -0,0 +1,17 @@
+package main
+
+import (
+	"embed"
+	"net/http"
+)
+
+// The dashboard is a single static page that polls /status and /metrics
+//
+//go:embed dashboard.html
+var dashboardFiles embed.FS
+
+func dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; connect-src 'self'")
+	http.ServeFileFS(w, r, dashboardFiles, "dashboard.html")
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Replace a gzip or deflate encoded request body with its decoded content
+// so backends that cannot decode it receive plain bytes. At most limit
+// decoded bytes are read, which stops small compressed bodies from
+// expanding without bound (see max_decompressed_size). On failure the
+// returned status should be sent to the client.
+func decompressRequestBody(r *http.Request, limit int64) (int, error) {
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	if r.Body == nil || (encoding != "gzip" && encoding != "deflate") {
+		return 0, nil
+	}
+
+	var decoder io.ReadCloser
+	var err error
+	if encoding == "gzip" {
+		decoder, err = gzip.NewReader(r.Body)
+	} else {
+		decoder, err = zlib.NewReader(r.Body)
+	}
+	if err != nil {
+		return requestBodyErrorStatus(err), fmt.Errorf("decoding %s request body: %w", encoding, err)
+	}
+	defer decoder.Close()
+
+	body, err := io.ReadAll(&decodedLimitReader{r: decoder, remaining: limit})
+	if err != nil {
+		return requestBodyErrorStatus(err), fmt.Errorf("decoding %s request body: %w", encoding, err)
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	r.Header.Del("Content-Encoding")
+	return 0, nil
+}
+
+var errDecodedTooLarge = errors.New("decoded request body too large")
+
+// decodedLimitReader fails as soon as more than remaining bytes have been
+// decoded, so a decompression bomb is stopped while it is being inflated
+// rather than after it has been fully expanded.
+type decodedLimitReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *decodedLimitReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.r.Read(p)
+	if int64(n) > l.remaining {
+		return 0, errDecodedTooLarge
+	}
+	l.remaining -= int64(n)
+	return n, err
+}
+
+// Map an error reading a request body to a status: bodies over the raw or
+// decoded size limit are too large, anything else is a malformed request.
+func requestBodyErrorStatus(err error) int {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) || errors.Is(err, errDecodedTooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
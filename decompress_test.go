@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func compress(t testing.TB, encoding string, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	if encoding == "gzip" {
+		w = gzip.NewWriter(&buf)
+	} else {
+		w = zlib.NewWriter(&buf)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestDecompressRequestBody(t *testing.T) {
+	tests := []struct {
+		name       string
+		encoding   string
+		body       []byte
+		wantStatus int
+		wantBody   string
+	}{
+		{"gzip", "gzip", compress(t, "gzip", []byte("hello")), 0, "hello"},
+		{"deflate", "deflate", compress(t, "deflate", []byte("hello")), 0, "hello"},
+		{"encoding in upper case", "GZIP", compress(t, "gzip", []byte("hello")), 0, "hello"},
+		{"not encoded", "", []byte("hello"), 0, "hello"},
+		{"other encoding left alone", "br", []byte("hello"), 0, "hello"},
+		{"malformed gzip", "gzip", []byte("not gzip"), http.StatusBadRequest, ""},
+		{"truncated gzip", "gzip", compress(t, "gzip", []byte("hello"))[:15], http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "http://example.com/", bytes.NewReader(tt.body))
+			if tt.encoding != "" {
+				r.Header.Set("Content-Encoding", tt.encoding)
+			}
+			status, err := decompressRequestBody(r, 1024)
+			if status != tt.wantStatus {
+				t.Fatalf("status %d (%v), want %d", status, err, tt.wantStatus)
+			}
+			if tt.wantStatus != 0 {
+				return
+			}
+			body, _ := io.ReadAll(r.Body)
+			if string(body) != tt.wantBody {
+				t.Errorf("body %q, want %q", body, tt.wantBody)
+			}
+			if tt.encoding == "gzip" || tt.encoding == "deflate" {
+				if r.Header.Get("Content-Encoding") != "" || r.ContentLength != int64(len(tt.wantBody)) {
+					t.Errorf("Content-Encoding %q, length %d after decoding", r.Header.Get("Content-Encoding"), r.ContentLength)
+				}
+			}
+		})
+	}
+}
+
+// The backend receives the decoded body only on domains that ask for it
+func TestDecompressRequests(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write([]byte(r.Header.Get("Content-Encoding") + ":" + string(body)))
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name   string
+		domain string
+		want   string
+	}{
+		{"enabled", "decompress_requests = true\n", ":hello"},
+		{"disabled", "", "gzip:" + string(compress(t, "gzip", []byte("hello")))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, "")
+			loadTestDomains(t, map[string]string{"example.com": "[proxy]\nbackend_url = " + backend.URL + "\n" + tt.domain})
+			r := httptest.NewRequest(http.MethodPost, "http://example.com/", bytes.NewReader(compress(t, "gzip", []byte("hello"))))
+			r.Header.Set("Content-Encoding", "gzip")
+			if got := serveTest(r).Body.String(); got != tt.want {
+				t.Errorf("backend got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestDecompressedSizeLimit(t *testing.T) {
+	tests := []struct {
+		name       string
+		size       int
+		wantStatus int
+	}{
+		{"under the limit", 1000, 0},
+		{"exactly the limit", 1024, 0},
+		{"one byte over", 1025, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "http://example.com/", bytes.NewReader(compress(t, "gzip", make([]byte, tt.size))))
+			r.Header.Set("Content-Encoding", "gzip")
+			if status, err := decompressRequestBody(r, 1024); status != tt.wantStatus {
+				t.Errorf("status %d (%v), want %d", status, err, tt.wantStatus)
+			}
+		})
+	}
+}
+
+// A zip bomb is refused while it is being inflated, long before all of it
+// has been read
+func TestDecompressZipBomb(t *testing.T) {
+	bomb := compress(t, "gzip", make([]byte, 64<<20))
+	body := &countingReader{r: bytes.NewReader(bomb)}
+	r := httptest.NewRequest(http.MethodPost, "http://example.com/", body)
+	r.Header.Set("Content-Encoding", "gzip")
+
+	if status, _ := decompressRequestBody(r, 1<<20); status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status %d, want 413", status)
+	}
+	if body.n > len(bomb)/8 {
+		t.Errorf("read %d of %d compressed bytes, want the inflating stopped early", body.n, len(bomb))
+	}
+}
+
+// Through the proxy, the compressed size counts against max_request_size
+// and the decoded size against max_decompressed_size
+func TestDecompressLimitsThroughProxy(t *testing.T) {
+	backend := newNamedBackend(t, "backend")
+	tests := []struct {
+		name   string
+		limits string
+		data   []byte
+		want   int
+	}{
+		{"within both", "max_request_size = 4096\nmax_decompressed_size = 65536\n", make([]byte, 60000), http.StatusOK},
+		{"decoded too large", "max_request_size = 4096\nmax_decompressed_size = 65536\n", make([]byte, 70000), http.StatusRequestEntityTooLarge},
+		{"compressed too large", "max_request_size = 4096\nmax_decompressed_size = 65536\n", randomBytes(t, 8000), http.StatusRequestEntityTooLarge},
+		{"bomb", "max_request_size = 1048576\nmax_decompressed_size = 1048576\n", make([]byte, 32<<20), http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, "[request_limits]\n"+tt.limits)
+			loadTestDomains(t, map[string]string{"example.com": "[proxy]\nbackend_url = " + backend.URL + "\ndecompress_requests = true\n"})
+			r := httptest.NewRequest(http.MethodPost, "http://example.com/", bytes.NewReader(compress(t, "gzip", tt.data)))
+			r.Header.Set("Content-Encoding", "gzip")
+			if got := serveTest(r).Code; got != tt.want {
+				t.Errorf("status %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// Bytes that don't compress
+func randomBytes(t testing.TB, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// hostResolver is the part of net.Resolver the DNS cache needs
+type hostResolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+// dnsCache resolves backend hostnames at most once per ttl. When a refresh
+// returns different addresses, onChange is called so pooled connections to
+// the old addresses can be closed.
+type dnsCache struct {
+	ttl      time.Duration
+	resolver hostResolver
+	dialer   *net.Dialer
+	onChange func()
+
+	mu      sync.Mutex
+	entries map[string]dnsEntry
+}
+
+func newDNSCache(ttl time.Duration, resolver hostResolver, dialer *net.Dialer) *dnsCache {
+	return &dnsCache{ttl: ttl, resolver: resolver, dialer: dialer, entries: make(map[string]dnsEntry)}
+}
+
+// Return the addresses of host, resolving it again once the cached answer
+// has expired. If the resolver fails, the expired answer is used instead.
+func (c *dnsCache) lookup(ctx context.Context, host string) ([]string, error) {
+	c.mu.Lock()
+	entry, exists := c.entries[host]
+	c.mu.Unlock()
+	if exists && time.Now().Before(entry.expires) {
+		return entry.addrs, nil
+	}
+
+	addrs, err := c.resolver.LookupHost(ctx, host)
+	if err != nil {
+		if exists {
+			logger.Warn("DNS lookup failed, using expired addresses", "host", host, "error", err)
+			return entry.addrs, nil
+		}
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.entries[host] = dnsEntry{addrs: addrs, expires: time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+
+	if exists && !sameAddrs(entry.addrs, addrs) {
+		logger.Info("Backend addresses changed", "host", host, "addrs", addrs)
+		if c.onChange != nil {
+			c.onChange()
+		}
+	}
+	return addrs, nil
+}
+
+func sameAddrs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[string]bool, len(a))
+	for _, addr := range a {
+		seen[addr] = true
+	}
+	for _, addr := range b {
+		if !seen[addr] {
+			return false
+		}
+	}
+	return true
+}
+
+// DialContext for http.Transport: resolve through the cache, then try each
+// address in turn
+func (c *dnsCache) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return c.dialer.DialContext(ctx, network, address)
+	}
+
+	addrs, err := c.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, addr := range addrs {
+		conn, err := c.dialer.DialContext(ctx, network, net.JoinHostPort(addr, port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if lastErr == nil {
+		lastErr = &net.DNSError{Err: "no addresses", Name: host, IsNotFound: true}
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeResolver answers with whatever addresses or error it was last given,
+// counting lookups
+type fakeResolver struct {
+	mu      sync.Mutex
+	addrs   []string
+	err     error
+	lookups int
+}
+
+func (f *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lookups++
+	return f.addrs, f.err
+}
+
+func (f *fakeResolver) answer(addrs []string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.addrs, f.err = addrs, err
+}
+
+func TestDNSCacheLookup(t *testing.T) {
+	resolver := &fakeResolver{addrs: []string{"192.0.2.1"}}
+	c := newDNSCache(50*time.Millisecond, resolver, &net.Dialer{})
+	changes := 0
+	c.onChange = func() { changes++ }
+
+	lookup := func(want ...string) {
+		t.Helper()
+		addrs, err := c.lookup(context.Background(), "backend.internal")
+		if err != nil || !sameAddrs(addrs, want) {
+			t.Fatalf("lookup = %v, %v, want %v", addrs, err, want)
+		}
+	}
+
+	// Cached within the TTL
+	lookup("192.0.2.1")
+	resolver.answer([]string{"192.0.2.2"}, nil)
+	lookup("192.0.2.1")
+	if resolver.lookups != 1 {
+		t.Errorf("%d lookups within the TTL, want 1", resolver.lookups)
+	}
+
+	// Refreshed after it, reporting the change
+	time.Sleep(60 * time.Millisecond)
+	lookup("192.0.2.2")
+	if changes != 1 {
+		t.Errorf("onChange called %d times, want 1", changes)
+	}
+
+	// The same addresses in another order are no change
+	resolver.answer([]string{"192.0.2.3", "192.0.2.2"}, nil)
+	time.Sleep(60 * time.Millisecond)
+	lookup("192.0.2.2", "192.0.2.3")
+	resolver.answer([]string{"192.0.2.2", "192.0.2.3"}, nil)
+	time.Sleep(60 * time.Millisecond)
+	lookup("192.0.2.2", "192.0.2.3")
+	if changes != 2 {
+		t.Errorf("onChange called %d times, want 2", changes)
+	}
+
+	// A failing resolver falls back to the expired answer
+	resolver.answer(nil, errors.New("server misbehaving"))
+	time.Sleep(60 * time.Millisecond)
+	lookup("192.0.2.2", "192.0.2.3")
+
+	if _, err := c.lookup(context.Background(), "other.internal"); err == nil {
+		t.Error("lookup of an unknown host succeeded with a failing resolver")
+	}
+}
+
+// Dials go to the resolved addresses in turn, skipping ones that refuse
+func TestDNSCacheDial(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	tests := []struct {
+		name    string
+		addrs   []string
+		address string
+		wantErr bool
+	}{
+		{"resolved", []string{"127.0.0.1"}, "backend.internal:" + port, false},
+		{"ip address skips the resolver", nil, "127.0.0.1:" + port, false},
+		// Nothing listens on 127.0.0.2, only on 127.0.0.1
+		{"first address refused", []string{"127.0.0.2", "127.0.0.1"}, "backend.internal:" + port, false},
+		{"no addresses", []string{}, "backend.internal:" + port, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newDNSCache(time.Minute, &fakeResolver{addrs: tt.addrs}, &net.Dialer{Timeout: time.Second})
+			conn, err := c.dialContext(context.Background(), "tcp", tt.address)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("dialContext error = %v, want error %v", err, tt.wantErr)
+			}
+			if conn != nil {
+				conn.Close()
+			}
+		})
+	}
+}
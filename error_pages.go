@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/ini.v1"
+)
+
+// Statuses that can be given a custom page in [error_pages]
+var errorPageStatuses = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+
+// domainWatchers key of the error page watcher, which is not a directory
+const errorPagesWatcherKey = "error_pages"
+
+// Read an [error_pages] section, which maps a status to the file served
+// for it, e.g. 503 = /etc/proxy/maintenance.html
+func loadErrorPages(section *ini.Section) (map[int]*staticFile, error) {
+	pages := make(map[int]*staticFile)
+	for _, key := range section.Keys() {
+		status, err := strconv.Atoi(key.Name())
+		if err != nil || !isErrorPageStatus(status) {
+			return nil, fmt.Errorf("error_pages: %s is not one of 502, 503 or 504", key.Name())
+		}
+		if pages[status], err = loadStaticFile(key.String()); err != nil {
+			return nil, fmt.Errorf("error_pages: %w", err)
+		}
+	}
+	return pages, nil
+}
+
+func isErrorPageStatus(status int) bool {
+	for _, s := range errorPageStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// Answer with an upstream error status, using the domain's page for it,
+// else the global one, else the status text
+func writeErrorPage(w http.ResponseWriter, r *http.Request, status int) {
+	page := currentState().errorPages[status]
+	if dp := lookupDomain(r); dp != nil && dp.config.ErrorPages[status] != nil {
+		page = dp.config.ErrorPages[status]
+	}
+	if page == nil {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(page.name))
+	if contentType == "" {
+		contentType = "text/html; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(page.body)
+}
+
+// Files of the error pages in use; a page that changes on disk is reloaded
+// with the config it came from
+func errorPageFiles() (global, domain map[string]bool) {
+	global, domain = make(map[string]bool), make(map[string]bool)
+	for _, page := range currentState().errorPages {
+		global[page.path] = true
+	}
+	mutex.RLock()
+	defer mutex.RUnlock()
+	for _, dp := range proxyMap {
+		for _, page := range dp.config.ErrorPages {
+			domain[page.path] = true
+		}
+	}
+	return global, domain
+}
+
+// Files the running error page watcher covers, so it is only restarted
+// when they change. Guarded by domainWatchersLock.
+var watchedErrorPages string
+
+// Watch the error page files in use, replacing any previous watcher. A
+// change to a global page reloads system.conf, and a change to a domain's
+// page reloads the domains.
+func watchErrorPages() error {
+	global, domain := errorPageFiles()
+	var files, watched []string
+	for path := range global {
+		files = append(files, path)
+		watched = append(watched, "global:"+path)
+	}
+	for path := range domain {
+		files = append(files, path)
+		watched = append(watched, "domain:"+path)
+	}
+	sort.Strings(watched)
+
+	domainWatchersLock.Lock()
+	defer domainWatchersLock.Unlock()
+	if strings.Join(watched, "\n") == watchedErrorPages {
+		return nil
+	}
+	if stop, exists := domainWatchers[errorPagesWatcherKey]; exists {
+		stop()
+		delete(domainWatchers, errorPagesWatcherKey)
+	}
+	watchedErrorPages = ""
+	if len(files) == 0 {
+		return nil
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	for _, path := range files {
+		if err := watcher.Add(filepath.Dir(path)); err != nil {
+			watcher.Close()
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	domainWatchers[errorPagesWatcherKey] = cancel
+	watchedErrorPages = strings.Join(watched, "\n")
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+					continue
+				}
+				path := filepath.Clean(event.Name)
+				if global[path] {
+					logger.Info("Error page changed, reloading configuration", "file", event.Name)
+					reload()
+				} else if domain[path] {
+					logger.Info("Error page changed, reloading domains", "file", event.Name)
+					loadDomains(domainsDirectory)
+				}
+
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.Error("Error watching error pages", "error", err)
+			}
+		}
+	}()
+	return nil
+}
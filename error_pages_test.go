@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+func writePageFile(t *testing.T, name, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// A domain's page overrides the global one for the same status, which in
+// turn overrides the plain status text
+func TestErrorPagePrecedence(t *testing.T) {
+	global := writePageFile(t, "global.html", "global page")
+	domain := writePageFile(t, "domain.html", "domain page")
+	backend := "http://" + closedAddress(t)
+
+	tests := []struct {
+		name            string
+		globalPages     string
+		domainPages     string
+		wantBody        string
+		wantContentType string
+	}{
+		{"domain over global", "502 = " + global, "502 = " + domain, "domain page", "text/html; charset=utf-8"},
+		{"domain only", "", "502 = " + domain, "domain page", "text/html; charset=utf-8"},
+		{"global for another status", "502 = " + global, "503 = " + domain, "global page", "text/html; charset=utf-8"},
+		{"global only", "502 = " + global, "", "global page", "text/html; charset=utf-8"},
+		{"status text", "", "", "Bad Gateway\n", "text/plain; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, "[error_pages]\n"+tt.globalPages+"\n")
+			loadTestDomains(t, map[string]string{
+				"example.com": "[proxy]\nbackend_url = " + backend + "\n[error_pages]\n" + tt.domainPages + "\n",
+			})
+			got := serveTest(httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+			if got.Code != http.StatusBadGateway {
+				t.Fatalf("status %d, want %d", got.Code, http.StatusBadGateway)
+			}
+			if got.Body.String() != tt.wantBody {
+				t.Errorf("body %q, want %q", got.Body, tt.wantBody)
+			}
+			if contentType := got.Header().Get("Content-Type"); contentType != tt.wantContentType {
+				t.Errorf("Content-Type %q, want %q", contentType, tt.wantContentType)
+			}
+		})
+	}
+}
+
+func TestLoadErrorPages(t *testing.T) {
+	page := writePageFile(t, "maintenance.html", "back soon")
+	tests := []struct {
+		name    string
+		section string
+		wantErr bool
+	}{
+		{"valid", "503 = " + page, false},
+		{"empty", "", false},
+		{"unsupported status", "500 = " + page, true},
+		{"not a status", "maintenance = " + page, true},
+		{"missing file", "503 = " + filepath.Join(t.TempDir(), "missing.html"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := ini.Load([]byte("[error_pages]\n" + tt.section + "\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			pages, err := loadErrorPages(cfg.Section("error_pages"))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadErrorPages error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && tt.section != "" && string(pages[http.StatusServiceUnavailable].body) != "back soon" {
+				t.Errorf("503 page %v, want the file's contents", pages[http.StatusServiceUnavailable])
+			}
+		})
+	}
+}
+
+// Editing a domain's page reloads it without touching the domain's config
+func TestDomainErrorPageReload(t *testing.T) {
+	page := writePageFile(t, "domain.html", "before")
+	loadTestConfig(t, "")
+	// A changed domain page reloads domainsDirectory, relative to the
+	// working directory
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	if err := os.Mkdir(domainsDirectory, 0755); err != nil {
+		t.Fatal(err)
+	}
+	contents := "[proxy]\nbackend_url = http://" + closedAddress(t) + "\n[error_pages]\n502 = " + page + "\n"
+	if err := os.WriteFile(filepath.Join(domainsDirectory, "example.com.conf"), []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadDomains(domainsDirectory); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { loadDomains(filepath.Join(domainsDirectory, "none")) })
+
+	if err := os.WriteFile(page, []byte("after"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		got := serveTest(httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+		if strings.TrimSpace(got.Body.String()) == "after" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("page still %q after the file changed", got.Body)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
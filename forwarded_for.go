@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type clientIPKey struct{}
+
+// Shared address space (RFC 6598), which net.IP has no predicate for
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0).To4(), Mask: net.CIDRMask(10, 32)}
+
+// Report whether an address cannot belong to a client on the internet
+func isPrivateOrReserved(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() ||
+		ip.IsMulticast() || sharedAddressSpace.Contains(ip)
+}
+
+// Parse one X-Forwarded-For entry. Some proxies include a port.
+func parseForwardedIP(entry string) net.IP {
+	entry = strings.TrimSpace(entry)
+	if ip := net.ParseIP(entry); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(entry); err == nil {
+		return net.ParseIP(host)
+	}
+	return nil
+}
+
+// Find the client IP behind trusted proxies. X-Forwarded-For is only
+// believed when the connection comes from a trusted proxy, and is read from
+// the right, since only the entries appended by trusted proxies can be relied
+// on. Trusted proxies and malformed entries are passed over, as are private
+// and reserved addresses when skipPrivate is set. The first remaining entry
+// is the client; if there is none, the connection's address is used.
+func forwardedClientIP(r *http.Request, trusted []*net.IPNet, skipPrivate bool) net.IP {
+	remote := clientIP(r)
+	if remote == nil || !ipInList(remote, trusted) {
+		return remote
+	}
+
+	entries := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(entries) - 1; i >= 0; i-- {
+		ip := parseForwardedIP(entries[i])
+		if ip == nil || ipInList(ip, trusted) || (skipPrivate && isPrivateOrReserved(ip)) {
+			continue
+		}
+		return ip
+	}
+	return remote
+}
+
+// Record the client IP found from X-Forwarded-For on the request, so that
+// clientIP returns it for ACLs and client affinity
+func withForwardedClientIP(r *http.Request, trusted []*net.IPNet, skipPrivate bool) *http.Request {
+	ip := forwardedClientIP(r, trusted, skipPrivate)
+	if ip == nil {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip))
+}
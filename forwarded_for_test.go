@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForwardedClientIP(t *testing.T) {
+	trusted, err := parseIPList([]string{"10.0.0.0/8", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name         string
+		remote       string
+		forwardedFor []string
+		skipPrivate  bool
+		want         string
+	}{
+		{"untrusted connection", "198.51.100.1:1000", []string{"203.0.113.9"}, false, "198.51.100.1"},
+		{"public client", "10.0.0.1:1000", []string{"203.0.113.9"}, false, "203.0.113.9"},
+		{"rightmost untrusted entry", "10.0.0.1:1000", []string{"203.0.113.8, 203.0.113.9, 10.0.0.2"}, false, "203.0.113.9"},
+		{"several headers", "10.0.0.1:1000", []string{"203.0.113.8", "203.0.113.9"}, false, "203.0.113.9"},
+		{"invalid entries skipped", "10.0.0.1:1000", []string{"203.0.113.9, unknown, 999.1.1.1"}, false, "203.0.113.9"},
+		{"entry with port", "10.0.0.1:1000", []string{"203.0.113.9:4711"}, false, "203.0.113.9"},
+		{"ipv6 entry with port", "10.0.0.1:1000", []string{"[2001:db9::1]:4711"}, false, "2001:db9::1"},
+		{"private kept by default", "10.0.0.1:1000", []string{"203.0.113.9, 192.168.1.5"}, false, "192.168.1.5"},
+		{"private skipped", "10.0.0.1:1000", []string{"203.0.113.9, 192.168.1.5, 100.64.0.1, 127.0.0.1, fe80::1"}, true, "203.0.113.9"},
+		{"only private entries", "10.0.0.1:1000", []string{"192.168.1.5, 172.16.0.1"}, true, "10.0.0.1"},
+		{"no header", "10.0.0.1:1000", nil, false, "10.0.0.1"},
+		{"ipv6 proxy", "[2001:db8::5]:1000", []string{"203.0.113.9"}, false, "203.0.113.9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			r.RemoteAddr = tt.remote
+			for _, value := range tt.forwardedFor {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			got := forwardedClientIP(r, trusted, tt.skipPrivate)
+			if !got.Equal(net.ParseIP(tt.want)) {
+				t.Errorf("forwardedClientIP = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
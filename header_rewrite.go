@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Parse cookie_domains, a comma-separated list of backend=public cookie
+// domains. An empty public domain removes the Domain attribute, leaving a
+// host-only cookie.
+func parseCookieDomains(list []string) (map[string]string, error) {
+	if len(list) == 0 {
+		return nil, nil
+	}
+	domains := make(map[string]string, len(list))
+	for _, entry := range list {
+		from, to, ok := strings.Cut(entry, "=")
+		from = normalizeCookieDomain(from)
+		if !ok || from == "" {
+			return nil, fmt.Errorf("cookie_domains: expected backend=public, got %q", entry)
+		}
+		domains[from] = strings.TrimSpace(to)
+	}
+	return domains, nil
+}
+
+// Cookie domains match case-insensitively, with or without the leading dot
+func normalizeCookieDomain(domain string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(domain), "."))
+}
+
+// Point an absolute Location that names the backend at the host the client
+// used instead, so redirects from backends that build them from their own
+// address keep the client on the proxy. Relative locations and redirects to
+// other hosts are left alone.
+func rewriteLocation(resp *http.Response) {
+	location := resp.Header.Get("Location")
+	if location == "" || resp.Request == nil {
+		return
+	}
+	target, err := url.Parse(location)
+	if err != nil || target.Host == "" {
+		return
+	}
+
+	backendHost := resp.Request.URL.Hostname()
+	if !strings.EqualFold(target.Hostname(), backendHost) {
+		return
+	}
+
+	target.Scheme = "http"
+	if resp.Request.TLS != nil {
+		target.Scheme = "https"
+	}
+	target.Host = resp.Request.Host
+	resp.Header.Set("Location", target.String())
+}
+
+// Replace the Domain attribute of every Set-Cookie header that names one of
+// the backend domains in the map. The rest of each header is kept as sent.
+func rewriteCookieDomains(resp *http.Response, domains map[string]string) {
+	cookies := resp.Header.Values("Set-Cookie")
+	for i, cookie := range cookies {
+		cookies[i] = rewriteCookieDomain(cookie, domains)
+	}
+}
+
+func rewriteCookieDomain(cookie string, domains map[string]string) string {
+	attrs := strings.Split(cookie, ";")
+	for i := 1; i < len(attrs); i++ {
+		name, value, _ := strings.Cut(attrs[i], "=")
+		if !strings.EqualFold(strings.TrimSpace(name), "domain") {
+			continue
+		}
+		public, ok := domains[normalizeCookieDomain(value)]
+		if !ok {
+			return cookie
+		}
+		if public == "" {
+			attrs = append(attrs[:i], attrs[i+1:]...)
+		} else {
+			attrs[i] = " Domain=" + public
+		}
+		return strings.Join(attrs, ";")
+	}
+	return cookie
+}
+
+// Response headers that may only appear once. Repeats of these are
+// dropped by normalizeResponseHeaders; headers that can legitimately
+// repeat, such as Set-Cookie, Vary or Link, are never collapsed.
+var singleValueResponseHeaders = []string{
+	"Access-Control-Allow-Credentials",
+	"Access-Control-Allow-Origin",
+	"Age",
+	"Content-Disposition",
+	"Content-Length",
+	"Content-Location",
+	"Content-Range",
+	"Content-Type",
+	"Date",
+	"Etag",
+	"Expires",
+	"Last-Modified",
+	"Location",
+	"Referrer-Policy",
+	"Retry-After",
+	"Server",
+	"Strict-Transport-Security",
+	"X-Content-Type-Options",
+	"X-Frame-Options",
+}
+
+// Merge headers whose names differ only in case under the canonical name,
+// then keep only the first value of headers that may appear once
+func normalizeResponseHeaders(header http.Header) {
+	for name, values := range header {
+		canonical := http.CanonicalHeaderKey(name)
+		if canonical == name {
+			continue
+		}
+		delete(header, name)
+		header[canonical] = append(header[canonical], values...)
+	}
+	for _, name := range singleValueResponseHeaders {
+		if values := header[name]; len(values) > 1 {
+			header[name] = values[:1]
+		}
+	}
+}
+
+// Name the proxy gives itself in Via headers unless via_header is set
+const defaultViaPseudonym = "coffee_proxy_reverse"
+
+// Append the proxy's entry to a message's Via header, as RFC 9110 asks of
+// proxies in both directions: the protocol version the message arrived
+// with, e.g. "1.1" or "2", then the proxy's name
+func addVia(header http.Header, protoMajor, protoMinor int, pseudonym string) {
+	version := strconv.Itoa(protoMajor)
+	if protoMajor < 2 {
+		version += "." + strconv.Itoa(protoMinor)
+	}
+	entry := version + " " + pseudonym
+	if via := header.Values("Via"); len(via) > 0 {
+		entry = strings.Join(via, ", ") + ", " + entry
+	}
+	header.Set("Via", entry)
+}
+
+// Replace the backend's Server header, or remove it when value is empty
+func setServerHeader(header http.Header, value string) {
+	if value == "" {
+		header.Del("Server")
+		return
+	}
+	header.Set("Server", value)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestRewriteLocation(t *testing.T) {
+	tests := []struct {
+		name     string
+		location string
+		tls      bool
+		want     string
+	}{
+		{"backend host", "http://10.0.0.5:8080/login?next=%2F", false, "http://example.com/login?next=%2F"},
+		{"backend host over tls", "http://10.0.0.5:8080/login", true, "https://example.com/login"},
+		{"relative", "/login", false, "/login"},
+		{"other host", "https://auth.example.org/login", false, "https://auth.example.org/login"},
+		{"none", "", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://10.0.0.5:8080/account", nil)
+			r.Host = "example.com"
+			if tt.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			resp := &http.Response{Header: http.Header{}, Request: r}
+			if tt.location != "" {
+				resp.Header.Set("Location", tt.location)
+			}
+			rewriteLocation(resp)
+			if got := resp.Header.Get("Location"); got != tt.want {
+				t.Errorf("Location %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewriteCookieDomain(t *testing.T) {
+	domains := map[string]string{"backend.internal": "example.com", "legacy.internal": ""}
+	tests := []struct {
+		cookie string
+		want   string
+	}{
+		{"id=1; Path=/; Domain=backend.internal; HttpOnly", "id=1; Path=/; Domain=example.com; HttpOnly"},
+		{"id=1; domain=.Backend.Internal", "id=1; Domain=example.com"},
+		{"id=1; Domain=legacy.internal; Secure", "id=1; Secure"},
+		{"id=1; Domain=other.example.org", "id=1; Domain=other.example.org"},
+		{"id=1; Path=/", "id=1; Path=/"},
+		// Only attributes are looked at, never the cookie's own name
+		{"Domain=backend.internal", "Domain=backend.internal"},
+	}
+	for _, tt := range tests {
+		if got := rewriteCookieDomain(tt.cookie, domains); got != tt.want {
+			t.Errorf("rewriteCookieDomain(%q) = %q, want %q", tt.cookie, got, tt.want)
+		}
+	}
+}
+
+func TestParseCookieDomains(t *testing.T) {
+	tests := []struct {
+		list    []string
+		want    map[string]string
+		wantErr bool
+	}{
+		{nil, nil, false},
+		{[]string{".Backend.Internal=example.com", "legacy.internal="}, map[string]string{"backend.internal": "example.com", "legacy.internal": ""}, false},
+		{[]string{"backend.internal"}, nil, true},
+		{[]string{"=example.com"}, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseCookieDomains(tt.list)
+		if (err != nil) != tt.wantErr || (!tt.wantErr && !reflect.DeepEqual(got, tt.want)) {
+			t.Errorf("parseCookieDomains(%q) = %v, %v, want %v, error %v", tt.list, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// Every Set-Cookie header of a proxied response is rewritten, along with a
+// Location naming the backend
+func TestLocationAndCookieRewriting(t *testing.T) {
+	var backend *httptest.Server
+	backend = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Set-Cookie", "session=abc; Domain=backend.internal; Path=/")
+		w.Header().Add("Set-Cookie", "theme=dark; Domain=backend.internal")
+		w.Header().Add("Set-Cookie", "tracking=1; Domain=other.example.org")
+		http.Redirect(w, r, backend.URL+"/login", http.StatusFound)
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name         string
+		options      string
+		wantLocation string
+		wantCookies  []string
+	}{
+		{
+			"rewriting off", "",
+			backend.URL + "/login",
+			[]string{"session=abc; Domain=backend.internal; Path=/", "theme=dark; Domain=backend.internal", "tracking=1; Domain=other.example.org"},
+		},
+		{
+			"rewriting on", "rewrite_location = true\ncookie_domains = backend.internal=example.com\n",
+			"http://example.com/login",
+			[]string{"session=abc; Domain=example.com; Path=/", "theme=dark; Domain=example.com", "tracking=1; Domain=other.example.org"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, "")
+			loadTestDomains(t, map[string]string{"example.com": "[proxy]\nbackend_url = " + backend.URL + "\n" + tt.options})
+			got := serveTest(httptest.NewRequest(http.MethodGet, "http://example.com/account", nil))
+			if location := got.Header().Get("Location"); location != tt.wantLocation {
+				t.Errorf("Location %q, want %q", location, tt.wantLocation)
+			}
+			if cookies := got.Header().Values("Set-Cookie"); !reflect.DeepEqual(cookies, tt.wantCookies) {
+				t.Errorf("Set-Cookie %q, want %q", cookies, tt.wantCookies)
+			}
+		})
+	}
+}
+
+func TestNormalizeResponseHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   http.Header
+	}{
+		{
+			"duplicate single-value header",
+			http.Header{"Content-Type": {"text/html", "application/json"}},
+			http.Header{"Content-Type": {"text/html"}},
+		},
+		{
+			"odd casing merged",
+			http.Header{"content-type": {"text/html"}, "X-CUSTOM": {"a"}, "X-Custom": {"b"}},
+			http.Header{"Content-Type": {"text/html"}, "X-Custom": {"b", "a"}},
+		},
+		{
+			"odd casing then duplicate",
+			http.Header{"Content-Type": {"text/html"}, "CONTENT-TYPE": {"text/plain"}},
+			http.Header{"Content-Type": {"text/html"}},
+		},
+		{
+			"multi-value headers kept",
+			http.Header{"Set-Cookie": {"a=1", "b=2"}, "set-cookie": {"c=3"}, "Vary": {"Accept", "Origin"}},
+			http.Header{"Set-Cookie": {"a=1", "b=2", "c=3"}, "Vary": {"Accept", "Origin"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			normalizeResponseHeaders(tt.header)
+			if !reflect.DeepEqual(tt.header, tt.want) {
+				t.Errorf("got %v, want %v", tt.header, tt.want)
+			}
+		})
+	}
+}
+
+// Duplicates from a backend reach the client only with
+// normalize_response_headers off
+func TestNormalizeResponseHeadersThroughProxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header()["Content-Type"] = []string{"text/html", "text/plain"}
+		w.Header()["Set-Cookie"] = []string{"a=1", "b=2"}
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		normalize       string
+		wantContentType []string
+	}{
+		{"false", []string{"text/html", "text/plain"}},
+		{"true", []string{"text/html"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.normalize, func(t *testing.T) {
+			loadTestConfig(t, "")
+			loadTestDomains(t, map[string]string{"example.com": "[proxy]\nbackend_url = " + backend.URL + "\nnormalize_response_headers = " + tt.normalize + "\n"})
+			got := serveTest(httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+			if contentType := got.Header().Values("Content-Type"); !reflect.DeepEqual(contentType, tt.wantContentType) {
+				t.Errorf("Content-Type %q, want %q", contentType, tt.wantContentType)
+			}
+			if cookies := got.Header().Values("Set-Cookie"); len(cookies) != 2 {
+				t.Errorf("Set-Cookie %q, want both cookies", cookies)
+			}
+		})
+	}
+}
+
+func TestAddVia(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing []string
+		major    int
+		minor    int
+		want     string
+	}{
+		{"http/1.1", nil, 1, 1, "1.1 edge"},
+		{"http/1.0", nil, 1, 0, "1.0 edge"},
+		{"http/2", nil, 2, 0, "2 edge"},
+		{"appended", []string{"1.1 cdn"}, 1, 1, "1.1 cdn, 1.1 edge"},
+		{"several headers joined", []string{"1.0 a", "1.1 b"}, 1, 1, "1.0 a, 1.1 b, 1.1 edge"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{"Via": tt.existing}
+			addVia(header, tt.major, tt.minor, "edge")
+			if got := header.Values("Via"); len(got) != 1 || got[0] != tt.want {
+				t.Errorf("Via %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// via_header names the proxy in Via both ways, or leaves Via alone when
+// empty; server_header replaces or removes the backend's Server header
+func TestViaAndServerHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Received-Via", r.Header.Get("Via"))
+		w.Header().Set("Server", "Apache/2.4")
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name           string
+		options        string
+		clientVia      string
+		wantBackendVia string
+		wantClientVia  string
+		wantServer     []string
+	}{
+		{"defaults", "", "", "1.1 coffee_proxy_reverse", "1.1 coffee_proxy_reverse", []string{"Apache/2.4"}},
+		{"custom via", "via_header = edge-1\n", "", "1.1 edge-1", "1.1 edge-1", []string{"Apache/2.4"}},
+		{"via off", "via_header =\n", "", "", "", []string{"Apache/2.4"}},
+		{"client via kept", "", "1.0 corporate-proxy", "1.0 corporate-proxy, 1.1 coffee_proxy_reverse", "1.1 coffee_proxy_reverse", []string{"Apache/2.4"}},
+		{"server replaced", "server_header = coffee\n", "", "1.1 coffee_proxy_reverse", "1.1 coffee_proxy_reverse", []string{"coffee"}},
+		{"server removed", "server_header =\n", "", "1.1 coffee_proxy_reverse", "1.1 coffee_proxy_reverse", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, "")
+			loadTestDomains(t, map[string]string{"example.com": "[proxy]\nbackend_url = " + backend.URL + "\n" + tt.options})
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			if tt.clientVia != "" {
+				r.Header.Set("Via", tt.clientVia)
+			}
+			got := serveTest(r)
+			if via := got.Header().Get("X-Received-Via"); via != tt.wantBackendVia {
+				t.Errorf("backend got Via %q, want %q", via, tt.wantBackendVia)
+			}
+			if via := got.Header().Get("Via"); via != tt.wantClientVia {
+				t.Errorf("client got Via %q, want %q", via, tt.wantClientVia)
+			}
+			if server := got.Header().Values("Server"); !reflect.DeepEqual(server, tt.wantServer) {
+				t.Errorf("Server %q, want %q", server, tt.wantServer)
+			}
+		})
+	}
+}
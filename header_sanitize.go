@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Headers a forward_headers allowlist always keeps, because the request
+// body or a protocol upgrade cannot be forwarded without them
+var requiredRequestHeaders = []string{
+	"Connection",
+	"Upgrade",
+	"Content-Type",
+	"Content-Encoding",
+	"Te",
+	"Sec-Websocket-Key",
+	"Sec-Websocket-Version",
+	"Sec-Websocket-Extensions",
+	"Sec-Websocket-Protocol",
+}
+
+// Remove headers a backend should not see from a request about to be
+// forwarded: everything not in forward (unless forward is empty), the
+// configured strip_headers, and any header whose combined values exceed
+// maxSize bytes (0 disables the size check).
+func sanitizeRequestHeaders(header http.Header, forward, strip []string, maxSize int) {
+	if len(forward) > 0 {
+		keepOnly(header, forward)
+	}
+	for _, name := range strip {
+		header.Del(name)
+	}
+	if maxSize <= 0 {
+		return
+	}
+
+	for name, values := range header {
+		size := 0
+		for _, value := range values {
+			size += len(value)
+		}
+		if size > maxSize {
+			logger.Debug("Dropped oversized request header", "header", name, "size", size)
+			delete(header, name)
+		}
+	}
+}
+
+// Delete every header that is neither listed in allowed nor required
+func keepOnly(header http.Header, allowed []string) {
+	keep := make(map[string]bool, len(allowed)+len(requiredRequestHeaders))
+	for _, name := range allowed {
+		keep[http.CanonicalHeaderKey(name)] = true
+	}
+	for _, name := range requiredRequestHeaders {
+		keep[name] = true
+	}
+	for name := range header {
+		if !keep[http.CanonicalHeaderKey(name)] {
+			delete(header, name)
+		}
+	}
+}
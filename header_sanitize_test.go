@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeRequestHeaders(t *testing.T) {
+	big := strings.Repeat("x", 100)
+	tests := []struct {
+		name    string
+		forward []string
+		strip   []string
+		maxSize int
+		want    []string
+	}{
+		{"unchanged", nil, nil, 0, []string{"Accept", "Content-Type", "Cookie", "X-Big", "X-Split"}},
+		{"oversized dropped", nil, nil, 64, []string{"Accept", "Content-Type", "Cookie"}},
+		{"values add up", nil, nil, 100, []string{"Accept", "Content-Type", "Cookie", "X-Big"}},
+		{"stripped", nil, []string{"cookie", "X-Big"}, 0, []string{"Accept", "Content-Type", "X-Split"}},
+		{"allowlist keeps required headers", []string{"accept"}, nil, 0, []string{"Accept", "Content-Type"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{
+				"Accept":       {"text/html"},
+				"Content-Type": {"text/plain"},
+				"Cookie":       {"session=1"},
+				"X-Big":        {big},
+				"X-Split":      {big[:60], big[:60]},
+			}
+			sanitizeRequestHeaders(header, tt.forward, tt.strip, tt.maxSize)
+			var got []string
+			for name := range header {
+				got = append(got, name)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("headers %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// What the backend sees through a domain with max_request_header_size and a
+// strip_cookies route for static assets
+func TestRequestHeadersForwarded(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("cookie=" + r.Header.Get("Cookie") + " big=" + r.Header.Get("X-Big")))
+	}))
+	defer backend.Close()
+	loadTestConfig(t, "")
+	loadTestDomains(t, map[string]string{"example.com": "[proxy]\nbackend_url = " + backend.URL + "\nmax_request_header_size = 64\n" +
+		"[route.static]\npath_prefix = /static\nstrip_cookies = true\n"})
+
+	tests := []struct {
+		name string
+		path string
+		big  string
+		want string
+	}{
+		{"cookie forwarded", "/page", "small", "cookie=session=1 big=small"},
+		{"oversized header dropped", "/page", strings.Repeat("x", 65), "cookie=session=1 big="},
+		{"cookie stripped for static assets", "/static/app.css", "small", "cookie= big=small"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://example.com"+tt.path, nil)
+			r.Header.Set("Cookie", "session=1")
+			r.Header.Set("X-Big", tt.big)
+			if got := serveTest(r).Body.String(); got != tt.want {
+				t.Errorf("backend got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// With forward_headers only the listed client headers reach the backend,
+// along with the ones a body needs and those the proxy adds itself
+func TestForwardHeadersAllowlist(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, name := range []string{"Accept", "X-Request-Id", "X-Evil", "Cookie", "Content-Type", "X-Forwarded-For"} {
+			if r.Header.Get(name) != "" {
+				w.Write([]byte(name + " "))
+			}
+		}
+		w.Write([]byte("host=" + r.Host))
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name    string
+		options string
+		want    string
+	}{
+		{"everything by default", "", "Accept X-Request-Id X-Evil Cookie Content-Type X-Forwarded-For host=example.com"},
+		{"allowlist", "forward_headers = accept, X-Request-Id\n", "Accept X-Request-Id Content-Type X-Forwarded-For host=example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, "")
+			loadTestDomains(t, map[string]string{"example.com": "[proxy]\nbackend_url = " + backend.URL + "\n" + tt.options})
+			r := httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader("{}"))
+			r.Header.Set("Accept", "application/json")
+			r.Header.Set("X-Request-Id", "42")
+			r.Header.Set("X-Evil", "1")
+			r.Header.Set("Cookie", "session=1")
+			r.Header.Set("Content-Type", "application/json")
+			if got := serveTest(r).Body.String(); got != tt.want {
+				t.Errorf("backend got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Backend weights are scaled by this much, so latency weighting can lower
+// them in steps finer than the configured weight
+const weightScale = 100
+
+// How much each health check's latency moves the moving average
+const latencyEWMAAlpha = 0.3
+
+// Health state of a backend, guarded by its group's mutex. Backends start
+// healthy and only change state after enough consecutive results, so a
+// single failed check doesn't take a backend out of rotation. unhealthy and
+// weight are atomic so random balancing can read them without the mutex.
+type backendHealth struct {
+	unhealthy            atomic.Bool
+	consecutiveSuccesses int
+	consecutiveFailures  int
+
+	// Exponentially weighted moving average of successful check latency
+	latency time.Duration
+	// The configured weight times weightScale, lowered by latency weighting
+	weight atomic.Int64
+}
+
+// The backend's weight for balancing, in units of 1/weightScale
+func (b *backend) weight() int {
+	return int(b.health.weight.Load())
+}
+
+// Fold a successful check's latency into the backend's moving average
+func (g *backendGroup) recordLatency(b *backend, latency time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if b.health.latency == 0 {
+		b.health.latency = latency
+		return
+	}
+	b.health.latency = time.Duration(latencyEWMAAlpha*float64(latency) + (1-latencyEWMAAlpha)*float64(b.health.latency))
+}
+
+// Weight each backend in inverse proportion to its check latency relative
+// to the fastest one, so a backend twice as slow gets half its configured
+// share. Weights never drop below 1, so slow backends still get traffic
+// and their checks keep being measured against real load.
+func (g *backendGroup) updateLatencyWeights() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var fastest time.Duration
+	for _, b := range g.backends {
+		if b.health.latency > 0 && (fastest == 0 || b.health.latency < fastest) {
+			fastest = b.health.latency
+		}
+	}
+	for _, b := range g.backends {
+		weight := int64(b.Weight * weightScale)
+		if fastest > 0 && b.health.latency > 0 {
+			weight = max(1, int64(float64(weight)*float64(fastest)/float64(b.health.latency)))
+		}
+		b.health.weight.Store(weight)
+	}
+}
+
+// Record the result of a health check, returning true if the backend
+// changed state
+func (g *backendGroup) recordHealth(b *backend, err error, healthyThreshold, unhealthyThreshold int) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if err != nil {
+		b.health.consecutiveSuccesses = 0
+		b.health.consecutiveFailures++
+		if !b.health.unhealthy.Load() && b.health.consecutiveFailures >= unhealthyThreshold {
+			b.health.unhealthy.Store(true)
+			return true
+		}
+		return false
+	}
+
+	b.health.consecutiveFailures = 0
+	b.health.consecutiveSuccesses++
+	if b.health.unhealthy.Load() && b.health.consecutiveSuccesses >= healthyThreshold {
+		b.health.unhealthy.Store(false)
+		return true
+	}
+	return false
+}
+
+// Check every backend of the domain each health_check_interval until ctx is done
+func (dp *domainProxy) runHealthChecks(ctx context.Context) {
+	interval := dp.config.HealthCheckInterval
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			dp.checkBackends()
+		}
+	}
+}
+
+func (dp *domainProxy) checkBackends() {
+	var wg sync.WaitGroup
+	for _, group := range dp.groups {
+		for _, b := range group.backends {
+			wg.Add(1)
+			go func(group *backendGroup, b *backend) {
+				defer wg.Done()
+				start := time.Now()
+				err := probeBackend(dp.config, b.BackendConfig, dp.config.HealthCheckTimeout)
+				if err == nil {
+					group.recordLatency(b, time.Since(start))
+				}
+				if !group.recordHealth(b, err, dp.config.HealthyThreshold, dp.config.UnhealthyThreshold) {
+					return
+				}
+				if err != nil {
+					logger.Warn("Backend marked unhealthy", "domain", dp.name, "backend", b.URL, "error", err)
+				} else {
+					logger.Info("Backend marked healthy", "domain", dp.name, "backend", b.URL)
+				}
+			}(group, b)
+		}
+	}
+	wg.Wait()
+
+	if dp.config.LatencyWeighting {
+		for _, group := range dp.groups {
+			group.updateLatencyWeights()
+		}
+	}
+}
+
+// Count the domains with at least one healthy backend
+func healthyDomainCount() int {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	count := 0
+	for name, dp := range proxyMap {
+		if name == dp.name && dp.hasHealthyBackend() {
+			count++
+		}
+	}
+	return count
+}
+
+func (dp *domainProxy) hasHealthyBackend() bool {
+	for _, group := range dp.groups {
+		for _, b := range group.backends {
+			if !b.health.unhealthy.Load() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type backendStatus struct {
+	Name                 string `json:"name"`
+	URL                  string `json:"url"`
+	Healthy              bool   `json:"healthy"`
+	ConsecutiveSuccesses int    `json:"consecutive_successes"`
+	ConsecutiveFailures  int    `json:"consecutive_failures"`
+	// Moving average of health check latency, and the weight balancing
+	// uses, which latency_weighting lowers for slow backends
+	LatencyMilliseconds float64 `json:"latency_ms"`
+	Weight              int     `json:"weight"`
+	EffectiveWeight     float64 `json:"effective_weight"`
+}
+
+// Report the health of every backend, by domain
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	mutex.RLock()
+	domains := make([]*domainProxy, 0, len(proxyMap))
+	for name, dp := range proxyMap {
+		if name != dp.name {
+			continue // an alias of a domain listed under its own name
+		}
+		domains = append(domains, dp)
+	}
+	mutex.RUnlock()
+
+	status := make(map[string][]backendStatus, len(domains))
+	for _, dp := range domains {
+		backends := []backendStatus{}
+		for _, group := range dp.groups {
+			group.mu.Lock()
+			for _, b := range group.backends {
+				backends = append(backends, backendStatus{
+					Name:                 b.Name,
+					URL:                  b.URL,
+					Healthy:              !b.health.unhealthy.Load(),
+					ConsecutiveSuccesses: b.health.consecutiveSuccesses,
+					ConsecutiveFailures:  b.health.consecutiveFailures,
+					LatencyMilliseconds:  float64(b.health.latency.Microseconds()) / 1000,
+					Weight:               b.Weight,
+					EffectiveWeight:      float64(b.weight()) / weightScale,
+				})
+			}
+			group.mu.Unlock()
+		}
+		status[dp.name] = backends
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"domains": status})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRecordLatency(t *testing.T) {
+	group := newWeightedGroup(balanceRoundRobin, 1)
+	b := group.backends[0]
+	for _, step := range []struct {
+		latency time.Duration
+		want    time.Duration
+	}{
+		// The first check sets the average, later ones move it by alpha
+		{100 * time.Millisecond, 100 * time.Millisecond},
+		{200 * time.Millisecond, 130 * time.Millisecond},
+		{200 * time.Millisecond, 151 * time.Millisecond},
+	} {
+		group.recordLatency(b, step.latency)
+		if diff := b.health.latency - step.want; diff < -time.Millisecond || diff > time.Millisecond {
+			t.Errorf("after %s, average %s, want %s", step.latency, b.health.latency, step.want)
+		}
+	}
+}
+
+func TestUpdateLatencyWeights(t *testing.T) {
+	tests := []struct {
+		name      string
+		weights   []int
+		latencies []time.Duration
+		want      []int
+	}{
+		{"equal", []int{1, 1}, []time.Duration{10 * time.Millisecond, 10 * time.Millisecond}, []int{100, 100}},
+		{"twice as slow", []int{1, 1}, []time.Duration{10 * time.Millisecond, 20 * time.Millisecond}, []int{100, 50}},
+		{"configured weight kept in proportion", []int{3, 1}, []time.Duration{40 * time.Millisecond, 10 * time.Millisecond}, []int{75, 100}},
+		{"never below 1", []int{1, 1}, []time.Duration{time.Millisecond, time.Hour}, []int{100, 1}},
+		{"not measured yet", []int{2, 1}, []time.Duration{0, 10 * time.Millisecond}, []int{200, 100}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			group := newWeightedGroup(balanceRoundRobin, tt.weights...)
+			for i, b := range group.backends {
+				b.health.latency = tt.latencies[i]
+			}
+			group.updateLatencyWeights()
+			for i, b := range group.backends {
+				if got := b.weight(); got != tt.want[i] {
+					t.Errorf("backend %s weight %d, want %d", b.Name, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+// A backend slow to answer health checks is weighted down, gets less
+// traffic, and the admin status shows its effective weight
+func TestLatencyWeighting(t *testing.T) {
+	fast := newNamedBackend(t, "fast")
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			time.Sleep(50 * time.Millisecond)
+		}
+		w.Write([]byte("slow"))
+	}))
+	defer slow.Close()
+
+	tests := []struct {
+		weighting   string
+		wantSlowMax float64
+		wantSlowMin float64
+	}{
+		{"false", 1, 1},
+		{"true", 0.2, 0.01},
+	}
+	for _, tt := range tests {
+		t.Run(tt.weighting, func(t *testing.T) {
+			loadTestConfig(t, "")
+			loadTestDomains(t, map[string]string{
+				"example.com": "[proxy]\nlatency_weighting = " + tt.weighting + "\n" +
+					"[backend.fast]\nurl = " + fast.URL + "\nhealth_path = /health\n" +
+					"[backend.slow]\nurl = " + slow.URL + "\nhealth_path = /health\n",
+			})
+			dp := lookupDomain(httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+			for i := 0; i < 3; i++ {
+				dp.checkBackends()
+			}
+
+			recorder := httptest.NewRecorder()
+			statusHandler(recorder, httptest.NewRequest(http.MethodGet, "/status", nil))
+			var status struct {
+				Domains map[string][]backendStatus `json:"domains"`
+			}
+			if err := json.NewDecoder(recorder.Body).Decode(&status); err != nil {
+				t.Fatal(err)
+			}
+			weights := map[string]float64{}
+			for _, b := range status.Domains["example.com"] {
+				weights[b.Name] = b.EffectiveWeight
+				if b.LatencyMilliseconds <= 0 {
+					t.Errorf("backend %s latency %f, want it measured", b.Name, b.LatencyMilliseconds)
+				}
+			}
+			if weights["fast"] != 1 || weights["slow"] < tt.wantSlowMin || weights["slow"] > tt.wantSlowMax {
+				t.Errorf("effective weights %v, want fast 1 and slow between %.2f and %.2f", weights, tt.wantSlowMin, tt.wantSlowMax)
+			}
+
+			reachedSlow := 0
+			const requests = 200
+			for i := 0; i < requests; i++ {
+				if serveTest(httptest.NewRequest(http.MethodGet, "http://example.com/", nil)).Body.String() == "slow" {
+					reachedSlow++
+				}
+			}
+			wantShare := tt.wantSlowMax / (1 + tt.wantSlowMax)
+			if share := float64(reachedSlow) / requests; share > wantShare+0.05 {
+				t.Errorf("slow backend got %.2f of requests, want at most %.2f", share, wantShare)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// A domain that also serves every host matching a pattern
+type hostRule struct {
+	pattern *regexp.Regexp
+	dp      *domainProxy
+}
+
+// Regex host rules, consulted in order when no domain matches a host
+// exactly. Guarded by mutex together with proxyMap.
+var hostRules []hostRule
+
+// Rebuild hostRules from the loaded domains, ordered by domain name so
+// overlapping patterns resolve the same way on every reload. The caller
+// must hold mutex.
+func rebuildHostRules() {
+	var rules []hostRule
+	for name, dp := range proxyMap {
+		if name == dp.name && dp.config.HostPattern != nil {
+			rules = append(rules, hostRule{pattern: dp.config.HostPattern, dp: dp})
+		}
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].dp.name < rules[j].dp.name })
+	hostRules = rules
+}
+
+// Find the first regex rule matching a host whose domain serves the local
+// port. The host's own port is ignored. The caller must hold mutex.
+func matchHostRule(host string, port int) *domainProxy {
+	if len(hostRules) == 0 {
+		return nil
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, rule := range hostRules {
+		if rule.pattern.MatchString(host) && rule.dp.servesPort(port) {
+			return rule.dp
+		}
+	}
+	return nil
+}
+
+// The local port a request arrived on, recorded by the server with the
+// connection, or 0 when unknown, e.g. on a Unix socket
+func localPort(r *http.Request) int {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr)
+	if !ok {
+		return 0
+	}
+	return addr.Port
+}
+
+// Whether a domain serves requests arriving on a local port; only domains
+// with listen_port are limited to one
+func (dp *domainProxy) servesPort(port int) bool {
+	return dp.config.ListenPort == 0 || dp.config.ListenPort == port
+}
+
+// Find the domain for a request and say how its host matched: "port" for a
+// domain named host:port after the local port the request arrived on,
+// "name" or "alias" for an exact match of the Host header, "host_regex", or
+// "default" for a request without a Host header served by default_domain.
+// Domains named after the arrival port win, so one hostname can be served
+// by different domains on different ports.
+func matchDomain(r *http.Request) (*domainProxy, string) {
+	port := localPort(r)
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	// HTTP/1.0 requests may have no Host header; net/http refuses HTTP/1.1
+	// ones without it
+	if r.Host == "" {
+		if dp, ok := proxyMap[currentConfig().Domains.DefaultDomain]; ok && currentConfig().Domains.DefaultDomain != "" && dp.servesPort(port) {
+			return dp, "default"
+		}
+		return nil, ""
+	}
+
+	if port != 0 {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if key := net.JoinHostPort(host, strconv.Itoa(port)); key != r.Host {
+			if dp, ok := proxyMap[key]; ok && dp.servesPort(port) {
+				return dp, "port"
+			}
+		}
+	}
+	if dp, ok := proxyMap[r.Host]; ok && dp.servesPort(port) {
+		if dp.name == r.Host {
+			return dp, "name"
+		}
+		return dp, "alias"
+	}
+	if dp := matchHostRule(r.Host, port); dp != nil {
+		return dp, "host_regex"
+	}
+	return nil, ""
+}
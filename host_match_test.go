@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gopkg.in/ini.v1"
+)
+
+// Exact names and aliases win over patterns, and overlapping patterns
+// resolve by domain name
+func TestMatchDomainHostRegex(t *testing.T) {
+	loadTestConfig(t, "")
+	loadTestDomains(t, map[string]string{
+		"a-dev":            "[proxy]\nbackend_url = http://127.0.0.1:1\nhost_regex = \\.dev\\.internal$\n",
+		"b-api":            "[proxy]\nbackend_url = http://127.0.0.1:1\nhost_regex = ^api\\.\n",
+		"api.dev.internal": "[proxy]\nbackend_url = http://127.0.0.1:1\naliases = docs.dev.internal\n",
+	})
+
+	tests := []struct {
+		host      string
+		wantName  string
+		wantMatch string
+	}{
+		{"api.dev.internal", "api.dev.internal", "name"},
+		{"docs.dev.internal", "api.dev.internal", "alias"},
+		{"shop.dev.internal", "a-dev", "host_regex"},
+		{"shop.dev.internal:8080", "a-dev", "host_regex"},
+		{"api.example.com", "b-api", "host_regex"},
+		{"api.staging.dev.internal", "a-dev", "host_regex"},
+		{"www.example.com", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://"+tt.host+"/", nil)
+			dp, match := matchDomain(r)
+			name := ""
+			if dp != nil {
+				name = dp.name
+			}
+			if name != tt.wantName || match != tt.wantMatch {
+				t.Errorf("matchDomain = %q by %q, want %q by %q", name, match, tt.wantName, tt.wantMatch)
+			}
+		})
+	}
+}
+
+func TestHostRegexInvalid(t *testing.T) {
+	cfg, err := ini.Load([]byte("[proxy]\nbackend_url = http://127.0.0.1:1\nhost_regex = ([a-z]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadDomainConfig(cfg); err == nil {
+		t.Error("loadDomainConfig accepted an invalid host_regex")
+	}
+}
+
+// The same hostname arriving on two local ports reaches the domain named
+// after each port, and listen_port keeps a domain to its own port
+func TestPortRouting(t *testing.T) {
+	first := newNamedBackend(t, "first")
+	second := newNamedBackend(t, "second")
+	other := newNamedBackend(t, "other")
+	api := newNamedBackend(t, "api")
+	loadTestConfig(t, "")
+
+	// The server records each connection's local address, which lookup
+	// reads the port from
+	ports := make([]string, 3)
+	for i := range ports {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := &http.Server{Handler: buildHandler()}
+		go server.Serve(listener)
+		t.Cleanup(func() { server.Close() })
+		_, ports[i], _ = net.SplitHostPort(listener.Addr().String())
+	}
+	loadTestDomains(t, map[string]string{
+		"example.com:" + ports[0]: "[proxy]\nbackend_url = " + first.URL + "\n",
+		"example.com:" + ports[1]: "[proxy]\nbackend_url = " + second.URL + "\n",
+		"example.com":             "[proxy]\nbackend_url = " + other.URL + "\n",
+		"api.example.com":         "[proxy]\nbackend_url = " + api.URL + "\nlisten_port = " + ports[1] + "\n",
+	})
+
+	tests := []struct {
+		host       string
+		port       string
+		wantStatus int
+		want       string
+	}{
+		{"example.com", ports[0], http.StatusOK, "first"},
+		{"example.com", ports[1], http.StatusOK, "second"},
+		{"example.com:" + ports[0], ports[0], http.StatusOK, "first"},
+		{"example.com:80", ports[1], http.StatusOK, "second"},
+		{"example.com", ports[2], http.StatusOK, "other"},
+		{"api.example.com", ports[1], http.StatusOK, "api"},
+		{"api.example.com", ports[0], http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host+" on "+tt.port, func(t *testing.T) {
+			r, err := http.NewRequest(http.MethodGet, "http://127.0.0.1:"+tt.port+"/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Host = tt.host
+			resp, err := http.DefaultClient.Do(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.wantStatus || (tt.want != "" && string(body) != tt.want) {
+				t.Errorf("reached %q (status %d), want %q (status %d)", body, resp.StatusCode, tt.want, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestListenPortInvalid(t *testing.T) {
+	for _, port := range []string{"-1", "65536"} {
+		cfg, err := ini.Load([]byte("[proxy]\nbackend_url = http://127.0.0.1:1\nlisten_port = " + port + "\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadDomainConfig(cfg); err == nil {
+			t.Errorf("loadDomainConfig accepted listen_port = %s", port)
+		}
+	}
+}
+
+// Requests without a Host header, as HTTP/1.0 allows, go to default_domain
+// and reach its backend under its name; without one they get 404
+func TestDefaultDomain(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host))
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name       string
+		config     string
+		request    string
+		wantStatus int
+		wantBody   string
+	}{
+		{"http/1.0 without host", "[domains]\ndefault_domain = example.com\n", "GET / HTTP/1.0\r\n\r\n", http.StatusOK, "example.com"},
+		{"http/1.0 with host", "[domains]\ndefault_domain = example.com\n", "GET / HTTP/1.0\r\nHost: other.example.com\r\n\r\n", http.StatusOK, "other.example.com"},
+		{"no default_domain", "", "GET / HTTP/1.0\r\n\r\n", http.StatusNotFound, ""},
+		{"default_domain not loaded", "[domains]\ndefault_domain = missing.example.com\n", "GET / HTTP/1.0\r\n\r\n", http.StatusNotFound, ""},
+		{"http/1.1 without host", "[domains]\ndefault_domain = example.com\n", "GET / HTTP/1.1\r\nConnection: close\r\n\r\n", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, tt.config)
+			loadTestDomains(t, map[string]string{
+				"example.com":       "[proxy]\nbackend_url = " + backend.URL + "\n",
+				"other.example.com": "[proxy]\nbackend_url = " + backend.URL + "\n",
+			})
+			server := httptest.NewServer(buildHandler())
+			defer server.Close()
+
+			conn, err := net.Dial("tcp", server.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if _, err := conn.Write([]byte(tt.request)); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.wantStatus || (tt.wantBody != "" && string(body) != tt.wantBody) {
+				t.Errorf("got %d with body %q, want %d with body %q", resp.StatusCode, body, tt.wantStatus, tt.wantBody)
+			}
+		})
+	}
+}
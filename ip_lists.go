@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Largest IP list accepted from a remote URL
+const maxRemoteIPListSize = 10 << 20
+
+// ipList is a whitelist or blacklist merged from the inline entries in
+// system.conf, an optional file that is reloaded when it changes and an
+// optional URL that is fetched periodically.
+type ipList struct {
+	name    string
+	inline  []*net.IPNet
+	file    string
+	url     string
+	refresh time.Duration
+
+	mu       sync.RWMutex
+	fileNets []*net.IPNet
+	urlNets  []*net.IPNet
+}
+
+// Build a list from its config, reading the file once up front so a
+// broken file is reported at startup
+func newIPList(name string, inline []*net.IPNet, file, url string, refresh time.Duration) (*ipList, error) {
+	if url != "" && refresh <= 0 {
+		return nil, fmt.Errorf("%s: refresh_interval must be positive", name)
+	}
+	l := &ipList{name: name, inline: inline, file: file, url: url, refresh: refresh}
+	if file != "" {
+		if err := l.reloadFile(); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func (l *ipList) contains(ip net.IP) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return ipInList(ip, l.inline) || ipInList(ip, l.fileNets) || ipInList(ip, l.urlNets)
+}
+
+// Parse one entry per line, skipping blank lines and # comments
+func readIPList(r io.Reader) ([]*net.IPNet, error) {
+	var entries []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		entries = append(entries, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return parseIPList(entries)
+}
+
+func (l *ipList) reloadFile() error {
+	f, err := os.Open(l.file)
+	if err != nil {
+		return fmt.Errorf("%s: %w", l.name, err)
+	}
+	defer f.Close()
+
+	networks, err := readIPList(f)
+	if err != nil {
+		return fmt.Errorf("%s: %s: %w", l.name, l.file, err)
+	}
+	l.mu.Lock()
+	l.fileNets = networks
+	l.mu.Unlock()
+	return nil
+}
+
+func (l *ipList) fetchURL(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, l.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	networks, err := readIPList(io.LimitReader(resp.Body, maxRemoteIPListSize))
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.urlNets = networks
+	l.mu.Unlock()
+	logger.Info("Refreshed IP list", "list", l.name, "url", l.url, "entries", len(networks))
+	return nil
+}
+
+// Keep the file and URL sources up to date until ctx is done. A source that
+// fails to reload keeps its previous entries.
+func (l *ipList) watch(ctx context.Context) error {
+	if l.file != "" {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			return err
+		}
+		// Watch the directory so files replaced via rename are picked up too
+		if err := watcher.Add(filepath.Dir(l.file)); err != nil {
+			watcher.Close()
+			return err
+		}
+		go l.handleFileEvents(ctx, watcher)
+	}
+
+	if l.url != "" {
+		go l.refreshURL(ctx)
+	}
+	return nil
+}
+
+func (l *ipList) handleFileEvents(ctx context.Context, watcher *fsnotify.Watcher) {
+	defer watcher.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create) == 0 || filepath.Clean(event.Name) != filepath.Clean(l.file) {
+				continue
+			}
+			if err := l.reloadFile(); err != nil {
+				logger.Error("Error reloading IP list", "list", l.name, "file", l.file, "error", err)
+				continue
+			}
+			logger.Info("Reloaded IP list", "list", l.name, "file", l.file)
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logger.Error("Error watching IP list", "list", l.name, "file", l.file, "error", err)
+		}
+	}
+}
+
+func (l *ipList) refreshURL(ctx context.Context) {
+	ticker := time.NewTicker(l.refresh)
+	defer ticker.Stop()
+	for {
+		if err := l.fetchURL(ctx); err != nil {
+			logger.Error("Error fetching IP list", "list", l.name, "url", l.url, "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseIPList(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries string
+		ip      string
+		want    bool
+		wantErr bool
+	}{
+		{"ipv4", "192.0.2.1", "192.0.2.1", true, false},
+		{"ipv4 other", "192.0.2.1", "192.0.2.2", false, false},
+		{"ipv4 cidr", "192.0.2.0/24", "192.0.2.200", true, false},
+		{"ipv6 compressed entry, full client", "2001:db8::1", "2001:0db8:0000:0000:0000:0000:0000:0001", true, false},
+		{"ipv6 full entry, compressed client", "2001:0db8:0:0::0001", "2001:db8::1", true, false},
+		{"ipv6 upper case", "2001:DB8::A", "2001:db8::a", true, false},
+		{"ipv6 other", "2001:db8::1", "2001:db8::2", false, false},
+		{"ipv6 cidr", "2001:db8::/32", "2001:db8:ffff::1", true, false},
+		{"ipv6 cidr other", "2001:db8::/32", "2001:db9::1", false, false},
+		{"ipv4-mapped client", "192.0.2.1", "::ffff:192.0.2.1", true, false},
+		{"ipv4-mapped entry", "::ffff:192.0.2.1", "192.0.2.1", true, false},
+		{"several entries with spaces", " 10.0.0.1 , 2001:db8::1 ,", "2001:db8::1", true, false},
+		{"invalid address", "192.0.2.256", "", false, true},
+		{"invalid cidr", "2001:db8::/129", "", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			networks, err := parseIPList(strings.Split(tt.entries, ","))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("parseIPList succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := ipInList(net.ParseIP(tt.ip), networks); got != tt.want {
+				t.Errorf("ipInList(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+// IPv6 clients are matched by address, not by how it is written, and are
+// logged in canonical form
+func TestIPv6Clients(t *testing.T) {
+	backend := newNamedBackend(t, "backend")
+	tests := []struct {
+		name       string
+		remoteAddr string
+		want       int
+		wantLogged string
+	}{
+		{"whitelisted", "[2001:db8::1]:1234", http.StatusOK, "2001:db8::1 200"},
+		{"whitelisted, written in full", "[2001:0db8:0000:0000:0000:0000:0000:0001]:1234", http.StatusOK, "2001:db8::1 200"},
+		{"blacklisted", "[2001:db8::bad]:1234", http.StatusForbidden, "2001:db8::bad 403"},
+		{"not whitelisted", "[2001:db9::1]:1234", http.StatusUnauthorized, "2001:db9::1 401"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, "[whitelist]\nips = 2001:db8::/64\n[blacklist]\nips = 2001:0DB8::0BAD\n"+
+				"[logging]\nformat = custom\ncustom_format = $remote_addr $status\n")
+			loadTestDomains(t, map[string]string{"example.com": "[proxy]\nbackend_url = " + backend.URL + "\n"})
+			logs := captureAccessLog(t)
+
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if got := serveTest(r).Code; got != tt.want {
+				t.Errorf("status %d, want %d", got, tt.want)
+			}
+			if got := strings.TrimSpace(logs.String()); got != tt.wantLogged {
+				t.Errorf("logged %q, want %q", got, tt.wantLogged)
+			}
+		})
+	}
+}
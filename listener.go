@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/activation"
+)
+
+var (
+	openConnections    = newGauge("open_connections", "Client connections currently open on the public listener.")
+	droppedBlacklisted = newCounterVec("blacklist_dropped_connections_total", "Connections from blacklisted addresses closed as soon as they were accepted.")
+)
+
+// Listeners opened by this process, keyed by role ("http", "admin"), so a
+// hot restart can hand each of them to the new process.
+var (
+	activeListeners     = make(map[string][]net.Listener)
+	activeListenersLock sync.Mutex
+)
+
+// Return the listeners to serve on for the given role. Sockets handed over
+// by a hot restart take precedence, then for the public listener those from
+// systemd socket activation (LISTEN_FDS is set), so the socket stays open
+// across restarts; otherwise each of addrs is bound directly.
+func getListeners(role, network string, addrs ...string) ([]net.Listener, error) {
+	listeners, err := openListeners(role, network, addrs)
+	if err != nil {
+		return nil, err
+	}
+
+	activeListenersLock.Lock()
+	activeListeners[role] = listeners
+	activeListenersLock.Unlock()
+	return listeners, nil
+}
+
+func openListeners(role, network string, addrs []string) ([]net.Listener, error) {
+	inherited, err := inheritedListeners(role)
+	if err != nil {
+		return nil, err
+	}
+	if len(inherited) > 0 {
+		logger.Info("Using sockets inherited from previous process", "role", role, "count", len(inherited))
+		return inherited, nil
+	}
+
+	if role == "http" && os.Getenv("LISTEN_FDS") != "" {
+		listeners, err := activation.Listeners()
+		if err != nil {
+			return nil, fmt.Errorf("socket activation: %w", err)
+		}
+
+		var usable []net.Listener
+		for _, listener := range listeners {
+			if listener != nil {
+				usable = append(usable, listener)
+			}
+		}
+		if len(usable) > 0 {
+			logger.Info("Using sockets passed by systemd", "count", len(usable))
+			return usable, nil
+		}
+	}
+
+	if network == "unix" {
+		return listenUnixSocket(addrs[0])
+	}
+
+	var lc net.ListenConfig
+	if role == "http" && startupConfig.Server.ReusePort {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			return setReusePort(c)
+		}
+	}
+	var listeners []net.Listener
+	for _, addr := range addrs {
+		listener, err := lc.Listen(context.Background(), network, addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// Listen on a Unix socket, replacing a socket file left behind by an
+// earlier run. The file is kept when the listener closes, so a process
+// inheriting the socket in a hot restart stays reachable at the same path.
+func listenUnixSocket(path string) ([]net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	listener.SetUnlinkOnClose(false)
+	return []net.Listener{listener}, nil
+}
+
+// tcpOptionsListener applies tcp_keepalive and tcp_nodelay to accepted
+// connections. Doing it here rather than through net.ListenConfig covers
+// sockets inherited from systemd or a previous process too, and picks up
+// changes on reload.
+type tcpOptionsListener struct {
+	net.Listener
+}
+
+func (l tcpOptionsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		if currentConfig().Server.TCPKeepAlive > 0 {
+			tcpConn.SetKeepAlive(true)
+			tcpConn.SetKeepAlivePeriod(time.Duration(currentConfig().Server.TCPKeepAlive) * time.Second)
+		} else {
+			tcpConn.SetKeepAlive(false)
+		}
+		tcpConn.SetNoDelay(currentConfig().Server.TCPNoDelay)
+	}
+	return conn, nil
+}
+
+// blacklistListener closes connections from blacklisted addresses before
+// any TLS or HTTP work is done for them, when drop_connections is enabled.
+// ipFilterMiddleware still checks every request.
+type blacklistListener struct {
+	net.Listener
+}
+
+func (l blacklistListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil || !currentConfig().Blacklist.DropConnections {
+			return conn, err
+		}
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && currentState().blacklist.contains(addr.IP) {
+			droppedBlacklisted.inc()
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
+
+// countingListener keeps the open_connections gauge up to date
+type countingListener struct {
+	net.Listener
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	openConnections.add(1)
+	return &countedConn{Conn: conn}, nil
+}
+
+type countedConn struct {
+	net.Conn
+	closeOnce sync.Once
+}
+
+func (c *countedConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		openConnections.add(-1)
+	})
+	return err
+}
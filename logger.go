@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync/atomic"
+)
+
+// logger writes the proxy's operational logs. Access logs are separate and
+// always written in the configured access log format. The logger itself
+// never changes; a reload swaps the handler behind it.
+var logger = slog.New(&swapHandler{})
+
+// Handler forwarding to whatever setLogger installed last, so requests in
+// flight can keep logging while a reload replaces the level or format
+type swapHandler struct {
+	current atomic.Pointer[handlerBox]
+}
+
+type handlerBox struct{ slog.Handler }
+
+func (h *swapHandler) handler() slog.Handler {
+	if box := h.current.Load(); box != nil {
+		return box.Handler
+	}
+	return defaultLogHandler
+}
+
+func (h *swapHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler().Enabled(ctx, level)
+}
+
+func (h *swapHandler) Handle(ctx context.Context, record slog.Record) error {
+	return h.handler().Handle(ctx, record)
+}
+
+// Derived handlers are bound to the handler installed at the time
+func (h *swapHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.handler().WithAttrs(attrs)
+}
+
+func (h *swapHandler) WithGroup(name string) slog.Handler {
+	return h.handler().WithGroup(name)
+}
+
+var defaultLogHandler = slog.NewTextHandler(os.Stderr, nil)
+
+var logLevelNames = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// Build the operational logger for the given level and format (text or
+// json)
+func newLogger(levelName, format string) (*slog.Logger, error) {
+	level, exists := logLevelNames[levelName]
+	if !exists {
+		return nil, fmt.Errorf("unknown log level %q", levelName)
+	}
+
+	options := &slog.HandlerOptions{Level: level}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, options)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q", format)
+}
+
+// Install l as the operational logger. It also becomes the default logger,
+// so output from the standard library's log package is routed through it.
+func setLogger(l *slog.Logger) {
+	logger.Handler().(*swapHandler).current.Store(&handlerBox{l.Handler()})
+	slog.SetDefault(logger)
+}
+
+// Log an unrecoverable error and exit, like log.Fatal
+func fatal(msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
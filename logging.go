@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Predefined access log templates, matching Apache's common and combined formats
+const (
+	commonLogFormat   = `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent`
+	combinedLogFormat = commonLogFormat + ` "$http_referer" "$http_user_agent"`
+)
+
+var (
+	accessLogger = log.New(os.Stdout, "", 0)
+
+	requestBodyBytes = newCounterVec("request_body_bytes_total", "Bytes of request bodies read from clients, by domain.", "domain")
+)
+
+// accessLogEntry collects the details of one request for the access log.
+// Handlers further down the chain fill in fields such as the upstream address.
+type accessLogEntry struct {
+	request        *http.Request
+	responseHeader http.Header
+	start          time.Time
+	duration       time.Duration
+	status         int
+	bytesSent      int64
+	bytesReceived  int64
+	upstreamAddr   string
+	// Time backends took to send response headers, summed over retries,
+	// and the number of attempts
+	upstreamTime     atomic.Int64
+	upstreamAttempts atomic.Int32
+}
+
+type accessLogKey struct{}
+
+// Record the backend a request was forwarded to, if the request is being logged
+func setUpstreamAddr(r *http.Request, addr string) {
+	if entry, ok := r.Context().Value(accessLogKey{}).(*accessLogEntry); ok {
+		entry.upstreamAddr = addr
+	}
+}
+
+// Record how long a backend attempt took to send response headers, if the
+// request is being logged
+func addUpstreamTime(r *http.Request, d time.Duration) {
+	if entry, ok := r.Context().Value(accessLogKey{}).(*accessLogEntry); ok {
+		entry.upstreamTime.Add(int64(d))
+		entry.upstreamAttempts.Add(1)
+	}
+}
+
+// Values available to access log templates, keyed by placeholder name
+var logVariables = map[string]func(e *accessLogEntry) string{
+	"remote_addr": func(e *accessLogEntry) string {
+		host, _, err := net.SplitHostPort(e.request.RemoteAddr)
+		if err != nil {
+			return e.request.RemoteAddr
+		}
+		// Log IPv6 addresses in their canonical form
+		if ip := net.ParseIP(host); ip != nil {
+			return ip.String()
+		}
+		return host
+	},
+	"remote_user": func(e *accessLogEntry) string {
+		if user, _, ok := e.request.BasicAuth(); ok && user != "" {
+			return user
+		}
+		return "-"
+	},
+	"time_local":   func(e *accessLogEntry) string { return e.start.Format("02/Jan/2006:15:04:05 -0700") },
+	"time_iso8601": func(e *accessLogEntry) string { return e.start.Format(time.RFC3339) },
+	"request": func(e *accessLogEntry) string {
+		return e.request.Method + " " + e.request.RequestURI + " " + e.request.Proto
+	},
+	"method":              func(e *accessLogEntry) string { return e.request.Method },
+	"uri":                 func(e *accessLogEntry) string { return e.request.RequestURI },
+	"host":                func(e *accessLogEntry) string { return e.request.Host },
+	"status":              func(e *accessLogEntry) string { return strconv.Itoa(e.status) },
+	"body_bytes_sent":     func(e *accessLogEntry) string { return strconv.FormatInt(e.bytesSent, 10) },
+	"body_bytes_received": func(e *accessLogEntry) string { return strconv.FormatInt(e.bytesReceived, 10) },
+	"request_time":        func(e *accessLogEntry) string { return strconv.FormatFloat(e.duration.Seconds(), 'f', 3, 64) },
+	"upstream_addr":       func(e *accessLogEntry) string { return dashIfEmpty(e.upstreamAddr) },
+	"http_referer":        func(e *accessLogEntry) string { return dashIfEmpty(e.request.Referer()) },
+	"http_user_agent":     func(e *accessLogEntry) string { return dashIfEmpty(e.request.UserAgent()) },
+}
+
+func dashIfEmpty(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// logFormat is a compiled access log template. A nil *logFormat writes JSON.
+type logFormat struct {
+	literals  []string
+	variables []func(e *accessLogEntry) string
+}
+
+// Build the access log formatter for the configured format name
+func newLogFormat(format, custom string) (*logFormat, error) {
+	switch format {
+	case "json":
+		return nil, nil
+	case "common":
+		return parseLogFormat(commonLogFormat)
+	case "combined":
+		return parseLogFormat(combinedLogFormat)
+	case "custom":
+		if custom == "" {
+			return nil, fmt.Errorf("logging format is custom but custom_format is empty")
+		}
+		return parseLogFormat(custom)
+	default:
+		return nil, fmt.Errorf("unknown logging format %q", format)
+	}
+}
+
+// Compile a template such as "$remote_addr $status" into literal text and
+// variable lookups. Unknown placeholders are rejected so typos fail at startup.
+func parseLogFormat(template string) (*logFormat, error) {
+	f := &logFormat{}
+	literal := ""
+	for i := 0; i < len(template); i++ {
+		if template[i] != '$' {
+			literal += string(template[i])
+			continue
+		}
+
+		j := i + 1
+		for j < len(template) && (template[j] == '_' || template[j] >= 'a' && template[j] <= 'z') {
+			j++
+		}
+		name := template[i+1 : j]
+		variable, exists := logVariables[name]
+		if !exists {
+			return nil, fmt.Errorf("unknown access log variable $%s", name)
+		}
+
+		f.literals = append(f.literals, literal)
+		f.variables = append(f.variables, variable)
+		literal = ""
+		i = j - 1
+	}
+	f.literals = append(f.literals, literal)
+	return f, nil
+}
+
+func (f *logFormat) format(e *accessLogEntry) string {
+	var b strings.Builder
+	for i, variable := range f.variables {
+		b.WriteString(f.literals[i])
+		b.WriteString(variable(e))
+	}
+	b.WriteString(f.literals[len(f.literals)-1])
+	return b.String()
+}
+
+// Headers logged as redactedValue unless redact_headers says otherwise,
+// since they carry credentials
+var defaultRedactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+const redactedValue = "[REDACTED]"
+
+// Collect the listed headers that are present, joining repeated values and
+// replacing those of redacted headers
+func logHeaders(header http.Header, names, redact []string) map[string]string {
+	fields := make(map[string]string)
+	for _, name := range names {
+		values := header.Values(name)
+		if len(values) == 0 {
+			continue
+		}
+		value := strings.Join(values, ", ")
+		for _, redacted := range redact {
+			if strings.EqualFold(name, redacted) {
+				value = redactedValue
+				break
+			}
+		}
+		fields[http.CanonicalHeaderKey(name)] = value
+	}
+	return fields
+}
+
+func formatJSONLog(e *accessLogEntry) string {
+	fields := map[string]interface{}{
+		"time":                e.start.Format(time.RFC3339),
+		"remote_addr":         logVariables["remote_addr"](e),
+		"method":              e.request.Method,
+		"host":                e.request.Host,
+		"uri":                 e.request.RequestURI,
+		"proto":               e.request.Proto,
+		"status":              e.status,
+		"body_bytes_sent":     e.bytesSent,
+		"body_bytes_received": e.bytesReceived,
+		"request_time":        e.duration.Seconds(),
+		"upstream_addr":       e.upstreamAddr,
+		"http_referer":        e.request.Referer(),
+		"http_user_agent":     e.request.UserAgent(),
+	}
+	if len(currentConfig().Logging.RequestHeaders) > 0 {
+		fields["request_headers"] = logHeaders(e.request.Header, currentConfig().Logging.RequestHeaders, currentConfig().Logging.RedactHeaders)
+	}
+	if len(currentConfig().Logging.ResponseHeaders) > 0 {
+		fields["response_headers"] = logHeaders(e.responseHeader, currentConfig().Logging.ResponseHeaders, currentConfig().Logging.RedactHeaders)
+	}
+	line, _ := json.Marshal(fields)
+	return string(line)
+}
+
+// statusRecorder captures the status code and body size written to a client
+type statusRecorder struct {
+	http.ResponseWriter
+	status    int
+	bytesSent int64
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(b)
+	sr.bytesSent += int64(n)
+	return n, err
+}
+
+// countingBody counts the bytes read from a request body. Only what is
+// read counts: a body the proxy rejects or abandons part way through
+// counts as far as it got. The count is atomic since the transport can
+// still be sending the body to a backend after the handler returns.
+type countingBody struct {
+	io.ReadCloser
+	bytesRead atomic.Int64
+}
+
+func (cb *countingBody) Read(p []byte) (int, error) {
+	n, err := cb.ReadCloser.Read(p)
+	cb.bytesRead.Add(int64(n))
+	return n, err
+}
+
+func (sr *statusRecorder) Flush() {
+	if flusher, ok := sr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (sr *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := sr.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	if sr.status == 0 {
+		sr.status = http.StatusSwitchingProtocols
+	}
+	return hijacker.Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// Whether sample_rate leaves a response out of the access log. Errors are
+// sampled like any other response unless always_log_errors is on.
+func sampledOut(status int) bool {
+	rate := currentConfig().Logging.SampleRate
+	if rate >= 1 || (status >= 400 && currentConfig().Logging.AlwaysLogErrors) {
+		return false
+	}
+	return rand.Float64() >= rate
+}
+
+// Log a request that took longer than slow_threshold, with where the time
+// went: waiting on the backend, or everything else, such as queueing,
+// reading the request body and sending the response to a slow client
+func logSlowRequest(entry *accessLogEntry, dp *domainProxy) {
+	domain := ""
+	if dp != nil {
+		domain = dp.name
+	}
+	upstream := time.Duration(entry.upstreamTime.Load())
+	logger.Warn("Slow request",
+		"request_id", entry.request.Header.Get("X-Request-Id"),
+		"domain", domain,
+		"method", entry.request.Method,
+		"path", entry.request.URL.Path,
+		"status", entry.status,
+		"duration", entry.duration,
+		"backend", entry.upstreamAddr,
+		"upstream_attempts", entry.upstreamAttempts.Load(),
+		"upstream_response_time", upstream,
+		"proxy_time", entry.duration-upstream,
+		"bytes_sent", entry.bytesSent,
+		"body_bytes_received", entry.bytesReceived)
+}
+
+func accessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entry := &accessLogEntry{start: time.Now()}
+		r = r.WithContext(context.WithValue(r.Context(), accessLogKey{}, entry))
+		entry.request = r
+
+		// Requests without a body keep http.NoBody, which the proxy and
+		// retries recognize
+		var body *countingBody
+		if r.Body != nil && r.Body != http.NoBody {
+			body = &countingBody{ReadCloser: r.Body}
+			r.Body = body
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+
+		entry.duration = time.Since(entry.start)
+		entry.status = recorder.status
+		if entry.status == 0 {
+			entry.status = http.StatusOK
+		}
+		entry.bytesSent = recorder.bytesSent
+		entry.responseHeader = recorder.Header()
+		if body != nil {
+			entry.bytesReceived = body.bytesRead.Load()
+		}
+
+		dp := lookupDomain(r)
+		if dp != nil && entry.bytesReceived > 0 {
+			requestBodyBytes.add(uint64(entry.bytesReceived), dp.name)
+		}
+		// Slow requests are reported even when the domain's access log is
+		// off or the request is sampled out
+		if threshold := currentConfig().Logging.SlowThreshold; threshold > 0 && entry.duration >= threshold {
+			logSlowRequest(entry, dp)
+		}
+		if dp != nil && !dp.config.AccessLog {
+			return
+		}
+		if sampledOut(entry.status) {
+			return
+		}
+
+		if format := currentState().accessLogFormat; format == nil {
+			accessLogger.Println(formatJSONLog(entry))
+		} else {
+			accessLogger.Println(format.format(entry))
+		}
+	})
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlowRequestLog(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(60 * time.Millisecond)
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name    string
+		logging string
+		domain  string
+		path    string
+		want    bool
+	}{
+		{"slow", "", "", "/slow", true},
+		{"fast", "", "", "/fast", false},
+		{"access log disabled", "", "[logging]\nenabled = false\n", "/slow", true},
+		{"sampled out", "sample_rate = 0\nalways_log_errors = false\n", "", "/slow", true},
+		{"no threshold", "slow_threshold = 0\n", "", "/slow", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, "[logging]\nslow_threshold = 0.05\n"+tt.logging)
+			loadTestDomains(t, map[string]string{
+				"example.com": "[proxy]\nbackend_url = " + backend.URL + "\n" + tt.domain,
+			})
+			logs := captureLogs(t)
+
+			serveTest(httptest.NewRequest(http.MethodGet, "http://example.com"+tt.path, nil))
+			if got := strings.Contains(logs.String(), `msg="Slow request"`); got != tt.want {
+				t.Errorf("slow request logged = %v, want %v; logs:\n%s", got, tt.want, logs)
+			}
+		})
+	}
+}
+
+func TestLogHeaders(t *testing.T) {
+	header := http.Header{
+		"User-Agent":    {"curl/8.0"},
+		"X-Request-Id":  {"abc"},
+		"Authorization": {"Bearer secret"},
+		"Accept":        {"text/html", "application/json"},
+	}
+	tests := []struct {
+		name   string
+		names  []string
+		redact []string
+		want   map[string]string
+	}{
+		{"listed only", []string{"user-agent", "X-Request-Id"}, defaultRedactedHeaders, map[string]string{"User-Agent": "curl/8.0", "X-Request-Id": "abc"}},
+		{"redacted", []string{"Authorization"}, defaultRedactedHeaders, map[string]string{"Authorization": redactedValue}},
+		{"redaction off", []string{"Authorization"}, nil, map[string]string{"Authorization": "Bearer secret"}},
+		{"custom redaction", []string{"X-Request-Id"}, []string{"x-request-id"}, map[string]string{"X-Request-Id": redactedValue}},
+		{"repeated values joined", []string{"Accept"}, nil, map[string]string{"Accept": "text/html, application/json"}},
+		{"absent skipped", []string{"Referer"}, nil, map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := logHeaders(header, tt.names, tt.redact); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("logHeaders = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Listed headers appear in JSON access log lines, credentials redacted
+func TestAccessLogHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Backend", "b1")
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "secret"})
+	}))
+	defer backend.Close()
+	loadTestConfig(t, "[logging]\nrequest_headers = User-Agent, Cookie\nresponse_headers = X-Backend, Set-Cookie\n")
+	loadTestDomains(t, map[string]string{"example.com": "[proxy]\nbackend_url = " + backend.URL + "\n"})
+	logs := captureAccessLog(t)
+
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	r.Header.Set("User-Agent", "curl/8.0")
+	r.Header.Set("Cookie", "session=secret")
+	serveTest(r)
+
+	var line struct {
+		RequestHeaders  map[string]string `json:"request_headers"`
+		ResponseHeaders map[string]string `json:"response_headers"`
+	}
+	if err := json.Unmarshal(logs.Bytes(), &line); err != nil {
+		t.Fatalf("access log %q: %v", logs.String(), err)
+	}
+	wantRequest := map[string]string{"User-Agent": "curl/8.0", "Cookie": redactedValue}
+	wantResponse := map[string]string{"X-Backend": "b1", "Set-Cookie": redactedValue}
+	if !reflect.DeepEqual(line.RequestHeaders, wantRequest) || !reflect.DeepEqual(line.ResponseHeaders, wantResponse) {
+		t.Errorf("logged %v and %v, want %v and %v", line.RequestHeaders, line.ResponseHeaders, wantRequest, wantResponse)
+	}
+	if strings.Contains(logs.String(), "secret") {
+		t.Errorf("credentials in the access log: %s", logs.String())
+	}
+}
+
+// sample_rate thins out successful requests while errors are always logged,
+// unless always_log_errors is turned off
+func TestAccessLogSampling(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		w.WriteHeader(status)
+	}))
+	defer backend.Close()
+
+	const requests = 200
+	tests := []struct {
+		name      string
+		config    string
+		status    int
+		minLogged int
+		maxLogged int
+	}{
+		{"no sampling", "", http.StatusOK, requests, requests},
+		{"success sampled out", "sample_rate = 0\n", http.StatusOK, 0, 0},
+		{"redirect sampled out", "sample_rate = 0\n", http.StatusFound, 0, 0},
+		{"client error kept", "sample_rate = 0\n", http.StatusNotFound, requests, requests},
+		{"server error kept", "sample_rate = 0\n", http.StatusServiceUnavailable, requests, requests},
+		{"errors sampled too", "sample_rate = 0\nalways_log_errors = false\n", http.StatusInternalServerError, 0, 0},
+		{"half", "sample_rate = 0.5\n", http.StatusOK, 60, 140},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, "[logging]\n"+tt.config)
+			loadTestDomains(t, map[string]string{"example.com": "[proxy]\nbackend_url = " + backend.URL + "\n"})
+			logs := captureAccessLog(t)
+
+			for i := 0; i < requests; i++ {
+				r := httptest.NewRequest(http.MethodGet, "http://example.com/"+strconv.Itoa(tt.status), nil)
+				if got := serveTest(r); got.Code != tt.status {
+					t.Fatalf("status %d, want %d", got.Code, tt.status)
+				}
+			}
+			if logged := strings.Count(logs.String(), "\n"); logged < tt.minLogged || logged > tt.maxLogged {
+				t.Errorf("%d of %d requests logged, want between %d and %d", logged, requests, tt.minLogged, tt.maxLogged)
+			}
+		})
+	}
+}
+
+// A domain with [logging] enabled = false writes no access log lines,
+// while other domains still do
+func TestAccessLogDisabled(t *testing.T) {
+	backend := newNamedBackend(t, "backend")
+	loadTestConfig(t, "")
+	loadTestDomains(t, map[string]string{
+		"quiet.example.com": "[proxy]\nbackend_url = " + backend.URL + "\n[logging]\nenabled = false\n",
+		"example.com":       "[proxy]\nbackend_url = " + backend.URL + "\n",
+	})
+	logs := captureAccessLog(t)
+
+	tests := []struct {
+		host      string
+		wantLines int
+	}{
+		{"quiet.example.com", 0},
+		{"example.com", 1},
+	}
+	for _, tt := range tests {
+		logs.Reset()
+		if got := serveTest(httptest.NewRequest(http.MethodGet, "http://"+tt.host+"/", nil)); got.Code != http.StatusOK {
+			t.Fatalf("%s: status %d, want 200", tt.host, got.Code)
+		}
+		if lines := strings.Count(logs.String(), "\n"); lines != tt.wantLines {
+			t.Errorf("%s: %d access log lines, want %d", tt.host, lines, tt.wantLines)
+		}
+	}
+}
+
+// The slow log is written by the logging middleware, so slow_threshold
+// is refused without it
+func TestSlowThresholdWithoutLoggingMiddleware(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "system.conf")
+	if err := os.WriteFile(path, []byte(testConfigBase+"[logging]\nslow_threshold = 1\n[middleware]\nlogging = false\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(path); err == nil {
+		t.Error("loadConfig accepted slow_threshold with the logging middleware off")
+	}
+	// Either one alone is fine
+	loadTestConfig(t, "[middleware]\nlogging = false\n")
+	loadTestConfig(t, "[logging]\nslow_threshold = 1\n")
+}
+
+func TestSampleRateInvalid(t *testing.T) {
+	for _, rate := range []string{"-0.1", "1.5"} {
+		path := filepath.Join(t.TempDir(), "system.conf")
+		if err := os.WriteFile(path, []byte(testConfigBase+"[logging]\nsample_rate = "+rate+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := loadConfig(path); err == nil {
+			t.Errorf("loadConfig accepted sample_rate = %s", rate)
+		}
+	}
+}
+
+// Bytes read from the client's body are logged and counted, as far as
+// they were read
+func TestRequestBodyAccounting(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name    string
+		limits  string
+		method  string
+		size    int
+		wantMin int64
+		wantMax int64
+	}{
+		{"upload", "", http.MethodPost, 10000, 10000, 10000},
+		{"empty body", "", http.MethodPost, 0, 0, 0},
+		{"no body", "", http.MethodGet, -1, 0, 0},
+		// Reading stops just past max_request_size
+		{"over the limit", "[request_limits]\nmax_request_size = 4096\n", http.MethodPost, 10000, 4096, 4097},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, tt.limits)
+			loadTestDomains(t, map[string]string{"example.com": "[proxy]\nbackend_url = " + backend.URL + "\n"})
+			logs := captureAccessLog(t)
+			before := counterValue(requestBodyBytes, "example.com")
+
+			var body io.Reader
+			if tt.size >= 0 {
+				body = bytes.NewReader(make([]byte, tt.size))
+			}
+			serveTest(httptest.NewRequest(tt.method, "http://example.com/upload", body))
+
+			var line struct {
+				BodyBytesReceived int64 `json:"body_bytes_received"`
+			}
+			if err := json.Unmarshal(logs.Bytes(), &line); err != nil {
+				t.Fatalf("access log %q: %v", logs.String(), err)
+			}
+			if line.BodyBytesReceived < tt.wantMin || line.BodyBytesReceived > tt.wantMax {
+				t.Errorf("logged %d bytes received, want between %d and %d", line.BodyBytesReceived, tt.wantMin, tt.wantMax)
+			}
+			if counted := int64(counterValue(requestBodyBytes, "example.com") - before); counted != line.BodyBytesReceived {
+				t.Errorf("request_body_bytes_total rose by %d, logged %d", counted, line.BodyBytesReceived)
+			}
+		})
+	}
+}
@@ -3,11 +3,9 @@ package main
 import (
 	"fmt"
 	"gopkg.in/ini.v1"
-	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
 	"strings"
 	"sync"
 	"time"
@@ -15,12 +13,35 @@ import (
 	"path/filepath"
 	"io/ioutil"
 	"github.com/fsnotify/fsnotify"
+	"crypto/tls"
+	"context"
+	"golang.org/x/net/netutil"
+	"crypto/subtle"
+	"os"
+	"regexp"
+	"sort"
+	"github.com/redis/go-redis/v9"
+	"strconv"
+	"slices"
 )
 
 type Config struct {
 	RateLimiting struct {
 		RequestsPerSecond int
 		BurstLimit        int
+		Algorithm         string
+		Window            int
+		LimiterTTL        int
+		// 429 body: inline text, or @path to read it from a file
+		ResponseBody        string
+		ResponseContentType string
+		// Limits for specific methods and paths, checked in order
+		Rules []RateLimitRule
+		// Clients in the same network of this size share a limiter
+		IPv4Prefix int
+		IPv6Prefix int
+		// Redis shared by all instances so limits apply cluster-wide
+		RedisURL string
 	}
 	Timeouts struct {
 		ReadTimeout  int
@@ -28,39 +49,404 @@ type Config struct {
 		IdleTimeout  int
 	}
 	RequestLimits struct {
-		MaxRequestSize int64
+		MaxRequestSize      int64
+		MaxDecompressedSize int64
 	}
 	SSL struct {
 		Enabled  bool
 		CertFile string
 		KeyFile  string
+		// Staple OCSP responses fetched from the certificate's responder,
+		// or read from OCSPStapleFile when set
+		OCSPStapling   bool
+		OCSPStapleFile string
+		// Whether clients may resume sessions with tickets, and how often
+		// the ticket keys are replaced; 0 leaves rotation to crypto/tls
+		SessionTickets        bool
+		SessionTicketRotation time.Duration
 	}
 	Whitelist struct {
-		IPs []string
+		IPs             []string
+		Networks        []*net.IPNet
+		File            string
+		URL             string
+		RefreshInterval int
 	}
 	Blacklist struct {
-		IPs []string
+		IPs             []string
+		Networks        []*net.IPNet
+		File            string
+		URL             string
+		RefreshInterval int
+		// Close connections from listed addresses as soon as they are accepted
+		DropConnections bool
+	}
+	Logging struct {
+		Format       string
+		CustomFormat string
+		LogLevel     string
+		LogFormat    string
+		// Headers added to JSON access log lines, and those logged redacted
+		RequestHeaders  []string
+		ResponseHeaders []string
+		RedactHeaders   []string
+		// Fraction of 2xx and 3xx responses written to the access log, and
+		// whether 4xx and 5xx responses are logged regardless
+		SampleRate      float64
+		AlwaysLogErrors bool
+		// Requests taking at least this long are logged at warn level,
+		// sampled or not; 0 disables the slow log
+		SlowThreshold time.Duration
+	}
+	Server struct {
+		MaxConnections        int
+		Workers               int
+		WorkerQueueHighWater  int
+		WorkerQueueAlertAfter int
+		UseWorkerPool         bool
+		RobotsTxt             string
+		Favicon               string
+		MaxHeaderBytes        int
+		PreShutdownDelay      int
+		// Longest a request waits for a worker before getting a 503; 0 waits indefinitely
+		QueueTimeout time.Duration
+		TCPKeepAlive int
+		TCPNoDelay   bool
+		ReusePort    bool
+		// Addresses of the public listeners
+		Listen []string
+	}
+	// Whether clients are told why their request was blocked
+	Security struct {
+		ExposeBlockReason bool
+	}
+	SecurityHeaders struct {
+		Enabled               bool
+		NoSniff               bool
+		FrameOptions          string
+		ReferrerPolicy        string
+		HSTSMaxAge            int
+		HSTSIncludeSubdomains bool
+		HSTSPreload           bool
+	}
+	Alerts struct {
+		WebhookURL string
+		Threshold  int
+		Window     int
+		Cooldown   int
+	}
+	Startup struct {
+		ProbeBackends     bool
+		ProbeTimeout      int
+		FailOnUnreachable bool
+	}
+	Admin struct {
+		Listen string
+		Token  string
+		// Unix socket served alongside or instead of Listen, and its permissions
+		SocketPath string
+		SocketMode os.FileMode
+		// Domains that need a healthy backend for /readyz to report ready
+		ReadyMinHealthyDomains int
+	}
+	Domains struct {
+		// Optional JSON or YAML file of domains, merged with domainsDirectory
+		Registry string
+		// Create domainsDirectory when it doesn't exist
+		CreateDirectory bool
+		// Domain serving requests without a Host header, such as HTTP/1.0 ones
+		DefaultDomain string
+	}
+	// Which middlewares are put in front of the proxy handler; disabled
+	// ones are left out of the chain entirely
+	Middleware struct {
+		StaticFiles  bool
+		Logging      bool
+		Recover      bool
+		RateLimiting bool
+		IPFilter     bool
+		RequestSize  bool
+	}
+	Debug struct {
+		Pprof bool
+		// Count and log backend connection reuse and setup timings
+		TraceUpstream bool
+	}
+	Backend struct {
+		MaxIdleConnsPerHost int
+		MaxConnsPerHost     int
+		DisableKeepAlives   bool
+		DNSCacheTTL         int
+		// TLS sessions remembered for resuming HTTPS backend connections;
+		// 0 resumes none
+		TLSSessionCacheSize int
+		// Bytes of the pooled buffers response bodies are copied through
+		CopyBufferSize int
+	}
+	Cache struct {
+		MaxEntries int
+	}
+	// Compression of backend responses, with Algorithms in order of preference
+	Compression struct {
+		Enabled      bool
+		Algorithms   []string
+		MinSize      int64
+		ContentTypes []string
 	}
 }
 
 var (
-	config      Config
-	proxyMap    = make(map[string]*httputil.ReverseProxy)
-	mutex       sync.RWMutex
-	workerPool  chan func()
-	rateLimiter = make(map[string]*rate.Limiter)
-	limiterLock sync.Mutex
+	proxyMap      = make(map[string]*domainProxy)
+	mutex         sync.RWMutex
+	workerPool    chan func()
+	rateLimiter   = make(map[string]*limiterEntry)
+	limiterLock   sync.Mutex
+	transports    = make(map[transportKey]*http.Transport)
+	transportLock sync.Mutex
+
+	domainsLoadLock    sync.Mutex
+	domainWatchers     = make(map[string]context.CancelFunc)
+	domainWatchersLock sync.Mutex
+
+	workerPoolSize       = newGauge("worker_pool_size", "Number of workers in the pool.")
+	busyWorkers          = newGauge("worker_pool_busy_workers", "Workers currently running a task.")
+	workerTasksProcessed = newCounterVec("worker_pool_tasks_processed_total", "Tasks completed by the worker pool.")
+	workerQueueTimeouts  = newCounterVec("worker_pool_queue_timeouts_total", "Requests answered with 503 after waiting longer than queue_timeout for a worker.")
+	_                    = newGaugeFunc("worker_pool_queue_length", "Tasks waiting for a free worker.", func() int64 {
+		return int64(len(workerPool))
+	})
+
+	domainRequests           = newCounterVec("domain_requests_total", "Requests received for a configured domain.", "domain")
+	domainRequestsInFlight   = newGaugeVec("domain_requests_in_flight", "Requests currently being proxied, by domain.", "domain")
+	concurrencyRejections    = newCounterVec("domain_concurrency_rejections_total", "Requests rejected because the domain reached max_concurrent_requests.", "domain")
+	backendLimiterRejections = newCounterVec("backend_limiter_rejections_total", "Requests rejected by a domain's outbound backend rate limiter.", "domain")
 )
 
+// transportKey identifies backend connection settings; proxies with equal
+// keys share one transport so idle connections are reused across domains.
+type transportKey struct {
+	maxIdleConnsPerHost   int
+	maxConnsPerHost       int
+	disableKeepAlives     bool
+	clientCertFile        string
+	clientKeyFile         string
+	responseHeaderTimeout time.Duration
+	upstreamProxy         string
+	dnsCacheTTL           time.Duration
+	serverName            string
+	disableHTTP2          bool
+	sessionCacheSize      int
+}
+
+// DomainConfig holds the settings read from a domain's .conf file
+type DomainConfig struct {
+	BackendCertFile string
+	BackendKeyFile  string
+	UpstreamProxy   string
+	// TLS server name sent to and verified against HTTPS backends, for
+	// backends addressed by IP or by a name their certificate doesn't cover
+	BackendSNI string
+	// Speak HTTP/1.1 to HTTPS backends even when they offer HTTP/2
+	DisableBackendHTTP2 bool
+	Backends            []BackendConfig
+	Routes              []RouteConfig
+	// Backends picked by a tenant header; nil when not configured
+	Tenants *TenantConfig
+
+	// Other hostnames served by this domain exactly like its own, and the
+	// hostname every other one is redirected to, if set
+	Aliases       []string
+	CanonicalHost string
+
+	// Extra hosts served by this domain, matched when no domain matches exactly
+	HostPattern *regexp.Regexp
+
+	// Local port requests must arrive on to be served by this domain; 0
+	// serves every port
+	ListenPort int
+
+	// Find/replace rules applied to response bodies
+	ResponseRewrites []ResponseRewrite
+
+	// Whether Location headers naming the backend are pointed at the
+	// client's host, and Set-Cookie domains rewritten from backend to public
+	RewriteLocation bool
+	CookieDomains   map[string]string
+
+	// Merge differently cased response headers and drop repeats of headers
+	// that may only appear once
+	NormalizeResponseHeaders bool
+
+	// Name the proxy adds to Via headers, empty for none, and the Server
+	// header sent to clients in place of the backend's when OverrideServer
+	// is set, empty to remove it
+	Via            string
+	ServerHeader   string
+	OverrideServer bool
+
+	// Paths whose requests bypass the global rate limiter
+	RateLimitExemptPaths RateLimitExemptions
+
+	// Methods accepted for this domain; empty allows all methods
+	AllowedMethods []string
+	// Answer OPTIONS requests other than CORS preflights with the allowed
+	// methods instead of forwarding them
+	HandleOptions bool
+
+	// Shared secret header a CDN must send; direct-to-origin requests without it are rejected
+	OriginHeader string
+	OriginSecret string
+
+	// How the trailing slash of request paths is adjusted before forwarding
+	TrailingSlash         string
+	TrailingSlashRedirect bool
+
+	// Decode gzip/deflate request bodies before forwarding
+	DecompressRequests bool
+
+	// Whether requests for this domain are written to the access log
+	AccessLog bool
+
+	// Requests proxied at once for this domain; 0 means unlimited
+	MaxConcurrentRequests int
+	// Requests in flight to each of the domain's backends; 0 means unlimited
+	MaxConnsPerBackend int
+
+	// Outbound rate limit towards the backend, shared by all clients
+	BackendRPS          float64
+	BackendBurst        int
+	BackendQueueTimeout time.Duration
+
+	// How requests are spread across backends: round_robin, ip_hash or random
+	Balance string
+
+	// Active health checks; backends are taken out of rotation after
+	// UnhealthyThreshold failed checks and return after HealthyThreshold
+	// successful ones
+	HealthCheckInterval time.Duration
+	HealthCheckTimeout  time.Duration
+	HealthyThreshold    int
+	UnhealthyThreshold  int
+	// Lower the weight of backends that answer health checks slowly
+	LatencyWeighting bool
+
+	// Close WebSocket and event streams after this long without traffic; 0 disables
+	StreamIdleTimeout time.Duration
+
+	// Longest deadline a client may set with X-Request-Timeout; 0 ignores the header
+	MaxRequestTimeout time.Duration
+
+	// Largest response body relayed from the backend; 0 means no limit
+	MaxResponseSize int64
+
+	// Times a failed backend request is retried on another pick from its
+	// group, and the delay before the first retry, doubled for each one
+	// after it, plus up to RetryJitter at random
+	Retries      int
+	RetryBackoff time.Duration
+	RetryJitter  time.Duration
+
+	// Request headers removed before forwarding, the only client headers
+	// forwarded when set, and the largest header value forwarded; larger
+	// headers are dropped
+	StripHeaders         []string
+	ForwardHeaders       []string
+	MaxRequestHeaderSize int
+
+	// Proxies in front of this one whose X-Forwarded-For is believed when
+	// finding the client IP, and whether private and reserved addresses in
+	// that header are passed over
+	TrustedProxies          []*net.IPNet
+	ForwardedForSkipPrivate bool
+
+	// Access rules combining client network, method and path
+	ACL ACLConfig
+
+	// Origins allowed to open WebSocket connections (empty allows all), and
+	// whether Sec-WebSocket-Protocol is passed on to the backend
+	WebSocketOrigins            []string
+	WebSocketForwardSubprotocol bool
+
+	// In-memory caching of backend responses
+	Cache CacheConfig
+
+	// Copies of requests sent to a second backend, e.g. a new version under test
+	Mirror MirrorConfig
+
+	// Overrides for the globally served robots.txt and favicon
+	RobotsTxt *staticFile
+	Favicon   *staticFile
+
+	// Pages served instead of the global ones for upstream errors, by status
+	ErrorPages map[int]*staticFile
+}
+
+// domainProxy is the loaded state for a single domain
+type domainProxy struct {
+	name           string
+	config         DomainConfig
+	proxy          *httputil.ReverseProxy
+	backendLimiter *rate.Limiter
+
+	// Semaphore for max_concurrent_requests; nil means unlimited
+	slots chan struct{}
+
+	// Backend groups of each route with its own backends, in route order,
+	// then of each tenant in name order, then of the domain's default backends
+	groups           []*backendGroup
+	stopHealthChecks context.CancelFunc
+
+	// Where copies of requests are sent; nil if not configured
+	mirror *requestMirror
+}
+
+// Load system.conf and apply it. Everything is parsed and validated before
+// anything is applied, so a failed reload leaves the running config intact.
 func loadConfig(filePath string) error {
 	cfg, err := ini.Load(filePath)
 	if err != nil {
 		return err
 	}
 
+	// Parse into fresh values, installed only once everything is valid
+	var config Config
+	var state configState
+
 	// Load rate limiting config
 	config.RateLimiting.RequestsPerSecond = cfg.Section("rate_limiting").Key("requests_per_second").MustInt(1)
 	config.RateLimiting.BurstLimit = cfg.Section("rate_limiting").Key("burst_limit").MustInt(5)
+	config.RateLimiting.Algorithm = cfg.Section("rate_limiting").Key("algorithm").In("token_bucket", []string{"token_bucket", "sliding_window"})
+	config.RateLimiting.Window = cfg.Section("rate_limiting").Key("window").MustInt(1)
+	config.RateLimiting.LimiterTTL = cfg.Section("rate_limiting").Key("limiter_ttl").MustInt(600)
+	config.RateLimiting.IPv4Prefix = cfg.Section("rate_limiting").Key("ipv4_prefix").MustInt(32)
+	config.RateLimiting.IPv6Prefix = cfg.Section("rate_limiting").Key("ipv6_prefix").MustInt(64)
+	if config.RateLimiting.IPv4Prefix < 1 || config.RateLimiting.IPv4Prefix > 32 {
+		return fmt.Errorf("rate_limiting: ipv4_prefix must be between 1 and 32")
+	}
+	if config.RateLimiting.IPv6Prefix < 1 || config.RateLimiting.IPv6Prefix > 128 {
+		return fmt.Errorf("rate_limiting: ipv6_prefix must be between 1 and 128")
+	}
+	config.RateLimiting.RedisURL = cfg.Section("rate_limiting").Key("redis_url").String()
+	if config.RateLimiting.RedisURL != "" {
+		if config.RateLimiting.Algorithm != "token_bucket" {
+			return fmt.Errorf("rate_limiting: redis_url requires algorithm = token_bucket")
+		}
+		if state.redisOptions, err = redis.ParseURL(config.RateLimiting.RedisURL); err != nil {
+			return fmt.Errorf("rate_limiting: redis_url: %w", err)
+		}
+		// A retry would outlast redisLimiterTimeout; fall back instead
+		state.redisOptions.MaxRetries = -1
+	}
+	config.RateLimiting.ResponseBody = cfg.Section("rate_limiting").Key("response_body").String()
+	config.RateLimiting.ResponseContentType = cfg.Section("rate_limiting").Key("response_content_type").MustString("text/plain; charset=utf-8")
+	config.RateLimiting.Rules, err = loadRateLimitRules(cfg, config.RateLimiting.BurstLimit)
+	if err != nil {
+		return err
+	}
+	state.rateLimitBody, err = loadResponseBody(config.RateLimiting.ResponseBody)
+	if err != nil {
+		return fmt.Errorf("rate_limiting: response_body: %w", err)
+	}
 
 	// Load timeouts config
 	config.Timeouts.ReadTimeout = cfg.Section("timeouts").Key("read_timeout").MustInt(5)
@@ -69,21 +455,204 @@ func loadConfig(filePath string) error {
 
 	// Load request limits
 	config.RequestLimits.MaxRequestSize = cfg.Section("request_limits").Key("max_request_size").MustInt64(1048576)
+	config.RequestLimits.MaxDecompressedSize = cfg.Section("request_limits").Key("max_decompressed_size").MustInt64(config.RequestLimits.MaxRequestSize)
 
 	// Load SSL config
 	config.SSL.Enabled = cfg.Section("ssl").Key("enabled").MustBool(true)
 	config.SSL.CertFile = cfg.Section("ssl").Key("cert_file").String()
 	config.SSL.KeyFile = cfg.Section("ssl").Key("key_file").String()
+	config.SSL.OCSPStapleFile = cfg.Section("ssl").Key("ocsp_staple_file").String()
+	config.SSL.OCSPStapling = cfg.Section("ssl").Key("ocsp_stapling").MustBool(config.SSL.OCSPStapleFile != "")
+	config.SSL.SessionTickets = cfg.Section("ssl").Key("session_tickets").MustBool(true)
+	config.SSL.SessionTicketRotation = time.Duration(cfg.Section("ssl").Key("session_ticket_rotation").MustInt(0)) * time.Second
 
 	// Load whitelist and blacklist IPs
 	config.Whitelist.IPs = strings.Split(cfg.Section("whitelist").Key("ips").String(), ",")
 	config.Blacklist.IPs = strings.Split(cfg.Section("blacklist").Key("ips").String(), ",")
+	config.Whitelist.Networks, err = parseIPList(config.Whitelist.IPs)
+	if err != nil {
+		return fmt.Errorf("whitelist: %w", err)
+	}
+	config.Blacklist.Networks, err = parseIPList(config.Blacklist.IPs)
+	if err != nil {
+		return fmt.Errorf("blacklist: %w", err)
+	}
+
+	// Load external IP list sources, merged with the inline entries
+	config.Whitelist.File = cfg.Section("whitelist").Key("file").String()
+	config.Whitelist.URL = cfg.Section("whitelist").Key("url").String()
+	config.Whitelist.RefreshInterval = cfg.Section("whitelist").Key("refresh_interval").MustInt(3600)
+	config.Blacklist.File = cfg.Section("blacklist").Key("file").String()
+	config.Blacklist.URL = cfg.Section("blacklist").Key("url").String()
+	config.Blacklist.RefreshInterval = cfg.Section("blacklist").Key("refresh_interval").MustInt(3600)
+	config.Blacklist.DropConnections = cfg.Section("blacklist").Key("drop_connections").MustBool(false)
+	state.whitelist, err = newIPList("whitelist", config.Whitelist.Networks, config.Whitelist.File, config.Whitelist.URL, time.Duration(config.Whitelist.RefreshInterval)*time.Second)
+	if err != nil {
+		return err
+	}
+	state.blacklist, err = newIPList("blacklist", config.Blacklist.Networks, config.Blacklist.File, config.Blacklist.URL, time.Duration(config.Blacklist.RefreshInterval)*time.Second)
+	if err != nil {
+		return err
+	}
+
+	// Load access log format, failing fast on an invalid template
+	config.Logging.Format = cfg.Section("logging").Key("format").MustString("json")
+	config.Logging.CustomFormat = cfg.Section("logging").Key("custom_format").String()
+	config.Logging.RequestHeaders = cfg.Section("logging").Key("request_headers").Strings(",")
+	config.Logging.ResponseHeaders = cfg.Section("logging").Key("response_headers").Strings(",")
+	// Key creates a missing key, so check for it first
+	config.Logging.RedactHeaders = defaultRedactedHeaders
+	if cfg.Section("logging").HasKey("redact_headers") {
+		config.Logging.RedactHeaders = cfg.Section("logging").Key("redact_headers").Strings(",")
+	}
+	config.Logging.SampleRate = cfg.Section("logging").Key("sample_rate").MustFloat64(1)
+	if config.Logging.SampleRate < 0 || config.Logging.SampleRate > 1 {
+		return fmt.Errorf("logging: sample_rate must be between 0 and 1")
+	}
+	config.Logging.AlwaysLogErrors = cfg.Section("logging").Key("always_log_errors").MustBool(true)
+	config.Logging.SlowThreshold = time.Duration(cfg.Section("logging").Key("slow_threshold").MustFloat64(0) * float64(time.Second))
+	if config.Logging.SlowThreshold < 0 {
+		return fmt.Errorf("logging: slow_threshold must not be negative")
+	}
+	state.accessLogFormat, err = newLogFormat(config.Logging.Format, config.Logging.CustomFormat)
+	if err != nil {
+		return err
+	}
+	config.Logging.LogLevel = cfg.Section("logging").Key("log_level").MustString("info")
+	config.Logging.LogFormat = cfg.Section("logging").Key("log_format").MustString("text")
+	state.logger, err = newLogger(config.Logging.LogLevel, config.Logging.LogFormat)
+	if err != nil {
+		return err
+	}
 
+	// Load server settings
+	config.Server.MaxConnections = cfg.Section("server").Key("max_connections").MustInt(0)
+	config.Server.UseWorkerPool = cfg.Section("server").Key("use_worker_pool").MustBool(false)
+	config.Server.Workers = cfg.Section("server").Key("workers").MustInt(100)
+	config.Server.WorkerQueueHighWater = cfg.Section("server").Key("worker_queue_high_water").MustInt(config.Server.Workers * 8 / 10)
+	config.Server.WorkerQueueAlertAfter = cfg.Section("server").Key("worker_queue_alert_after").MustInt(30)
+	config.Server.QueueTimeout = time.Duration(cfg.Section("server").Key("queue_timeout").MustFloat64(0) * float64(time.Second))
+	config.Server.MaxHeaderBytes = cfg.Section("server").Key("max_header_bytes").MustInt(http.DefaultMaxHeaderBytes)
+	config.Server.PreShutdownDelay = cfg.Section("server").Key("pre_shutdown_delay").MustInt(0)
+	config.Server.TCPKeepAlive = cfg.Section("server").Key("tcp_keepalive").MustInt(15)
+	config.Server.TCPNoDelay = cfg.Section("server").Key("tcp_nodelay").MustBool(true)
+	config.Server.ReusePort = cfg.Section("server").Key("reuse_port").MustBool(false)
+	config.Server.Listen = cfg.Section("server").Key("listen").Strings(",")
+	if len(config.Server.Listen) == 0 {
+		config.Server.Listen = []string{":8080"}
+	}
+	config.Server.RobotsTxt = cfg.Section("server").Key("robots_txt").String()
+	config.Server.Favicon = cfg.Section("server").Key("favicon").String()
+	state.robotsTxt, err = loadStaticFile(config.Server.RobotsTxt)
+	if err != nil {
+		return fmt.Errorf("robots_txt: %w", err)
+	}
+	state.favicon, err = loadStaticFile(config.Server.Favicon)
+	if err != nil {
+		return fmt.Errorf("favicon: %w", err)
+	}
+	if state.errorPages, err = loadErrorPages(cfg.Section("error_pages")); err != nil {
+		return err
+	}
+
+	// Load security headers added to responses
+	config.Security.ExposeBlockReason = cfg.Section("security").Key("expose_block_reason").MustBool(false)
+	config.SecurityHeaders.Enabled = cfg.Section("security_headers").Key("enabled").MustBool(true)
+	config.SecurityHeaders.NoSniff = cfg.Section("security_headers").Key("nosniff").MustBool(true)
+	config.SecurityHeaders.FrameOptions = cfg.Section("security_headers").Key("frame_options").MustString("SAMEORIGIN")
+	config.SecurityHeaders.ReferrerPolicy = cfg.Section("security_headers").Key("referrer_policy").MustString("strict-origin-when-cross-origin")
+	config.SecurityHeaders.HSTSMaxAge = cfg.Section("security_headers").Key("hsts_max_age").MustInt(0)
+	config.SecurityHeaders.HSTSIncludeSubdomains = cfg.Section("security_headers").Key("hsts_include_subdomains").MustBool(false)
+	config.SecurityHeaders.HSTSPreload = cfg.Section("security_headers").Key("hsts_preload").MustBool(false)
+
+	// Load rate limit alerting
+	config.Alerts.WebhookURL = cfg.Section("alerts").Key("webhook_url").String()
+	config.Alerts.Threshold = cfg.Section("alerts").Key("threshold").MustInt(0)
+	config.Alerts.Window = cfg.Section("alerts").Key("window").MustInt(60)
+	config.Alerts.Cooldown = cfg.Section("alerts").Key("cooldown").MustInt(300)
+
+	// Load startup checks
+	config.Startup.ProbeBackends = cfg.Section("startup").Key("probe_backends").MustBool(false)
+	config.Startup.ProbeTimeout = cfg.Section("startup").Key("probe_timeout").MustInt(2)
+	config.Startup.FailOnUnreachable = cfg.Section("startup").Key("fail_on_unreachable").MustBool(false)
+
+	// Load admin server settings
+	config.Admin.Listen = cfg.Section("admin").Key("listen").String()
+	config.Admin.Token = cfg.Section("admin").Key("token").String()
+	config.Admin.SocketPath = cfg.Section("admin").Key("socket_path").String()
+	socketMode, err := strconv.ParseUint(cfg.Section("admin").Key("socket_mode").MustString("0600"), 8, 32)
+	if err != nil || socketMode > 0777 {
+		return fmt.Errorf("admin: socket_mode must be octal permissions such as 0660")
+	}
+	config.Admin.SocketMode = os.FileMode(socketMode)
+	config.Admin.ReadyMinHealthyDomains = cfg.Section("admin").Key("ready_min_healthy_domains").MustInt(0)
+
+	// Load the domain registry location
+	config.Domains.Registry = cfg.Section("domains").Key("registry").String()
+	config.Domains.CreateDirectory = cfg.Section("domains").Key("create_directory").MustBool(false)
+	config.Domains.DefaultDomain = cfg.Section("domains").Key("default_domain").String()
+
+	// Load middleware config
+	config.Middleware.StaticFiles = cfg.Section("middleware").Key("static_files").MustBool(true)
+	config.Middleware.Logging = cfg.Section("middleware").Key("logging").MustBool(true)
+	config.Middleware.Recover = cfg.Section("middleware").Key("recover").MustBool(true)
+	config.Middleware.RateLimiting = cfg.Section("middleware").Key("rate_limiting").MustBool(true)
+	config.Middleware.IPFilter = cfg.Section("middleware").Key("ip_filter").MustBool(true)
+	config.Middleware.RequestSize = cfg.Section("middleware").Key("request_size").MustBool(true)
+	// Slow requests are timed and reported by the access log middleware
+	if config.Logging.SlowThreshold > 0 && !config.Middleware.Logging {
+		return fmt.Errorf("logging: slow_threshold requires [middleware] logging = true")
+	}
+
+	// Load debugging options
+	config.Debug.Pprof = cfg.Section("debug").Key("pprof").MustBool(false)
+	config.Debug.TraceUpstream = cfg.Section("debug").Key("trace_upstream").MustBool(false)
+
+	// Load backend connection settings
+	config.Backend.MaxIdleConnsPerHost = cfg.Section("backend").Key("max_idle_conns_per_host").MustInt(100)
+	config.Backend.MaxConnsPerHost = cfg.Section("backend").Key("max_conns_per_host").MustInt(0)
+	config.Backend.DisableKeepAlives = cfg.Section("backend").Key("disable_keep_alives").MustBool(false)
+	config.Backend.DNSCacheTTL = cfg.Section("backend").Key("dns_cache_ttl").MustInt(0)
+	config.Backend.TLSSessionCacheSize = cfg.Section("backend").Key("tls_session_cache_size").MustInt(0)
+	config.Backend.CopyBufferSize = cfg.Section("backend").Key("copy_buffer_size").MustInt(defaultCopyBufferSize)
+	if config.Backend.CopyBufferSize < 1024 {
+		return fmt.Errorf("backend: copy_buffer_size must be at least 1024")
+	}
+
+	// Load response cache size, shared by all domains
+	config.Cache.MaxEntries = cfg.Section("cache").Key("max_entries").MustInt(10000)
+
+	// Load response compression settings
+	config.Compression.Enabled = cfg.Section("compression").Key("enabled").MustBool(false)
+	config.Compression.Algorithms = cfg.Section("compression").Key("algorithms").Strings(",")
+	if len(config.Compression.Algorithms) == 0 {
+		config.Compression.Algorithms = []string{encodingBrotli, encodingGzip}
+	}
+	if err := validCompressionAlgorithms(config.Compression.Algorithms); err != nil {
+		return err
+	}
+	config.Compression.MinSize = cfg.Section("compression").Key("min_size").MustInt64(1024)
+	config.Compression.ContentTypes = cfg.Section("compression").Key("content_types").Strings(",")
+	if len(config.Compression.ContentTypes) == 0 {
+		config.Compression.ContentTypes = defaultCompressibleTypes
+	}
+
+	// Start keeping the new IP lists up to date, then apply everything
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	for _, list := range []*ipList{state.whitelist, state.blacklist} {
+		if err := list.watch(watchCtx); err != nil {
+			stopWatching()
+			return fmt.Errorf("%s: %w", list.name, err)
+		}
+	}
+	state.stopIPLists = stopWatching
+	applyConfig(config, state)
 	return nil
 }
 
 func initWorkerPool(numWorkers int) {
 	workerPool = make(chan func(), numWorkers)
+	workerPoolSize.set(int64(numWorkers))
 	for i := 0; i < numWorkers; i++ {
 		go worker()
 	}
@@ -91,23 +660,155 @@ func initWorkerPool(numWorkers int) {
 
 func worker() {
 	for task := range workerPool {
+		busyWorkers.add(1)
+		task()
+		busyWorkers.add(-1)
+		workerTasksProcessed.inc()
+	}
+}
+
+// Run task on a pool worker and wait for it to finish, so the handler
+// doesn't return while the ResponseWriter is still in use. A panic in the
+// task, such as http.ErrAbortHandler, is re-raised on the calling goroutine
+// where net/http recovers it.
+//
+// If ctx ends while the task is still queued, for example because the client
+// disconnected, or the task waits longer than queueTimeout (if set) for a
+// worker, the task is skipped and false is returned.
+func runInWorkerPool(ctx context.Context, queueTimeout time.Duration, task func()) bool {
+	done := make(chan struct{})
+	var panicked interface{}
+	ran := false
+	enqueued := time.Now()
+	job := func() {
+		defer close(done)
+		defer func() {
+			panicked = recover()
+		}()
+		if ctx.Err() != nil || (queueTimeout > 0 && time.Since(enqueued) > queueTimeout) {
+			return
+		}
+		ran = true
 		task()
 	}
+
+	queueCtx := ctx
+	if queueTimeout > 0 {
+		var cancel context.CancelFunc
+		queueCtx, cancel = context.WithTimeout(ctx, queueTimeout)
+		defer cancel()
+	}
+	select {
+	case workerPool <- job:
+	case <-queueCtx.Done():
+		return false
+	}
+	<-done
+	if panicked != nil {
+		panic(panicked)
+	}
+	return ran
 }
 
-func getRateLimiter(ip string) *rate.Limiter {
+// Warn when the worker queue stays at or above highWater for longer than
+// sustain, which means the pool is the bottleneck
+func monitorWorkerQueue(highWater int, sustain time.Duration) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var aboveSince time.Time
+	warned := false
+	for range ticker.C {
+		queued := len(workerPool)
+		if queued < highWater {
+			if warned {
+				logger.Info("Worker queue back below high-water mark", "queued", queued, "high_water", highWater)
+			}
+			aboveSince = time.Time{}
+			warned = false
+			continue
+		}
+
+		if aboveSince.IsZero() {
+			aboveSince = time.Now()
+		}
+		if !warned && time.Since(aboveSince) >= sustain {
+			logger.Warn("Worker queue above high-water mark", "queued", queued, "high_water", highWater, "busy_workers", busyWorkers.get(), "for", time.Since(aboveSince))
+			warned = true
+		}
+	}
+}
+
+// Return the limiter for a client IP under the given rule, or under the
+// global limits when rule is nil. Each rule limits clients separately, and
+// clients in the same ipv4_prefix or ipv6_prefix network share a limiter.
+func getRateLimiter(ip string, rule *RateLimitRule) Limiter {
+	key := clientNetwork(ip, currentConfig().RateLimiting.IPv4Prefix, currentConfig().RateLimiting.IPv6Prefix)
+	requestsPerSecond, burstLimit := currentConfig().RateLimiting.RequestsPerSecond, currentConfig().RateLimiting.BurstLimit
+	if rule != nil {
+		key = rule.Name + "|" + key
+		requestsPerSecond, burstLimit = rule.RequestsPerSecond, rule.BurstLimit
+	}
+
 	limiterLock.Lock()
 	defer limiterLock.Unlock()
 
-	if limiter, exists := rateLimiter[ip]; exists {
-		return limiter
+	if entry, exists := rateLimiter[key]; exists {
+		entry.lastSeen = time.Now()
+		return entry.limiter
 	}
 
-	limiter := rate.NewLimiter(rate.Limit(config.RateLimiting.RequestsPerSecond), config.RateLimiting.BurstLimit)
-	rateLimiter[ip] = limiter
+	var limiter Limiter
+	if currentConfig().RateLimiting.Algorithm == "sliding_window" {
+		window := time.Duration(currentConfig().RateLimiting.Window) * time.Second
+		limiter = newSlidingWindowLimiter(requestsPerSecond*currentConfig().RateLimiting.Window, window)
+	} else {
+		limiter = rate.NewLimiter(rate.Limit(requestsPerSecond), burstLimit)
+	}
+	if rateLimitRedis != nil {
+		limiter = &redisLimiter{
+			client:   rateLimitRedis,
+			key:      "ratelimit:" + key,
+			rate:     requestsPerSecond,
+			burst:    burstLimit,
+			fallback: limiter,
+		}
+	}
+	rateLimiter[key] = &limiterEntry{limiter: limiter, lastSeen: time.Now()}
 	return limiter
 }
 
+type middleware struct {
+	name    string
+	enabled bool
+	wrap    func(http.Handler) http.Handler
+}
+
+// The middlewares in front of proxyHandler, outermost first, and whether
+// [middleware] enables them
+func middlewareChain() []middleware {
+	return []middleware{
+		{"static_files", startupConfig.Middleware.StaticFiles, staticFilesMiddleware},
+		{"logging", startupConfig.Middleware.Logging, accessLogMiddleware},
+		{"recover", startupConfig.Middleware.Recover, recoverMiddleware},
+		{"rate_limiting", startupConfig.Middleware.RateLimiting, rateLimitMiddleware},
+		{"ip_filter", startupConfig.Middleware.IPFilter, ipFilterMiddleware},
+		{"request_size", startupConfig.Middleware.RequestSize, limitRequestSizeMiddleware},
+	}
+}
+
+// Compose the enabled middlewares around proxyHandler
+func buildHandler() http.Handler {
+	middlewares := middlewareChain()
+	var handler http.Handler = http.HandlerFunc(proxyHandler)
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		if middlewares[i].enabled {
+			handler = middlewares[i].wrap(handler)
+		}
+	}
+	return handler
+}
+
 func rateLimitMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ip, _, err := net.SplitHostPort(r.RemoteAddr)
@@ -116,43 +817,71 @@ func rateLimitMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		limiter := getRateLimiter(ip)
+		if rateLimitExempt(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		limiter := getRateLimiter(ip, matchRateLimitRule(currentConfig().RateLimiting.Rules, r))
 		if !limiter.Allow() {
-			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			recordRejection(ip, r.Host)
+			writeTooManyRequests(w)
 			return
 		}
+		resetRejections(ip)
 
 		next.ServeHTTP(w, r)
 	})
 }
 
+// Resolve a configured response body: "@path" reads the file, anything else
+// is used as is, and an empty value leaves the default in place
+func loadResponseBody(value string) ([]byte, error) {
+	if path, ok := strings.CutPrefix(value, "@"); ok {
+		return os.ReadFile(path)
+	}
+	if value == "" {
+		return nil, nil
+	}
+	return []byte(value), nil
+}
+
+func writeTooManyRequests(w http.ResponseWriter) {
+	// The body and its content type come from one snapshot, so a reload
+	// can't pair them up wrong
+	cfg := live.Load()
+	if cfg.rateLimitBody == nil {
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		return
+	}
+	w.Header().Set("Content-Type", cfg.RateLimiting.ResponseContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write(cfg.rateLimitBody)
+}
+
 func ipFilterMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
 		if err != nil {
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
 
 		// Check blacklist
-		for _, blockedIP := range config.Blacklist.IPs {
-			if blockedIP == ip {
-				http.Error(w, "Forbidden", http.StatusForbidden)
-				return
-			}
+		if currentState().blacklist.contains(ip) {
+			writeBlocked(w, r, http.StatusForbidden, blockBlacklist)
+			return
 		}
 
 		// Check whitelist
-		allowed := false
-		for _, allowedIP := range config.Whitelist.IPs {
-			if allowedIP == ip {
-				allowed = true
-				break
-			}
-		}
-
-		if !allowed {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		if !currentState().whitelist.contains(ip) {
+			writeBlocked(w, r, http.StatusUnauthorized, blockNotWhitelisted)
 			return
 		}
 
@@ -162,67 +891,708 @@ func ipFilterMiddleware(next http.Handler) http.Handler {
 
 func limitRequestSizeMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		r.Body = http.MaxBytesReader(w, r.Body, config.RequestLimits.MaxRequestSize)
+		r.Body = http.MaxBytesReader(w, r.Body, currentConfig().RequestLimits.MaxRequestSize)
 		next.ServeHTTP(w, r)
 	})
 }
 
-// Load domain proxy configuration from .conf files
+// Load every domain config in directory and swap the new set in at once.
+// Domains removed from the directory stop being served; a domain whose file
+// fails to load keeps its previous config, if it had one.
 func loadDomains(directory string) error {
+	domainsLoadLock.Lock()
+	defer domainsLoadLock.Unlock()
+
+	// A missing directory holds no domains, so the proxy can still run on
+	// the registry's
 	files, err := ioutil.ReadDir(directory)
+	if os.IsNotExist(err) && currentConfig().Domains.CreateDirectory {
+		if err = os.MkdirAll(directory, 0755); err == nil {
+			logger.Info("Created domain directory", "directory", directory)
+		}
+	} else if os.IsNotExist(err) {
+		logger.Warn("Domain directory does not exist, loading no domains from it", "directory", directory)
+		err = nil
+	}
 	if err != nil {
 		return err
 	}
 
-	mutex.Lock()
-	defer mutex.Unlock()
+	mutex.RLock()
+	current := proxyMap
+	mutex.RUnlock()
 
+	domains := make(map[string]*domainProxy)
+	load := func(domain string, cfg *ini.File, err error) {
+		keepPrevious := func() {
+			if dp, exists := current[domain]; exists && dp.name == domain {
+				domains[domain] = dp
+			}
+		}
+
+		if err != nil {
+			logger.Error("Error loading config for domain", "domain", domain, "error", err)
+			keepPrevious()
+			return
+		}
+
+		domainConfig, err := loadDomainConfig(cfg)
+		if err != nil {
+			logger.Error("Error loading config for domain", "domain", domain, "error", err)
+			keepPrevious()
+			return
+		}
+		proxy, groups, err := newReverseProxy(domainConfig)
+		if err != nil {
+			logger.Error("Error creating proxy for domain", "domain", domain, "error", err)
+			keepPrevious()
+			return
+		}
+		mirror, err := newRequestMirror(domainConfig)
+		if err != nil {
+			logger.Error("Error creating mirror for domain", "domain", domain, "error", err)
+			keepPrevious()
+			return
+		}
+		domains[domain] = newDomainProxy(domain, domainConfig, proxy, groups, mirror)
+		for _, backend := range domainConfig.Backends {
+			logger.Info("Loaded proxy for domain", "domain", domain, "backend", backend.URL)
+		}
+	}
+
+	fromFiles := make(map[string]bool)
 	for _, file := range files {
 		if filepath.Ext(file.Name()) == ".conf" {
 			domain := strings.TrimSuffix(file.Name(), filepath.Ext(file.Name()))
-			filePath := filepath.Join(directory, file.Name())
-			cfg, err := ini.Load(filePath)
-			if err != nil {
-				log.Printf("Error loading config for domain %s: %v", domain, err)
+			cfg, err := ini.Load(filepath.Join(directory, file.Name()))
+			fromFiles[domain] = true
+			load(domain, cfg, err)
+		}
+	}
+
+	// Domains added through the admin API, unless a .conf file defines them
+	names, added := addedDomains()
+	for _, domain := range names {
+		if fromFiles[domain] {
+			logger.Warn("Domain added through the admin API also has a .conf file, using the file", "domain", domain)
+			continue
+		}
+		load(domain, added[domain], nil)
+	}
+
+	// Domains from the registry, unless a .conf file or the admin API
+	// already defines them
+	if currentConfig().Domains.Registry != "" {
+		names, registry := registryDomains(currentConfig().Domains.Registry)
+		for _, domain := range names {
+			if fromFiles[domain] {
+				logger.Warn("Domain is in both the registry and the domain directory, using its .conf file", "domain", domain)
 				continue
 			}
+			if added[domain] != nil {
+				logger.Warn("Domain is in both the registry and the admin API's domains, using the admin API's", "domain", domain)
+				continue
+			}
+			load(domain, registry[domain], nil)
+		}
+	}
+
+	if len(domains) == 0 {
+		logger.Warn("No domains configured, requests for every host will get 404", "directory", directory)
+	}
+	registerAliases(domains)
+	if name := currentConfig().Domains.DefaultDomain; name != "" && domains[name] == nil {
+		logger.Warn("default_domain is not a loaded domain, requests without a Host header will get 404", "domain", name)
+	}
 
-			backendURL := cfg.Section("proxy").Key("backend_url").String()
-			proxyMap[domain] = newReverseProxy(backendURL)
-			fmt.Printf("Loaded proxy for domain: %s -> %s\n", domain, backendURL)
+	mutex.Lock()
+	previous := proxyMap
+	proxyMap = domains
+	rebuildHostRules()
+	mutex.Unlock()
+
+	// Stop the background work of domains that were replaced or removed
+	kept := make(map[*domainProxy]bool, len(domains))
+	for _, dp := range domains {
+		kept[dp] = true
+	}
+	for name, dp := range previous {
+		if name == dp.name && !kept[dp] {
+			dp.close()
 		}
 	}
+	pruneTransports(domains)
+
+	if err := watchErrorPages(); err != nil {
+		logger.Error("Failed to watch error pages", "error", err)
+	}
 	return nil
 }
 
-func newReverseProxy(target string) *httputil.ReverseProxy {
-	url, _ := url.Parse(target)
+// Add each domain's aliases to the map, pointing at the domain's proxy.
+// Domains are visited by name so conflicts resolve the same way on every
+// reload; a hostname with its own .conf file always keeps it.
+func registerAliases(domains map[string]*domainProxy) {
+	names := make([]string, 0, len(domains))
+	for name := range domains {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		dp := domains[name]
+		for _, alias := range dp.config.Aliases {
+			if other, exists := domains[alias]; exists {
+				logger.Warn("Ignoring alias already served by another domain", "domain", name, "alias", alias, "served_by", other.name)
+				continue
+			}
+			domains[alias] = dp
+		}
+	}
+}
+
+// Read the per-domain settings from a parsed domain .conf file
+func loadDomainConfig(cfg *ini.File) (DomainConfig, error) {
+	var domainConfig DomainConfig
+	domainConfig.BackendCertFile = cfg.Section("proxy").Key("backend_cert_file").String()
+	domainConfig.BackendKeyFile = cfg.Section("proxy").Key("backend_key_file").String()
+	domainConfig.UpstreamProxy = cfg.Section("proxy").Key("upstream_proxy").String()
+	domainConfig.BackendSNI = cfg.Section("proxy").Key("backend_sni").String()
+	domainConfig.DisableBackendHTTP2 = !cfg.Section("proxy").Key("backend_http2").MustBool(true)
+
+	domainConfig.Aliases = cfg.Section("proxy").Key("aliases").Strings(",")
+	if host := cfg.Section("proxy").Key("canonical_host").String(); host != "" {
+		if err := validCanonicalHost(host); err != nil {
+			return domainConfig, err
+		}
+		domainConfig.CanonicalHost = host
+	}
+
+	if pattern := cfg.Section("proxy").Key("host_regex").String(); pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return domainConfig, fmt.Errorf("host_regex: %w", err)
+		}
+		domainConfig.HostPattern = re
+	}
+
+	domainConfig.ListenPort = cfg.Section("proxy").Key("listen_port").MustInt(0)
+	if domainConfig.ListenPort < 0 || domainConfig.ListenPort > 65535 {
+		return domainConfig, fmt.Errorf("listen_port: %d is not a port", domainConfig.ListenPort)
+	}
+
+	domainConfig.AllowedMethods = cfg.Section("proxy").Key("allowed_methods").Strings(",")
+	for i, method := range domainConfig.AllowedMethods {
+		domainConfig.AllowedMethods[i] = strings.ToUpper(method)
+	}
+	domainConfig.HandleOptions = cfg.Section("proxy").Key("handle_options").MustBool(false)
+	domainConfig.StripHeaders = cfg.Section("proxy").Key("strip_headers").Strings(",")
+	domainConfig.ForwardHeaders = cfg.Section("proxy").Key("forward_headers").Strings(",")
+	domainConfig.MaxRequestHeaderSize = cfg.Section("proxy").Key("max_request_header_size").MustInt(0)
+	domainConfig.MaxResponseSize = cfg.Section("proxy").Key("max_response_size").MustInt64(0)
+	var err error
+	if domainConfig.TrustedProxies, err = parseIPList(cfg.Section("proxy").Key("trusted_proxies").Strings(",")); err != nil {
+		return domainConfig, fmt.Errorf("trusted_proxies: %w", err)
+	}
+	if domainConfig.RateLimitExemptPaths, err = parseRateLimitExemptions(cfg.Section("proxy").Key("rate_limit_exempt_paths").Strings(",")); err != nil {
+		return domainConfig, fmt.Errorf("rate_limit_exempt_paths: %w", err)
+	}
+	domainConfig.ForwardedForSkipPrivate = cfg.Section("proxy").Key("forwarded_for_skip_private").MustBool(false)
+	domainConfig.RewriteLocation = cfg.Section("proxy").Key("rewrite_location").MustBool(false)
+	domainConfig.NormalizeResponseHeaders = cfg.Section("proxy").Key("normalize_response_headers").MustBool(false)
+	domainConfig.Via = defaultViaPseudonym
+	if cfg.Section("proxy").HasKey("via_header") {
+		domainConfig.Via = cfg.Section("proxy").Key("via_header").String()
+	}
+	if domainConfig.OverrideServer = cfg.Section("proxy").HasKey("server_header"); domainConfig.OverrideServer {
+		domainConfig.ServerHeader = cfg.Section("proxy").Key("server_header").String()
+	}
+	if domainConfig.CookieDomains, err = parseCookieDomains(cfg.Section("proxy").Key("cookie_domains").Strings(",")); err != nil {
+		return domainConfig, err
+	}
+	domainConfig.DecompressRequests = cfg.Section("proxy").Key("decompress_requests").MustBool(false)
+	domainConfig.TrailingSlash = cfg.Section("proxy").Key("trailing_slash").MustString(trailingSlashPreserve)
+	if err := validTrailingSlashMode(domainConfig.TrailingSlash); err != nil {
+		return domainConfig, err
+	}
+	domainConfig.TrailingSlashRedirect = cfg.Section("proxy").Key("trailing_slash_redirect").MustBool(false)
+
+	// The secret itself is read from the environment so it stays out of config files
+	domainConfig.OriginHeader = cfg.Section("origin_protection").Key("header_name").String()
+	if domainConfig.OriginHeader != "" {
+		secretEnv := cfg.Section("origin_protection").Key("secret_env").String()
+		domainConfig.OriginSecret = os.Getenv(secretEnv)
+		if domainConfig.OriginSecret == "" {
+			return domainConfig, fmt.Errorf("origin_protection: environment variable %q from secret_env is empty", secretEnv)
+		}
+	}
+	domainConfig.AccessLog = cfg.Section("logging").Key("enabled").MustBool(true)
+	domainConfig.WebSocketOrigins = cfg.Section("websocket").Key("allowed_origins").Strings(",")
+	domainConfig.WebSocketForwardSubprotocol = cfg.Section("websocket").Key("forward_subprotocol").MustBool(true)
+
+	if domainConfig.RobotsTxt, err = loadStaticFile(cfg.Section("static").Key("robots_txt").String()); err != nil {
+		return domainConfig, fmt.Errorf("robots_txt: %w", err)
+	}
+	if domainConfig.Favicon, err = loadStaticFile(cfg.Section("static").Key("favicon").String()); err != nil {
+		return domainConfig, fmt.Errorf("favicon: %w", err)
+	}
+	if domainConfig.ErrorPages, err = loadErrorPages(cfg.Section("error_pages")); err != nil {
+		return domainConfig, err
+	}
+
+	domainConfig.MaxConcurrentRequests = cfg.Section("proxy").Key("max_concurrent_requests").MustInt(0)
+	domainConfig.MaxConnsPerBackend = cfg.Section("proxy").Key("max_conns_per_backend").MustInt(0)
+	domainConfig.BackendRPS = cfg.Section("proxy").Key("backend_rps").MustFloat64(0)
+	domainConfig.BackendBurst = cfg.Section("proxy").Key("backend_burst").MustInt(1)
+	domainConfig.BackendQueueTimeout = time.Duration(cfg.Section("proxy").Key("backend_queue_timeout").MustFloat64(0) * float64(time.Second))
+	domainConfig.Balance = cfg.Section("proxy").Key("balance").MustString(balanceRoundRobin)
+	if err := validBalance(domainConfig.Balance); err != nil {
+		return domainConfig, err
+	}
+	domainConfig.HealthCheckInterval = time.Duration(cfg.Section("proxy").Key("health_check_interval").MustFloat64(0) * float64(time.Second))
+	domainConfig.HealthCheckTimeout = time.Duration(cfg.Section("proxy").Key("health_check_timeout").MustFloat64(2) * float64(time.Second))
+	domainConfig.HealthyThreshold = cfg.Section("proxy").Key("healthy_threshold").MustInt(2)
+	domainConfig.UnhealthyThreshold = cfg.Section("proxy").Key("unhealthy_threshold").MustInt(3)
+	if domainConfig.HealthyThreshold < 1 || domainConfig.UnhealthyThreshold < 1 {
+		return domainConfig, fmt.Errorf("healthy_threshold and unhealthy_threshold must be at least 1")
+	}
+	domainConfig.LatencyWeighting = cfg.Section("proxy").Key("latency_weighting").MustBool(false)
+	domainConfig.Cache.Enabled = cfg.Section("cache").Key("enabled").MustBool(false)
+	domainConfig.Cache.TTL = time.Duration(cfg.Section("cache").Key("ttl").MustInt(60)) * time.Second
+	domainConfig.Cache.MaxEntrySize = cfg.Section("cache").Key("max_entry_size").MustInt64(1048576)
+	domainConfig.Cache.ServeStaleOnError = cfg.Section("cache").Key("serve_stale_on_error").MustBool(false)
+	domainConfig.Cache.StaleMaxAge = time.Duration(cfg.Section("cache").Key("stale_max_age").MustInt(3600)) * time.Second
+	domainConfig.StreamIdleTimeout = time.Duration(cfg.Section("proxy").Key("stream_idle_timeout").MustFloat64(0) * float64(time.Second))
+	domainConfig.MaxRequestTimeout = time.Duration(cfg.Section("proxy").Key("max_request_timeout").MustFloat64(0) * float64(time.Second))
+	domainConfig.Retries = cfg.Section("proxy").Key("retries").MustInt(0)
+	domainConfig.RetryBackoff = time.Duration(cfg.Section("proxy").Key("retry_backoff").MustFloat64(0.1) * float64(time.Second))
+	domainConfig.RetryJitter = time.Duration(cfg.Section("proxy").Key("retry_jitter").MustFloat64(0.1) * float64(time.Second))
+	if domainConfig.Retries < 0 || domainConfig.RetryBackoff < 0 || domainConfig.RetryJitter < 0 {
+		return domainConfig, fmt.Errorf("retries, retry_backoff and retry_jitter must not be negative")
+	}
+	if domainConfig.Mirror, err = loadMirrorConfig(cfg); err != nil {
+		return domainConfig, err
+	}
+
+	backends, err := loadBackends(cfg)
+	if err != nil {
+		return domainConfig, err
+	}
+	if len(backends) == 0 {
+		return domainConfig, fmt.Errorf("no backends configured")
+	}
+	domainConfig.Backends = backends
+
+	routes, err := loadRoutes(cfg)
+	if err != nil {
+		return domainConfig, err
+	}
+	domainConfig.Routes = routes
+
+	if domainConfig.Tenants, err = loadTenants(cfg); err != nil {
+		return domainConfig, err
+	}
+
+	acl, err := loadACL(cfg)
+	if err != nil {
+		return domainConfig, err
+	}
+	domainConfig.ACL = acl
+
+	rewrites, err := loadResponseRewrites(cfg)
+	if err != nil {
+		return domainConfig, err
+	}
+	domainConfig.ResponseRewrites = rewrites
+	return domainConfig, nil
+}
+
+func newDomainProxy(name string, domainConfig DomainConfig, proxy *httputil.ReverseProxy, groups []*backendGroup, mirror *requestMirror) *domainProxy {
+	dp := &domainProxy{name: name, config: domainConfig, proxy: proxy, groups: groups, mirror: mirror}
+	if domainConfig.MaxConcurrentRequests > 0 {
+		dp.slots = make(chan struct{}, domainConfig.MaxConcurrentRequests)
+	}
+	if domainConfig.BackendRPS > 0 {
+		dp.backendLimiter = rate.NewLimiter(rate.Limit(domainConfig.BackendRPS), domainConfig.BackendBurst)
+	}
+	if domainConfig.HealthCheckInterval > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		dp.stopHealthChecks = cancel
+		go dp.runHealthChecks(ctx)
+	}
+	return dp
+}
+
+// Stop the background work of a domain that is being replaced
+func (dp *domainProxy) close() {
+	if dp.stopHealthChecks != nil {
+		dp.stopHealthChecks()
+	}
+}
+
+// Take one of the domain's concurrency slots without waiting. The returned
+// function releases it.
+func (dp *domainProxy) acquireSlot() (func(), bool) {
+	if dp.slots == nil {
+		return func() {}, true
+	}
+	select {
+	case dp.slots <- struct{}{}:
+		return func() { <-dp.slots }, true
+	default:
+		return nil, false
+	}
+}
+
+// Check the CDN shared secret header, comparing in constant time
+func (dp *domainProxy) originAllowed(r *http.Request) bool {
+	if dp.config.OriginHeader == "" {
+		return true
+	}
+	secret := r.Header.Get(dp.config.OriginHeader)
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(dp.config.OriginSecret)) == 1
+}
+
+func (dp *domainProxy) methodAllowed(method string) bool {
+	if len(dp.config.AllowedMethods) == 0 {
+		return true
+	}
+	for _, allowed := range dp.config.AllowedMethods {
+		if allowed == method {
+			return true
+		}
+	}
+	return false
+}
+
+// Methods advertised in the Allow header of OPTIONS answers when
+// allowed_methods is unset
+var defaultOptionsAllow = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions}
+
+// Whether the proxy answers an OPTIONS request itself. CORS preflights are
+// left to the backend, which knows the origins and headers it accepts.
+func (dp *domainProxy) answersOptions(r *http.Request) bool {
+	return dp.config.HandleOptions && r.Method == http.MethodOptions && !isCORSPreflight(r)
+}
+
+func isCORSPreflight(r *http.Request) bool {
+	return r.Header.Get("Origin") != "" && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// Answer an OPTIONS request with 204 and the methods the domain accepts,
+// OPTIONS included since the proxy answers it
+func (dp *domainProxy) serveOptions(w http.ResponseWriter) {
+	allow := defaultOptionsAllow
+	if len(dp.config.AllowedMethods) > 0 {
+		allow = dp.config.AllowedMethods
+		if !slices.Contains(allow, http.MethodOptions) {
+			allow = append(slices.Clip(allow), http.MethodOptions)
+		}
+	}
+	w.Header().Set("Allow", strings.Join(allow, ", "))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Wait for the backend limiter, queueing for at most backend_queue_timeout
+// and never beyond the request's own deadline. Returns false if the request
+// should be rejected.
+func (dp *domainProxy) acquireBackend(r *http.Request) bool {
+	if dp.backendLimiter == nil {
+		return true
+	}
+	if dp.config.BackendQueueTimeout <= 0 {
+		return dp.backendLimiter.Allow()
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), dp.config.BackendQueueTimeout)
+	defer cancel()
+	return dp.backendLimiter.Wait(ctx) == nil
+}
+
+func newReverseProxy(domainConfig DomainConfig) (*httputil.ReverseProxy, []*backendGroup, error) {
+	var groups []*backendGroup
+	routes := make([]route, 0, len(domainConfig.Routes))
+	for _, routeConfig := range domainConfig.Routes {
+		if routeConfig.BackendURL == "" {
+			routes = append(routes, route{RouteConfig: routeConfig})
+			continue
+		}
+		group, err := newBackendGroup(parseBackendList(routeConfig.BackendURL), domainConfig)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", routeConfig.Name, err)
+		}
+		routes = append(routes, route{RouteConfig: routeConfig, group: group})
+		groups = append(groups, group)
+	}
+
+	tenantGroups := make(map[string]*backendGroup)
+	if domainConfig.Tenants != nil {
+		for _, name := range domainConfig.Tenants.names() {
+			group, err := newBackendGroup(parseBackendList(domainConfig.Tenants.Backends[name]), domainConfig)
+			if err != nil {
+				return nil, nil, fmt.Errorf("tenant %s: %w", name, err)
+			}
+			tenantGroups[name] = group
+			groups = append(groups, group)
+		}
+	}
+
+	group, err := newBackendGroup(domainConfig.Backends, domainConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	groups = append(groups, group)
+
 	return &httputil.ReverseProxy{
+		BufferPool: copyBuffers,
 		Director: func(req *http.Request) {
-			req.URL.Scheme = url.Scheme
-			req.URL.Host = url.Host
+			rt := selectRoute(routes, req)
+			defaultGroup := group
+			if tenant, ok := domainConfig.Tenants.tenant(req); ok {
+				defaultGroup = tenantGroups[tenant]
+			}
+			g := selectGroup(rt, defaultGroup)
+			b := g.pick(req)
+			if b == nil {
+				return
+			}
+			if rt != nil && rt.StripCookies {
+				req.Header.Del("Cookie")
+			}
+			// Negotiate before sanitizing, which may drop Accept-Encoding
+			ctx := req.Context()
+			if currentConfig().Compression.Enabled {
+				ctx = context.WithValue(ctx, compressionKey{}, selectEncoding(req.Header.Values("Accept-Encoding"), currentConfig().Compression.Algorithms))
+			}
+			sanitizeRequestHeaders(req.Header, domainConfig.ForwardHeaders, domainConfig.StripHeaders, domainConfig.MaxRequestHeaderSize)
+			req.URL.Scheme = b.target.Scheme
+			req.URL.Host = b.target.Host
+			applyTrailingSlash(req.URL, domainConfig.TrailingSlash)
+			if !domainConfig.WebSocketForwardSubprotocol {
+				req.Header.Del("Sec-WebSocket-Protocol")
+			}
+			if domainConfig.Via != "" {
+				addVia(req.Header, req.ProtoMajor, req.ProtoMinor, domainConfig.Via)
+			}
+			ctx = context.WithValue(ctx, backendGroupKey{}, g)
+			*req = *req.WithContext(context.WithValue(ctx, backendKey{}, b))
+			setUpstreamAddr(req, b.target.Host)
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			if domainConfig.MaxResponseSize > 0 {
+				if err := limitResponseSize(resp, domainConfig.MaxResponseSize); err != nil {
+					return err
+				}
+			}
+			if domainConfig.NormalizeResponseHeaders {
+				normalizeResponseHeaders(resp.Header)
+			}
+			if domainConfig.Via != "" {
+				addVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor, domainConfig.Via)
+			}
+			if domainConfig.OverrideServer {
+				setServerHeader(resp.Header, domainConfig.ServerHeader)
+			}
+			addSecurityHeaders(resp)
+			if domainConfig.RewriteLocation {
+				rewriteLocation(resp)
+			}
+			if len(domainConfig.CookieDomains) > 0 {
+				rewriteCookieDomains(resp, domainConfig.CookieDomains)
+			}
+			if domainConfig.StreamIdleTimeout > 0 {
+				watchStreamIdle(resp)
+			}
+			if len(domainConfig.ResponseRewrites) > 0 {
+				if err := rewriteResponseBody(resp, domainConfig.ResponseRewrites); err != nil {
+					return err
+				}
+			}
+			compressResponse(resp)
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			recordBackendError(r, err)
+			if domainConfig.Cache.ServeStaleOnError && serveStaleOnError(w, r) {
+				logger.Warn("Backend request failed, served stale response", "host", r.Host, "path", r.URL.Path, "error", err)
+				return
+			}
+			proxyErrorHandler(w, r, err)
 		},
+		Transport: backendTransport{
+			retries:      domainConfig.Retries,
+			retryBackoff: domainConfig.RetryBackoff,
+			retryJitter:  domainConfig.RetryJitter,
+		},
+	}, groups, nil
+}
+
+// Return the shared transport for the given settings, creating it on first use
+func getTransport(key transportKey) (*http.Transport, error) {
+	transportLock.Lock()
+	defer transportLock.Unlock()
+
+	if transport, exists := transports[key]; exists {
+		return transport, nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = 0
+	transport.MaxIdleConnsPerHost = key.maxIdleConnsPerHost
+	transport.MaxConnsPerHost = key.maxConnsPerHost
+	transport.DisableKeepAlives = key.disableKeepAlives
+	transport.ResponseHeaderTimeout = key.responseHeaderTimeout
+
+	// Resolve backend hostnames at most once per dns_cache_ttl
+	if key.dnsCacheTTL > 0 {
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		resolver := newDNSCache(key.dnsCacheTTL, net.DefaultResolver, dialer)
+		resolver.onChange = transport.CloseIdleConnections
+		transport.DialContext = resolver.dialContext
+	}
+
+	// Reach backends through an egress proxy; credentials in the URL are
+	// sent as proxy authentication
+	if key.upstreamProxy != "" {
+		proxyURL, err := parseUpstreamProxy(key.upstreamProxy)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	// Present a client certificate to backends that require mutual TLS
+	if key.clientCertFile != "" || key.clientKeyFile != "" {
+		clientCert, err := loadClientCert(key.clientCertFile, key.clientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = &tls.Config{
+			GetClientCertificate: clientCert.get,
+		}
+	}
+
+	// Override the server name taken from the backend URL
+	if key.serverName != "" {
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.ServerName = key.serverName
+	}
+
+	// Resume TLS sessions with backends instead of a full handshake per
+	// new connection
+	if key.sessionCacheSize > 0 {
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(key.sessionCacheSize)
 	}
+
+	// Only offer HTTP/1.1 in the TLS handshake, and drop the HTTP/2
+	// upgrade so a backend that negotiates it anyway is not used over it
+	if key.disableHTTP2 {
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.NextProtos = []string{"http/1.1"}
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+
+	transports[key] = transport
+	return transport, nil
 }
 
-// Watch for changes in domain config directory
-func watchDomains(directory string) {
+// Drop the shared transports none of the loaded domains use any more, such
+// as those of backends removed by a reload, closing their idle connections
+func pruneTransports(domains map[string]*domainProxy) {
+	used := make(map[http.RoundTripper]bool)
+	for _, dp := range domains {
+		for _, group := range dp.groups {
+			for _, b := range group.backends {
+				used[b.transport] = true
+			}
+		}
+		if dp.mirror != nil {
+			used[dp.mirror.transport] = true
+		}
+	}
+
+	transportLock.Lock()
+	defer transportLock.Unlock()
+	for key, transport := range transports {
+		if !used[transport] {
+			delete(transports, key)
+			transport.CloseIdleConnections()
+		}
+	}
+}
+
+// Watch for changes in domain config directory until ctx is cancelled.
+// Only one watcher runs per directory: starting another one stops the
+// previous watcher, and the fsnotify watcher is closed when its goroutine exits.
+func watchDomains(ctx context.Context, directory string) error {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+
+	// A directory that doesn't exist yet is watched for from its parent
+	// and loaded once created
+	directory = filepath.Clean(directory)
+	waiting := false
+	if _, err := os.Stat(directory); os.IsNotExist(err) {
+		waiting = true
+		err = watcher.Add(filepath.Dir(directory))
+	} else {
+		err = watcher.Add(directory)
+	}
+	if err != nil {
+		watcher.Close()
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	domainWatchersLock.Lock()
+	if stop, exists := domainWatchers[directory]; exists {
+		stop()
 	}
-	defer watcher.Close()
+	domainWatchers[directory] = cancel
+	domainWatchersLock.Unlock()
 
 	go func() {
+		defer watcher.Close()
 		for {
 			select {
+			case <-ctx.Done():
+				return
+
 			case event, ok := <-watcher.Events:
 				if !ok {
 					return
 				}
 
+				if waiting {
+					if filepath.Clean(event.Name) != directory || event.Op&fsnotify.Create == 0 {
+						continue
+					}
+					if err := watcher.Add(directory); err != nil {
+						logger.Error("Error watching domain directory", "directory", directory, "error", err)
+						continue
+					}
+					waiting = false
+					logger.Info("Domain directory created, loading domains", "directory", directory)
+					loadDomains(directory)
+					continue
+				}
+				// The parent stays watched if the directory was waited for
+				if filepath.Dir(filepath.Clean(event.Name)) != directory {
+					continue
+				}
+
 				if event.Op&fsnotify.Write == fsnotify.Write || event.Op&fsnotify.Create == fsnotify.Create || event.Op&fsnotify.Remove == fsnotify.Remove {
-					fmt.Println("Domain configuration changed. Reloading...")
+					logger.Info("Domain configuration changed, reloading", "file", event.Name, "op", event.Op.String())
 					loadDomains(directory)
 				}
 
@@ -230,65 +1600,250 @@ func watchDomains(directory string) {
 				if !ok {
 					return
 				}
-				log.Println("Error watching domain directory:", err)
+				logger.Error("Error watching domain directory", "directory", directory, "error", err)
 			}
 		}
 	}()
+	return nil
+}
 
-	err = watcher.Add(directory)
-	if err != nil {
-		log.Fatal(err)
-	}
+// Return the loaded proxy for a request, or nil if its host is not
+// configured. Exact matches win over regex host rules.
+func lookupDomain(r *http.Request) *domainProxy {
+	dp, _ := matchDomain(r)
+	return dp
 }
 
 func proxyHandler(w http.ResponseWriter, r *http.Request) {
-	domain := r.Host
-	mutex.RLock()
-	proxy, exists := proxyMap[domain]
-	mutex.RUnlock()
+	dp := lookupDomain(r)
+
+	if dp != nil {
+		domainRequests.inc(dp.name)
+		// Requests without a Host header reach the backend as if they had
+		// named default_domain
+		if r.Host == "" {
+			r.Host = dp.name
+		}
+		if len(dp.config.TrustedProxies) > 0 {
+			r = withForwardedClientIP(r, dp.config.TrustedProxies, dp.config.ForwardedForSkipPrivate)
+		}
+
+		if dp.config.CanonicalHost != "" && redirectToCanonicalHost(w, r, dp.config.CanonicalHost) {
+			return
+		}
+
+		if !dp.originAllowed(r) {
+			writeBlocked(w, r, http.StatusForbidden, blockOriginSecret)
+			return
+		}
+
+		if !dp.config.ACL.allows(r) {
+			writeBlocked(w, r, http.StatusForbidden, blockACL)
+			return
+		}
+
+		if dp.answersOptions(r) {
+			dp.serveOptions(w)
+			return
+		}
+		// OPTIONS * asks about the server rather than a resource, so it
+		// can't be forwarded; answer it as net/http does by default
+		if r.Method == http.MethodOptions && r.RequestURI == "*" {
+			w.Header().Set("Content-Length", "0")
+			return
+		}
+
+		if !dp.methodAllowed(r.Method) {
+			w.Header().Set("Allow", strings.Join(dp.config.AllowedMethods, ", "))
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
 
-	if exists {
-		workerPool <- func() {
-			proxy.ServeHTTP(w, r)
+		// Refuse cross-origin WebSocket upgrades before the connection is hijacked
+		if isWebSocketUpgrade(r) && !dp.webSocketOriginAllowed(r) {
+			writeBlocked(w, r, http.StatusForbidden, blockWebSocketOrigin)
+			return
+		}
+
+		if dp.config.TrailingSlash == trailingSlashStrip && dp.config.TrailingSlashRedirect && redirectTrailingSlash(w, r) {
+			return
 		}
+
+		if dp.config.DecompressRequests {
+			if status, err := decompressRequestBody(r, currentConfig().RequestLimits.MaxDecompressedSize); err != nil {
+				logger.Debug("Rejected compressed request body", "domain", dp.name, "error", err)
+				http.Error(w, http.StatusText(status), status)
+				return
+			}
+		}
+
+		if dp.mirror != nil {
+			r = dp.mirrorRequest(r)
+		}
+
+		if dp.config.Cache.Enabled && cacheableRequest(r) {
+			dp.serveCached(w, r)
+			return
+		}
+		dp.forward(w, r)
 	} else {
 		http.Error(w, "Domain not found", http.StatusNotFound)
 	}
 }
 
+// Send a request that passed the domain's checks to its backend, subject to
+// the domain's concurrency and backend rate limits
+func (dp *domainProxy) forward(w http.ResponseWriter, r *http.Request) {
+	if dp.config.MaxRequestTimeout > 0 {
+		var cancel context.CancelFunc
+		r, cancel = withRequestTimeout(r, dp.config.MaxRequestTimeout)
+		defer cancel()
+	}
+
+	release, ok := dp.acquireSlot()
+	if !ok {
+		concurrencyRejections.inc(dp.name)
+		writeErrorPage(w, r, http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+	domainRequestsInFlight.add(1, dp.name)
+	defer domainRequestsInFlight.add(-1, dp.name)
+
+	if !dp.acquireBackend(r) {
+		if r.Context().Err() != nil {
+			endedBeforeBackend(w, r, dp.name, "the backend rate limiter")
+			return
+		}
+		backendLimiterRejections.inc(dp.name)
+		writeErrorPage(w, r, http.StatusServiceUnavailable)
+		return
+	}
+
+	if dp.config.StreamIdleTimeout > 0 {
+		var idle *streamIdleTimer
+		w, r, idle = withStreamIdleTimeout(w, r, dp.config.StreamIdleTimeout)
+		defer idle.stop()
+	}
+
+	if startupConfig.Server.UseWorkerPool {
+		// The backend request below is bound to r's context, so it is
+		// cancelled as soon as the client goes away
+		if !runInWorkerPool(r.Context(), currentConfig().Server.QueueTimeout, func() { dp.proxy.ServeHTTP(w, r) }) {
+			if r.Context().Err() != nil {
+				endedBeforeBackend(w, r, dp.name, "a worker")
+				return
+			}
+			workerQueueTimeouts.inc()
+			logger.Debug("Request waited too long for a worker", "domain", dp.name, "queue_timeout", currentConfig().Server.QueueTimeout)
+			writeErrorPage(w, r, http.StatusServiceUnavailable)
+		}
+	} else {
+		dp.proxy.ServeHTTP(w, r)
+	}
+}
+
 func main() {
 	// Load global system config
-	err := loadConfig("system.conf")
+	err := loadConfig(systemConfigFile)
 	if err != nil {
-		log.Fatalf("Failed to load config: %v", err)
+		fatal("Failed to load config", "error", err)
 	}
+	startupConfig = currentConfig()
 
 	// Load domain proxies
-	err = loadDomains("./list_domain")
+	err = loadDomains(domainsDirectory)
 	if err != nil {
-		log.Fatalf("Failed to load domain proxies: %v", err)
+		fatal("Failed to load domain proxies", "error", err)
+	}
+
+	// Verify backends are reachable before accepting traffic
+	if startupConfig.Startup.ProbeBackends {
+		unreachable := probeBackends(time.Duration(startupConfig.Startup.ProbeTimeout) * time.Second)
+		if unreachable > 0 && startupConfig.Startup.FailOnUnreachable {
+			fatal("Backends unreachable at startup", "count", unreachable)
+		}
 	}
 
 	// Watch for changes in domain configurations
-	go watchDomains("./list_domain")
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	defer stopWatching()
+	if err := watchDomains(watchCtx, domainsDirectory); err != nil {
+		fatal("Failed to watch domain directory", "directory", domainsDirectory, "error", err)
+	}
+	if startupConfig.Domains.Registry != "" {
+		if err := watchRegistry(watchCtx, startupConfig.Domains.Registry); err != nil {
+			fatal("Failed to watch domain registry", "file", startupConfig.Domains.Registry, "error", err)
+		}
+	}
+
+	// Drop rate limiters for clients that have gone quiet
+	go evictRateLimiters(time.Duration(startupConfig.RateLimiting.LimiterTTL) * time.Second)
+
+	// Serve metrics and other operational endpoints
+	startAdminServer()
 
 	// Initialize worker pool
-	initWorkerPool(100)
+	if startupConfig.Server.UseWorkerPool {
+		initWorkerPool(startupConfig.Server.Workers)
+		go monitorWorkerQueue(startupConfig.Server.WorkerQueueHighWater, time.Duration(startupConfig.Server.WorkerQueueAlertAfter)*time.Second)
+	}
 
 	// Setup server with timeouts and optional TLS
 	server := &http.Server{
-		Addr:         ":8080",
-		ReadTimeout:  time.Duration(config.Timeouts.ReadTimeout) * time.Second,
-		WriteTimeout: time.Duration(config.Timeouts.WriteTimeout) * time.Second,
-		IdleTimeout:  time.Duration(config.Timeouts.IdleTimeout) * time.Second,
-		Handler:      rateLimitMiddleware(ipFilterMiddleware(limitRequestSizeMiddleware(http.HandlerFunc(proxyHandler)))),
+		Addr:           startupConfig.Server.Listen[0],
+		ReadTimeout:    time.Duration(startupConfig.Timeouts.ReadTimeout) * time.Second,
+		WriteTimeout:   time.Duration(startupConfig.Timeouts.WriteTimeout) * time.Second,
+		IdleTimeout:    time.Duration(startupConfig.Timeouts.IdleTimeout) * time.Second,
+		MaxHeaderBytes: startupConfig.Server.MaxHeaderBytes,
+		ErrorLog:       newServerErrorLog(),
+		ConnState:      observeTLSHandshake,
+		Handler:        buildHandler(),
+		// Let domains answer OPTIONS * themselves with handle_options
+		DisableGeneralOptionsHandler: true,
 	}
 
-	if config.SSL.Enabled {
-		fmt.Println("Starting HTTPS server...")
-		log.Fatal(server.ListenAndServeTLS(config.SSL.CertFile, config.SSL.KeyFile))
+	listeners, err := getListeners("http", "tcp", startupConfig.Server.Listen...)
+	if err != nil {
+		fatal("Failed to listen", "addr", strings.Join(startupConfig.Server.Listen, ","), "error", err)
+	}
+
+	// Drop blacklisted clients, then count open connections and cap them
+	// before any handler runs
+	for i := range listeners {
+		listeners[i] = countingListener{blacklistListener{tcpOptionsListener{listeners[i]}}}
+		if startupConfig.Server.MaxConnections > 0 {
+			listeners[i] = netutil.LimitListener(listeners[i], startupConfig.Server.MaxConnections)
+		}
+	}
+
+	if startupConfig.SSL.Enabled {
+		if server.TLSConfig, err = newServerTLSConfig(context.Background()); err != nil {
+			fatal("Failed to set up TLS", "error", err)
+		}
+	}
+
+	serve := func(listener net.Listener) error {
+		if startupConfig.SSL.Enabled {
+			return server.Serve(tls.NewListener(listener, server.TLSConfig))
+		}
+		return server.Serve(listener)
+	}
+
+	if startupConfig.SSL.Enabled {
+		logger.Info("Starting HTTPS server", "addr", strings.Join(startupConfig.Server.Listen, ","))
 	} else {
-		fmt.Println("Starting HTTP server...")
-		log.Fatal(server.ListenAndServe())
+		logger.Info("Starting HTTP server", "addr", strings.Join(startupConfig.Server.Listen, ","))
 	}
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			if err := serve(listener); err != http.ErrServerClosed {
+				fatal("Server failed", "error", err)
+			}
+		}(listener)
+	}
+	ready.Store(true)
+	notifyParentReady()
+
+	waitForShutdown(server)
 }
@@ -0,0 +1,1069 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+func TestMain(m *testing.M) {
+	// Access logs go to stdout; tests that check them use captureAccessLog
+	accessLogger.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// Send the access log to a buffer for the rest of the test
+func captureAccessLog(t testing.TB) *bytes.Buffer {
+	t.Helper()
+	var logs bytes.Buffer
+	accessLogger.SetOutput(&logs)
+	t.Cleanup(func() {
+		accessLogger.SetOutput(io.Discard)
+	})
+	return &logs
+}
+
+// Settings every test config starts from: httptest requests come from
+// 192.0.2.1, which the whitelist has to let through, and tests send more
+// requests than the default rate limit allows
+const testConfigBase = "[whitelist]\nips = 192.0.2.0/24,127.0.0.1,::1\n" +
+	"[rate_limiting]\nrequests_per_second = 1000\nburst_limit = 1000\n" +
+	"[logging]\nlog_level = warn\n"
+
+// Install a system.conf with the given contents, on top of
+// testConfigBase, for the duration of the test, as if the proxy had
+// started with it
+func loadTestConfig(t testing.TB, contents string) {
+	t.Helper()
+	previous := live.Load()
+	previousStartup := startupConfig
+
+	path := filepath.Join(t.TempDir(), "system.conf")
+	if err := os.WriteFile(path, []byte(testConfigBase+contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(path); err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	startupConfig = currentConfig()
+
+	t.Cleanup(func() {
+		if stop := currentState().stopIPLists; stop != nil {
+			stop()
+		}
+		live.Store(previous)
+		startupConfig = previousStartup
+		if previous.logger != nil {
+			setLogger(previous.logger)
+		}
+	})
+}
+
+// Load the given domains, keyed by name, from a fresh domain directory.
+// They are unloaded again when the test ends.
+func loadTestDomains(t testing.TB, domains map[string]string) {
+	t.Helper()
+	directory := t.TempDir()
+	for name, contents := range domains {
+		if err := os.WriteFile(filepath.Join(directory, name+".conf"), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := loadDomains(directory); err != nil {
+		t.Fatalf("loadDomains: %v", err)
+	}
+	t.Cleanup(func() {
+		loadDomains(filepath.Join(directory, "none"))
+	})
+}
+
+// Send the operational log to a buffer for the rest of the test. Call it
+// after loadTestConfig, which installs the config's own logger.
+func captureLogs(t testing.TB) *bytes.Buffer {
+	t.Helper()
+	var logs bytes.Buffer
+	setLogger(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() {
+		setLogger(currentState().logger)
+	})
+	return &logs
+}
+
+// Send r through the full middleware chain and return the response
+func serveTest(r *http.Request) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	buildHandler().ServeHTTP(recorder, r)
+	return recorder
+}
+
+// Current value of one of c's counters
+func counterValue(c *counterVec, labelValues ...string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if value, exists := c.values[strings.Join(labelValues, "\xff")]; exists {
+		return atomic.LoadUint64(value)
+	}
+	return 0
+}
+
+func gaugeValue(g *gaugeVec, labelValues ...string) int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if value, exists := g.values[strings.Join(labelValues, "\xff")]; exists {
+		return atomic.LoadInt64(value)
+	}
+	return 0
+}
+
+// Start a backend answering "ok" that counts the connections made to it
+func newCountingBackend(t testing.TB) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+	var dials atomic.Int64
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	backend.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			dials.Add(1)
+		}
+	}
+	backend.Start()
+	t.Cleanup(backend.Close)
+	return backend, &dials
+}
+
+func TestBackendKeepAlive(t *testing.T) {
+	tests := []struct {
+		name      string
+		backend   string
+		wantDials int64
+	}{
+		{"keep-alive", "", 1},
+		{"keep-alive disabled", "disable_keep_alives = true\n", 5},
+		{"no idle connections kept", "max_idle_conns_per_host = -1\n", 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend, dials := newCountingBackend(t)
+			loadTestConfig(t, "[backend]\n"+tt.backend)
+			loadTestDomains(t, map[string]string{"example.com": "[proxy]\nbackend_url = " + backend.URL + "\n"})
+
+			for i := 0; i < 5; i++ {
+				if got := serveTest(httptest.NewRequest(http.MethodGet, "http://example.com/", nil)); got.Code != http.StatusOK {
+					t.Fatalf("request %d: status %d", i, got.Code)
+				}
+			}
+			if got := dials.Load(); got != tt.wantDials {
+				t.Errorf("%d connections to the backend, want %d", got, tt.wantDials)
+			}
+		})
+	}
+}
+
+// Domains with the same connection settings share a transport, and so
+// its idle connections
+func TestTransportsShared(t *testing.T) {
+	loadTestConfig(t, "")
+	a, err := getTransport(DomainConfig{}.transportKey(BackendConfig{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := getTransport(DomainConfig{}.transportKey(BackendConfig{}))
+	c, _ := getTransport(DomainConfig{BackendSNI: "internal"}.transportKey(BackendConfig{}))
+	if a != b {
+		t.Error("equal settings got different transports")
+	}
+	if a == c {
+		t.Error("different settings share a transport")
+	}
+}
+
+// A reload drops the transports only removed domains used, closing their
+// idle backend connections, and keeps those still in use
+func TestPruneTransports(t *testing.T) {
+	closed := make(chan struct{}, 10)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	backend.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- struct{}{}
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+	loadTestConfig(t, "")
+	kept := "[proxy]\nbackend_url = " + backend.URL + "\nbackend_sni = kept.internal\n"
+	removed := "[proxy]\nbackend_url = " + backend.URL + "\nbackend_sni = removed.internal\n"
+	loadTestDomains(t, map[string]string{"kept.example.com": kept, "removed.example.com": removed})
+
+	keptTransport, _ := getTransport(DomainConfig{BackendSNI: "kept.internal"}.transportKey(BackendConfig{}))
+	// Leave an idle connection in the transport about to be dropped
+	serveTest(httptest.NewRequest(http.MethodGet, "http://removed.example.com/", nil))
+
+	loadTestDomains(t, map[string]string{"kept.example.com": kept})
+	transportLock.Lock()
+	count := len(transports)
+	transportLock.Unlock()
+	if count != 1 {
+		t.Errorf("%d transports after the reload, want 1", count)
+	}
+	if got, _ := getTransport(DomainConfig{BackendSNI: "kept.internal"}.transportKey(BackendConfig{})); got != keptTransport {
+		t.Error("transport still in use was replaced")
+	}
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Error("idle connection of the dropped transport was not closed")
+	}
+}
+
+// Connections made to the backend per request, with and without
+// keep-alive
+func BenchmarkBackendKeepAlive(b *testing.B) {
+	for _, bb := range []struct {
+		name    string
+		backend string
+	}{
+		{"keep-alive", ""},
+		{"disabled", "disable_keep_alives = true\n"},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			backend, dials := newCountingBackend(b)
+			loadTestConfig(b, "[backend]\n"+bb.backend)
+			loadTestDomains(b, map[string]string{"example.com": "[proxy]\nbackend_url = " + backend.URL + "\n"})
+			handler := buildHandler()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+			}
+			b.ReportMetric(float64(dials.Load())/float64(b.N), "dials/op")
+		})
+	}
+}
+
+// Start a backend that answers every request with its name
+func newNamedBackend(t testing.TB, name string) *httptest.Server {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(name))
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+func TestAllowedMethods(t *testing.T) {
+	backend := newNamedBackend(t, "backend")
+	tests := []struct {
+		name      string
+		allowed   string
+		method    string
+		want      int
+		wantAllow string
+	}{
+		{"no list", "", http.MethodDelete, http.StatusOK, ""},
+		{"listed", "get, post", http.MethodPost, http.StatusOK, ""},
+		{"not listed", "get, post", http.MethodDelete, http.StatusMethodNotAllowed, "GET, POST"},
+		{"case of the config ignored", "Get", http.MethodGet, http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, "")
+			loadTestDomains(t, map[string]string{"example.com": "[proxy]\nbackend_url = " + backend.URL + "\nallowed_methods = " + tt.allowed + "\n"})
+			got := serveTest(httptest.NewRequest(tt.method, "http://example.com/", nil))
+			if got.Code != tt.want || got.Header().Get("Allow") != tt.wantAllow {
+				t.Errorf("got %d with Allow %q, want %d with Allow %q", got.Code, got.Header().Get("Allow"), tt.want, tt.wantAllow)
+			}
+		})
+	}
+}
+
+// With handle_options the proxy answers OPTIONS itself with the allowed
+// methods, leaving CORS preflights and other methods to the backend
+func TestHandleOptions(t *testing.T) {
+	backend := newNamedBackend(t, "backend")
+	tests := []struct {
+		name       string
+		config     string
+		target     string
+		method     string
+		preflight  bool
+		wantStatus int
+		wantAllow  string
+		wantBody   string
+	}{
+		{"off", "", "/", http.MethodOptions, false, http.StatusOK, "", "backend"},
+		{"path", "handle_options = true\n", "/items", http.MethodOptions, false, http.StatusNoContent, "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS", ""},
+		{"server", "handle_options = true\n", "*", http.MethodOptions, false, http.StatusNoContent, "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS", ""},
+		{"server without handle_options", "", "*", http.MethodOptions, false, http.StatusOK, "", ""},
+		{"allowed methods", "handle_options = true\nallowed_methods = get, post\n", "/", http.MethodOptions, false, http.StatusNoContent, "GET, POST, OPTIONS", ""},
+		{"options already allowed", "handle_options = true\nallowed_methods = options, get\n", "/", http.MethodOptions, false, http.StatusNoContent, "OPTIONS, GET", ""},
+		{"cors preflight forwarded", "handle_options = true\n", "/", http.MethodOptions, true, http.StatusOK, "", "backend"},
+		{"other methods forwarded", "handle_options = true\n", "/", http.MethodGet, false, http.StatusOK, "", "backend"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, "")
+			loadTestDomains(t, map[string]string{"example.com": "[proxy]\nbackend_url = " + backend.URL + "\n" + tt.config})
+			r := httptest.NewRequest(tt.method, tt.target, nil)
+			r.Host = "example.com"
+			if tt.preflight {
+				r.Header.Set("Origin", "https://app.example.com")
+				r.Header.Set("Access-Control-Request-Method", http.MethodPut)
+			}
+			got := serveTest(r)
+			if got.Code != tt.wantStatus || got.Header().Get("Allow") != tt.wantAllow || got.Body.String() != tt.wantBody {
+				t.Errorf("got %d with Allow %q and body %q, want %d with Allow %q and body %q",
+					got.Code, got.Header().Get("Allow"), got.Body, tt.wantStatus, tt.wantAllow, tt.wantBody)
+			}
+		})
+	}
+}
+
+// Watching the same directory again, as every reload does, replaces the
+// watcher instead of leaking one, and stopping it ends its goroutines
+func TestWatchDomainsReplacesWatcher(t *testing.T) {
+	loadTestConfig(t, "")
+	directory := t.TempDir()
+	// Wait for goroutines on their way out, up to a limit
+	settled := func(want int) int {
+		deadline := time.Now().Add(2 * time.Second)
+		for runtime.NumGoroutine() > want && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return runtime.NumGoroutine()
+	}
+
+	before := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := watchDomains(ctx, directory); err != nil {
+		t.Fatal(err)
+	}
+	watching := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		if err := watchDomains(ctx, directory); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := settled(watching); got > watching {
+		t.Errorf("%d goroutines after 20 more watches, want %d", got, watching)
+	}
+	cancel()
+	if got := settled(before); got > before {
+		t.Errorf("%d goroutines after stopping the watcher, want %d", got, before)
+	}
+}
+
+// A watched directory is reloaded when a domain file is added
+func TestWatchDomainsReloads(t *testing.T) {
+	loadTestConfig(t, "")
+	directory := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := watchDomains(ctx, directory); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { loadDomains(filepath.Join(directory, "none")) })
+
+	backend := newNamedBackend(t, "backend")
+	if err := os.WriteFile(filepath.Join(directory, "example.com.conf"), []byte("[proxy]\nbackend_url = "+backend.URL+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for serveTest(httptest.NewRequest(http.MethodGet, "http://example.com/", nil)).Code != http.StatusOK {
+		if time.Now().After(deadline) {
+			t.Fatal("new domain file was not loaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// A missing domain directory is a warning, not an error: the proxy starts
+// with no domains from it, or creates it when create_directory is set, and
+// registry domains are still served
+func TestLoadDomainsMissingDirectory(t *testing.T) {
+	backend := newNamedBackend(t, "registry")
+	tests := []struct {
+		create bool
+	}{
+		{false},
+		{true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("create_directory=%v", tt.create), func(t *testing.T) {
+			registry := filepath.Join(t.TempDir(), "registry.json")
+			if err := os.WriteFile(registry, []byte(`{"registry.example.com": "`+backend.URL+`"}`), 0644); err != nil {
+				t.Fatal(err)
+			}
+			loadTestConfig(t, fmt.Sprintf("[domains]\nregistry = %s\ncreate_directory = %v\n", registry, tt.create))
+			logs := captureLogs(t)
+			directory := filepath.Join(t.TempDir(), "list_domain")
+			if err := loadDomains(directory); err != nil {
+				t.Fatalf("loadDomains with no directory: %v", err)
+			}
+			t.Cleanup(func() { loadDomains(filepath.Join(directory, "none")) })
+
+			_, err := os.Stat(directory)
+			if created := err == nil; created != tt.create {
+				t.Errorf("directory created %v, want %v", created, tt.create)
+			}
+			if warned := strings.Contains(logs.String(), "Domain directory does not exist"); warned == tt.create {
+				t.Errorf("missing directory warned %v, want %v", warned, !tt.create)
+			}
+			if got := serveTest(httptest.NewRequest(http.MethodGet, "http://registry.example.com/", nil)); got.Body.String() != "registry" {
+				t.Errorf("registry domain got %q (status %d), want it served", got.Body, got.Code)
+			}
+			if got := serveTest(httptest.NewRequest(http.MethodGet, "http://example.com/", nil)); got.Code != http.StatusNotFound {
+				t.Errorf("status %d for an unknown host, want 404", got.Code)
+			}
+		})
+	}
+}
+
+// A domain directory that doesn't exist yet is loaded once it's created
+func TestWatchDomainsMissingDirectory(t *testing.T) {
+	loadTestConfig(t, "")
+	directory := filepath.Join(t.TempDir(), "list_domain")
+	if err := loadDomains(directory); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := watchDomains(ctx, directory); err != nil {
+		t.Fatalf("watchDomains with no directory: %v", err)
+	}
+	t.Cleanup(func() { loadDomains(filepath.Join(directory, "none")) })
+
+	backend := newNamedBackend(t, "backend")
+	staging := filepath.Join(t.TempDir(), "list_domain")
+	if err := os.Mkdir(staging, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(staging, "example.com.conf"), []byte("[proxy]\nbackend_url = "+backend.URL+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(staging, directory); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for serveTest(httptest.NewRequest(http.MethodGet, "http://example.com/", nil)).Code != http.StatusOK {
+		if time.Now().After(deadline) {
+			t.Fatal("domains in the created directory were not loaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testSOCKS5 is a minimal SOCKS5 server supporting CONNECT, with no
+// authentication or, when user is set, username/password authentication
+type testSOCKS5 struct {
+	listener net.Listener
+	user     string
+	password string
+	// Addresses clients asked to connect to
+	targets chan string
+}
+
+func newTestSOCKS5(t testing.TB, user, password string) *testSOCKS5 {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testSOCKS5{listener: listener, user: user, password: password, targets: make(chan string, 100)}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *testSOCKS5) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *testSOCKS5) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	read := func(n int) []byte {
+		b := make([]byte, n)
+		if _, err := io.ReadFull(reader, b); err != nil {
+			return nil
+		}
+		return b
+	}
+
+	header := read(2)
+	if header == nil || header[0] != 5 || read(int(header[1])) == nil {
+		return
+	}
+	if s.user == "" {
+		conn.Write([]byte{5, 0})
+	} else {
+		conn.Write([]byte{5, 2})
+		version := read(2)
+		if version == nil {
+			return
+		}
+		user := read(int(version[1]))
+		passwordLength := read(1)
+		if passwordLength == nil {
+			return
+		}
+		password := read(int(passwordLength[0]))
+		if string(user) != s.user || string(password) != s.password {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	request := read(4)
+	if request == nil || request[1] != 1 {
+		return
+	}
+	var host string
+	switch request[3] {
+	case 1:
+		host = net.IP(read(4)).String()
+	case 3:
+		host = string(read(int(read(1)[0])))
+	case 4:
+		host = net.IP(read(16)).String()
+	}
+	port := read(2)
+	target := net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1])))
+	s.targets <- target
+
+	backend, err := net.Dial("tcp", target)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer backend.Close()
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	go io.Copy(backend, reader)
+	io.Copy(conn, backend)
+}
+
+// Whether the SOCKS5 server was asked to connect to target. It is asked
+// before the backend answers, so there is no need to wait
+func proxiedTo(s *testSOCKS5, target string) bool {
+	select {
+	case got := <-s.targets:
+		return got == target
+	default:
+		return false
+	}
+}
+
+func TestUpstreamProxy(t *testing.T) {
+	backend := newNamedBackend(t, "backend")
+	backendAddr := backend.Listener.Addr().String()
+	open := newTestSOCKS5(t, "", "")
+	authenticated := newTestSOCKS5(t, "proxy", "secret")
+
+	// An HTTP forward proxy requiring credentials. The proxied request
+	// carries the client's Host, which doesn't resolve here, so it always
+	// goes to the backend
+	var forwarded atomic.Int64
+	httpProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte("proxy:secret")) {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		forwarded.Add(1)
+		r.Header.Del("Proxy-Authorization")
+		r.URL.Host = backendAddr
+		resp, err := http.DefaultTransport.RoundTrip(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	defer httpProxy.Close()
+
+	tests := []struct {
+		name     string
+		proxy    string
+		want     int
+		wantSeen func() bool
+	}{
+		{"socks5", "socks5://" + open.addr(), http.StatusOK, func() bool { return proxiedTo(open, backendAddr) }},
+		{"socks5 with credentials", "socks5://proxy:secret@" + authenticated.addr(), http.StatusOK, func() bool { return proxiedTo(authenticated, backendAddr) }},
+		{"socks5 with wrong credentials", "socks5://proxy:wrong@" + authenticated.addr(), http.StatusBadGateway, nil},
+		{"http proxy", "http://proxy:secret@" + httpProxy.Listener.Addr().String(), http.StatusOK, func() bool { return forwarded.Load() == 1 }},
+		{"http proxy without credentials", "http://" + httpProxy.Listener.Addr().String(), http.StatusProxyAuthRequired, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, "")
+			loadTestDomains(t, map[string]string{"example.com": "[proxy]\nbackend_url = " + backend.URL + "\nupstream_proxy = " + tt.proxy + "\n"})
+			got := serveTest(httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+			if got.Code != tt.want {
+				t.Fatalf("status %d, want %d", got.Code, tt.want)
+			}
+			if tt.wantSeen != nil && !tt.wantSeen() {
+				t.Error("request did not go through the proxy")
+			}
+		})
+	}
+}
+
+func TestParseUpstreamProxy(t *testing.T) {
+	tests := []struct {
+		raw     string
+		wantErr bool
+	}{
+		{"http://proxy:3128", false},
+		{"https://proxy:3128", false},
+		{"socks5://proxy:1080", false},
+		{"socks5h://proxy:1080", false},
+		{"ftp://proxy:21", true},
+		{"://", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			if _, err := parseUpstreamProxy(tt.raw); (err != nil) != tt.wantErr {
+				t.Errorf("parseUpstreamProxy error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOriginProtection(t *testing.T) {
+	backend := newNamedBackend(t, "backend")
+	t.Setenv("TEST_ORIGIN_SECRET", "s3cret")
+	loadTestConfig(t, "")
+	loadTestDomains(t, map[string]string{
+		"cdn.example.com":    "[proxy]\nbackend_url = " + backend.URL + "\n[origin_protection]\nheader_name = X-Origin-Secret\nsecret_env = TEST_ORIGIN_SECRET\n",
+		"public.example.com": "[proxy]\nbackend_url = " + backend.URL + "\n",
+	})
+
+	tests := []struct {
+		name   string
+		host   string
+		secret string
+		want   int
+	}{
+		{"correct secret", "cdn.example.com", "s3cret", http.StatusOK},
+		{"missing secret", "cdn.example.com", "", http.StatusForbidden},
+		{"wrong secret", "cdn.example.com", "s3cre", http.StatusForbidden},
+		{"unprotected domain", "public.example.com", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://"+tt.host+"/", nil)
+			if tt.secret != "" {
+				r.Header.Set("X-Origin-Secret", tt.secret)
+			}
+			if got := serveTest(r); got.Code != tt.want {
+				t.Errorf("status %d, want %d", got.Code, tt.want)
+			}
+		})
+	}
+}
+
+// A protected domain whose secret is missing from the environment fails
+// to load rather than letting every request through
+func TestOriginProtectionWithoutSecret(t *testing.T) {
+	cfg, err := ini.Load([]byte("[proxy]\nbackend_url = http://127.0.0.1:1\n[origin_protection]\nheader_name = X-Origin-Secret\nsecret_env = TEST_ORIGIN_SECRET_UNSET\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadDomainConfig(cfg); err == nil {
+		t.Error("loadDomainConfig succeeded without the secret")
+	}
+}
+
+// Header blocks over max_header_bytes are refused with 431 before any
+// handler runs. net/http allows 4096 bytes of slack over the limit.
+func TestMaxHeaderBytes(t *testing.T) {
+	backend := newNamedBackend(t, "backend")
+	tests := []struct {
+		name       string
+		config     string
+		headerSize int
+		want       int
+	}{
+		{"default limit", "", 16 << 10, http.StatusOK},
+		{"within limit", "[server]\nmax_header_bytes = 1024\n", 512, http.StatusOK},
+		{"over limit", "[server]\nmax_header_bytes = 1024\n", 16 << 10, http.StatusRequestHeaderFieldsTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, tt.config)
+			loadTestDomains(t, map[string]string{"example.com": "[proxy]\nbackend_url = " + backend.URL + "\n"})
+			server := httptest.NewUnstartedServer(buildHandler())
+			server.Config.MaxHeaderBytes = startupConfig.Server.MaxHeaderBytes
+			server.Start()
+			defer server.Close()
+
+			r, _ := http.NewRequest(http.MethodGet, server.URL+"/", nil)
+			r.Host = "example.com"
+			r.Header.Set("X-Padding", strings.Repeat("a", tt.headerSize))
+			resp, err := server.Client().Do(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Errorf("status %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+var startWorkers sync.Once
+
+// Serve requests through the worker pool for the rest of the test. The pool
+// is started once and shared by every test using it.
+func useWorkerPool(t testing.TB) {
+	t.Helper()
+	startWorkers.Do(func() { initWorkerPool(8) })
+	startupConfig.Server.UseWorkerPool = true
+	t.Cleanup(func() { startupConfig.Server.UseWorkerPool = false })
+}
+
+func TestRunInWorkerPool(t *testing.T) {
+	useWorkerPool(t)
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name      string
+		ctx       context.Context
+		task      func()
+		want      bool
+		wantPanic any
+	}{
+		{"runs", context.Background(), func() {}, true, nil},
+		{"client gone", cancelled, func() { t.Error("task ran for a cancelled request") }, false, nil},
+		{"panic re-raised", context.Background(), func() { panic(http.ErrAbortHandler) }, false, http.ErrAbortHandler},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if got := recover(); got != tt.wantPanic {
+					t.Errorf("panic %v, want %v", got, tt.wantPanic)
+				}
+			}()
+			if got := runInWorkerPool(tt.ctx, 0, tt.task); got != tt.want {
+				t.Errorf("runInWorkerPool = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// A full pool turns queued requests away with 503 after queue_timeout
+func TestWorkerQueueTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	loadTestConfig(t, "[server]\nqueue_timeout = 0.05\n")
+	loadTestDomains(t, map[string]string{"example.com": "[proxy]\nbackend_url = " + backend.URL + "\n"})
+	useWorkerPool(t)
+
+	// Occupy every worker and fill the queue
+	for i := 0; i < 2*cap(workerPool); i++ {
+		go runInWorkerPool(context.Background(), 0, func() { <-release })
+	}
+	for len(workerPool) < cap(workerPool) {
+		time.Sleep(time.Millisecond)
+	}
+
+	before := counterValue(workerQueueTimeouts)
+	if got := serveTest(httptest.NewRequest(http.MethodGet, "http://example.com/", nil)); got.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want 503", got.Code)
+	}
+	if counterValue(workerQueueTimeouts) != before+1 {
+		t.Error("queue timeout not counted")
+	}
+}
+
+// A task that got into the queue but waited there past queue_timeout, or
+// whose request ended meanwhile, is dropped when a worker picks it up
+func TestWorkerQueueStale(t *testing.T) {
+	useWorkerPool(t)
+	tests := []struct {
+		name         string
+		queueTimeout time.Duration
+		cancelAfter  time.Duration
+		busyFor      time.Duration
+		want         bool
+	}{
+		{"picked up in time", 200 * time.Millisecond, 0, 20 * time.Millisecond, true},
+		{"waited too long", 50 * time.Millisecond, 0, 150 * time.Millisecond, false},
+		{"no queue timeout", 0, 0, 150 * time.Millisecond, true},
+		{"request ended while queued", 0, 20 * time.Millisecond, 150 * time.Millisecond, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Occupy every worker, leaving the queue empty
+			release := make(chan struct{})
+			started := make(chan struct{})
+			for i := 0; i < 8; i++ {
+				go runInWorkerPool(context.Background(), 0, func() {
+					started <- struct{}{}
+					<-release
+				})
+			}
+			for i := 0; i < 8; i++ {
+				<-started
+			}
+			time.AfterFunc(tt.busyFor, func() { close(release) })
+
+			ctx := context.Background()
+			if tt.cancelAfter > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithCancel(ctx)
+				defer time.AfterFunc(tt.cancelAfter, cancel).Stop()
+			}
+			ran := false
+			if got := runInWorkerPool(ctx, tt.queueTimeout, func() { ran = true }); got != tt.want || ran != tt.want {
+				t.Errorf("runInWorkerPool = %v, task ran %v, want %v", got, ran, tt.want)
+			}
+		})
+	}
+}
+
+// Proxy requests with and without the worker pool, for its cost in latency
+func BenchmarkWorkerPool(b *testing.B) {
+	for _, bb := range []struct {
+		name string
+		pool bool
+	}{
+		{"direct", false},
+		{"worker pool", true},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			backend := newNamedBackend(b, "backend")
+			loadTestConfig(b, "")
+			loadTestDomains(b, map[string]string{"example.com": "[proxy]\nbackend_url = " + backend.URL + "\n"})
+			if bb.pool {
+				useWorkerPool(b)
+			}
+			handler := buildHandler()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+				}
+			})
+		})
+	}
+}
+
+// Saturating one domain's max_concurrent_requests turns its further
+// requests away while other domains keep serving
+func TestMaxConcurrentRequests(t *testing.T) {
+	arrived := make(chan struct{})
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-release
+	}))
+	defer slow.Close()
+	fast := newNamedBackend(t, "fast")
+	loadTestConfig(t, "")
+	loadTestDomains(t, map[string]string{
+		"busy.example.com":  "[proxy]\nbackend_url = " + slow.URL + "\nmax_concurrent_requests = 2\n",
+		"quiet.example.com": "[proxy]\nbackend_url = " + fast.URL + "\n",
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serveTest(httptest.NewRequest(http.MethodGet, "http://busy.example.com/", nil))
+		}()
+		<-arrived
+	}
+	defer wg.Wait()
+	defer close(release)
+
+	if got := gaugeValue(domainRequestsInFlight, "busy.example.com"); got != 2 {
+		t.Errorf("%d requests in flight, want 2", got)
+	}
+	before := counterValue(concurrencyRejections, "busy.example.com")
+	if got := serveTest(httptest.NewRequest(http.MethodGet, "http://busy.example.com/", nil)); got.Code != http.StatusServiceUnavailable {
+		t.Errorf("saturated domain answered %d, want 503", got.Code)
+	}
+	if counterValue(concurrencyRejections, "busy.example.com") != before+1 {
+		t.Error("rejection not counted")
+	}
+	if got := serveTest(httptest.NewRequest(http.MethodGet, "http://quiet.example.com/", nil)); got.Code != http.StatusOK || got.Body.String() != "fast" {
+		t.Errorf("other domain answered %d %q, want 200 fast", got.Code, got.Body.String())
+	}
+}
+
+func TestDomainAliases(t *testing.T) {
+	site := newNamedBackend(t, "site")
+	other := newNamedBackend(t, "other")
+	loadTestConfig(t, "")
+	directory := t.TempDir()
+	t.Cleanup(func() { loadDomains(filepath.Join(directory, "none")) })
+	writeDomains := func(aliases string) {
+		t.Helper()
+		files := map[string]string{
+			"example.com": "[proxy]\nbackend_url = " + site.URL + "\naliases = " + aliases + "\n",
+			"example.org": "[proxy]\nbackend_url = " + other.URL + "\n",
+		}
+		for name, contents := range files {
+			if err := os.WriteFile(filepath.Join(directory, name+".conf"), []byte(contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := loadDomains(directory); err != nil {
+			t.Fatal(err)
+		}
+	}
+	servedBy := func(host string) string {
+		got := serveTest(httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+		if got.Code == http.StatusNotFound {
+			return ""
+		}
+		return got.Body.String()
+	}
+
+	// An alias naming another domain is ignored
+	writeDomains("www.example.com, example.net, example.org")
+	for host, want := range map[string]string{
+		"example.com":     "site",
+		"www.example.com": "site",
+		"example.net":     "site",
+		"example.org":     "other",
+	} {
+		if got := servedBy(host); got != want {
+			t.Errorf("%s served by %q, want %q", host, got, want)
+		}
+	}
+
+	// Removing an alias on reload unregisters it
+	writeDomains("www.example.com")
+	if got := servedBy("www.example.com"); got != "site" {
+		t.Errorf("www.example.com served by %q after reload, want site", got)
+	}
+	if got := servedBy("example.net"); got != "" {
+		t.Errorf("removed alias example.net still served by %q", got)
+	}
+}
+
+// Backend trailers reach the client on a chunked response, also through
+// response rewriting and the cache
+func TestResponseTrailers(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte("from http://internal-app"))
+		w.(http.Flusher).Flush()
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name    string
+		options string
+	}{
+		{"plain", ""},
+		{"response rewrite", "[response_rewrite]\nsearch = http://internal-app\nreplace = https://example.com\n"},
+		{"cache", "[cache]\nenabled = true\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetCache(t)
+			loadTestConfig(t, "")
+			loadTestDomains(t, map[string]string{"example.com": "[proxy]\nbackend_url = " + backend.URL + "\n" + tt.options})
+			proxy := httptest.NewServer(buildHandler())
+			defer proxy.Close()
+
+			// Twice, so a cached copy would be served the second time
+			for i := 0; i < 2; i++ {
+				r, _ := http.NewRequest(http.MethodGet, proxy.URL+"/", nil)
+				r.Host = "example.com"
+				resp, err := proxy.Client().Do(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if string(body) != "from http://internal-app" {
+					t.Errorf("request %d: body %q, want it unchanged", i, body)
+				}
+				if resp.ContentLength != -1 {
+					t.Errorf("request %d: Content-Length %d, want a chunked response", i, resp.ContentLength)
+				}
+				if got := resp.Trailer.Get("Grpc-Status"); got != "0" {
+					t.Errorf("request %d: Grpc-Status trailer %q, want 0", i, got)
+				}
+			}
+		})
+	}
+}
+
+// A client going away cancels the backend request, with or without the
+// worker pool
+func TestClientDisconnectCancelsBackend(t *testing.T) {
+	for _, pool := range []bool{false, true} {
+		t.Run(fmt.Sprintf("worker pool %v", pool), func(t *testing.T) {
+			arrived := make(chan struct{})
+			cancelled := make(chan bool, 1)
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(arrived)
+				select {
+				case <-r.Context().Done():
+					cancelled <- true
+				case <-time.After(5 * time.Second):
+					cancelled <- false
+				}
+			}))
+			defer backend.Close()
+			loadTestConfig(t, "")
+			loadTestDomains(t, map[string]string{"example.com": "[proxy]\nbackend_url = " + backend.URL + "\n"})
+			if pool {
+				useWorkerPool(t)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				serveTest(httptest.NewRequest(http.MethodGet, "http://example.com/work", nil).WithContext(ctx))
+			}()
+			<-arrived
+			cancel()
+			if !<-cancelled {
+				t.Error("backend request not cancelled after the client went away")
+			}
+			<-done
+		})
+	}
+}
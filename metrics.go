@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// A small Prometheus-compatible metrics registry. Metrics register
+// themselves on creation and are rendered in the text exposition format.
+type metric interface {
+	writeTo(w io.Writer)
+}
+
+var (
+	metricsRegistry []metric
+	metricsLock     sync.Mutex
+)
+
+func registerMetric(m metric) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	metricsRegistry = append(metricsRegistry, m)
+}
+
+// counterVec is a monotonically increasing counter partitioned by labels
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]*uint64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: make(map[string]*uint64)}
+	registerMetric(c)
+	return c
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.add(1, labelValues...)
+}
+
+func (c *counterVec) add(n uint64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+
+	c.mu.Lock()
+	value, exists := c.values[key]
+	if !exists {
+		value = new(uint64)
+		c.values[key] = value
+	}
+	c.mu.Unlock()
+
+	atomic.AddUint64(value, n)
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+
+	c.mu.Lock()
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %d\n", c.name, formatLabels(c.labels, strings.Split(key, "\xff")), atomic.LoadUint64(c.values[key]))
+	}
+	c.mu.Unlock()
+}
+
+// gauge is a single value that can go up and down
+type gauge struct {
+	name  string
+	help  string
+	value int64
+}
+
+func newGauge(name, help string) *gauge {
+	g := &gauge{name: name, help: help}
+	registerMetric(g)
+	return g
+}
+
+func (g *gauge) add(n int64) {
+	atomic.AddInt64(&g.value, n)
+}
+
+func (g *gauge) set(n int64) {
+	atomic.StoreInt64(&g.value, n)
+}
+
+func (g *gauge) get() int64 {
+	return atomic.LoadInt64(&g.value)
+}
+
+func (g *gauge) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", g.name, g.help, g.name, g.name, g.get())
+}
+
+// gaugeVec is a gauge partitioned by labels
+type gaugeVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]*int64
+}
+
+func newGaugeVec(name, help string, labels ...string) *gaugeVec {
+	g := &gaugeVec{name: name, help: help, labels: labels, values: make(map[string]*int64)}
+	registerMetric(g)
+	return g
+}
+
+func (g *gaugeVec) add(n int64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+
+	g.mu.Lock()
+	value, exists := g.values[key]
+	if !exists {
+		value = new(int64)
+		g.values[key] = value
+	}
+	g.mu.Unlock()
+
+	atomic.AddInt64(value, n)
+}
+
+func (g *gaugeVec) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+
+	g.mu.Lock()
+	keys := make([]string, 0, len(g.values))
+	for key := range g.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %d\n", g.name, formatLabels(g.labels, strings.Split(key, "\xff")), atomic.LoadInt64(g.values[key]))
+	}
+	g.mu.Unlock()
+}
+
+// gaugeFunc is a gauge whose value is read when metrics are collected
+type gaugeFunc struct {
+	name  string
+	help  string
+	value func() int64
+}
+
+func newGaugeFunc(name, help string, value func() int64) *gaugeFunc {
+	g := &gaugeFunc{name: name, help: help, value: value}
+	registerMetric(g)
+	return g
+}
+
+func (g *gaugeFunc) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", g.name, g.help, g.name, g.name, g.value())
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, value)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	for _, m := range metricsRegistry {
+		m.writeTo(w)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Each [middleware] flag turns exactly its own middleware off
+func TestMiddlewareChain(t *testing.T) {
+	names := []string{"static_files", "logging", "recover", "rate_limiting", "ip_filter", "request_size"}
+	for _, disabled := range names {
+		t.Run(disabled, func(t *testing.T) {
+			loadTestConfig(t, "[middleware]\n"+disabled+" = false\n")
+			chain := middlewareChain()
+			if len(chain) != len(names) {
+				t.Fatalf("%d middlewares, want %d", len(chain), len(names))
+			}
+			for i, m := range chain {
+				if m.name != names[i] {
+					t.Errorf("middleware %d is %s, want %s", i, m.name, names[i])
+				}
+				if m.enabled != (m.name != disabled) {
+					t.Errorf("%s enabled %v with %s = false", m.name, m.enabled, disabled)
+				}
+			}
+		})
+	}
+}
+
+// A disabled middleware never sees the request: what it would have
+// rejected or logged goes through untouched
+func TestDisabledMiddleware(t *testing.T) {
+	backend := newNamedBackend(t, "site")
+	tests := []struct {
+		name   string
+		config string
+		// Sends requests from its own address and reports whether the
+		// middleware acted on any of them
+		acted func(t *testing.T, remote string) bool
+	}{
+		{"ip_filter", "", func(t *testing.T, remote string) bool {
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			r.RemoteAddr = "198.51.100.1:1234"
+			return serveTest(r).Code == http.StatusUnauthorized
+		}},
+		{"rate_limiting", "[rate_limiting]\nrequests_per_second = 1\nburst_limit = 1\n", func(t *testing.T, remote string) bool {
+			limited := false
+			for i := 0; i < 3; i++ {
+				r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+				r.RemoteAddr = remote
+				limited = limited || serveTest(r).Code == http.StatusTooManyRequests
+			}
+			return limited
+		}},
+		{"request_size", "[request_limits]\nmax_request_size = 16\n", func(t *testing.T, remote string) bool {
+			r := httptest.NewRequest(http.MethodPost, "http://example.com/", bytes.NewReader(make([]byte, 1024)))
+			r.RemoteAddr = remote
+			// The backend never gets the body it was sent in full
+			return serveTest(r).Code != http.StatusOK
+		}},
+		{"logging", "", func(t *testing.T, remote string) bool {
+			logs := captureAccessLog(t)
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			r.RemoteAddr = remote
+			serveTest(r)
+			return strings.TrimSpace(logs.String()) != ""
+		}},
+	}
+	for i, tt := range tests {
+		for j, enabled := range []bool{true, false} {
+			name := tt.name + " enabled"
+			if !enabled {
+				name = tt.name + " disabled"
+			}
+			t.Run(name, func(t *testing.T) {
+				flag := "true"
+				if !enabled {
+					flag = "false"
+				}
+				loadTestConfig(t, tt.config+"[middleware]\n"+tt.name+" = "+flag+"\n")
+				loadTestDomains(t, map[string]string{"example.com": "[proxy]\nbackend_url = " + backend.URL + "\n"})
+				// A whitelisted address no other case shares, so rate limiter
+				// state doesn't carry over
+				remote := fmt.Sprintf("192.0.2.%d:1234", 10+2*i+j)
+				if acted := tt.acted(t, remote); acted != enabled {
+					t.Errorf("%s acted %v, want %v", tt.name, acted, enabled)
+				}
+			})
+		}
+	}
+}
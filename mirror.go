@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// Mirrored requests in flight per domain; beyond this, copies are dropped
+// rather than queued so the mirror can never hold up clients
+const maxMirrorsInFlight = 100
+
+var mirrorRequests = newCounterVec("mirror_requests_total", "Copies of client requests sent to a domain's mirror backend, by result.", "domain", "result")
+
+// MirrorConfig sends a copy of a share of a domain's requests to a second
+// backend whose responses are discarded
+type MirrorConfig struct {
+	BackendURL string
+	Percentage float64
+	Timeout    time.Duration
+}
+
+func loadMirrorConfig(cfg *ini.File) (MirrorConfig, error) {
+	section := cfg.Section("mirror")
+	mirror := MirrorConfig{
+		BackendURL: section.Key("backend_url").String(),
+		Percentage: section.Key("percentage").MustFloat64(100),
+		Timeout:    time.Duration(section.Key("timeout").MustFloat64(5) * float64(time.Second)),
+	}
+	if mirror.BackendURL == "" {
+		return mirror, nil
+	}
+	if mirror.Percentage < 0 || mirror.Percentage > 100 {
+		return mirror, fmt.Errorf("mirror: percentage must be between 0 and 100")
+	}
+	if _, err := url.Parse(mirror.BackendURL); err != nil {
+		return mirror, fmt.Errorf("mirror: invalid backend_url: %w", err)
+	}
+	return mirror, nil
+}
+
+// requestMirror is a domain's MirrorConfig with its backend ready to use
+type requestMirror struct {
+	MirrorConfig
+	target    *url.URL
+	transport http.RoundTripper
+	slots     chan struct{}
+}
+
+// Set up the domain's mirror, or return nil if it has none
+func newRequestMirror(domainConfig DomainConfig) (*requestMirror, error) {
+	if domainConfig.Mirror.BackendURL == "" {
+		return nil, nil
+	}
+	target, err := url.Parse(domainConfig.Mirror.BackendURL)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := getTransport(domainConfig.transportKey(BackendConfig{Timeout: domainConfig.Mirror.Timeout}))
+	if err != nil {
+		return nil, err
+	}
+	return &requestMirror{
+		MirrorConfig: domainConfig.Mirror,
+		target:       target,
+		transport:    transport,
+		slots:        make(chan struct{}, maxMirrorsInFlight),
+	}, nil
+}
+
+// Start sending a copy of r to the domain's mirror if it is picked by
+// percentage and a slot is free. The body is then read into memory and r
+// is given a fresh reader over it, so the caller must use the returned
+// request.
+func (dp *domainProxy) mirrorRequest(r *http.Request) *http.Request {
+	m := dp.mirror
+	if isWebSocketUpgrade(r) || rand.Float64()*100 >= m.Percentage {
+		return r
+	}
+
+	// Take a slot before buffering, so dropped copies cost nothing
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		mirrorRequests.inc(dp.name, "dropped")
+		return r
+	}
+
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(r.Body)
+		// Hand over what was read; the body repeats its error to the primary
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		if err != nil {
+			<-m.slots
+			return r
+		}
+	}
+
+	// The copy must outlive the client's request, so it gets its own context
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+	copied := r.Clone(ctx)
+	copied.RequestURI = ""
+	copied.URL.Scheme = m.target.Scheme
+	copied.URL.Host = m.target.Host
+	copied.URL.Path, copied.URL.RawPath = joinURLPath(m.target, copied.URL)
+	copied.Body = io.NopCloser(bytes.NewReader(body))
+	copied.ContentLength = int64(len(body))
+	if len(body) == 0 {
+		copied.Body = http.NoBody
+	}
+	copied.Header.Del("Connection")
+	sanitizeRequestHeaders(copied.Header, dp.config.ForwardHeaders, dp.config.StripHeaders, dp.config.MaxRequestHeaderSize)
+
+	go func() {
+		defer func() { <-m.slots }()
+		defer cancel()
+		resp, err := m.transport.RoundTrip(copied)
+		if err != nil {
+			logger.Debug("Mirror request failed", "domain", dp.name, "mirror", m.target.Host, "error", err)
+			mirrorRequests.inc(dp.name, "error")
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		mirrorRequests.inc(dp.name, "sent")
+	}()
+	return r
+}
+
+// Put the path of base in front of the path of u, as
+// httputil.NewSingleHostReverseProxy does, keeping u's escaping
+func joinURLPath(base, u *url.URL) (path, rawPath string) {
+	if base.RawPath == "" && u.RawPath == "" {
+		return singleJoiningSlash(base.Path, u.Path), ""
+	}
+	basePath, uPath := base.EscapedPath(), u.EscapedPath()
+	baseSlash, uSlash := strings.HasSuffix(basePath, "/"), strings.HasPrefix(uPath, "/")
+	switch {
+	case baseSlash && uSlash:
+		return base.Path + u.Path[1:], basePath + uPath[1:]
+	case !baseSlash && !uSlash:
+		return base.Path + "/" + u.Path, basePath + "/" + uPath
+	}
+	return base.Path + u.Path, basePath + uPath
+}
+
+func singleJoiningSlash(a, b string) string {
+	aSlash, bSlash := strings.HasSuffix(a, "/"), strings.HasPrefix(b, "/")
+	switch {
+	case aSlash && bSlash:
+		return a + b[1:]
+	case !aSlash && !bSlash:
+		return a + "/" + b
+	}
+	return a + b
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+func TestJoinURLPath(t *testing.T) {
+	tests := []struct {
+		base, path  string
+		want        string
+		wantRawPath string
+	}{
+		{"http://mirror", "/orders", "/orders", ""},
+		{"http://mirror/", "/orders", "/orders", ""},
+		{"http://mirror/v2", "/orders", "/v2/orders", ""},
+		{"http://mirror/v2/", "/orders/", "/v2/orders/", ""},
+		{"http://mirror/v2", "/a%2Fb", "/v2/a/b", "/v2/a%2Fb"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.base+tt.path, func(t *testing.T) {
+			base, _ := url.Parse(tt.base)
+			u, _ := url.Parse("http://example.com" + tt.path)
+			path, rawPath := joinURLPath(base, u)
+			if path != tt.want || rawPath != tt.wantRawPath {
+				t.Errorf("joinURLPath = %q, %q, want %q, %q", path, rawPath, tt.want, tt.wantRawPath)
+			}
+		})
+	}
+}
+
+// The client gets the primary backend's response and the primary gets the
+// whole body, while the mirror gets a copy at its own path
+func TestMirrorRequest(t *testing.T) {
+	mirrored := make(chan string, 1)
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mirrored <- r.URL.RequestURI() + " " + string(body)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("mirror"))
+	}))
+	defer mirror.Close()
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write([]byte("primary " + r.URL.RequestURI() + " " + string(body)))
+	}))
+	defer primary.Close()
+
+	loadTestConfig(t, "")
+	loadTestDomains(t, map[string]string{
+		"example.com": "[proxy]\nbackend_url = " + primary.URL + "\n[mirror]\nbackend_url = " + mirror.URL + "/v2\n",
+	})
+
+	r := httptest.NewRequest(http.MethodPost, "http://example.com/orders?id=1", strings.NewReader("order"))
+	got := serveTest(r)
+	if got.Code != http.StatusOK || got.Body.String() != "primary /orders?id=1 order" {
+		t.Errorf("client got %d %q, want the primary's response", got.Code, got.Body.String())
+	}
+	select {
+	case copy := <-mirrored:
+		if copy != "/v2/orders?id=1 order" {
+			t.Errorf("mirror got %q, want /v2/orders?id=1 order", copy)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("mirror got no copy")
+	}
+}
+
+// Without a free slot the copy is dropped before the body is read
+func TestMirrorDroppedWithoutReadingBody(t *testing.T) {
+	loadTestConfig(t, "")
+	loadTestDomains(t, map[string]string{
+		"example.com": "[proxy]\nbackend_url = http://127.0.0.1:1\n[mirror]\nbackend_url = http://127.0.0.1:1\n",
+	})
+	dp := lookupDomain(httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	for i := 0; i < cap(dp.mirror.slots); i++ {
+		dp.mirror.slots <- struct{}{}
+	}
+	defer func() {
+		for i := 0; i < cap(dp.mirror.slots); i++ {
+			<-dp.mirror.slots
+		}
+	}()
+
+	body := &countingBody{ReadCloser: io.NopCloser(strings.NewReader("order"))}
+	r := httptest.NewRequest(http.MethodPost, "http://example.com/orders", nil)
+	r.Body = body
+	before := counterValue(mirrorRequests, "example.com", "dropped")
+	if got := dp.mirrorRequest(r); got.Body != body {
+		t.Error("request body was replaced for a dropped copy")
+	}
+	if n := body.bytesRead.Load(); n != 0 {
+		t.Errorf("%d body bytes read for a dropped copy, want 0", n)
+	}
+	if counterValue(mirrorRequests, "example.com", "dropped") != before+1 {
+		t.Error("dropped copy not counted")
+	}
+}
+
+// A slow or unreachable mirror leaves the client's response and its timing
+// to the primary backend
+func TestMirrorDoesNotAffectPrimary(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+	primary := newNamedBackend(t, "primary")
+
+	tests := []struct {
+		name   string
+		mirror string
+	}{
+		{"slow mirror", slow.URL},
+		{"unreachable mirror", "http://" + closedAddress(t)},
+		{"none picked", slow.URL + "\npercentage = 0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, "")
+			loadTestDomains(t, map[string]string{
+				"example.com": "[proxy]\nbackend_url = " + primary.URL + "\n[mirror]\nbackend_url = " + tt.mirror + "\ntimeout = 10\n",
+			})
+			start := time.Now()
+			got := serveTest(httptest.NewRequest(http.MethodPost, "http://example.com/orders", strings.NewReader("order")))
+			if got.Code != http.StatusOK || got.Body.String() != "primary" {
+				t.Errorf("client got %d %q, want the primary's response", got.Code, got.Body.String())
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("response took %s", elapsed)
+			}
+		})
+	}
+}
+
+func TestLoadMirrorConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		want    MirrorConfig
+		wantErr bool
+	}{
+		{"none", "", MirrorConfig{Percentage: 100, Timeout: 5 * time.Second}, false},
+		{"defaults", "[mirror]\nbackend_url = http://mirror\n", MirrorConfig{BackendURL: "http://mirror", Percentage: 100, Timeout: 5 * time.Second}, false},
+		{"share and timeout", "[mirror]\nbackend_url = http://mirror\npercentage = 12.5\ntimeout = 0.5\n", MirrorConfig{BackendURL: "http://mirror", Percentage: 12.5, Timeout: 500 * time.Millisecond}, false},
+		{"percentage over 100", "[mirror]\nbackend_url = http://mirror\npercentage = 101\n", MirrorConfig{}, true},
+		{"invalid url", "[mirror]\nbackend_url = http://mir ror:port\n", MirrorConfig{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := ini.Load([]byte(tt.config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := loadMirrorConfig(cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadMirrorConfig error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("loadMirrorConfig = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	// How often a staple file is read again for a newer response
+	ocspFileCheckInterval = 10 * time.Minute
+	// How long to wait after a failed refresh before trying again
+	ocspRetryInterval = 5 * time.Minute
+	// Largest OCSP response accepted from a responder
+	maxOCSPResponseSize = 1 << 20
+)
+
+// stapledCert is the server certificate with an OCSP response attached,
+// kept fresh in the background. The response is either read from a file
+// maintained by an external tool or fetched from the certificate's OCSP
+// responder.
+type stapledCert struct {
+	stapleFile string
+	issuer     *x509.Certificate
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// Load the server certificate for stapling. The issuer must follow the leaf
+// in the certificate file, as it is needed to check OCSP responses.
+func newStapledCert(certFile, keyFile, stapleFile string) (*stapledCert, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(cert.Certificate) < 2 {
+		return nil, fmt.Errorf("ocsp stapling: %s must include the issuer certificate after the server certificate", certFile)
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, fmt.Errorf("ocsp stapling: parsing issuer certificate: %w", err)
+	}
+	if stapleFile == "" && len(cert.Leaf.OCSPServer) == 0 {
+		return nil, fmt.Errorf("ocsp stapling: %s names no OCSP responder; set ocsp_staple_file instead", certFile)
+	}
+	return &stapledCert{stapleFile: stapleFile, issuer: issuer, cert: &cert}, nil
+}
+
+// get is used as tls.Config.GetCertificate
+func (sc *stapledCert) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	return sc.cert, nil
+}
+
+// Get a current OCSP response for the certificate and check it
+func (sc *stapledCert) fetch(ctx context.Context) ([]byte, *ocsp.Response, error) {
+	leaf := sc.cert.Leaf
+
+	var der []byte
+	var err error
+	if sc.stapleFile != "" {
+		der, err = os.ReadFile(sc.stapleFile)
+	} else {
+		der, err = requestOCSP(ctx, leaf, sc.issuer)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := ocsp.ParseResponseForCert(der, leaf, sc.issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.Status != ocsp.Good {
+		return nil, nil, fmt.Errorf("certificate status is %s", ocspStatus(resp.Status))
+	}
+	if !resp.NextUpdate.IsZero() && time.Now().After(resp.NextUpdate) {
+		return nil, nil, errors.New("OCSP response has expired")
+	}
+	return der, resp, nil
+}
+
+func requestOCSP(ctx context.Context, leaf, issuer *x509.Certificate) ([]byte, error) {
+	body, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, leaf.OCSPServer[0], bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OCSP responder %s answered %s", leaf.OCSPServer[0], resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxOCSPResponseSize))
+}
+
+func ocspStatus(status int) string {
+	switch status {
+	case ocsp.Revoked:
+		return "revoked"
+	case ocsp.Unknown:
+		return "unknown"
+	}
+	return "good"
+}
+
+// Fetch and attach a fresh OCSP response, returning when to refresh next:
+// halfway to the response's expiry, or sooner for staple files. On failure
+// the current staple is kept until it expires.
+func (sc *stapledCert) refresh(ctx context.Context) time.Duration {
+	der, resp, err := sc.fetch(ctx)
+	if err != nil {
+		logger.Error("Failed to refresh OCSP staple", "error", err)
+		sc.dropExpiredStaple()
+		return ocspRetryInterval
+	}
+
+	sc.mu.Lock()
+	cert := *sc.cert
+	cert.OCSPStaple = der
+	sc.cert = &cert
+	sc.mu.Unlock()
+	logger.Debug("OCSP staple refreshed", "next_update", resp.NextUpdate)
+
+	next := ocspFileCheckInterval
+	if sc.stapleFile == "" {
+		next = time.Hour
+		if !resp.NextUpdate.IsZero() {
+			next = time.Until(resp.NextUpdate) / 2
+		}
+	}
+	if next < time.Minute {
+		next = time.Minute
+	}
+	return next
+}
+
+func (sc *stapledCert) dropExpiredStaple() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.cert.OCSPStaple == nil {
+		return
+	}
+	resp, err := ocsp.ParseResponse(sc.cert.OCSPStaple, sc.issuer)
+	if err == nil && (resp.NextUpdate.IsZero() || time.Now().Before(resp.NextUpdate)) {
+		return
+	}
+	logger.Warn("OCSP staple expired, serving the certificate without one")
+	cert := *sc.cert
+	cert.OCSPStaple = nil
+	sc.cert = &cert
+}
+
+// Keep the staple fresh until ctx is done
+func (sc *stapledCert) run(ctx context.Context) {
+	for {
+		timer := time.NewTimer(sc.refresh(ctx))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// Write a certificate file holding the leaf followed by its issuer, as
+// stapling needs, and the leaf's key. responder, if set, is named in the
+// leaf as its OCSP server.
+func writeStaplingKeyPair(t *testing.T, ca *testCA, responder string, withIssuer bool) (certFile, keyFile string, leaf *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if responder != "" {
+		template.OCSPServer = []string{responder}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if withIssuer {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})...)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, chain, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, leaf
+}
+
+// An OCSP response for leaf signed by the CA, valid until nextUpdate
+func ocspResponse(t *testing.T, ca *testCA, leaf *x509.Certificate, status int, nextUpdate time.Time) []byte {
+	t.Helper()
+	der, err := ocsp.CreateResponse(ca.cert, ca.cert, ocsp.Response{
+		Status:       status,
+		SerialNumber: leaf.SerialNumber,
+		ThisUpdate:   time.Now().Add(-time.Hour),
+		NextUpdate:   nextUpdate,
+		RevokedAt:    time.Now().Add(-time.Hour),
+	}, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+// The OCSP response a client gets in the handshake with sc
+func handshakeStaple(t *testing.T, ca *testCA, sc *stapledCert) []byte {
+	t.Helper()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{GetCertificate: sc.get})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		conn.(*tls.Conn).Handshake()
+		conn.Close()
+	}()
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{RootCAs: ca.pool, ServerName: "example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().OCSPResponse
+}
+
+// A good response from a staple file or the responder is served in the
+// handshake; a revoked or expired one is not
+func TestOCSPStapling(t *testing.T) {
+	ca := newTestCA(t)
+	tests := []struct {
+		name       string
+		responder  bool
+		status     int
+		nextUpdate time.Duration
+		wantStaple bool
+	}{
+		{"file good", false, ocsp.Good, time.Hour, true},
+		{"file revoked", false, ocsp.Revoked, time.Hour, false},
+		{"file expired", false, ocsp.Good, -time.Minute, false},
+		{"responder good", true, ocsp.Good, time.Hour, true},
+		{"responder revoked", true, ocsp.Revoked, time.Hour, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var staple []byte
+			responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Content-Type") != "application/ocsp-request" {
+					http.Error(w, "bad request", http.StatusBadRequest)
+					return
+				}
+				w.Write(staple)
+			}))
+			defer responder.Close()
+
+			responderURL := ""
+			if tt.responder {
+				responderURL = responder.URL
+			}
+			certFile, keyFile, leaf := writeStaplingKeyPair(t, ca, responderURL, true)
+			staple = ocspResponse(t, ca, leaf, tt.status, time.Now().Add(tt.nextUpdate))
+			stapleFile := ""
+			if !tt.responder {
+				stapleFile = filepath.Join(t.TempDir(), "staple.der")
+				if err := os.WriteFile(stapleFile, staple, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			sc, err := newStapledCert(certFile, keyFile, stapleFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			next := sc.refresh(context.Background())
+			var want []byte
+			if tt.wantStaple {
+				want = staple
+			}
+			if got := handshakeStaple(t, ca, sc); !bytes.Equal(got, want) {
+				t.Errorf("handshake stapled %d bytes, want %d", len(got), len(want))
+			}
+			if !tt.wantStaple && next != ocspRetryInterval {
+				t.Errorf("next refresh in %s after a failure, want %s", next, ocspRetryInterval)
+			}
+		})
+	}
+}
+
+// A staple that expires is dropped at the next failed refresh rather than
+// served stale
+func TestOCSPStapleExpiry(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile, leaf := writeStaplingKeyPair(t, ca, "", true)
+	stapleFile := filepath.Join(t.TempDir(), "staple.der")
+	if err := os.WriteFile(stapleFile, ocspResponse(t, ca, leaf, ocsp.Good, time.Now().Add(time.Second)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sc, err := newStapledCert(certFile, keyFile, stapleFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc.refresh(context.Background())
+	if handshakeStaple(t, ca, sc) == nil {
+		t.Fatal("no staple while the response is valid")
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	sc.refresh(context.Background())
+	if got := handshakeStaple(t, ca, sc); got != nil {
+		t.Errorf("expired staple of %d bytes still served", len(got))
+	}
+}
+
+func TestNewStapledCertInvalid(t *testing.T) {
+	ca := newTestCA(t)
+	tests := []struct {
+		name       string
+		withIssuer bool
+		responder  string
+	}{
+		{"no issuer", false, "http://ocsp.example.com"},
+		{"no responder or staple file", true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			certFile, keyFile, _ := writeStaplingKeyPair(t, ca, tt.responder, tt.withIssuer)
+			if _, err := newStapledCert(certFile, keyFile, ""); err == nil {
+				t.Error("newStapledCert succeeded")
+			}
+		})
+	}
+}
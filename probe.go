@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// Bytes of a health check response searched for expected_body_contains
+const maxHealthBodySize = 64 * 1024
+
+// Check that every configured backend, including those of routes and
+// tenants, is reachable, logging the result of each probe. Backends with
+// a health_path get an HTTP GET and must answer with a non-5xx status, or
+// their expected_status and body; others only need to accept a TCP
+// connection.
+// Returns the number of unreachable backends.
+func probeBackends(timeout time.Duration) int {
+	mutex.RLock()
+	domains := make([]*domainProxy, 0, len(proxyMap))
+	for name, dp := range proxyMap {
+		if name != dp.name {
+			continue // an alias of a domain listed under its own name
+		}
+		domains = append(domains, dp)
+	}
+	mutex.RUnlock()
+
+	unreachable := 0
+	for _, dp := range domains {
+		backends := dp.config.Backends
+		for _, routeConfig := range dp.config.Routes {
+			backends = append(backends, parseBackendList(routeConfig.BackendURL)...)
+		}
+		if dp.config.Tenants != nil {
+			for _, name := range dp.config.Tenants.names() {
+				backends = append(backends, parseBackendList(dp.config.Tenants.Backends[name])...)
+			}
+		}
+
+		for _, backend := range backends {
+			start := time.Now()
+			err := probeBackend(dp.config, backend, timeout)
+			if err != nil {
+				unreachable++
+				logger.Warn("Backend unreachable", "domain", dp.name, "backend", backend.URL, "error", err)
+				continue
+			}
+			logger.Info("Backend reachable", "domain", dp.name, "backend", backend.URL, "latency", time.Since(start))
+		}
+	}
+	return unreachable
+}
+
+func probeBackend(domainConfig DomainConfig, backend BackendConfig, timeout time.Duration) error {
+	target, err := url.Parse(backend.URL)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if backend.HealthPath == "" {
+		address := target.Host
+		if target.Port() == "" {
+			port := "80"
+			if target.Scheme == "https" {
+				port = "443"
+			}
+			address = net.JoinHostPort(target.Hostname(), port)
+		}
+
+		conn, err := dialBackend(ctx, domainConfig.UpstreamProxy, address)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	healthURL := *target
+	healthURL.Path = backend.HealthPath
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, healthURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	transport, err := getTransport(domainConfig.transportKey(backend))
+	if err != nil {
+		return err
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case backend.ExpectedStatus != 0 && resp.StatusCode != backend.ExpectedStatus:
+		return fmt.Errorf("health check returned %s, expected %d", resp.Status, backend.ExpectedStatus)
+	case backend.ExpectedStatus == 0 && resp.StatusCode >= 500:
+		return fmt.Errorf("health check returned %s", resp.Status)
+	}
+
+	if backend.ExpectedBodyContains != "" {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthBodySize))
+		if err != nil {
+			return fmt.Errorf("reading health check response: %w", err)
+		}
+		if !bytes.Contains(body, []byte(backend.ExpectedBodyContains)) {
+			return fmt.Errorf("health check response does not contain %q", backend.ExpectedBodyContains)
+		}
+	}
+	return nil
+}
+
+// Parse an upstream_proxy URL, accepting the schemes both request
+// forwarding and health checks support
+func parseUpstreamProxy(raw string) (*url.URL, error) {
+	proxyURL, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream_proxy: %w", err)
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported upstream_proxy scheme %q", proxyURL.Scheme)
+	}
+	return proxyURL, nil
+}
+
+// Open a TCP connection to a backend address for a health check, through
+// the domain's upstream_proxy if it has one, so checks take the same
+// network path as the requests they vouch for
+func dialBackend(ctx context.Context, upstreamProxy, address string) (net.Conn, error) {
+	var dialer net.Dialer
+	if upstreamProxy == "" {
+		return dialer.DialContext(ctx, "tcp", address)
+	}
+	proxyURL, err := parseUpstreamProxy(upstreamProxy)
+	if err != nil {
+		return nil, err
+	}
+
+	if proxyURL.Scheme == "socks5" || proxyURL.Scheme == "socks5h" {
+		socks, err := proxy.FromURL(proxyURL, &dialer)
+		if err != nil {
+			return nil, err
+		}
+		return socks.(proxy.ContextDialer).DialContext(ctx, "tcp", address)
+	}
+	return dialConnectTunnel(ctx, proxyURL, address)
+}
+
+// Ask an HTTP(S) proxy for a CONNECT tunnel to address
+func dialConnectTunnel(ctx context.Context, proxyURL *url.URL, address string) (net.Conn, error) {
+	proxyAddress := proxyURL.Host
+	if proxyURL.Port() == "" {
+		port := "80"
+		if proxyURL.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddress = net.JoinHostPort(proxyURL.Hostname(), port)
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddress)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if user := proxyURL.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("upstream_proxy refused CONNECT to %s: %s", address, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
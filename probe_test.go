@@ -0,0 +1,221 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// Address of a port nothing listens on
+func closedAddress(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	return addr
+}
+
+func TestProbeBackends(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+	down := "http://" + closedAddress(t)
+
+	tests := []struct {
+		name   string
+		domain string
+		want   int
+	}{
+		{"reachable", "[proxy]\nbackend_url = " + up.URL + "\n", 0},
+		{"unreachable", "[proxy]\nbackend_url = " + down + "\n", 1},
+		{"route backend", "[proxy]\nbackend_url = " + up.URL + "\n[route.api]\npath_prefix = /api\nbackend_url = " + down + "\n", 1},
+		{"tenant backend", "[proxy]\nbackend_url = " + up.URL + "\n[tenants]\nacme = " + down + "\nglobex = " + up.URL + "\n", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, "")
+			loadTestDomains(t, map[string]string{"example.com": tt.domain})
+			if got := probeBackends(time.Second); got != tt.want {
+				t.Errorf("probeBackends = %d unreachable, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// A backend answering its health check with another status than
+// expected_status, or without expected_body_contains, is marked unhealthy
+// although it accepts connections
+func TestHealthCheckExpectations(t *testing.T) {
+	tests := []struct {
+		name        string
+		expect      string
+		status      int
+		body        string
+		wantHealthy bool
+	}{
+		{"any status below 500", "", http.StatusNotFound, "", true},
+		{"5xx by default", "", http.StatusServiceUnavailable, "database down", false},
+		{"expected status", "expected_status = 204\n", http.StatusNoContent, "", true},
+		{"status mismatch", "expected_status = 200\n", http.StatusAccepted, "ok", false},
+		{"expected 5xx", "expected_status = 503\n", http.StatusServiceUnavailable, "", true},
+		{"body contains", "expected_status = 200\nexpected_body_contains = db: ok\n", http.StatusOK, "db: ok\ncache: ok\n", true},
+		{"body mismatch", "expected_status = 200\nexpected_body_contains = db: ok\n", http.StatusOK, "db: down\ncache: ok\n", false},
+		{"body without status", "expected_body_contains = healthy\n", http.StatusOK, "healthy", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer backend.Close()
+			loadTestConfig(t, "")
+			loadTestDomains(t, map[string]string{
+				"example.com": "[proxy]\nunhealthy_threshold = 1\n[backend.app]\nurl = " + backend.URL + "\nhealth_path = /health\n" + tt.expect,
+			})
+
+			if got := probeBackends(time.Second) == 0; got != tt.wantHealthy {
+				t.Errorf("startup probe passed %v, want %v", got, tt.wantHealthy)
+			}
+			dp := lookupDomain(httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+			dp.checkBackends()
+			if healthy := dp.hasHealthyBackend(); healthy != tt.wantHealthy {
+				t.Errorf("backend healthy %v after a check, want %v", healthy, tt.wantHealthy)
+			}
+		})
+	}
+}
+
+func TestHealthCheckExpectationsInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend string
+	}{
+		{"status without health_path", "expected_status = 200\n"},
+		{"body without health_path", "expected_body_contains = ok\n"},
+		{"status out of range", "health_path = /health\nexpected_status = 99\n"},
+		{"status too large", "health_path = /health\nexpected_status = 600\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := ini.Load([]byte("[backend.app]\nurl = http://127.0.0.1:1\n" + tt.backend))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := loadBackends(cfg); err == nil {
+				t.Error("loadBackends accepted the config")
+			}
+		})
+	}
+}
+
+// An egress proxy that is the only way to reach backend.internal: CONNECT
+// tunnels and forwarded requests for it all go to the real backend. It
+// records the targets it was asked for.
+func newEgressProxy(t *testing.T, backendAddr string) (*httptest.Server, chan string) {
+	t.Helper()
+	targets := make(chan string, 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			targets <- r.URL.Host
+			r.URL.Host = backendAddr
+			resp, err := http.DefaultTransport.RoundTrip(r)
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			defer resp.Body.Close()
+			w.WriteHeader(resp.StatusCode)
+			io.Copy(w, resp.Body)
+			return
+		}
+
+		targets <- r.Host
+		backend, err := net.Dial("tcp", backendAddr)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer backend.Close()
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go io.Copy(backend, conn)
+		io.Copy(conn, backend)
+	}))
+	t.Cleanup(server.Close)
+	return server, targets
+}
+
+// Health checks of backends only reachable through upstream_proxy go
+// through it, both TCP checks and health_path requests
+func TestHealthChecksThroughUpstreamProxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	backendAddr := backend.Listener.Addr().String()
+	egress, egressTargets := newEgressProxy(t, backendAddr)
+	socks := newTestSOCKS5(t, "", "")
+	refusing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusProxyAuthRequired)
+	}))
+	defer refusing.Close()
+
+	tests := []struct {
+		name        string
+		proxy       string
+		backend     string
+		healthPath  string
+		wantHealthy bool
+		// Target the proxy should have been asked for
+		wantTarget string
+		targets    chan string
+	}{
+		{"tcp without a proxy", "", "http://backend.internal:8080", "", false, "", nil},
+		{"tcp through connect", "http://" + egress.Listener.Addr().String(), "http://backend.internal:8080", "", true, "backend.internal:8080", egressTargets},
+		{"http through the proxy", "http://" + egress.Listener.Addr().String(), "http://backend.internal:8080", "/health", true, "backend.internal:8080", egressTargets},
+		{"tcp through socks5", "socks5://" + socks.addr(), backend.URL, "", true, backendAddr, socks.targets},
+		{"http through socks5", "socks5://" + socks.addr(), backend.URL, "/health", true, backendAddr, socks.targets},
+		{"connect refused", "http://" + refusing.Listener.Addr().String(), "http://backend.internal:8080", "", false, "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, "")
+			domain := "[proxy]\nunhealthy_threshold = 1\n"
+			if tt.proxy != "" {
+				domain += "upstream_proxy = " + tt.proxy + "\n"
+			}
+			domain += "[backend.app]\nurl = " + tt.backend + "\n"
+			if tt.healthPath != "" {
+				domain += "health_path = " + tt.healthPath + "\n"
+			}
+			loadTestDomains(t, map[string]string{"example.com": domain})
+
+			dp := lookupDomain(httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+			dp.checkBackends()
+			if healthy := dp.hasHealthyBackend(); healthy != tt.wantHealthy {
+				t.Errorf("backend healthy %v after a check, want %v", healthy, tt.wantHealthy)
+			}
+			if tt.targets == nil {
+				return
+			}
+			select {
+			case got := <-tt.targets:
+				if got != tt.wantTarget {
+					t.Errorf("proxy asked for %q, want %q", got, tt.wantTarget)
+				}
+			default:
+				t.Error("health check did not go through the proxy")
+			}
+		})
+	}
+}
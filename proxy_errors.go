@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+// errNoBackend is returned when a request has no backend to go to
+var errNoBackend = errors.New("no backend available")
+
+// Map a failed backend round-trip to the status that best describes it:
+// 503 when there is no backend to use or it is at its connection limit, 504 when the backend timed out, and
+// 502 for everything else (connection refused, DNS failure, bad response).
+func proxyErrorStatus(err error) int {
+	if errors.Is(err, errNoBackend) || errors.Is(err, errBackendBusy) {
+		return http.StatusServiceUnavailable
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+var backendErrors = newCounterVec("backend_errors_total", "Failed backend requests, by domain, backend and type of error.", "domain", "backend", "error_type")
+
+// Classify a failed backend round-trip for the backend_errors_total metric
+func backendErrorType(err error) string {
+	var dnsErr *net.DNSError
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errNoBackend):
+		return "no_backend"
+	case errors.Is(err, errBackendBusy):
+		return "backend_busy"
+	case errors.Is(err, errResponseTooLarge):
+		return "response_too_large"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection_refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "connection_reset"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "connection_closed"
+	case errors.As(err, &certErr), errors.As(err, &recordErr), errors.As(err, &authorityErr), errors.As(err, &hostnameErr):
+		return "tls"
+	}
+	return "other"
+}
+
+// Count a failed backend round-trip against its domain and backend. Only
+// configured names are used as labels, so the number of series stays bounded.
+// Clients that went away are not counted.
+func recordBackendError(r *http.Request, err error) {
+	if errors.Is(err, context.Canceled) && r.Context().Err() != nil {
+		return
+	}
+	domain := ""
+	if dp := lookupDomain(r); dp != nil {
+		domain = dp.name
+	}
+	backendHost := ""
+	if b, ok := r.Context().Value(backendKey{}).(*backend); ok {
+		backendHost = b.target.Host
+	}
+	backendErrors.inc(domain, backendHost, backendErrorType(err))
+}
+
+// proxyErrorHandler is the ReverseProxy ErrorHandler for all domains
+func proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	status := proxyErrorStatus(err)
+
+	// A client that went away is not a backend failure
+	if errors.Is(err, context.Canceled) && r.Context().Err() != nil {
+		logger.Debug("Client disconnected before backend responded", "host", r.Host, "path", r.URL.Path, "error", err)
+	} else {
+		logger.Error("Backend request failed", "host", r.Host, "path", r.URL.Path, "backend", r.URL.Host, "status", status, "error", err)
+	}
+
+	writeErrorPage(w, r, status)
+}
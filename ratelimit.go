@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// Limiter decides whether a single request may proceed. Both the token
+// bucket (*rate.Limiter) and the sliding window implement it.
+type Limiter interface {
+	Allow() bool
+}
+
+// limiterEntry tracks when a client's limiter was last used so idle ones
+// can be evicted and the map stays bounded.
+type limiterEntry struct {
+	limiter  Limiter
+	lastSeen time.Time
+}
+
+// Return the network of the given size containing ip, in CIDR notation, so
+// that clients rotating addresses within their allocation share a limiter.
+// Unparseable addresses are returned unchanged.
+func clientNetwork(ip string, ipv4Prefix, ipv6Prefix int) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	if ip4 := parsed.To4(); ip4 != nil {
+		mask := net.CIDRMask(ipv4Prefix, 32)
+		return (&net.IPNet{IP: ip4.Mask(mask), Mask: mask}).String()
+	}
+	mask := net.CIDRMask(ipv6Prefix, 128)
+	return (&net.IPNet{IP: parsed.Mask(mask), Mask: mask}).String()
+}
+
+// slidingWindowLimiter allows at most limit requests in any rolling window.
+// Unlike a token bucket it never lets a full burst through on top of the
+// steady rate, giving backends a hard cap.
+type slidingWindowLimiter struct {
+	mu         sync.Mutex
+	limit      int
+	window     time.Duration
+	timestamps []time.Time
+}
+
+func newSlidingWindowLimiter(limit int, window time.Duration) *slidingWindowLimiter {
+	return &slidingWindowLimiter{
+		limit:      limit,
+		window:     window,
+		timestamps: make([]time.Time, 0, limit),
+	}
+}
+
+func (l *slidingWindowLimiter) Allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	cutoff := now.Add(-l.window)
+
+	// Drop requests that have slid out of the window
+	expired := 0
+	for expired < len(l.timestamps) && !l.timestamps[expired].After(cutoff) {
+		expired++
+	}
+	l.timestamps = append(l.timestamps[:0], l.timestamps[expired:]...)
+
+	if len(l.timestamps) >= l.limit {
+		return false
+	}
+	l.timestamps = append(l.timestamps, now)
+	return true
+}
+
+// Periodically remove limiters that have not been used for ttl
+func evictRateLimiters(ttl time.Duration) {
+	interval := ttl / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		cutoff := time.Now().Add(-ttl)
+		limiterLock.Lock()
+		for key, entry := range rateLimiter {
+			if entry.lastSeen.Before(cutoff) {
+				delete(rateLimiter, key)
+			}
+		}
+		limiterLock.Unlock()
+	}
+}
+
+// RateLimitRule gives requests matching a method and path prefix their own
+// per-client limit instead of the global one. Empty conditions match every
+// request.
+type RateLimitRule struct {
+	Name              string
+	Methods           []string
+	PathPrefix        string
+	RequestsPerSecond int
+	BurstLimit        int
+}
+
+// Read one [rate_limiting.<name>] section per rule, in file order. Rules
+// without a burst_limit use the global one.
+func loadRateLimitRules(cfg *ini.File, defaultBurst int) ([]RateLimitRule, error) {
+	var rules []RateLimitRule
+	for _, section := range cfg.Sections() {
+		if !strings.HasPrefix(section.Name(), "rate_limiting.") {
+			continue
+		}
+
+		rule := RateLimitRule{
+			Name:              section.Name(),
+			Methods:           section.Key("methods").Strings(","),
+			PathPrefix:        section.Key("path_prefix").String(),
+			RequestsPerSecond: section.Key("requests_per_second").MustInt(0),
+			BurstLimit:        section.Key("burst_limit").MustInt(defaultBurst),
+		}
+		if rule.RequestsPerSecond <= 0 {
+			return nil, fmt.Errorf("%s: requests_per_second must be at least 1", rule.Name)
+		}
+		for i, method := range rule.Methods {
+			rule.Methods[i] = strings.ToUpper(method)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (rule *RateLimitRule) matches(r *http.Request) bool {
+	if len(rule.Methods) > 0 {
+		found := false
+		for _, method := range rule.Methods {
+			if method == r.Method {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return strings.HasPrefix(r.URL.Path, rule.PathPrefix)
+}
+
+// RateLimitExemptions are the paths of a domain whose requests skip the
+// rate limiter, such as health checks and metrics scraped by monitoring
+type RateLimitExemptions struct {
+	Prefixes []string
+	Patterns []*regexp.Regexp
+}
+
+// Parse rate_limit_exempt_paths: path prefixes, or regular expressions
+// matched against the path when written as ~pattern
+func parseRateLimitExemptions(values []string) (RateLimitExemptions, error) {
+	var exemptions RateLimitExemptions
+	for _, value := range values {
+		if pattern, ok := strings.CutPrefix(value, "~"); ok {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return exemptions, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			}
+			exemptions.Patterns = append(exemptions.Patterns, re)
+		} else if strings.HasPrefix(value, "/") {
+			exemptions.Prefixes = append(exemptions.Prefixes, value)
+		} else {
+			return exemptions, fmt.Errorf("%q is neither a path starting with / nor a ~pattern", value)
+		}
+	}
+	return exemptions, nil
+}
+
+// Whether a request path is exempt. Paths with dot segments are never
+// exempt, since the backend would resolve /healthz/../login to a path
+// that isn't.
+func (e RateLimitExemptions) matches(requestPath string) bool {
+	if len(e.Prefixes) == 0 && len(e.Patterns) == 0 {
+		return false
+	}
+	if cleaned := path.Clean(requestPath); cleaned != requestPath && cleaned+"/" != requestPath {
+		return false
+	}
+	for _, prefix := range e.Prefixes {
+		if strings.HasPrefix(requestPath, prefix) {
+			return true
+		}
+	}
+	for _, re := range e.Patterns {
+		if re.MatchString(requestPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether a request is for a path its domain exempts from rate limiting
+func rateLimitExempt(r *http.Request) bool {
+	dp := lookupDomain(r)
+	return dp != nil && dp.config.RateLimitExemptPaths.matches(r.URL.Path)
+}
+
+// Return the first rule matching the request, or nil to use the global limit
+func matchRateLimitRule(rules []RateLimitRule, r *http.Request) *RateLimitRule {
+	for i := range rules {
+		if rules[i].matches(r) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// A burst of requests against each algorithm: the token bucket lets
+// burst_limit through at once, the sliding window only
+// requests_per_second × window
+func TestRateLimitAlgorithms(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      string
+		wantAllowed int
+	}{
+		{"token bucket", "algorithm = token_bucket\nrequests_per_second = 2\nburst_limit = 5\n", 5},
+		{"sliding window", "algorithm = sliding_window\nrequests_per_second = 2\nburst_limit = 5\n", 2},
+		{"sliding window over several seconds", "algorithm = sliding_window\nrequests_per_second = 2\nwindow = 3\nburst_limit = 5\n", 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, "[rate_limiting]\n"+tt.config)
+			limiter := getRateLimiter("198.51.100.7", nil)
+			allowed := 0
+			for i := 0; i < 20; i++ {
+				if limiter.Allow() {
+					allowed++
+				}
+			}
+			if allowed != tt.wantAllowed {
+				t.Errorf("%d of 20 requests allowed, want %d", allowed, tt.wantAllowed)
+			}
+		})
+	}
+}
+
+func TestSlidingWindowLimiter(t *testing.T) {
+	limiter := newSlidingWindowLimiter(3, 50*time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if !limiter.Allow() {
+			t.Fatalf("request %d refused within the limit", i)
+		}
+	}
+	if limiter.Allow() {
+		t.Fatal("request over the limit allowed")
+	}
+
+	// Once the first requests slide out of the window, new ones fit
+	time.Sleep(60 * time.Millisecond)
+	if !limiter.Allow() {
+		t.Error("request refused after the window passed")
+	}
+}
+
+// Rate limited requests get 429 from the middleware
+func TestRateLimitMiddleware(t *testing.T) {
+	loadTestConfig(t, "[rate_limiting]\nalgorithm = sliding_window\nrequests_per_second = 1\n")
+	handler := rateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	codes := make([]int, 3)
+	for i := range codes {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		r.RemoteAddr = "198.51.100.8:1234"
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, r)
+		codes[i] = recorder.Code
+	}
+	if codes[0] != http.StatusOK || codes[1] != http.StatusTooManyRequests || codes[2] != http.StatusTooManyRequests {
+		t.Errorf("statuses %v, want 200 then 429s", codes)
+	}
+}
+
+func TestTooManyRequestsBody(t *testing.T) {
+	bodyFile := filepath.Join(t.TempDir(), "429.html")
+	if err := os.WriteFile(bodyFile, []byte("<h1>Slow down</h1>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name            string
+		config          string
+		wantBody        string
+		wantContentType string
+	}{
+		{"default", "", "Too Many Requests\n", "text/plain; charset=utf-8"},
+		{"inline", "response_body = {\"error\": \"rate_limited\"}\nresponse_content_type = application/json\n", `{"error": "rate_limited"}`, "application/json"},
+		{"file", "response_body = @" + bodyFile + "\nresponse_content_type = text/html\n", "<h1>Slow down</h1>", "text/html"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, "[rate_limiting]\nrequests_per_second = 1\nburst_limit = 1\n"+tt.config)
+			handler := rateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			var got *httptest.ResponseRecorder
+			for i := 0; i < 2; i++ {
+				r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+				r.RemoteAddr = "198.51.100.9:1234"
+				got = httptest.NewRecorder()
+				handler.ServeHTTP(got, r)
+			}
+			if got.Code != http.StatusTooManyRequests {
+				t.Fatalf("status %d, want 429", got.Code)
+			}
+			if got.Body.String() != tt.wantBody || got.Header().Get("Content-Type") != tt.wantContentType {
+				t.Errorf("got %q as %q, want %q as %q", got.Body.String(), got.Header().Get("Content-Type"), tt.wantBody, tt.wantContentType)
+			}
+		})
+	}
+}
+
+func TestLoadResponseBodyMissingFile(t *testing.T) {
+	if _, err := loadResponseBody("@" + filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("loadResponseBody succeeded for a missing file")
+	}
+}
+
+func TestMatchRateLimitRule(t *testing.T) {
+	cfg, err := ini.Load([]byte(`
+[rate_limiting.orders]
+methods = post, PUT
+path_prefix = /orders
+requests_per_second = 2
+
+[rate_limiting.writes]
+methods = POST
+requests_per_second = 10
+
+[rate_limiting.search]
+path_prefix = /search
+requests_per_second = 5
+burst_limit = 7
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := loadRateLimitRules(cfg, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules[0].BurstLimit != 3 || rules[2].BurstLimit != 7 {
+		t.Errorf("burst limits %d and %d, want the default 3 and 7", rules[0].BurstLimit, rules[2].BurstLimit)
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		want   string
+	}{
+		{http.MethodPost, "/orders/42", "rate_limiting.orders"},
+		{http.MethodPut, "/orders", "rate_limiting.orders"},
+		{http.MethodPost, "/cart", "rate_limiting.writes"},
+		{http.MethodGet, "/search?q=coffee", "rate_limiting.search"},
+		{http.MethodGet, "/orders", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			got := ""
+			if rule := matchRateLimitRule(rules, httptest.NewRequest(tt.method, "http://example.com"+tt.path, nil)); rule != nil {
+				got = rule.Name
+			}
+			if got != tt.want {
+				t.Errorf("matched %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	invalid, _ := ini.Load([]byte("[rate_limiting.orders]\npath_prefix = /orders\n"))
+	if _, err := loadRateLimitRules(invalid, 3); err == nil {
+		t.Error("rule without requests_per_second accepted")
+	}
+}
+
+// Writes hit their own limit while reads from the same client keep to the
+// global one
+func TestRateLimitRulesMiddleware(t *testing.T) {
+	loadTestConfig(t, "[rate_limiting]\nrequests_per_second = 50\nburst_limit = 50\n[rate_limiting.orders]\nmethods = POST\npath_prefix = /orders\nrequests_per_second = 2\nburst_limit = 2\n")
+	handler := rateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func(method, path string) int {
+		r := httptest.NewRequest(method, "http://example.com"+path, nil)
+		r.RemoteAddr = "198.51.100.10:1234"
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, r)
+		return recorder.Code
+	}
+
+	for i := 0; i < 2; i++ {
+		if code := serve(http.MethodPost, "/orders"); code != http.StatusOK {
+			t.Fatalf("write %d got %d within its limit", i, code)
+		}
+	}
+	if code := serve(http.MethodPost, "/orders"); code != http.StatusTooManyRequests {
+		t.Errorf("third write got %d, want 429", code)
+	}
+	for i := 0; i < 20; i++ {
+		if code := serve(http.MethodGet, "/orders"); code != http.StatusOK {
+			t.Fatalf("read %d got %d after the writes were limited", i, code)
+		}
+	}
+}
+
+func TestClientNetwork(t *testing.T) {
+	tests := []struct {
+		ip         string
+		ipv4Prefix int
+		ipv6Prefix int
+		want       string
+	}{
+		{"198.51.100.7", 32, 128, "198.51.100.7/32"},
+		{"198.51.100.7", 24, 128, "198.51.100.0/24"},
+		{"2001:db8:1:2:3:4:5:6", 32, 64, "2001:db8:1:2::/64"},
+		{"2001:db8:1:2:3:4:5:6", 32, 128, "2001:db8:1:2:3:4:5:6/128"},
+		{"::ffff:198.51.100.7", 24, 64, "198.51.100.0/24"},
+		{"not-an-ip", 24, 64, "not-an-ip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := clientNetwork(tt.ip, tt.ipv4Prefix, tt.ipv6Prefix); got != tt.want {
+				t.Errorf("clientNetwork = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// Addresses in one block share a limiter, so rotating within it doesn't
+// get around the limit
+func TestRateLimitBySubnet(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      string
+		first       string
+		second      string
+		wantLimited bool
+	}{
+		{"same ipv6 /64", "ipv6_prefix = 64\n", "2001:db8:0:1::1", "2001:db8:0:1::2", true},
+		{"other ipv6 /64", "ipv6_prefix = 64\n", "2001:db8:0:1::1", "2001:db8:0:2::1", false},
+		{"same ipv4 /24", "ipv4_prefix = 24\n", "198.51.100.1", "198.51.100.2", true},
+		{"exact ipv4 by default", "", "198.51.100.1", "198.51.100.2", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, "[rate_limiting]\nrequests_per_second = 1\nburst_limit = 1\n"+tt.config)
+			if !getRateLimiter(tt.first, nil).Allow() {
+				t.Fatal("first request refused")
+			}
+			if limited := !getRateLimiter(tt.second, nil).Allow(); limited != tt.wantLimited {
+				t.Errorf("second address limited = %v, want %v", limited, tt.wantLimited)
+			}
+		})
+	}
+}
+
+func TestRateLimitPrefixInvalid(t *testing.T) {
+	for _, prefix := range []string{"ipv4_prefix = 0", "ipv4_prefix = 33", "ipv6_prefix = 129"} {
+		path := filepath.Join(t.TempDir(), "system.conf")
+		if err := os.WriteFile(path, []byte(testConfigBase+"[rate_limiting]\n"+prefix+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := loadConfig(path); err == nil {
+			t.Errorf("loadConfig accepted %s", prefix)
+		}
+	}
+}
+
+// Requests for a domain's exempt paths are never limited, while its other
+// paths and other domains still are
+func TestRateLimitExemptPaths(t *testing.T) {
+	tests := []struct {
+		name        string
+		host        string
+		path        string
+		wantLimited bool
+	}{
+		{"prefix", "example.com", "/healthz", false},
+		{"below prefix", "example.com", "/healthz/db", false},
+		{"pattern", "example.com", "/api/v2/metrics", false},
+		{"other path", "example.com", "/login", true},
+		{"dot segments", "example.com", "/healthz/../login", true},
+		{"other domain", "other.example.com", "/healthz", true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, "[rate_limiting]\nrequests_per_second = 1\nburst_limit = 1\n")
+			loadTestDomains(t, map[string]string{
+				"example.com":       "[proxy]\nbackend_url = http://127.0.0.1:1\nrate_limit_exempt_paths = /healthz, ~^/api/v[0-9]+/metrics$\n",
+				"other.example.com": "[proxy]\nbackend_url = http://127.0.0.1:1\n",
+			})
+			handler := rateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			limited := 0
+			for j := 0; j < 20; j++ {
+				r := httptest.NewRequest(http.MethodGet, "http://"+tt.host+tt.path, nil)
+				r.RemoteAddr = fmt.Sprintf("198.51.100.%d:1234", 20+i)
+				recorder := httptest.NewRecorder()
+				handler.ServeHTTP(recorder, r)
+				if recorder.Code == http.StatusTooManyRequests {
+					limited++
+				}
+			}
+			if (limited > 0) != tt.wantLimited {
+				t.Errorf("%d of 20 requests limited, want limited %v", limited, tt.wantLimited)
+			}
+		})
+	}
+}
+
+func TestParseRateLimitExemptions(t *testing.T) {
+	tests := []struct {
+		values  []string
+		wantErr bool
+	}{
+		{nil, false},
+		{[]string{"/healthz", "/metrics"}, false},
+		{[]string{"~^/status/[a-z]+$"}, false},
+		{[]string{"healthz"}, true},
+		{[]string{"~(unclosed"}, true},
+	}
+	for _, tt := range tests {
+		if _, err := parseRateLimitExemptions(tt.values); (err != nil) != tt.wantErr {
+			t.Errorf("parseRateLimitExemptions(%q) error = %v, want error %v", tt.values, err, tt.wantErr)
+		}
+	}
+}
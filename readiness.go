@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// ready is true while the proxy wants new traffic: from the moment it is
+// serving until shutdown begins
+var ready atomic.Bool
+
+// Report readiness for load balancer and Kubernetes probes. With
+// ready_min_healthy_domains set, the proxy is also not ready while fewer
+// domains than that have a healthy backend, as it has little to serve.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	if !ready.Load() {
+		http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if required := currentConfig().Admin.ReadyMinHealthyDomains; required > 0 && healthyDomainCount() < required {
+		http.Error(w, "Too few domains with a healthy backend", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("OK\n"))
+}
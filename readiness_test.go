@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// Readiness follows ready_min_healthy_domains as backends go down, counting
+// a domain once however many aliases it has
+func TestReadyHealthyDomains(t *testing.T) {
+	backend := newNamedBackend(t, "site")
+	tests := []struct {
+		name       string
+		required   int
+		down       []string
+		shutdown   bool
+		wantStatus int
+	}{
+		{"no threshold, all down", 0, []string{"a.example.com", "b.example.com"}, false, http.StatusOK},
+		{"all up", 1, nil, false, http.StatusOK},
+		{"partly up", 1, []string{"a.example.com"}, false, http.StatusOK},
+		{"all down", 1, []string{"a.example.com", "b.example.com"}, false, http.StatusServiceUnavailable},
+		{"both required, one down", 2, []string{"b.example.com"}, false, http.StatusServiceUnavailable},
+		{"both required, both up", 2, nil, false, http.StatusOK},
+		{"aliases not counted", 3, nil, false, http.StatusServiceUnavailable},
+		{"shutting down", 0, nil, true, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, "[admin]\nready_min_healthy_domains = "+strconv.Itoa(tt.required)+"\n")
+			loadTestDomains(t, map[string]string{
+				"a.example.com": "[proxy]\nbackend_url = " + backend.URL + "\naliases = www.a.example.com\n",
+				"b.example.com": "[proxy]\nbackend_url = " + backend.URL + "\n",
+			})
+			ready.Store(!tt.shutdown)
+			t.Cleanup(func() { ready.Store(false) })
+
+			mutex.RLock()
+			for _, name := range tt.down {
+				for _, group := range proxyMap[name].groups {
+					for _, b := range group.backends {
+						b.health.unhealthy.Store(true)
+					}
+				}
+			}
+			mutex.RUnlock()
+
+			recorder := httptest.NewRecorder()
+			readyHandler(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if recorder.Code != tt.wantStatus {
+				t.Errorf("status %d, want %d: %s", recorder.Code, tt.wantStatus, recorder.Body)
+			}
+		})
+	}
+}
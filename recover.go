@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+var handlerPanics = newCounterVec("handler_panics_total", "Requests whose handler panicked.")
+
+// Recover from a panic while handling a request so it doesn't take the
+// connection down with it, logging the stack trace. The client gets a 500
+// if nothing was written yet; otherwise the response can't be repaired and
+// the connection is closed as net/http would. http.ErrAbortHandler, the
+// deliberate way to abort a response, is passed on untouched.
+func recoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+
+			handlerPanics.inc()
+			logger.Error("Panic while handling request",
+				"method", r.Method,
+				"host", r.Host,
+				"path", r.URL.Path,
+				"request_id", r.Header.Get("X-Request-Id"),
+				"panic", fmt.Sprint(v),
+				"stack", string(debug.Stack()))
+
+			if recorder.status != 0 {
+				panic(http.ErrAbortHandler)
+			}
+			http.Error(recorder, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(recorder, r)
+	})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// A panic before anything was written becomes a clean 500 with the stack
+// logged; one after the response started, or a deliberate abort, still
+// aborts the connection
+func TestRecoverMiddleware(t *testing.T) {
+	tests := []struct {
+		name       string
+		handler    http.HandlerFunc
+		wantStatus int
+		wantAbort  bool
+		wantLogged bool
+	}{
+		{
+			"panic", func(w http.ResponseWriter, r *http.Request) {
+				var routes map[string]string
+				routes["/"] = "home"
+			}, http.StatusInternalServerError, false, true,
+		},
+		{
+			"panic after writing", func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+				panic("half-written")
+			}, http.StatusOK, true, true,
+		},
+		{
+			"abort", func(w http.ResponseWriter, r *http.Request) {
+				panic(http.ErrAbortHandler)
+			}, 0, true, false,
+		},
+		{
+			"no panic", func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("ok"))
+			}, http.StatusOK, false, false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, "")
+			logs := captureLogs(t)
+			before := counterValue(handlerPanics)
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/shop", nil)
+			r.Header.Set("X-Request-Id", "req-42")
+			recorder := httptest.NewRecorder()
+
+			aborted := func() (aborted bool) {
+				defer func() {
+					if v := recover(); v != nil {
+						if v != http.ErrAbortHandler {
+							t.Fatalf("re-panicked with %v, want http.ErrAbortHandler", v)
+						}
+						aborted = true
+					}
+				}()
+				recoverMiddleware(tt.handler).ServeHTTP(recorder, r)
+				return false
+			}()
+
+			if aborted != tt.wantAbort {
+				t.Errorf("aborted %v, want %v", aborted, tt.wantAbort)
+			}
+			if tt.wantStatus != 0 && recorder.Code != tt.wantStatus {
+				t.Errorf("status %d, want %d", recorder.Code, tt.wantStatus)
+			}
+			output := logs.String()
+			logged := strings.Contains(output, "Panic while handling request")
+			if logged != tt.wantLogged {
+				t.Fatalf("panic logged %v, want %v: %s", logged, tt.wantLogged, output)
+			}
+			if !logged {
+				return
+			}
+			for _, want := range []string{"method=GET", "host=example.com", "path=/shop", "request_id=req-42", "recover_test.go"} {
+				if !strings.Contains(output, want) {
+					t.Errorf("log missing %q: %s", want, output)
+				}
+			}
+			if got := counterValue(handlerPanics) - before; got != 1 {
+				t.Errorf("handler_panics_total rose by %d, want 1", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Shared Redis for rate limiting across proxy instances; nil when redis_url
+// is unset. Guarded by limiterLock.
+var rateLimitRedis *redis.Client
+
+// How long a limiter waits for Redis before falling back to its local state
+const redisLimiterTimeout = 100 * time.Millisecond
+
+// Token bucket kept in a Redis hash, so every instance draws from the same
+// bucket. Redis's own clock is used so instances with skewed clocks agree.
+// Returns 1 if a token was taken.
+var tokenBucketScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local clock = redis.call('TIME')
+local now = tonumber(clock[1]) + tonumber(clock[2]) / 1000000
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens = tonumber(state[1]) or burst
+local updated = tonumber(state[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - updated) * rate)
+
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'updated', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return allowed
+`)
+
+// How long limiters stay local after Redis fails before trying it again,
+// so an outage doesn't add redisLimiterTimeout to every request
+const redisRetryInterval = time.Second
+
+// Whether the last Redis call failed, so an outage is logged once rather
+// than for every request, and when Redis may next be tried (Unix nanoseconds)
+var (
+	redisLimiterDown atomic.Bool
+	redisNextAttempt atomic.Int64
+)
+
+// redisLimiter enforces a client's limit across all instances sharing
+// Redis. While Redis can't be reached it fails open to a local limiter
+// with the same settings, so each instance still applies the limit itself.
+type redisLimiter struct {
+	client   *redis.Client
+	key      string
+	rate     int
+	burst    int
+	fallback Limiter
+}
+
+func (l *redisLimiter) Allow() bool {
+	if redisLimiterDown.Load() && time.Now().UnixNano() < redisNextAttempt.Load() {
+		return l.fallback.Allow()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisLimiterTimeout)
+	defer cancel()
+
+	allowed, err := tokenBucketScript.Run(ctx, l.client, []string{l.key}, l.rate, l.burst).Int()
+	if err != nil {
+		redisNextAttempt.Store(time.Now().Add(redisRetryInterval).UnixNano())
+		if !redisLimiterDown.Swap(true) {
+			logger.Error("Rate limiting Redis unavailable, limiting locally", "error", err)
+		}
+		return l.fallback.Allow()
+	}
+	if redisLimiterDown.Swap(false) {
+		logger.Info("Rate limiting Redis available again")
+	}
+	return allowed == 1
+}
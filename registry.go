@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/ini.v1"
+	"gopkg.in/yaml.v3"
+)
+
+// domainWatchers key of the registry watcher, which is not a directory
+const registryWatcherKey = "registry"
+
+// The registry's last good contents, used when a reload finds it invalid
+var (
+	lastRegistry     map[string]*ini.File
+	lastRegistryPath string
+)
+
+// Read the domain registry: one entry per hostname, either a backend URL or
+// a map of the sections and keys a .conf file for the domain would have.
+// The format follows the extension: .json, or .yaml/.yml.
+func loadRegistry(path string) (map[string]*ini.File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		// Keep numbers as written; as float64, large ones would print in
+		// exponent form, which the ini parsers reject
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		err = decoder.Decode(&entries)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &entries)
+	default:
+		return nil, fmt.Errorf("unknown registry format %q, expected .json, .yaml or .yml", filepath.Ext(path))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	domains := make(map[string]*ini.File, len(entries))
+	for domain, entry := range entries {
+		cfg, err := registryEntryConfig(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", domain, err)
+		}
+		domains[domain] = cfg
+	}
+	return domains, nil
+}
+
+// Turn one registry entry into the equivalent domain .conf contents
+func registryEntryConfig(entry interface{}) (*ini.File, error) {
+	cfg := ini.Empty()
+	switch entry := entry.(type) {
+	case string:
+		cfg.Section("proxy").Key("backend_url").SetValue(entry)
+	case map[string]interface{}:
+		for sectionName, keys := range entry {
+			keys, ok := keys.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("section %q must be a map of keys", sectionName)
+			}
+			section := cfg.Section(sectionName)
+			for name, value := range keys {
+				section.Key(name).SetValue(registryValue(value))
+			}
+		}
+	default:
+		return nil, fmt.Errorf("entry must be a backend URL or a map of sections")
+	}
+	return cfg, nil
+}
+
+// Format a registry value as an ini value; lists become comma-separated
+func registryValue(value interface{}) string {
+	if list, ok := value.([]interface{}); ok {
+		items := make([]string, len(list))
+		for i, item := range list {
+			items[i] = registryScalar(item)
+		}
+		return strings.Join(items, ",")
+	}
+	return registryScalar(value)
+}
+
+// Format a single registry value. Floats, as YAML decodes 1.5 or 1e6, are
+// written out in full so MustInt64 and MustFloat64 can parse them.
+func registryScalar(value interface{}) string {
+	if f, ok := value.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
+
+// Return the registry's domains, sorted by name. If the registry cannot be
+// read, the contents last read from the same file are used instead.
+func registryDomains(path string) ([]string, map[string]*ini.File) {
+	domains, err := loadRegistry(path)
+	if err != nil {
+		if path != lastRegistryPath {
+			lastRegistry = nil
+		}
+		logger.Error("Error loading domain registry, keeping its previous domains", "file", path, "error", err)
+		domains = lastRegistry
+	} else {
+		lastRegistry, lastRegistryPath = domains, path
+	}
+
+	names := make([]string, 0, len(domains))
+	for name := range domains {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, domains
+}
+
+// Reload the domains whenever the registry file changes, until ctx is
+// cancelled. The file's directory is watched so that editors replacing the
+// file are noticed. Starting a new watch stops the previous one.
+func watchRegistry(ctx context.Context, path string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	domainWatchersLock.Lock()
+	if stop, exists := domainWatchers[registryWatcherKey]; exists {
+		stop()
+	}
+	domainWatchers[registryWatcherKey] = cancel
+	domainWatchersLock.Unlock()
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != filepath.Clean(path) {
+					continue
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+					logger.Info("Domain registry changed, reloading", "file", event.Name, "op", event.Op.String())
+					loadDomains(domainsDirectory)
+				}
+
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.Error("Error watching domain registry", "file", path, "error", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop watching the registry, if it is watched
+func stopWatchingRegistry() {
+	domainWatchersLock.Lock()
+	defer domainWatchersLock.Unlock()
+	if stop, exists := domainWatchers[registryWatcherKey]; exists {
+		stop()
+		delete(domainWatchers, registryWatcherKey)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadRegistry(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		contents string
+		domain   string
+		section  string
+		key      string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "json backend url",
+			file:     "registry.json",
+			contents: `{"example.com": "http://127.0.0.1:3000"}`,
+			domain:   "example.com", section: "proxy", key: "backend_url",
+			want: "http://127.0.0.1:3000",
+		},
+		{
+			name:     "json large number",
+			file:     "registry.json",
+			contents: `{"example.com": {"proxy": {"backend_url": "http://127.0.0.1:3000", "max_response_size": 10485760}}}`,
+			domain:   "example.com", section: "proxy", key: "max_response_size",
+			want: "10485760",
+		},
+		{
+			name:     "json fraction",
+			file:     "registry.json",
+			contents: `{"example.com": {"proxy": {"request_timeout": 2.5}}}`,
+			domain:   "example.com", section: "proxy", key: "request_timeout",
+			want: "2.5",
+		},
+		{
+			name:     "json list",
+			file:     "registry.json",
+			contents: `{"example.com": {"proxy": {"aliases": ["www.example.com", "example.org"]}}}`,
+			domain:   "example.com", section: "proxy", key: "aliases",
+			want: "www.example.com,example.org",
+		},
+		{
+			name:     "yaml large float",
+			file:     "registry.yaml",
+			contents: "example.com:\n  proxy:\n    max_response_size: 1.048576e+07\n",
+			domain:   "example.com", section: "proxy", key: "max_response_size",
+			want: "10485760",
+		},
+		{
+			name:     "yaml bool",
+			file:     "registry.yml",
+			contents: "example.com:\n  proxy:\n    backend_http2: false\n",
+			domain:   "example.com", section: "proxy", key: "backend_http2",
+			want: "false",
+		},
+		{
+			name:     "section not a map",
+			file:     "registry.json",
+			contents: `{"example.com": {"proxy": "http://127.0.0.1:3000"}}`,
+			wantErr:  true,
+		},
+		{
+			name:     "entry not a url or map",
+			file:     "registry.json",
+			contents: `{"example.com": 3000}`,
+			wantErr:  true,
+		},
+		{
+			name:     "unknown format",
+			file:     "registry.toml",
+			contents: `example = "x"`,
+			wantErr:  true,
+		},
+		{
+			name:     "invalid json",
+			file:     "registry.json",
+			contents: `{"example.com": `,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, []byte(tt.contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+			domains, err := loadRegistry(path)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("loadRegistry succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg := domains[tt.domain]
+			if cfg == nil {
+				t.Fatalf("no entry for %s", tt.domain)
+			}
+			if got := cfg.Section(tt.section).Key(tt.key).String(); got != tt.want {
+				t.Errorf("%s.%s = %q, want %q", tt.section, tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+// A large max_response_size from the registry has to reach the domain
+// rather than falling back to MustInt64's default
+func TestRegistryLargeNumberReachesDomain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.json")
+	if err := os.WriteFile(path, []byte(`{"example.com": {"proxy": {"backend_url": "http://127.0.0.1:3000", "max_response_size": 10485760}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	domains, err := loadRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	domainConfig, err := loadDomainConfig(domains["example.com"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if domainConfig.MaxResponseSize != 10485760 {
+		t.Errorf("MaxResponseSize = %d, want 10485760", domainConfig.MaxResponseSize)
+	}
+}
+
+// Reloading picks up registry changes, and an invalid registry keeps the
+// domains it had
+func TestRegistryReload(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("backend"))
+	}))
+	defer backend.Close()
+
+	path := filepath.Join(t.TempDir(), "registry.json")
+	write := func(contents string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	status := func(host string) int {
+		return serveTest(httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)).Code
+	}
+
+	write(`{"a.example.com": "` + backend.URL + `"}`)
+	loadTestConfig(t, "[domains]\nregistry = "+path+"\n")
+	loadTestDomains(t, nil)
+
+	steps := []struct {
+		name     string
+		registry string
+		want     map[string]int
+	}{
+		{"initial", "", map[string]int{"a.example.com": http.StatusOK, "b.example.com": http.StatusNotFound}},
+		{"domain added", `{"a.example.com": "` + backend.URL + `", "b.example.com": "` + backend.URL + `"}`, map[string]int{"a.example.com": http.StatusOK, "b.example.com": http.StatusOK}},
+		{"invalid registry", `{"a.example.com": `, map[string]int{"a.example.com": http.StatusOK, "b.example.com": http.StatusOK}},
+		{"domain removed", `{"b.example.com": "` + backend.URL + `"}`, map[string]int{"a.example.com": http.StatusNotFound, "b.example.com": http.StatusOK}},
+	}
+	for _, step := range steps {
+		if step.registry != "" {
+			write(step.registry)
+		}
+		if err := loadDomains(filepath.Join(t.TempDir(), "none")); err != nil {
+			t.Fatal(err)
+		}
+		for host, want := range step.want {
+			if got := status(host); got != want {
+				t.Errorf("%s: %s got %d, want %d", step.name, host, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"reflect"
+	"sync"
+	"sync/atomic"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	systemConfigFile = "system.conf"
+	domainsDirectory = "./list_domain"
+)
+
+// State built from system.conf alongside Config and swapped in with it
+type configState struct {
+	whitelist       *ipList
+	blacklist       *ipList
+	stopIPLists     context.CancelFunc
+	accessLogFormat *logFormat
+	logger          *slog.Logger
+	// Files answered directly for every host, unless the domain
+	// configures its own
+	robotsTxt *staticFile
+	favicon   *staticFile
+	// Body of 429 responses, from [rate_limiting] response_body
+	rateLimitBody []byte
+	// Pages from system.conf, used for domains without their own
+	errorPages   map[int]*staticFile
+	redisOptions *redis.Options
+}
+
+// runtimeConfig is a config installed by applyConfig together with the
+// state built from it
+type runtimeConfig struct {
+	Config
+	configState
+}
+
+// The running config. Requests read it while a reload installs the next
+// one, so it is only ever replaced whole, never changed in place.
+var live atomic.Pointer[runtimeConfig]
+
+// The config the proxy started with. Settings that only take effect on a
+// restart, such as use_worker_pool, are read from it, so a reload can't
+// half apply them. Set once before serving.
+var startupConfig = &Config{}
+
+func init() {
+	live.Store(&runtimeConfig{configState: configState{
+		whitelist: &ipList{name: "whitelist"},
+		blacklist: &ipList{name: "blacklist"},
+	}})
+}
+
+func currentConfig() *Config {
+	return &live.Load().Config
+}
+
+func currentState() *configState {
+	return &live.Load().configState
+}
+
+// Install a fully loaded config, replacing the running one
+func applyConfig(newConfig Config, state configState) {
+	previous := *currentConfig()
+	previousState := currentState()
+	live.Store(&runtimeConfig{Config: newConfig, configState: state})
+
+	setLogger(state.logger)
+	if previousState.stopIPLists != nil {
+		previousState.stopIPLists()
+	}
+
+	cache.setMaxEntries(newConfig.Cache.MaxEntries)
+
+	// Rate limiters are created from the config, so start over when it changes
+	if rateLimitSettingsChanged(previous, newConfig) {
+		limiterLock.Lock()
+		rateLimiter = make(map[string]*limiterEntry)
+		if previous.RateLimiting.RedisURL != newConfig.RateLimiting.RedisURL {
+			if rateLimitRedis != nil {
+				rateLimitRedis.Close()
+				rateLimitRedis = nil
+			}
+			if state.redisOptions != nil {
+				rateLimitRedis = redis.NewClient(state.redisOptions)
+			}
+		}
+		limiterLock.Unlock()
+	}
+}
+
+func rateLimitSettingsChanged(previous, current Config) bool {
+	a, b := previous.RateLimiting, current.RateLimiting
+	a.ResponseBody, a.ResponseContentType = "", ""
+	b.ResponseBody, b.ResponseContentType = "", ""
+	return !reflect.DeepEqual(a, b)
+}
+
+// Report settings that differ between two configs but only take effect
+// when the listeners are set up, i.e. after a restart or hot upgrade
+func restartRequiredChanges(previous, current Config) []string {
+	var changed []string
+	check := func(name string, a, b interface{}) {
+		if !reflect.DeepEqual(a, b) {
+			changed = append(changed, name)
+		}
+	}
+	check("timeouts", previous.Timeouts, current.Timeouts)
+	check("ssl", previous.SSL, current.SSL)
+	check("admin.listen", previous.Admin.Listen, current.Admin.Listen)
+	check("admin.socket_path", previous.Admin.SocketPath, current.Admin.SocketPath)
+	check("admin.socket_mode", previous.Admin.SocketMode, current.Admin.SocketMode)
+	check("debug.pprof", previous.Debug.Pprof, current.Debug.Pprof)
+	check("middleware", previous.Middleware, current.Middleware)
+	check("server.max_connections", previous.Server.MaxConnections, current.Server.MaxConnections)
+	check("server.max_header_bytes", previous.Server.MaxHeaderBytes, current.Server.MaxHeaderBytes)
+	check("server.use_worker_pool", previous.Server.UseWorkerPool, current.Server.UseWorkerPool)
+	check("server.workers", previous.Server.Workers, current.Server.Workers)
+	check("server.reuse_port", previous.Server.ReusePort, current.Server.ReusePort)
+	check("server.listen", previous.Server.Listen, current.Server.Listen)
+	check("rate_limiting.limiter_ttl", previous.RateLimiting.LimiterTTL, current.RateLimiting.LimiterTTL)
+	return changed
+}
+
+// reloadLock keeps a SIGHUP reload from interleaving with another one
+var reloadLock sync.Mutex
+
+// Re-read system.conf and all domain configs without dropping connections.
+// If system.conf is invalid, the running config stays in place.
+func reload() {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	previous := *currentConfig()
+	if err := loadConfig(systemConfigFile); err != nil {
+		logger.Error("Reload failed, keeping the current configuration", "error", err)
+		return
+	}
+	if changed := restartRequiredChanges(previous, *currentConfig()); len(changed) > 0 {
+		logger.Warn("Some changed settings only take effect after a restart", "settings", changed)
+	}
+
+	if err := loadDomains(domainsDirectory); err != nil {
+		logger.Error("Reload failed to load domains, keeping the current domains", "error", err)
+		return
+	}
+	if registry := currentConfig().Domains.Registry; registry != previous.Domains.Registry {
+		stopWatchingRegistry()
+		if registry != "" {
+			if err := watchRegistry(context.Background(), registry); err != nil {
+				logger.Error("Failed to watch domain registry", "file", registry, "error", err)
+			}
+		}
+	}
+	logger.Info("Configuration reloaded")
+}
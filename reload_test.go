@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestRestartRequiredChanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(*Config)
+		want   []string
+	}{
+		{"nothing", func(c *Config) {}, nil},
+		{"reloadable", func(c *Config) { c.RateLimiting.RequestsPerSecond = 50 }, nil},
+		{"worker pool", func(c *Config) { c.Server.UseWorkerPool = true }, []string{"server.use_worker_pool"}},
+		{"middleware", func(c *Config) { c.Middleware.Logging = true }, []string{"middleware"}},
+		{"listen", func(c *Config) { c.Server.Listen = []string{":9090"} }, []string{"server.listen"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var previous Config
+			previous.Server.Listen = []string{":8080"}
+			current := previous
+			current.Server.Listen = []string{":8080"}
+			tt.change(&current)
+			got := restartRequiredChanges(previous, current)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("restartRequiredChanges = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Requests keep reading the config while reloads replace it; run with
+// -race to check they never see one half installed
+func TestReloadWhileServing(t *testing.T) {
+	loadTestConfig(t, "[rate_limiting]\nresponse_body = slow down\n")
+
+	path := filepath.Join(t.TempDir(), "system.conf")
+	if err := os.WriteFile(path, []byte(testConfigBase+"[rate_limiting]\nresponse_body = later\n[logging]\nlog_format = json\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				recorder := httptest.NewRecorder()
+				writeTooManyRequests(recorder)
+				if body := recorder.Body.String(); body != "slow down" && body != "later" {
+					t.Errorf("429 body = %q", body)
+					return
+				}
+				currentState().blacklist.contains(net.ParseIP("203.0.113.10"))
+				logger.Debug("serving")
+			}
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		if err := loadConfig(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+}
+
+// use_worker_pool only takes effect on a restart, so a reload turning it
+// on must not send requests to a pool that was never started
+func TestWorkerPoolReadFromStartupConfig(t *testing.T) {
+	loadTestConfig(t, "")
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	loadTestDomains(t, map[string]string{"example.com": "[proxy]\nbackend_url = " + backend.URL + "\n"})
+
+	path := filepath.Join(t.TempDir(), "system.conf")
+	if err := os.WriteFile(path, []byte(testConfigBase+"[server]\nuse_worker_pool = true\nqueue_timeout = 0.01\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	if got := serveTest(r); got.Code != http.StatusOK || got.Body.String() != "ok" {
+		t.Errorf("got %d %q, want 200 from the backend", got.Code, got.Body.String())
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Header clients use to ask for a shorter deadline than the backend timeout
+const requestTimeoutHeader = "X-Request-Timeout"
+
+// Parse a client's requested timeout: a Go duration such as "1.5s" or
+// "500ms", or a number of seconds. Returns false for malformed or
+// non-positive values, which are ignored.
+func parseRequestTimeout(value string) (time.Duration, bool) {
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return 0, false
+		}
+		timeout = time.Duration(seconds * float64(time.Second))
+	}
+	if timeout <= 0 {
+		return 0, false
+	}
+	return timeout, true
+}
+
+// Bound a request by the deadline its client asked for in X-Request-Timeout,
+// clamped to max. The returned cancel function must be called once the
+// request is done. When the deadline passes, the backend request is
+// cancelled and the client gets 504.
+func withRequestTimeout(r *http.Request, max time.Duration) (*http.Request, context.CancelFunc) {
+	value := r.Header.Get(requestTimeoutHeader)
+	if value == "" {
+		return r, func() {}
+	}
+	timeout, ok := parseRequestTimeout(value)
+	if !ok {
+		logger.Debug("Ignoring invalid request timeout", "host", r.Host, "value", value)
+		return r, func() {}
+	}
+	if timeout > max {
+		timeout = max
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	return r.WithContext(ctx), cancel
+}
+
+// Answer a request whose context ended while it was waiting for something
+// before the backend: 504 if its X-Request-Timeout passed, nothing if the
+// client went away
+func endedBeforeBackend(w http.ResponseWriter, r *http.Request, domain, waitingFor string) {
+	if errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+		logger.Debug("Request timeout passed while waiting for "+waitingFor, "domain", domain)
+		writeErrorPage(w, r, http.StatusGatewayTimeout)
+		return
+	}
+	logger.Debug("Client disconnected while waiting for "+waitingFor, "domain", domain)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseRequestTimeout(t *testing.T) {
+	tests := []struct {
+		value  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{"5s", 5 * time.Second, true},
+		{"500ms", 500 * time.Millisecond, true},
+		{"1.5", 1500 * time.Millisecond, true},
+		{"2", 2 * time.Second, true},
+		{"0", 0, false},
+		{"-1s", 0, false},
+		{"soon", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, ok := parseRequestTimeout(tt.value)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("parseRequestTimeout = %s, %v, want %s, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+// The client's deadline cuts the backend request short with 504, never
+// beyond max_request_timeout, and invalid values are ignored
+func TestRequestTimeoutHeader(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(300 * time.Millisecond):
+			w.Write([]byte("done"))
+		case <-r.Context().Done():
+		}
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name       string
+		timeout    string
+		wantStatus int
+		wantBefore time.Duration
+	}{
+		{"within max", "50ms", http.StatusGatewayTimeout, 200 * time.Millisecond},
+		{"clamped to max", "10s", http.StatusGatewayTimeout, 290 * time.Millisecond},
+		{"malformed", "soon", http.StatusOK, time.Second},
+		{"none", "", http.StatusOK, time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, "")
+			loadTestDomains(t, map[string]string{"example.com": "[proxy]\nbackend_url = " + backend.URL + "\nmax_request_timeout = 0.2\n"})
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			if tt.timeout != "" {
+				r.Header.Set(requestTimeoutHeader, tt.timeout)
+			}
+			start := time.Now()
+			got := serveTest(r)
+			if got.Code != tt.wantStatus {
+				t.Errorf("status %d, want %d", got.Code, tt.wantStatus)
+			}
+			if elapsed := time.Since(start); elapsed > tt.wantBefore {
+				t.Errorf("answered after %s, want within %s", elapsed, tt.wantBefore)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type resolvedBackend struct {
+	Name    string `json:"name"`
+	URL     string `json:"url"`
+	Healthy bool   `json:"healthy"`
+}
+
+type resolvedRateLimit struct {
+	Rule              string `json:"rule,omitempty"`
+	Algorithm         string `json:"algorithm"`
+	RequestsPerSecond int    `json:"requests_per_second"`
+	BurstLimit        int    `json:"burst_limit"`
+	Shared            bool   `json:"shared"`
+	// The domain's rate_limit_exempt_paths cover the path
+	Exempt bool `json:"exempt,omitempty"`
+}
+
+// What the proxy would do with a request, as reported by /admin/resolve
+type resolution struct {
+	Host        string   `json:"host"`
+	Path        string   `json:"path"`
+	Method      string   `json:"method"`
+	Middlewares []string `json:"middlewares"`
+
+	Domain    string `json:"domain,omitempty"`
+	MatchedBy string `json:"matched_by,omitempty"`
+
+	// Why the request would be answered without reaching a backend, if it would
+	Answer string `json:"answer,omitempty"`
+
+	Route        string            `json:"route,omitempty"`
+	Tenant       string            `json:"tenant,omitempty"`
+	StripCookies bool              `json:"strip_cookies,omitempty"`
+	Balance      string            `json:"balance,omitempty"`
+	Backends     []resolvedBackend `json:"backends,omitempty"`
+	// The backend ip_hash would pick; other strategies pick per request
+	Backend string `json:"backend,omitempty"`
+
+	RateLimit             *resolvedRateLimit `json:"rate_limit,omitempty"`
+	MaxConcurrentRequests int                `json:"max_concurrent_requests,omitempty"`
+	BackendRPS            float64            `json:"backend_rps,omitempty"`
+	Cached                bool               `json:"cached,omitempty"`
+}
+
+// Dry-run a request described by the query string (host, path, method and
+// optionally client_ip, repeated cookie=name=value, tenant, sent in the
+// domain's tenant header, and the local port it arrives on) through the routing
+// decisions, without proxying it
+func resolveHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	req := &http.Request{
+		Method:     strings.ToUpper(query.Get("method")),
+		Host:       query.Get("host"),
+		URL:        &url.URL{Path: query.Get("path")},
+		Header:     make(http.Header),
+		RemoteAddr: net.JoinHostPort(query.Get("client_ip"), "0"),
+	}
+	if req.Host == "" {
+		http.Error(w, "host is required", http.StatusBadRequest)
+		return
+	}
+	if req.Method == "" {
+		req.Method = http.MethodGet
+	}
+	if req.URL.Path == "" {
+		req.URL.Path = "/"
+	}
+	for _, cookie := range query["cookie"] {
+		req.Header.Add("Cookie", cookie)
+	}
+	tenant := query.Get("tenant")
+	if port := query.Get("port"); port != "" {
+		n, err := strconv.Atoi(port)
+		if err != nil || n < 1 || n > 65535 {
+			http.Error(w, "port must be a port number", http.StatusBadRequest)
+			return
+		}
+		req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, &net.TCPAddr{Port: n}))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resolve(req, tenant, query.Get("client_ip") != ""))
+}
+
+func resolve(r *http.Request, tenant string, haveClientIP bool) resolution {
+	res := resolution{Host: r.Host, Path: r.URL.Path, Method: r.Method, Middlewares: []string{}}
+	for _, m := range middlewareChain() {
+		if m.enabled {
+			res.Middlewares = append(res.Middlewares, m.name)
+		}
+	}
+
+	if startupConfig.Middleware.StaticFiles && staticFileFor(r) != nil && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		res.Answer = "static file"
+		return res
+	}
+	if startupConfig.Middleware.RateLimiting {
+		rateLimit := &resolvedRateLimit{
+			Algorithm:         currentConfig().RateLimiting.Algorithm,
+			RequestsPerSecond: currentConfig().RateLimiting.RequestsPerSecond,
+			BurstLimit:        currentConfig().RateLimiting.BurstLimit,
+			Shared:            currentConfig().RateLimiting.RedisURL != "",
+		}
+		if rule := matchRateLimitRule(currentConfig().RateLimiting.Rules, r); rule != nil {
+			rateLimit.Rule = rule.Name
+			rateLimit.RequestsPerSecond, rateLimit.BurstLimit = rule.RequestsPerSecond, rule.BurstLimit
+		}
+		res.RateLimit = rateLimit
+	}
+
+	dp, matchedBy := matchDomain(r)
+	if dp == nil {
+		res.Answer = "domain not found"
+		return res
+	}
+	res.MatchedBy = matchedBy
+	res.Domain = dp.name
+	if res.RateLimit != nil {
+		res.RateLimit.Exempt = dp.config.RateLimitExemptPaths.matches(r.URL.Path)
+	}
+	res.MaxConcurrentRequests = dp.config.MaxConcurrentRequests
+	res.BackendRPS = dp.config.BackendRPS
+
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	switch {
+	case dp.config.CanonicalHost != "" && !strings.EqualFold(host, dp.config.CanonicalHost):
+		res.Answer = "redirect to canonical host " + dp.config.CanonicalHost
+		return res
+	case haveClientIP && !dp.config.ACL.allows(r):
+		res.Answer = "forbidden by acl"
+		return res
+	case dp.answersOptions(r):
+		res.Answer = "options answered by proxy"
+		return res
+	case !dp.methodAllowed(r.Method):
+		res.Answer = "method not allowed"
+		return res
+	}
+
+	// dp.groups holds a group per route with its own backends, then one per
+	// tenant in name order, then the default group
+	routeGroups := 0
+	for _, rc := range dp.config.Routes {
+		if rc.BackendURL != "" {
+			routeGroups++
+		}
+	}
+	group := dp.groups[len(dp.groups)-1]
+	if dp.config.Tenants != nil {
+		r.Header.Set(dp.config.Tenants.Header, tenant)
+		if name, ok := dp.config.Tenants.tenant(r); ok {
+			res.Tenant = name
+			group = dp.groups[routeGroups+sort.SearchStrings(dp.config.Tenants.names(), name)]
+		}
+	}
+	routeGroup := 0
+	for _, rc := range dp.config.Routes {
+		rt := route{RouteConfig: rc}
+		if rt.matches(r) {
+			res.Route = rc.Name
+			res.StripCookies = rc.StripCookies
+			if rc.BackendURL != "" {
+				group = dp.groups[routeGroup]
+				res.Tenant = ""
+			}
+			break
+		}
+		if rc.BackendURL != "" {
+			routeGroup++
+		}
+	}
+
+	res.Balance = dp.config.Balance
+	group.mu.Lock()
+	for _, b := range group.backends {
+		res.Backends = append(res.Backends, resolvedBackend{Name: b.Name, URL: b.URL, Healthy: !b.health.unhealthy.Load()})
+	}
+	group.mu.Unlock()
+	if group.balance == balanceIPHash && haveClientIP {
+		if ip := clientIP(r); ip != nil {
+			if b := group.hashed(ip.String()); b != nil {
+				res.Backend = b.URL
+			}
+		}
+	}
+	res.Cached = dp.config.Cache.Enabled && cacheableRequest(r)
+	return res
+}
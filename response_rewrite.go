@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+// Bodies larger than this are passed through without rewriting
+const maxRewriteBodySize = 10 << 20
+
+// ResponseRewrite replaces text in response bodies of the given content types
+type ResponseRewrite struct {
+	ContentTypes []string
+	Search       string
+	Replace      string
+}
+
+// Read [response_rewrite] and [response_rewrite.<name>] sections, one rule each
+func loadResponseRewrites(cfg *ini.File) ([]ResponseRewrite, error) {
+	var rewrites []ResponseRewrite
+	for _, section := range cfg.Sections() {
+		if section.Name() != "response_rewrite" && !strings.HasPrefix(section.Name(), "response_rewrite.") {
+			continue
+		}
+
+		rewrite := ResponseRewrite{
+			ContentTypes: section.Key("content_types").Strings(","),
+			Search:       section.Key("search").String(),
+			Replace:      section.Key("replace").String(),
+		}
+		if rewrite.Search == "" {
+			return nil, fmt.Errorf("%s: search is required", section.Name())
+		}
+		if len(rewrite.ContentTypes) == 0 {
+			rewrite.ContentTypes = []string{"text/html"}
+		}
+		for _, contentType := range rewrite.ContentTypes {
+			if !isTextContentType(contentType) {
+				return nil, fmt.Errorf("%s: %s is not a text content type", section.Name(), contentType)
+			}
+		}
+		rewrites = append(rewrites, rewrite)
+	}
+	return rewrites, nil
+}
+
+func isTextContentType(mediaType string) bool {
+	if strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml", "application/xhtml+xml":
+		return true
+	}
+	return false
+}
+
+// Apply the rewrite rules matching the response's content type to its body.
+// Gzip bodies are decoded first and sent on uncompressed; other encodings
+// and oversized bodies are left untouched.
+func rewriteResponseBody(resp *http.Response, rewrites []ResponseRewrite) error {
+	// Responses without a body keep the backend's Content-Length, which for
+	// HEAD is the length of the body a GET would get
+	if resp.Body == nil || resp.Body == http.NoBody || (resp.Request != nil && resp.Request.Method == http.MethodHead) ||
+		resp.StatusCode < 200 || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return nil
+	}
+
+	var replacements []string
+	for _, rewrite := range rewrites {
+		for _, contentType := range rewrite.ContentTypes {
+			if contentType == mediaType {
+				replacements = append(replacements, rewrite.Search, rewrite.Replace)
+				break
+			}
+		}
+	}
+	if len(replacements) == 0 {
+		return nil
+	}
+
+	encoding := resp.Header.Get("Content-Encoding")
+	if encoding != "" && encoding != "gzip" {
+		return nil
+	}
+	// Setting Content-Length would stop the response being chunked, and
+	// trailers can only be sent on a chunked response
+	if len(resp.Trailer) > 0 {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRewriteBodySize+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > maxRewriteBodySize {
+		resp.Body = readCloser{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return nil
+	}
+	resp.Body.Close()
+
+	if encoding == "gzip" {
+		decoder, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("decoding gzip response for rewriting: %w", err)
+		}
+		body, err = io.ReadAll(io.LimitReader(decoder, maxRewriteBodySize+1))
+		if err != nil {
+			return fmt.Errorf("decoding gzip response for rewriting: %w", err)
+		}
+		if len(body) > maxRewriteBodySize {
+			return fmt.Errorf("decoded response exceeds %d bytes", maxRewriteBodySize)
+		}
+		resp.Header.Del("Content-Encoding")
+	}
+
+	body = []byte(strings.NewReplacer(replacements...).Replace(string(body)))
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// readCloser reads from one reader and closes another
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
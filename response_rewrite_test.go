@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// Matching bodies have the backend's host replaced and a Content-Length
+// to match; gzip bodies are decoded to be rewritten, other content types
+// and bodiless responses are left as the backend sent them
+func TestResponseRewrite(t *testing.T) {
+	page := []byte(`<a href="http://internal-app/login">Log in</a> <img src="http://internal-app/logo.png">`)
+	rewritten := `<a href="https://example.com/login">Log in</a> <img src="https://example.com/logo.png">`
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	zw.Write(page)
+	zw.Close()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/gzip":
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(gzipped.Bytes())
+		case "/binary":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(page)
+		case "/no-content":
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(http.StatusNoContent)
+		case "/not-modified":
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(http.StatusNotModified)
+		default:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write(page)
+		}
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name              string
+		method            string
+		path              string
+		wantStatus        int
+		wantBody          string
+		wantContentLength string
+	}{
+		{"html", http.MethodGet, "/", http.StatusOK, rewritten, strconv.Itoa(len(rewritten))},
+		{"gzip decoded and rewritten", http.MethodGet, "/gzip", http.StatusOK, rewritten, strconv.Itoa(len(rewritten))},
+		{"other content type", http.MethodGet, "/binary", http.StatusOK, string(page), strconv.Itoa(len(page))},
+		{"head keeps the backend's length", http.MethodHead, "/", http.StatusOK, "", strconv.Itoa(len(page))},
+		{"no content", http.MethodGet, "/no-content", http.StatusNoContent, "", ""},
+		{"not modified", http.MethodGet, "/not-modified", http.StatusNotModified, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, "")
+			loadTestDomains(t, map[string]string{
+				"example.com": "[proxy]\nbackend_url = " + backend.URL + "\n[response_rewrite]\nsearch = http://internal-app\nreplace = https://example.com\n",
+			})
+			r := httptest.NewRequest(tt.method, "http://example.com"+tt.path, nil)
+			r.Header.Set("Accept-Encoding", "gzip")
+			got := serveTest(r)
+			if got.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d", got.Code, tt.wantStatus)
+			}
+			if got.Body.String() != tt.wantBody {
+				t.Errorf("body %q, want %q", got.Body, tt.wantBody)
+			}
+			if length := got.Header().Get("Content-Length"); length != tt.wantContentLength {
+				t.Errorf("Content-Length %q, want %q", length, tt.wantContentLength)
+			}
+			if encoding := got.Header().Get("Content-Encoding"); encoding != "" {
+				t.Errorf("Content-Encoding %q, want the body sent uncompressed", encoding)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+)
+
+// errResponseTooLarge is returned for backend responses over max_response_size
+var errResponseTooLarge = errors.New("backend response exceeds max_response_size")
+
+// Enforce max_response_size on a backend response. A declared length over
+// the limit fails the response up front, so the client gets a 502. Bodies
+// of unknown length are cut off once they pass the limit; by then headers
+// have been sent, so the connection is aborted instead. Upgraded
+// connections are streams rather than responses and are left alone.
+func limitResponseSize(resp *http.Response, max int64) error {
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return nil
+	}
+	if resp.ContentLength > max {
+		return errResponseTooLarge
+	}
+	if resp.Body != nil && resp.Body != http.NoBody {
+		resp.Body = &sizeLimitedBody{ReadCloser: resp.Body, resp: resp, remaining: max}
+	}
+	return nil
+}
+
+type sizeLimitedBody struct {
+	io.ReadCloser
+	resp      *http.Response
+	remaining int64
+}
+
+func (b *sizeLimitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, errResponseTooLarge
+	}
+	// Read one byte past the limit to tell a body of exactly max bytes
+	// from a longer one
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		req := b.resp.Request
+		logger.Error("Backend response exceeded max_response_size, aborting", "host", req.Host, "path", req.URL.Path, "backend", req.URL.Host)
+		recordBackendError(req, errResponseTooLarge)
+		return n + int(b.remaining), errResponseTooLarge
+	}
+	return n, err
+}
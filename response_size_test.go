@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLimitResponseSize(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          string
+		contentLength int64
+		status        int
+		wantErr       error
+		wantReadErr   error
+	}{
+		{"under the limit", "hello", 5, http.StatusOK, nil, nil},
+		{"exactly the limit", "0123456789", 10, http.StatusOK, nil, nil},
+		{"declared over the limit", "0123456789a", 11, http.StatusOK, errResponseTooLarge, nil},
+		{"unknown length over the limit", "0123456789abcdef", -1, http.StatusOK, nil, errResponseTooLarge},
+		{"unknown length under the limit", "short", -1, http.StatusOK, nil, nil},
+		{"upgrade", "0123456789abcdef", -1, http.StatusSwitchingProtocols, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			resp := &http.Response{
+				StatusCode:    tt.status,
+				ContentLength: tt.contentLength,
+				Body:          io.NopCloser(strings.NewReader(tt.body)),
+				Request:       req,
+			}
+			if err := limitResponseSize(resp, 10); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("limitResponseSize error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			_, err := io.ReadAll(resp.Body)
+			if !errors.Is(err, tt.wantReadErr) {
+				t.Errorf("reading body: error = %v, want %v", err, tt.wantReadErr)
+			}
+		})
+	}
+}
+
+// A WebSocket upgrade through a domain with max_response_size has to keep
+// working in both directions, however much is sent over it
+func TestUpgradeWithMaxResponseSize(t *testing.T) {
+	loadTestConfig(t, "")
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		rw.Flush()
+		// Echo every line back
+		for {
+			line, err := rw.ReadString('\n')
+			if err != nil {
+				return
+			}
+			rw.WriteString(line)
+			rw.Flush()
+		}
+	}))
+	defer backend.Close()
+	loadTestDomains(t, map[string]string{
+		"example.com": "[proxy]\nbackend_url = " + backend.URL + "\nmax_response_size = 16\nstream_idle_timeout = 5\n",
+	})
+	proxy := httptest.NewServer(buildHandler())
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want 101", resp.StatusCode)
+	}
+
+	// More than max_response_size in total
+	for i := 0; i < 4; i++ {
+		message := strings.Repeat("x", 10) + "\n"
+		io.WriteString(conn, message)
+		echo, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if echo != message {
+			t.Fatalf("message %d: echo = %q, want %q", i, echo, message)
+		}
+	}
+}
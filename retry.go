@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+var backendRetries = newCounterVec("backend_retries_total", "Backend requests retried after a failed attempt, by domain.", "domain")
+
+type backendGroupKey struct{}
+
+// Only requests that can be sent again safely are retried: idempotent
+// methods without a body, since the body of a failed attempt is gone
+func retryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete, http.MethodTrace:
+	default:
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody
+}
+
+// Delay before the given retry (1 for the first): the base backoff doubled
+// for every earlier retry, plus up to jitter at random so clients that
+// failed together don't retry together
+func retryDelay(retry int, backoff, jitter time.Duration) time.Duration {
+	delay := backoff << (retry - 1)
+	if jitter > 0 {
+		delay += rand.N(jitter)
+	}
+	return delay
+}
+
+// Wait out a retry delay. Returns false without waiting the delay out if
+// the request is cancelled meanwhile, or if its deadline would pass first.
+func waitToRetry(ctx context.Context, delay time.Duration) bool {
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= delay {
+		return false
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// Send a request to its backend, retrying failed attempts up to retries
+// times on a backend picked afresh from the same group. A backend that
+// answered, with any status, is not retried.
+func (t backendTransport) roundTripWithRetries(req *http.Request, b *backend) (*http.Response, error) {
+	resp, err := roundTripLimited(req, b)
+	group, _ := req.Context().Value(backendGroupKey{}).(*backendGroup)
+	if err == nil || t.retries == 0 || group == nil || !retryable(req) {
+		return resp, err
+	}
+
+	domain := ""
+	if dp := lookupDomain(req); dp != nil {
+		domain = dp.name
+	}
+	for retry := 1; retry <= t.retries; retry++ {
+		if errors.Is(err, context.Canceled) || !waitToRetry(req.Context(), retryDelay(retry, t.retryBackoff, t.retryJitter)) {
+			break
+		}
+		if b = group.pick(req); b == nil {
+			break
+		}
+
+		recordBackendError(req, err)
+		backendRetries.inc(domain)
+		logger.Debug("Retrying backend request", "host", req.Host, "path", req.URL.Path, "retry", retry, "backend", b.target.Host, "error", err)
+
+		req = req.Clone(context.WithValue(req.Context(), backendKey{}, b))
+		req.URL.Scheme = b.target.Scheme
+		req.URL.Host = b.target.Host
+		setUpstreamAddr(req, b.target.Host)
+		if resp, err = roundTripLimited(req, b); err == nil {
+			return resp, nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		retry   int
+		backoff time.Duration
+		jitter  time.Duration
+		min     time.Duration
+		max     time.Duration
+	}{
+		{1, 100 * time.Millisecond, 0, 100 * time.Millisecond, 100 * time.Millisecond},
+		{2, 100 * time.Millisecond, 0, 200 * time.Millisecond, 200 * time.Millisecond},
+		{4, 100 * time.Millisecond, 0, 800 * time.Millisecond, 800 * time.Millisecond},
+		{1, 0, 0, 0, 0},
+		{1, 0, 50 * time.Millisecond, 0, 50*time.Millisecond - 1},
+		{3, 10 * time.Millisecond, 5 * time.Millisecond, 40 * time.Millisecond, 45*time.Millisecond - 1},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			if got := retryDelay(tt.retry, tt.backoff, tt.jitter); got < tt.min || got > tt.max {
+				t.Fatalf("retryDelay(%d, %s, %s) = %s, want between %s and %s", tt.retry, tt.backoff, tt.jitter, got, tt.min, tt.max)
+			}
+		}
+	}
+}
+
+func TestWaitToRetry(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	soon, cancelSoon := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelSoon()
+
+	tests := []struct {
+		name  string
+		ctx   context.Context
+		delay time.Duration
+		want  bool
+		min   time.Duration
+		max   time.Duration
+	}{
+		{"waits the delay", context.Background(), 50 * time.Millisecond, true, 50 * time.Millisecond, time.Second},
+		{"cancelled", cancelled, time.Second, false, 0, 100 * time.Millisecond},
+		{"deadline before the delay ends", soon, time.Second, false, 0, 40 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			got := waitToRetry(tt.ctx, tt.delay)
+			elapsed := time.Since(start)
+			if got != tt.want {
+				t.Errorf("waitToRetry = %v, want %v", got, tt.want)
+			}
+			if elapsed < tt.min || elapsed > tt.max {
+				t.Errorf("returned after %s, want between %s and %s", elapsed, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+// Retries of a refused backend wait out a doubling backoff, stop short of
+// the request's deadline and end as soon as the client goes away
+func TestRetryBackoff(t *testing.T) {
+	tests := []struct {
+		name        string
+		timeout     string
+		disconnect  time.Duration
+		wantRetries uint64
+		min         time.Duration
+		max         time.Duration
+	}{
+		// 50ms + 100ms + 200ms
+		{"all retries", "", 0, 3, 350 * time.Millisecond, time.Second},
+		// The 100ms second wait would outlast the 120ms deadline
+		{"within the deadline", "0.12", 0, 1, 50 * time.Millisecond, 120 * time.Millisecond},
+		{"client disconnect", "", 75 * time.Millisecond, 1, 75 * time.Millisecond, 150 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, "")
+			loadTestDomains(t, map[string]string{
+				"example.com": "[proxy]\nbackend_url = http://" + closedAddress(t) + "\nmax_request_timeout = 5\nretries = 3\nretry_backoff = 0.05\nretry_jitter = 0\n",
+			})
+			before := counterValue(backendRetries, "example.com")
+
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			if tt.timeout != "" {
+				r.Header.Set(requestTimeoutHeader, tt.timeout)
+			}
+			if tt.disconnect > 0 {
+				ctx, cancel := context.WithCancel(r.Context())
+				defer time.AfterFunc(tt.disconnect, cancel).Stop()
+				r = r.WithContext(ctx)
+			}
+			start := time.Now()
+			serveTest(r)
+			elapsed := time.Since(start)
+
+			if got := counterValue(backendRetries, "example.com") - before; got != tt.wantRetries {
+				t.Errorf("%d retries, want %d", got, tt.wantRetries)
+			}
+			if elapsed < tt.min || elapsed > tt.max {
+				t.Errorf("answered after %s, want between %s and %s", elapsed, tt.min, tt.max)
+			}
+		})
+	}
+}
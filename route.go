@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+// RouteConfig sends matching requests to an alternative backend. A route
+// matches on path prefix and, optionally, on the value of a named cookie.
+// Routes without a backend_url use the domain's backends.
+type RouteConfig struct {
+	Name        string
+	PathPrefix  string
+	MatchCookie string
+	CookieValue string
+	CookieRegex *regexp.Regexp
+	BackendURL  string
+
+	// Drop the Cookie header before forwarding, e.g. for static assets
+	StripCookies bool
+}
+
+// Read [route] and [route.<name>] sections in file order; the first
+// matching route wins and unmatched requests use the domain's backend_url.
+func loadRoutes(cfg *ini.File) ([]RouteConfig, error) {
+	var routes []RouteConfig
+	for _, section := range cfg.Sections() {
+		if section.Name() != "route" && !strings.HasPrefix(section.Name(), "route.") {
+			continue
+		}
+
+		route := RouteConfig{
+			Name:        section.Name(),
+			PathPrefix:  section.Key("path_prefix").MustString("/"),
+			MatchCookie: section.Key("match_cookie").String(),
+			CookieValue: section.Key("cookie_value").String(),
+			BackendURL:  section.Key("backend_url").String(),
+
+			StripCookies: section.Key("strip_cookies").MustBool(false),
+		}
+		if route.BackendURL == "" && !route.StripCookies {
+			return nil, fmt.Errorf("%s: backend_url is required", route.Name)
+		}
+		if pattern := section.Key("cookie_regex").String(); pattern != "" {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid cookie_regex: %w", route.Name, err)
+			}
+			route.CookieRegex = re
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// route is a RouteConfig with its backends ready to serve; group is nil
+// when the route uses the domain's backends
+type route struct {
+	RouteConfig
+	group *backendGroup
+}
+
+func (rt *route) matches(req *http.Request) bool {
+	if !strings.HasPrefix(req.URL.Path, rt.PathPrefix) {
+		return false
+	}
+	if rt.MatchCookie == "" {
+		return true
+	}
+
+	cookie, err := req.Cookie(rt.MatchCookie)
+	if err != nil {
+		return false
+	}
+	if rt.CookieRegex != nil {
+		return rt.CookieRegex.MatchString(cookie.Value)
+	}
+	return rt.CookieValue == "" || cookie.Value == rt.CookieValue
+}
+
+// Find the first route matching a request, or nil
+func selectRoute(routes []route, req *http.Request) *route {
+	for i := range routes {
+		if routes[i].matches(req) {
+			return &routes[i]
+		}
+	}
+	return nil
+}
+
+// Pick the backend group for a request, falling back to the domain default
+func selectGroup(rt *route, defaultGroup *backendGroup) *backendGroup {
+	if rt != nil && rt.group != nil {
+		return rt.group
+	}
+	return defaultGroup
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gopkg.in/ini.v1"
+)
+
+func TestRouteByCookie(t *testing.T) {
+	stable := newNamedBackend(t, "stable")
+	beta := newNamedBackend(t, "beta")
+	canary := newNamedBackend(t, "canary")
+	loadTestConfig(t, "")
+	loadTestDomains(t, map[string]string{"example.com": "[proxy]\nbackend_url = " + stable.URL + "\n" +
+		"[route.beta]\nmatch_cookie = channel\ncookie_value = beta\nbackend_url = " + beta.URL + "\n" +
+		"[route.canary]\npath_prefix = /app\nmatch_cookie = user\ncookie_regex = ^[0-4]\nbackend_url = " + canary.URL + "\n"})
+
+	tests := []struct {
+		name   string
+		path   string
+		cookie string
+		want   string
+	}{
+		{"no cookie", "/", "", "stable"},
+		{"matching value", "/", "channel=beta", "beta"},
+		{"other value", "/", "channel=stable", "stable"},
+		{"matching regex", "/app/page", "user=3141", "canary"},
+		{"regex not matching", "/app/page", "user=9000", "stable"},
+		{"regex outside the path prefix", "/other", "user=3141", "stable"},
+		{"first route wins", "/app", "channel=beta; user=1", "beta"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://example.com"+tt.path, nil)
+			if tt.cookie != "" {
+				r.Header.Set("Cookie", tt.cookie)
+			}
+			if got := serveTest(r).Body.String(); got != tt.want {
+				t.Errorf("served by %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadRoutesErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		domain string
+	}{
+		{"missing backend_url", "[route.api]\npath_prefix = /api\n"},
+		{"invalid cookie_regex", "[route.api]\nbackend_url = http://127.0.0.1:1\ncookie_regex = (\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := ini.Load([]byte(tt.domain))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := loadRoutes(cfg); err == nil {
+				t.Error("loadRoutes succeeded, want an error")
+			}
+		})
+	}
+}
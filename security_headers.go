@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Add the configured baseline security headers to a backend response.
+// Headers the backend already set are left untouched, and HSTS is only
+// sent on responses to HTTPS requests.
+func addSecurityHeaders(resp *http.Response) {
+	headers := currentConfig().SecurityHeaders
+	if !headers.Enabled {
+		return
+	}
+
+	setDefault := func(name, value string) {
+		if value != "" && resp.Header.Get(name) == "" {
+			resp.Header.Set(name, value)
+		}
+	}
+
+	if headers.NoSniff {
+		setDefault("X-Content-Type-Options", "nosniff")
+	}
+	setDefault("X-Frame-Options", headers.FrameOptions)
+	setDefault("Referrer-Policy", headers.ReferrerPolicy)
+
+	if headers.HSTSMaxAge > 0 && resp.Request != nil && resp.Request.TLS != nil {
+		hsts := fmt.Sprintf("max-age=%d", headers.HSTSMaxAge)
+		if headers.HSTSIncludeSubdomains {
+			hsts += "; includeSubDomains"
+		}
+		if headers.HSTSPreload {
+			hsts += "; preload"
+		}
+		setDefault("Strict-Transport-Security", hsts)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+func setReusePort(c syscall.RawConn) error {
+	return errors.New("reuse_port is only supported on Linux")
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A small file served by the proxy itself, read into memory when the config is loaded
+type staticFile struct {
+	path    string
+	name    string
+	body    []byte
+	modTime time.Time
+}
+
+// Load a static file from disk; an empty path means the file is not configured
+func loadStaticFile(path string) (*staticFile, error) {
+	if path == "" {
+		return nil, nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &staticFile{path: filepath.Clean(path), name: filepath.Base(path), body: body, modTime: info.ModTime()}, nil
+}
+
+func (f *staticFile) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	http.ServeContent(w, r, f.name, f.modTime, bytes.NewReader(f.body))
+}
+
+// Pick the static file for a request path, preferring the domain's own copy
+func staticFileFor(r *http.Request) *staticFile {
+	var global *staticFile
+	switch r.URL.Path {
+	case "/robots.txt":
+		global = currentState().robotsTxt
+	case "/favicon.ico":
+		global = currentState().favicon
+	default:
+		return nil
+	}
+
+	if dp := lookupDomain(r); dp != nil {
+		if r.URL.Path == "/robots.txt" && dp.config.RobotsTxt != nil {
+			return dp.config.RobotsTxt
+		}
+		if r.URL.Path == "/favicon.ico" && dp.config.Favicon != nil {
+			return dp.config.Favicon
+		}
+	}
+	return global
+}
+
+// Answer /robots.txt and /favicon.ico from the configured files before the
+// rest of the middleware chain runs, so crawlers don't reach the backends
+func staticFilesMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			if f := staticFileFor(r); f != nil {
+				f.ServeHTTP(w, r)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
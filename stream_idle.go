@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type streamIdleKey struct{}
+
+// streamIdleTimer closes the connections of a long-lived stream (WebSocket or
+// server-sent events) once neither side has sent anything for the timeout.
+// It is only armed once a stream is tracked, so ordinary requests never
+// start a timer.
+type streamIdleTimer struct {
+	timeout      time.Duration
+	lastActivity atomic.Int64
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	closers []io.Closer
+	stopped bool
+}
+
+func (t *streamIdleTimer) touch() {
+	t.lastActivity.Store(time.Now().UnixNano())
+}
+
+// Close c together with the rest of the stream when it goes idle
+func (t *streamIdleTimer) track(c io.Closer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped {
+		return
+	}
+	t.closers = append(t.closers, c)
+	if t.timer == nil {
+		t.touch()
+		t.timer = time.AfterFunc(t.timeout, t.check)
+	}
+}
+
+func (t *streamIdleTimer) check() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped {
+		return
+	}
+	idle := time.Since(time.Unix(0, t.lastActivity.Load()))
+	if idle < t.timeout {
+		t.timer.Reset(t.timeout - idle)
+		return
+	}
+	t.stopped = true
+	for _, c := range t.closers {
+		c.Close()
+	}
+	logger.Debug("Closed idle stream", "idle", idle)
+}
+
+// Disarm the timer once the request is done
+func (t *streamIdleTimer) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stopped = true
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
+
+// Wrap a client request and its response writer so streams started by it
+// are subject to the idle timeout
+func withStreamIdleTimeout(w http.ResponseWriter, r *http.Request, timeout time.Duration) (http.ResponseWriter, *http.Request, *streamIdleTimer) {
+	t := &streamIdleTimer{timeout: timeout}
+	r = r.WithContext(context.WithValue(r.Context(), streamIdleKey{}, t))
+	return &streamIdleWriter{ResponseWriter: w, idle: t}, r, t
+}
+
+// Start watching a backend response if it opens a stream: an upgraded
+// connection or an event stream
+func watchStreamIdle(resp *http.Response) {
+	t, ok := resp.Request.Context().Value(streamIdleKey{}).(*streamIdleTimer)
+	if !ok {
+		return
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		if rwc, ok := resp.Body.(io.ReadWriteCloser); ok {
+			resp.Body = &idleReadWriteCloser{rwc: rwc, idle: t}
+			t.track(rwc)
+		}
+		return
+	}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		t.track(resp.Body)
+		resp.Body = &idleReadWriteCloser{rwc: resp.Body, idle: t}
+	}
+}
+
+// streamIdleWriter records writes to the client and wraps hijacked connections
+type streamIdleWriter struct {
+	http.ResponseWriter
+	idle *streamIdleTimer
+}
+
+func (sw *streamIdleWriter) Write(b []byte) (int, error) {
+	sw.idle.touch()
+	return sw.ResponseWriter.Write(b)
+}
+
+func (sw *streamIdleWriter) Flush() {
+	if flusher, ok := sw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (sw *streamIdleWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := sw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	sw.idle.track(conn)
+	return &idleConn{Conn: conn, idle: sw.idle}, brw, nil
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (sw *streamIdleWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// idleConn is a hijacked client connection that reports its activity
+type idleConn struct {
+	net.Conn
+	idle *streamIdleTimer
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.idle.touch()
+	}
+	return n, err
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	c.idle.touch()
+	return c.Conn.Write(b)
+}
+
+// idleReadWriteCloser is a backend stream that reports its activity. Write
+// is only used for upgraded connections.
+type idleReadWriteCloser struct {
+	rwc  io.ReadCloser
+	idle *streamIdleTimer
+}
+
+func (c *idleReadWriteCloser) Read(b []byte) (int, error) {
+	n, err := c.rwc.Read(b)
+	if n > 0 {
+		c.idle.touch()
+	}
+	return n, err
+}
+
+func (c *idleReadWriteCloser) Write(b []byte) (int, error) {
+	w, ok := c.rwc.(io.Writer)
+	if !ok {
+		return 0, fmt.Errorf("stream is not writable")
+	}
+	c.idle.touch()
+	return w.Write(b)
+}
+
+func (c *idleReadWriteCloser) Close() error {
+	return c.rwc.Close()
+}
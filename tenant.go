@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+// Tenant names substituted into backend_template must be usable as a
+// hostname label, so a name can't point the template somewhere else
+var tenantNamePattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+
+// TenantConfig sends requests to the backends of the tenant named in a
+// request header. Only tenants listed in [tenants] are routed; requests
+// without the header or with any other value use the domain's backends.
+type TenantConfig struct {
+	Header string
+	// Backend URLs by tenant name
+	Backends map[string]string
+}
+
+// Read [tenant_routing] and [tenants]. Each [tenants] key is a tenant and
+// its value the tenant's backend_url; an empty value takes the URL from
+// backend_template, e.g. http://{tenant}.internal:8080. Returns nil when
+// no tenants are configured.
+func loadTenants(cfg *ini.File) (*TenantConfig, error) {
+	if !cfg.HasSection("tenants") {
+		return nil, nil
+	}
+	routing := cfg.Section("tenant_routing")
+	tenants := &TenantConfig{
+		Header:   http.CanonicalHeaderKey(routing.Key("header").MustString("X-Tenant-ID")),
+		Backends: make(map[string]string),
+	}
+	template := routing.Key("backend_template").String()
+	if template != "" && !strings.Contains(template, "{tenant}") {
+		return nil, fmt.Errorf("tenant_routing: backend_template must contain {tenant}")
+	}
+
+	for _, key := range cfg.Section("tenants").Keys() {
+		name, backendURL := key.Name(), key.String()
+		if backendURL == "" {
+			if template == "" {
+				return nil, fmt.Errorf("tenants: %s has no backend_url and there is no backend_template", name)
+			}
+			if !tenantNamePattern.MatchString(name) {
+				return nil, fmt.Errorf("tenants: %q is not a valid hostname label for backend_template", name)
+			}
+			backendURL = strings.ReplaceAll(template, "{tenant}", name)
+		}
+		tenants.Backends[name] = backendURL
+	}
+	if len(tenants.Backends) == 0 {
+		return nil, fmt.Errorf("tenants: no tenants listed")
+	}
+	return tenants, nil
+}
+
+// Tenant names in the order their backend groups are created
+func (tc *TenantConfig) names() []string {
+	names := make([]string, 0, len(tc.Backends))
+	for name := range tc.Backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// The tenant a request is for, if it names a configured one. The header
+// value is only ever looked up, never used to build a URL.
+func (tc *TenantConfig) tenant(req *http.Request) (string, bool) {
+	if tc == nil {
+		return "", false
+	}
+	name := req.Header.Get(tc.Header)
+	_, ok := tc.Backends[name]
+	return name, ok && name != ""
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"gopkg.in/ini.v1"
+)
+
+// Listed tenants reach their own backend; anything else, however crafted,
+// falls back to the domain's backend
+func TestTenantRouting(t *testing.T) {
+	site := newNamedBackend(t, "site")
+	acme := newNamedBackend(t, "acme")
+	globex := newNamedBackend(t, "globex")
+
+	tests := []struct {
+		name    string
+		routing string
+		header  string
+		value   string
+		want    string
+	}{
+		{"mapped", "", "X-Tenant-ID", "acme", "acme"},
+		{"another mapped", "", "X-Tenant-ID", "globex", "globex"},
+		{"no header", "", "", "", "site"},
+		{"empty header", "", "X-Tenant-ID", "", "site"},
+		{"unmapped", "", "X-Tenant-ID", "initech", "site"},
+		{"case differs", "", "X-Tenant-ID", "ACME", "site"},
+		{"suffixed host", "", "X-Tenant-ID", "acme.evil.example", "site"},
+		{"path traversal", "", "X-Tenant-ID", "../acme", "site"},
+		{"url", "", "X-Tenant-ID", "http://169.254.169.254/", "site"},
+		{"custom header", "[tenant_routing]\nheader = x-customer\n", "X-Customer", "globex", "globex"},
+		{"default header ignored", "[tenant_routing]\nheader = x-customer\n", "X-Tenant-ID", "globex", "site"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, "")
+			loadTestDomains(t, map[string]string{
+				"example.com": "[proxy]\nbackend_url = " + site.URL + "\n" + tt.routing +
+					"[tenants]\nacme = " + acme.URL + "\nglobex = " + globex.URL + "\n",
+			})
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			if tt.header != "" {
+				r.Header.Set(tt.header, tt.value)
+			}
+			if got := serveTest(r); got.Code != http.StatusOK || got.Body.String() != tt.want {
+				t.Errorf("reached %q (status %d), want %s", got.Body, got.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadTenants(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		want    *TenantConfig
+		wantErr bool
+	}{
+		{"none", "[proxy]\n", nil, false},
+		{
+			"template",
+			"[tenant_routing]\nbackend_template = http://{tenant}.internal:8080\n[tenants]\nacme =\nglobex = http://10.0.0.9\n",
+			&TenantConfig{Header: "X-Tenant-Id", Backends: map[string]string{"acme": "http://acme.internal:8080", "globex": "http://10.0.0.9"}},
+			false,
+		},
+		{"template without placeholder", "[tenant_routing]\nbackend_template = http://tenant.internal\n[tenants]\nacme =\n", nil, true},
+		{"no url or template", "[tenants]\nacme =\n", nil, true},
+		{"name not a hostname label", "[tenant_routing]\nbackend_template = http://{tenant}.internal\n[tenants]\nacme.evil.example =\n", nil, true},
+		{"no tenants", "[tenants]\n", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := ini.Load([]byte(tt.config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := loadTenants(cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadTenants error = %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("loadTenants = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
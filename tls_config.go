@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"time"
+)
+
+// Ticket keys kept when rotating: the newest encrypts new tickets, and the
+// previous one still decrypts tickets issued before the last rotation
+const sessionTicketKeysKept = 2
+
+// Build the TLS config the server listens with. It is used as is rather
+// than cloned by ServeTLS, so ticket keys set on it later take effect.
+func newServerTLSConfig(ctx context.Context) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		NextProtos:             []string{"h2", "http/1.1"},
+		SessionTicketsDisabled: !startupConfig.SSL.SessionTickets,
+	}
+
+	// With OCSP stapling the certificate comes from GetCertificate, which
+	// carries the current staple
+	if startupConfig.SSL.OCSPStapling {
+		stapled, err := newStapledCert(startupConfig.SSL.CertFile, startupConfig.SSL.KeyFile, startupConfig.SSL.OCSPStapleFile)
+		if err != nil {
+			return nil, err
+		}
+		go stapled.run(ctx)
+		tlsConfig.GetCertificate = stapled.get
+	} else {
+		cert, err := tls.LoadX509KeyPair(startupConfig.SSL.CertFile, startupConfig.SSL.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	// Note each client's hello, so failed handshakes can be explained
+	tlsConfig.GetConfigForClient = recordClientHello(tlsConfig)
+
+	if startupConfig.SSL.SessionTickets && startupConfig.SSL.SessionTicketRotation > 0 {
+		go rotateSessionTicketKeys(ctx, tlsConfig, startupConfig.SSL.SessionTicketRotation)
+	}
+	return tlsConfig, nil
+}
+
+// Replace the session ticket keys with a fresh random one every interval,
+// so a leaked key only exposes the sessions of the last two intervals.
+// Without this, crypto/tls rotates its own keys daily.
+func rotateSessionTicketKeys(ctx context.Context, tlsConfig *tls.Config, interval time.Duration) {
+	var keys [][32]byte
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var key [32]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			logger.Error("Failed to generate session ticket key", "error", err)
+		} else {
+			keys = append([][32]byte{key}, keys...)
+			if len(keys) > sessionTicketKeysKept {
+				keys = keys[:sessionTicketKeysKept]
+			}
+			tlsConfig.SetSessionTicketKeys(keys)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Serve TLS with tlsConfig until the test ends, writing one byte on each
+// connection so clients read the session tickets sent after the handshake
+func serveTLSTest(t *testing.T, tlsConfig *tls.Config) string {
+	t.Helper()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte{1})
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// Whether a connection using the client's session cache resumed a session
+func resumed(t *testing.T, addr string, clientConfig *tls.Config) bool {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Read(make([]byte, 1))
+	return conn.ConnectionState().DidResume
+}
+
+func TestSessionTickets(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := writeKeyPair(t, t.TempDir(), ca.issue(t, "example.com", time.Now().Add(time.Hour)))
+	tests := []struct {
+		tickets    string
+		wantResume bool
+	}{
+		{"true", true},
+		{"false", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tickets, func(t *testing.T) {
+			loadTestConfig(t, "[ssl]\ncert_file = "+certFile+"\nkey_file = "+keyFile+"\nsession_tickets = "+tt.tickets+"\n")
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			tlsConfig, err := newServerTLSConfig(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			addr := serveTLSTest(t, tlsConfig)
+
+			clientConfig := &tls.Config{RootCAs: ca.pool, ServerName: "example.com", ClientSessionCache: tls.NewLRUClientSessionCache(8)}
+			if resumed(t, addr, clientConfig) {
+				t.Fatal("first connection resumed a session")
+			}
+			if got := resumed(t, addr, clientConfig); got != tt.wantResume {
+				t.Errorf("second connection resumed %v, want %v", got, tt.wantResume)
+			}
+		})
+	}
+}
+
+// Tickets stay usable for one rotation after their key is replaced, and
+// no longer
+func TestRotateSessionTicketKeys(t *testing.T) {
+	ca := newTestCA(t)
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{ca.issue(t, "example.com", time.Now().Add(time.Hour))}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	const interval = 200 * time.Millisecond
+	go rotateSessionTicketKeys(ctx, tlsConfig, interval)
+	time.Sleep(interval / 10)
+	addr := serveTLSTest(t, tlsConfig)
+
+	clientConfig := &tls.Config{RootCAs: ca.pool, ServerName: "example.com", ClientSessionCache: tls.NewLRUClientSessionCache(8)}
+	resumed(t, addr, clientConfig)
+	if !resumed(t, addr, clientConfig) {
+		t.Fatal("no resumption within the rotation interval")
+	}
+
+	// Each resumption issues a fresh ticket, so use a client whose only
+	// ticket is from before two rotations
+	staleClient := &tls.Config{RootCAs: ca.pool, ServerName: "example.com", ClientSessionCache: tls.NewLRUClientSessionCache(8)}
+	resumed(t, addr, staleClient)
+	time.Sleep(interval*2 + interval/2)
+	if resumed(t, addr, staleClient) {
+		t.Error("resumed with a ticket whose key was rotated out")
+	}
+}
+
+// tls_session_cache_size lets the proxy resume TLS sessions with backends
+func TestBackendSessionResumption(t *testing.T) {
+	ca := newTestCA(t)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A new connection, and so a new handshake, for every request
+		w.Header().Set("Connection", "close")
+		w.Write([]byte(strconv.FormatBool(r.TLS.DidResume)))
+	}))
+	backend.TLS = &tls.Config{Certificates: []tls.Certificate{ca.issue(t, "backend", time.Now().Add(time.Hour))}}
+	backend.StartTLS()
+	defer backend.Close()
+
+	tests := []struct {
+		cacheSize  string
+		wantResume string
+	}{
+		{"0", "false"},
+		{"16", "true"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cacheSize, func(t *testing.T) {
+			loadTestConfig(t, "[backend]\ntls_session_cache_size = "+tt.cacheSize+"\n")
+			loadTestDomains(t, map[string]string{"example.com": "[proxy]\nbackend_url = " + backend.URL + "\n"})
+			trustBackendCA(t, "example.com", ca)
+
+			serveTest(httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+			if got := serveTest(httptest.NewRequest(http.MethodGet, "http://example.com/", nil)); got.Body.String() != tt.wantResume {
+				t.Errorf("second backend connection resumed %s, want %s", got.Body, tt.wantResume)
+			}
+		})
+	}
+}
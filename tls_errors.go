@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+var tlsHandshakeErrors = newCounterVec("tls_handshake_errors_total", "Failed TLS handshakes with clients, by reason.", "reason")
+
+// Alerts a client sends when it gives up on the handshake, and the reason
+// they are counted under
+var tlsAlertReasons = map[tls.AlertError]string{
+	40:  "no_shared_cipher", // handshake_failure
+	71:  "no_shared_cipher", // insufficient_security
+	70:  "unsupported_version",
+	112: "unknown_server_name",
+	116: "missing_client_certificate",
+	45:  "expired_certificate",
+	48:  "unknown_certificate_authority",
+	42:  "bad_certificate",
+	43:  "bad_certificate", // unsupported_certificate
+	44:  "bad_certificate", // certificate_revoked
+	46:  "bad_certificate", // certificate_unknown
+}
+
+// Reasons that are mostly scanners and clients going away, logged at debug level
+var noisyTLSErrors = map[string]bool{"not_tls": true, "timeout": true, "connection_reset": true, "eof": true}
+
+// What the server saw of a client's hello, kept until its connection closes
+type clientHello struct {
+	serverName string
+	// Why the hello could not be served, found when it arrives, since
+	// crypto/tls reports these failures as untyped errors
+	problem string
+}
+
+// TLS connections mid-handshake, by their underlying connection
+var clientHellos sync.Map
+
+// Used as tls.Config.GetConfigForClient. It only records the hello; the
+// config itself is left unchanged.
+func recordClientHello(tlsConfig *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		clientHellos.Store(hello.Conn, &clientHello{serverName: hello.ServerName, problem: helloProblem(tlsConfig, hello)})
+		return nil, nil
+	}
+}
+
+// Check a client's hello against what the server offers
+func helloProblem(tlsConfig *tls.Config, hello *tls.ClientHelloInfo) string {
+	minVersion := tlsConfig.MinVersion
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
+	}
+	if !slices.ContainsFunc(hello.SupportedVersions, func(v uint16) bool { return v >= minVersion && v <= tls.VersionTLS13 }) {
+		return "unsupported_version"
+	}
+
+	var cert *tls.Certificate
+	if tlsConfig.GetCertificate != nil {
+		var err error
+		if cert, err = tlsConfig.GetCertificate(hello); err != nil || cert == nil {
+			return "unknown_server_name"
+		}
+	} else if len(tlsConfig.Certificates) > 0 {
+		cert = &tlsConfig.Certificates[0]
+	}
+	if cert != nil && hello.SupportsCertificate(cert) != nil {
+		return "no_shared_cipher"
+	}
+	return ""
+}
+
+// Used as http.Server.ConnState. When a TLS connection closes without
+// completing its handshake, the handshake's error is counted by reason
+// and logged.
+func observeTLSHandshake(conn net.Conn, state http.ConnState) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok || state == http.StateNew || state == http.StateIdle {
+		return
+	}
+	value, _ := clientHellos.LoadAndDelete(tlsConn.NetConn())
+	if state != http.StateClosed || tlsConn.ConnectionState().HandshakeComplete {
+		return
+	}
+	hello, _ := value.(*clientHello)
+	if hello == nil {
+		hello = &clientHello{}
+	}
+
+	// The handshake has already run and failed, so this returns its
+	// error without touching the connection
+	err := tlsConn.HandshakeContext(context.Background())
+	if err == nil {
+		return
+	}
+	reason := tlsErrorReason(err, hello)
+	tlsHandshakeErrors.inc(reason)
+	args := []any{"client", conn.RemoteAddr().String(), "server_name", hello.serverName, "reason", reason, "error", err}
+	if noisyTLSErrors[reason] {
+		logger.Debug("TLS handshake failed", args...)
+	} else {
+		logger.Info("TLS handshake failed", args...)
+	}
+}
+
+// Classify a failed handshake
+func tlsErrorReason(err error, hello *clientHello) string {
+	var recordErr tls.RecordHeaderError
+	var netErr net.Error
+	var verifyErr *tls.CertificateVerificationError
+	switch {
+	case errors.As(err, &recordErr):
+		return "not_tls"
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "connection_reset"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	case errors.As(err, &verifyErr):
+		return certificateErrorReason(verifyErr.Err)
+	}
+	if alert, ok := tlsAlert(err); ok {
+		if reason, known := tlsAlertReasons[alert]; known {
+			return reason
+		}
+	}
+	if hello != nil && hello.problem != "" {
+		return hello.problem
+	}
+	return "other"
+}
+
+// Classify a client certificate that failed verification
+func certificateErrorReason(err error) string {
+	var invalid x509.CertificateInvalidError
+	var unknownAuthority x509.UnknownAuthorityError
+	switch {
+	case errors.As(err, &invalid) && invalid.Reason == x509.Expired:
+		return "expired_certificate"
+	case errors.As(err, &unknownAuthority):
+		return "unknown_certificate_authority"
+	}
+	return "bad_certificate"
+}
+
+// Return the alert a client sent to end the handshake. crypto/tls reports
+// it as a "remote error" whose alert type is unexported, so its value is
+// converted to the exported tls.AlertError.
+func tlsAlert(err error) (tls.AlertError, bool) {
+	var alert tls.AlertError
+	if errors.As(err, &alert) {
+		return alert, true
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "remote error" && opErr.Err != nil {
+		if v := reflect.ValueOf(opErr.Err); v.Kind() == reflect.Uint8 {
+			return tls.AlertError(v.Uint()), true
+		}
+	}
+	return 0, false
+}
+
+// serverErrorLog receives net/http's own error log. TLS handshake failures
+// are reported by observeTLSHandshake instead, so net/http's line for
+// them is dropped.
+type serverErrorLog struct{}
+
+func newServerErrorLog() *log.Logger {
+	return log.New(serverErrorLog{}, "", 0)
+}
+
+func (serverErrorLog) Write(p []byte) (int, error) {
+	msg := strings.TrimSpace(string(p))
+	if strings.HasPrefix(msg, "http: TLS handshake error from ") {
+		return len(p), nil
+	}
+	logger.Error("HTTP server error", "error", msg)
+	return len(p), nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTLSErrorReason(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		hello *clientHello
+		want  string
+	}{
+		{"record header", tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}, nil, "not_tls"},
+		{"deadline", &net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}, nil, "timeout"},
+		{"reset", &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, nil, "connection_reset"},
+		{"eof", io.EOF, nil, "eof"},
+		{"wrapped eof", fmt.Errorf("handshake: %w", io.ErrUnexpectedEOF), nil, "eof"},
+		{"alert error", tls.AlertError(48), nil, "unknown_certificate_authority"},
+		{"unknown alert", tls.AlertError(10), nil, "other"},
+		{"expired client certificate", &tls.CertificateVerificationError{Err: x509.CertificateInvalidError{Reason: x509.Expired}}, nil, "expired_certificate"},
+		{"unknown client certificate authority", &tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}, nil, "unknown_certificate_authority"},
+		{"invalid client certificate", &tls.CertificateVerificationError{Err: x509.CertificateInvalidError{Reason: x509.NotAuthorizedToSign}}, nil, "bad_certificate"},
+		{"hello problem", errors.New("tls: client offered only unsupported versions"), &clientHello{problem: "unsupported_version"}, "unsupported_version"},
+		{"untyped", errors.New("tls: something else"), &clientHello{}, "other"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tlsErrorReason(tt.err, tt.hello); got != tt.want {
+				t.Errorf("tlsErrorReason(%v) = %q, want %q", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+// Fail handshakes against a real TLS server and check what they are
+// counted as
+func TestTLSHandshakeFailures(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Config.ConnState = observeTLSHandshake
+	server.Config.ErrorLog = newServerErrorLog()
+	server.Config.ReadTimeout = 500 * time.Millisecond
+	server.StartTLS()
+	defer server.Close()
+	server.TLS.GetConfigForClient = recordClientHello(server.TLS)
+	addr := server.Listener.Addr().String()
+
+	// Suites the server's certificate can't be used with over TLS 1.2
+	mismatchedSuites := []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+	if server.Certificate().PublicKeyAlgorithm == x509.RSA {
+		mismatchedSuites = []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	handshake := func(config *tls.Config) func(net.Conn) {
+		return func(conn net.Conn) {
+			config.ServerName = "example.com"
+			tls.Client(conn, config).Handshake()
+		}
+	}
+	tests := []struct {
+		name   string
+		client func(net.Conn)
+		want   string
+	}{
+		{"plain http", func(conn net.Conn) {
+			io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+			io.ReadAll(conn)
+		}, "not_tls"},
+		{"closed before hello", func(conn net.Conn) {}, "eof"},
+		{"silent client", func(conn net.Conn) { time.Sleep(time.Second) }, "timeout"},
+		{"old version", handshake(&tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11, RootCAs: roots}), "unsupported_version"},
+		{"no shared cipher", handshake(&tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: mismatchedSuites, RootCAs: roots}), "no_shared_cipher"},
+		{"untrusted certificate", handshake(&tls.Config{}), "bad_certificate"},
+		{"success", handshake(&tls.Config{RootCAs: roots}), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var before uint64
+			if tt.want != "" {
+				before = counterValue(tlsHandshakeErrors, tt.want)
+			}
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+			tt.client(conn)
+			conn.Close()
+
+			if tt.want == "" {
+				return
+			}
+			// The server notices the failure on its own time
+			deadline := time.Now().Add(2 * time.Second)
+			for counterValue(tlsHandshakeErrors, tt.want) == before {
+				if time.Now().After(deadline) {
+					t.Fatalf("no handshake failure counted as %q", tt.want)
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+		})
+	}
+}
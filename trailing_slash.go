@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Trailing slash modes for trailing_slash
+const (
+	trailingSlashPreserve = "preserve"
+	trailingSlashAdd      = "add"
+	trailingSlashStrip    = "strip"
+)
+
+func validTrailingSlashMode(mode string) error {
+	switch mode {
+	case trailingSlashPreserve, trailingSlashAdd, trailingSlashStrip:
+		return nil
+	}
+	return fmt.Errorf("unknown trailing_slash mode %q", mode)
+}
+
+// Add or strip the trailing slash of a backend request path. The root path
+// "/" is never changed.
+func applyTrailingSlash(u *url.URL, mode string) {
+	if u.Path == "" || u.Path == "/" {
+		return
+	}
+
+	switch mode {
+	case trailingSlashAdd:
+		if !strings.HasSuffix(u.Path, "/") {
+			u.Path += "/"
+			if u.RawPath != "" {
+				u.RawPath += "/"
+			}
+		}
+	case trailingSlashStrip:
+		u.Path = strings.TrimRight(u.Path, "/")
+		if u.Path == "" {
+			u.Path = "/"
+		}
+		if u.RawPath != "" {
+			u.RawPath = strings.TrimRight(u.RawPath, "/")
+		}
+	}
+}
+
+// Permanently redirect a client to the path without its trailing slash.
+// Returns true if a redirect was sent.
+func redirectTrailingSlash(w http.ResponseWriter, r *http.Request) bool {
+	if r.URL.Path == "/" || !strings.HasSuffix(r.URL.Path, "/") {
+		return false
+	}
+
+	target := *r.URL
+	applyTrailingSlash(&target, trailingSlashStrip)
+	// Never emit a protocol-relative "//host" location
+	location := "/" + strings.TrimLeft(target.EscapedPath(), "/")
+	if target.RawQuery != "" {
+		location += "?" + target.RawQuery
+	}
+	http.Redirect(w, r, location, http.StatusMovedPermanently)
+	return true
+}
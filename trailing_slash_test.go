@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestApplyTrailingSlash(t *testing.T) {
+	tests := []struct {
+		mode, path string
+		want       string
+	}{
+		{trailingSlashPreserve, "/foo", "/foo"},
+		{trailingSlashPreserve, "/foo/", "/foo/"},
+		{trailingSlashAdd, "/foo", "/foo/"},
+		{trailingSlashAdd, "/foo/", "/foo/"},
+		{trailingSlashAdd, "/", "/"},
+		{trailingSlashAdd, "/a%2Fb", "/a%2Fb/"},
+		{trailingSlashStrip, "/foo/", "/foo"},
+		{trailingSlashStrip, "/foo//", "/foo"},
+		{trailingSlashStrip, "/foo", "/foo"},
+		{trailingSlashStrip, "/", "/"},
+		{trailingSlashStrip, "/a%2Fb/", "/a%2Fb"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode+" "+tt.path, func(t *testing.T) {
+			u, _ := url.Parse("http://backend" + tt.path)
+			applyTrailingSlash(u, tt.mode)
+			if got := u.EscapedPath(); got != tt.want {
+				t.Errorf("path %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// Each mode as the backend sees it, and the redirect strip mode can send
+// clients instead
+func TestTrailingSlash(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.RequestURI()))
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name         string
+		options      string
+		path         string
+		wantStatus   int
+		wantPath     string
+		wantLocation string
+	}{
+		{"preserve", "", "/foo/", http.StatusOK, "/foo/", ""},
+		{"add", "trailing_slash = add\n", "/foo?q=1", http.StatusOK, "/foo/?q=1", ""},
+		{"strip", "trailing_slash = strip\n", "/foo/?q=1", http.StatusOK, "/foo?q=1", ""},
+		{"strip root", "trailing_slash = strip\n", "/", http.StatusOK, "/", ""},
+		{"strip with redirect", "trailing_slash = strip\ntrailing_slash_redirect = true\n", "/foo/?q=1", http.StatusMovedPermanently, "", "/foo?q=1"},
+		{"redirect without a trailing slash", "trailing_slash = strip\ntrailing_slash_redirect = true\n", "/foo", http.StatusOK, "/foo", ""},
+		{"redirect never protocol-relative", "trailing_slash = strip\ntrailing_slash_redirect = true\n", "//evil.example/", http.StatusMovedPermanently, "", "/evil.example"},
+		{"redirect ignored outside strip", "trailing_slash = add\ntrailing_slash_redirect = true\n", "/foo/", http.StatusOK, "/foo/", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, "")
+			loadTestDomains(t, map[string]string{"example.com": "[proxy]\nbackend_url = " + backend.URL + "\n" + tt.options})
+
+			got := serveTest(httptest.NewRequest(http.MethodGet, "http://example.com"+tt.path, nil))
+			if got.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d", got.Code, tt.wantStatus)
+			}
+			if tt.wantPath != "" && got.Body.String() != tt.wantPath {
+				t.Errorf("backend got %q, want %q", got.Body.String(), tt.wantPath)
+			}
+			if location := got.Header().Get("Location"); location != tt.wantLocation {
+				t.Errorf("Location %q, want %q", location, tt.wantLocation)
+			}
+		})
+	}
+}
+
+func TestValidTrailingSlashMode(t *testing.T) {
+	for _, mode := range []string{trailingSlashPreserve, trailingSlashAdd, trailingSlashStrip} {
+		if err := validTrailingSlashMode(mode); err != nil {
+			t.Errorf("validTrailingSlashMode(%q) = %v", mode, err)
+		}
+	}
+	if err := validTrailingSlashMode("remove"); err == nil {
+		t.Error("validTrailingSlashMode accepted an unknown mode")
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+)
+
+const shutdownTimeout = 30 * time.Second
+
+// Report not ready and keep serving for pre_shutdown_delay, so load
+// balancers stop sending traffic before the listeners close. A second
+// SIGINT or SIGTERM ends the wait early.
+func drainBeforeShutdown(signals <-chan os.Signal) {
+	ready.Store(false)
+	delay := time.Duration(currentConfig().Server.PreShutdownDelay) * time.Second
+	if delay <= 0 {
+		return
+	}
+
+	logger.Info("Reporting not ready before shutdown", "delay", delay)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			return
+		case sig := <-signals:
+			if sig == syscall.SIGINT || sig == syscall.SIGTERM {
+				logger.Info("Received second signal, shutting down now", "signal", sig.String())
+				return
+			}
+		}
+	}
+}
+
+// Stop accepting and wait up to shutdownTimeout for in-flight requests
+func shutdownServer(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Error("Error during shutdown", "error", err)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Readiness turns off as soon as shutdown begins, and the drain lasts
+// pre_shutdown_delay unless a second SIGINT or SIGTERM arrives
+func TestDrainBeforeShutdown(t *testing.T) {
+	tests := []struct {
+		name    string
+		delay   string
+		signals []os.Signal
+		min     time.Duration
+		max     time.Duration
+	}{
+		{"no delay", "0", nil, 0, 100 * time.Millisecond},
+		{"delay", "1", nil, time.Second, 2 * time.Second},
+		{"second signal", "5", []os.Signal{syscall.SIGTERM}, 0, time.Second},
+		{"reload signal ignored", "1", []os.Signal{syscall.SIGHUP}, time.Second, 2 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, "[server]\npre_shutdown_delay = "+tt.delay+"\n")
+			ready.Store(true)
+			t.Cleanup(func() { ready.Store(false) })
+
+			signals := make(chan os.Signal, 1)
+			done := make(chan struct{})
+			start := time.Now()
+			go func() {
+				drainBeforeShutdown(signals)
+				close(done)
+			}()
+
+			// Not ready while still draining
+			deadline := time.Now().Add(time.Second)
+			for {
+				recorder := httptest.NewRecorder()
+				readyHandler(recorder, httptest.NewRequest(http.MethodGet, "/ready", nil))
+				if recorder.Code == http.StatusServiceUnavailable {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatal("still ready after shutdown began")
+				}
+				time.Sleep(time.Millisecond)
+			}
+			for _, sig := range tt.signals {
+				signals <- sig
+			}
+
+			select {
+			case <-done:
+			case <-time.After(tt.max):
+				t.Fatalf("drain still running after %s", tt.max)
+			}
+			if elapsed := time.Since(start); elapsed < tt.min {
+				t.Errorf("drain ended after %s, want at least %s", elapsed, tt.min)
+			}
+		})
+	}
+}
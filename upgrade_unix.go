@@ -0,0 +1,196 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Environment variables used to hand listening sockets to a new process
+// during a hot restart. Inherited sockets start at fd 3 and are described
+// by a comma-separated list of their roles; the readiness pipe follows them.
+const (
+	inheritFDsEnv = "COFFEE_PROXY_INHERIT_FDS"
+	readyFDEnv    = "COFFEE_PROXY_READY_FD"
+)
+
+const upgradeReadyTimeout = 30 * time.Second
+
+var (
+	inherited     map[string][]net.Listener
+	inheritedErr  error
+	inheritedOnce sync.Once
+)
+
+// Return the listeners for a role inherited from a parent process
+// performing a hot restart, or nil if this process was started normally.
+func inheritedListeners(role string) ([]net.Listener, error) {
+	inheritedOnce.Do(func() {
+		inherited, inheritedErr = loadInheritedListeners()
+	})
+	return inherited[role], inheritedErr
+}
+
+func loadInheritedListeners() (map[string][]net.Listener, error) {
+	value := os.Getenv(inheritFDsEnv)
+	if value == "" {
+		return nil, nil
+	}
+	os.Unsetenv(inheritFDsEnv)
+
+	listeners := make(map[string][]net.Listener)
+	for i, role := range strings.Split(value, ",") {
+		file := os.NewFile(uintptr(3+i), role)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inheriting %s listener: %w", role, err)
+		}
+		listeners[role] = append(listeners[role], listener)
+	}
+	return listeners, nil
+}
+
+// Tell the parent process that this process is serving and it can drain
+func notifyParentReady() {
+	value := os.Getenv(readyFDEnv)
+	if value == "" {
+		return
+	}
+	os.Unsetenv(readyFDEnv)
+
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		logger.Warn("Invalid readiness fd", "env", readyFDEnv, "value", value)
+		return
+	}
+	pipe := os.NewFile(uintptr(fd), "ready")
+	pipe.Write([]byte{1})
+	pipe.Close()
+}
+
+// Start a new copy of the binary that inherits the listening sockets and
+// wait until it reports ready. On error the new process is killed and the
+// current one keeps serving.
+func startUpgrade() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	var files []*os.File
+	var roles []string
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	activeListenersLock.Lock()
+	for role, listeners := range activeListeners {
+		for _, listener := range listeners {
+			filer, ok := listener.(interface{ File() (*os.File, error) })
+			if !ok {
+				activeListenersLock.Unlock()
+				return fmt.Errorf("listener %s cannot be passed to a new process", listener.Addr())
+			}
+			file, err := filer.File()
+			if err != nil {
+				activeListenersLock.Unlock()
+				return err
+			}
+			files = append(files, file)
+			roles = append(roles, role)
+		}
+	}
+	activeListenersLock.Unlock()
+
+	readyRead, readyWrite, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyRead.Close()
+
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "LISTEN_") {
+			env = append(env, kv)
+		}
+	}
+	env = append(env,
+		fmt.Sprintf("%s=%s", inheritFDsEnv, strings.Join(roles, ",")),
+		fmt.Sprintf("%s=%d", readyFDEnv, 3+len(files)),
+	)
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = env
+	cmd.ExtraFiles = append(files, readyWrite)
+	err = cmd.Start()
+	readyWrite.Close()
+	if err != nil {
+		return err
+	}
+
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := readyRead.Read(buf)
+		ready <- err
+	}()
+
+	select {
+	case err = <-ready:
+		if err == nil {
+			go cmd.Wait()
+			return nil
+		}
+		err = fmt.Errorf("new process exited before becoming ready: %w", err)
+	case <-time.After(upgradeReadyTimeout):
+		err = fmt.Errorf("new process not ready after %s", upgradeReadyTimeout)
+	}
+	cmd.Process.Kill()
+	cmd.Wait()
+	return err
+}
+
+// Block until the process should exit. SIGHUP reloads the configuration;
+// SIGUSR2 hands the listeners to a new process (hot restart); SIGINT and
+// SIGTERM stop serving. Either way in-flight requests are drained before
+// returning.
+func waitForShutdown(server *http.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGUSR2, syscall.SIGINT, syscall.SIGTERM)
+
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			logger.Info("Received SIGHUP, reloading configuration")
+			reload()
+			continue
+		}
+		if sig == syscall.SIGUSR2 {
+			logger.Info("Received SIGUSR2, starting new process")
+			if err := startUpgrade(); err != nil {
+				logger.Error("Upgrade failed, continuing to serve", "error", err)
+				continue
+			}
+			logger.Info("New process is ready, draining connections")
+		} else {
+			logger.Info("Shutting down", "signal", sig.String())
+			drainBeforeShutdown(signals)
+		}
+		break
+	}
+	shutdownServer(server)
+}
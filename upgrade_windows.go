@@ -0,0 +1,32 @@
+//go:build windows
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Hot restart passes listening sockets as inherited file descriptors,
+// which Windows doesn't support, so there are never any to inherit
+func inheritedListeners(role string) ([]net.Listener, error) {
+	return nil, nil
+}
+
+func notifyParentReady() {}
+
+// Block until SIGINT or SIGTERM, then drain in-flight requests. Windows has
+// no SIGHUP or SIGUSR2, so configuration reloads and hot restarts are not
+// available.
+func waitForShutdown(server *http.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-signals
+	logger.Info("Shutting down", "signal", sig.String())
+	drainBeforeShutdown(signals)
+	shutdownServer(server)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	upstreamConnections = newCounterVec("upstream_connections_total", "Backend requests by whether they reused a pooled connection, when trace_upstream is on.", "domain", "backend", "reused")
+	upstreamDialTime    = newCounterVec("upstream_dial_microseconds_total", "Time spent setting up new backend connections, by phase (dns, connect, tls), when trace_upstream is on.", "domain", "backend", "phase")
+)
+
+// upstreamTrace collects what httptrace reports about one backend
+// round-trip. Dials can finish on their own goroutine after the round-trip
+// returns, hence the mutex.
+type upstreamTrace struct {
+	mu           sync.Mutex
+	gotConn      bool
+	reused       bool
+	dnsStart     time.Time
+	dns          time.Duration
+	connectStart time.Time
+	connect      time.Duration
+	tlsStart     time.Time
+	tls          time.Duration
+}
+
+func (t *upstreamTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.record(func() { t.gotConn, t.reused = true, info.Reused })
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.record(func() { t.dnsStart = time.Now() })
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.record(func() { t.dns = time.Since(t.dnsStart) })
+		},
+		ConnectStart: func(network, addr string) {
+			t.record(func() { t.connectStart = time.Now() })
+		},
+		ConnectDone: func(network, addr string, err error) {
+			t.record(func() { t.connect = time.Since(t.connectStart) })
+		},
+		TLSHandshakeStart: func() {
+			t.record(func() { t.tlsStart = time.Now() })
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.record(func() { t.tls = time.Since(t.tlsStart) })
+		},
+	}
+}
+
+func (t *upstreamTrace) record(update func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	update()
+}
+
+// Send a request to a backend. With trace_upstream on, whether the
+// connection was reused and how long a new one took to set up are counted
+// and logged at debug level.
+func roundTripBackend(req *http.Request, b *backend) (*http.Response, error) {
+	if !currentConfig().Debug.TraceUpstream {
+		start := time.Now()
+		resp, err := b.transport.RoundTrip(req)
+		addUpstreamTime(req, time.Since(start))
+		return resp, err
+	}
+
+	trace := &upstreamTrace{}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace.clientTrace()))
+	start := time.Now()
+	resp, err := b.transport.RoundTrip(req)
+	elapsed := time.Since(start)
+	addUpstreamTime(req, elapsed)
+
+	trace.mu.Lock()
+	defer trace.mu.Unlock()
+	domain := ""
+	if dp := lookupDomain(req); dp != nil {
+		domain = dp.name
+	}
+	if trace.gotConn {
+		upstreamConnections.inc(domain, b.target.Host, strconv.FormatBool(trace.reused))
+	}
+	if !trace.reused {
+		upstreamDialTime.add(uint64(trace.dns.Microseconds()), domain, b.target.Host, "dns")
+		upstreamDialTime.add(uint64(trace.connect.Microseconds()), domain, b.target.Host, "connect")
+		upstreamDialTime.add(uint64(trace.tls.Microseconds()), domain, b.target.Host, "tls")
+	}
+	logger.Debug("Upstream round-trip",
+		"host", req.Host,
+		"path", req.URL.Path,
+		"backend", b.target.Host,
+		"reused", trace.reused,
+		"dns", trace.dns,
+		"connect", trace.connect,
+		"tls", trace.tls,
+		"response_headers", elapsed,
+		"error", err)
+	return resp, err
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Each phase's duration is captured between its start and done hooks
+func TestUpstreamTraceFields(t *testing.T) {
+	trace := &upstreamTrace{}
+	hooks := trace.clientTrace()
+	phases := []struct {
+		name  string
+		start func()
+		done  func()
+		got   *time.Duration
+	}{
+		{"dns", func() { hooks.DNSStart(httptrace.DNSStartInfo{Host: "backend.internal"}) }, func() { hooks.DNSDone(httptrace.DNSDoneInfo{}) }, &trace.dns},
+		{"connect", func() { hooks.ConnectStart("tcp", "192.0.2.1:443") }, func() { hooks.ConnectDone("tcp", "192.0.2.1:443", nil) }, &trace.connect},
+		{"tls", hooks.TLSHandshakeStart, func() { hooks.TLSHandshakeDone(tls.ConnectionState{}, nil) }, &trace.tls},
+	}
+	for _, phase := range phases {
+		phase.start()
+		time.Sleep(10 * time.Millisecond)
+		phase.done()
+		if *phase.got < 10*time.Millisecond || *phase.got > time.Second {
+			t.Errorf("%s took %s, want about 10ms", phase.name, *phase.got)
+		}
+	}
+
+	hooks.GotConn(httptrace.GotConnInfo{Reused: true})
+	if !trace.gotConn || !trace.reused {
+		t.Errorf("gotConn %v, reused %v, want both true", trace.gotConn, trace.reused)
+	}
+}
+
+// With trace_upstream on, the first request dials and the next reuses its
+// connection; with it off nothing is counted
+func TestTraceUpstream(t *testing.T) {
+	tests := []struct {
+		name       string
+		enabled    bool
+		wantNew    uint64
+		wantReused uint64
+	}{
+		{"off", false, 0, 0},
+		{"on", true, 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A backend of its own, so no pooled connection is left over
+			backend := newNamedBackend(t, "site")
+			host := strings.TrimPrefix(backend.URL, "http://")
+			if tt.enabled {
+				loadTestConfig(t, "[debug]\ntrace_upstream = true\n")
+			} else {
+				loadTestConfig(t, "")
+			}
+			loadTestDomains(t, map[string]string{"example.com": "[proxy]\nbackend_url = " + backend.URL + "\n"})
+			logs := captureLogs(t)
+			newBefore := counterValue(upstreamConnections, "example.com", host, "false")
+			reusedBefore := counterValue(upstreamConnections, "example.com", host, "true")
+
+			for i := 0; i < 2; i++ {
+				if got := serveTest(httptest.NewRequest(http.MethodGet, "http://example.com/", nil)); got.Code != http.StatusOK {
+					t.Fatalf("status %d", got.Code)
+				}
+			}
+
+			if got := counterValue(upstreamConnections, "example.com", host, "false") - newBefore; got != tt.wantNew {
+				t.Errorf("%d new connections, want %d", got, tt.wantNew)
+			}
+			if got := counterValue(upstreamConnections, "example.com", host, "true") - reusedBefore; got != tt.wantReused {
+				t.Errorf("%d reused connections, want %d", got, tt.wantReused)
+			}
+			logged := strings.Count(logs.String(), "Upstream round-trip")
+			if want := int(tt.wantNew + tt.wantReused); logged != want {
+				t.Errorf("%d round-trips logged, want %d: %s", logged, want, logs)
+			}
+			if tt.enabled && !strings.Contains(logs.String(), "reused=true") {
+				t.Errorf("log missing reused=true: %s", logs)
+			}
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// Report whether a request asks to be upgraded to a WebSocket connection
+func isWebSocketUpgrade(r *http.Request) bool {
+	return httpguts.HeaderValuesContainsToken(r.Header["Connection"], "upgrade") &&
+		strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// Check the Origin of a WebSocket upgrade against the domain's allowed
+// origins. An empty list allows every origin, "*" in the list too.
+func (dp *domainProxy) webSocketOriginAllowed(r *http.Request) bool {
+	if len(dp.config.WebSocketOrigins) == 0 {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	for _, allowed := range dp.config.WebSocketOrigins {
+		if allowed == "*" || (origin != "" && strings.EqualFold(allowed, origin)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIsWebSocketUpgrade(t *testing.T) {
+	tests := []struct {
+		name       string
+		connection string
+		upgrade    string
+		want       bool
+	}{
+		{"websocket", "Upgrade", "websocket", true},
+		{"token list", "keep-alive, Upgrade", "WebSocket", true},
+		{"other protocol", "Upgrade", "h2c", false},
+		{"no connection upgrade", "keep-alive", "websocket", false},
+		{"plain request", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			r.Header.Set("Connection", tt.connection)
+			r.Header.Set("Upgrade", tt.upgrade)
+			if got := isWebSocketUpgrade(r); got != tt.want {
+				t.Errorf("isWebSocketUpgrade = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// A backend accepting every WebSocket upgrade, echoing the subprotocol it
+// was offered and then every byte it receives
+func newWebSocketBackend(t *testing.T) *httptest.Server {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subprotocol := r.Header.Get("Sec-WebSocket-Protocol")
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n")
+		if subprotocol != "" {
+			rw.WriteString("Sec-WebSocket-Protocol: " + subprotocol + "\r\n")
+		}
+		rw.WriteString("\r\n")
+		rw.Flush()
+		buf := make([]byte, 64)
+		for {
+			n, err := rw.Read(buf)
+			if err != nil {
+				return
+			}
+			conn.Write(buf[:n])
+		}
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+func TestWebSocketProxy(t *testing.T) {
+	backend := newWebSocketBackend(t)
+
+	// Ping, pong and close frames, masked as they come from a client
+	frames := [][]byte{
+		{0x89, 0x84, 1, 2, 3, 4, 'p' ^ 1, 'i' ^ 2, 'n' ^ 3, 'g' ^ 4},
+		{0x8a, 0x84, 1, 2, 3, 4, 'p' ^ 1, 'o' ^ 2, 'n' ^ 3, 'g' ^ 4},
+		{0x88, 0x82, 1, 2, 3, 4, 0x03 ^ 1, 0xe8 ^ 2},
+	}
+
+	tests := []struct {
+		name            string
+		options         string
+		origin          string
+		wantStatus      int
+		wantSubprotocol string
+	}{
+		{"any origin", "", "https://elsewhere.example", http.StatusSwitchingProtocols, "chat"},
+		{"allowed origin", "allowed_origins = https://app.example.com,https://admin.example.com\n", "https://admin.example.com", http.StatusSwitchingProtocols, "chat"},
+		{"origin case", "allowed_origins = https://app.example.com\n", "https://APP.example.com", http.StatusSwitchingProtocols, "chat"},
+		{"disallowed origin", "allowed_origins = https://app.example.com\n", "https://evil.example", http.StatusForbidden, ""},
+		{"missing origin", "allowed_origins = https://app.example.com\n", "", http.StatusForbidden, ""},
+		{"wildcard", "allowed_origins = *\n", "", http.StatusSwitchingProtocols, "chat"},
+		{"subprotocol not forwarded", "forward_subprotocol = false\n", "https://app.example.com", http.StatusSwitchingProtocols, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, "")
+			loadTestDomains(t, map[string]string{
+				"example.com": "[proxy]\nbackend_url = " + backend.URL + "\nstream_idle_timeout = 5\n[websocket]\n" + tt.options,
+			})
+			proxy := httptest.NewServer(buildHandler())
+			defer proxy.Close()
+
+			conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			request := "GET /socket HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Protocol: chat\r\n"
+			if tt.origin != "" {
+				request += "Origin: " + tt.origin + "\r\n"
+			}
+			io.WriteString(conn, request+"\r\n")
+
+			reader := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(reader, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				return
+			}
+			if got := resp.Header.Get("Sec-WebSocket-Protocol"); got != tt.wantSubprotocol {
+				t.Errorf("subprotocol %q, want %q", got, tt.wantSubprotocol)
+			}
+
+			for _, frame := range frames {
+				conn.Write(frame)
+				echo := make([]byte, len(frame))
+				if _, err := io.ReadFull(reader, echo); err != nil {
+					t.Fatalf("frame %x: %v", frame, err)
+				}
+				if !bytes.Equal(echo, frame) {
+					t.Errorf("frame %x came back as %x", frame, echo)
+				}
+			}
+		})
+	}
+}